@@ -1,48 +1,93 @@
 package main
 
 import (
+	"fmt"
 	"log"
+	"mime"
 	"net/http"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/yuhangang/chat-app-backend/internal/service"
 )
 
 type FileServer struct {
 	addr      string
 	uploadDir string
+	signer    service.FileSigner
 }
 
 // NewFileServer creates a new FileServer instance
-func NewFileServer(addr string) *FileServer {
+func NewFileServer(addr string, signer service.FileSigner) *FileServer {
 	uploadDir := os.Getenv("UPLOAD_DIR")
 	if uploadDir == "" {
 		log.Fatal("UPLOAD_DIR environment variable not set")
 	}
 
+	absUploadDir, err := filepath.Abs(uploadDir)
+	if err != nil {
+		log.Fatalf("Failed to resolve UPLOAD_DIR: %v", err)
+	}
+
 	return &FileServer{
 		addr:      addr,
-		uploadDir: uploadDir,
+		uploadDir: absUploadDir,
+		signer:    signer,
 	}
 }
 
 // Run starts the file server
 func (s *FileServer) Run() error {
 	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		const prefix = "/uploads"
+		const prefix = "/uploads/"
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
 		// Restrict the URL to /uploads
-		if len(r.URL.Path) < len(prefix) || r.URL.Path[:len(prefix)] != prefix {
+		if !strings.HasPrefix(r.URL.Path, prefix) {
 			http.NotFound(w, r)
 			return
 		}
 
-		// Get the file path from the request URL
-		filePath := s.uploadDir + r.URL.Path[len(prefix):]
+		fileKey := r.URL.Path[len(prefix):]
+
+		// Verify the signed query parameters before touching the disk
+		query := r.URL.Query()
+		userID, err := strconv.ParseUint(query.Get("uid"), 10, 64)
+		if err != nil {
+			http.Error(w, "invalid file url", http.StatusForbidden)
+			return
+		}
+		expires, err := strconv.ParseInt(query.Get("exp"), 10, 64)
+		if err != nil {
+			http.Error(w, "invalid file url", http.StatusForbidden)
+			return
+		}
+		if err := s.signer.VerifyFileURL(fileKey, uint(userID), expires, query.Get("sig")); err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+
+		// Confine the resolved path to the upload directory
+		filePath, ok := s.resolvePath(fileKey)
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
 
 		// Check if the file exists
-		if _, err := os.Stat(filePath); os.IsNotExist(err) {
+		info, err := os.Stat(filePath)
+		if err != nil || info.IsDir() {
 			http.NotFound(w, r)
 			return
 		}
 
+		s.setFileHeaders(w, filePath, expires)
+
 		// Serve the file
 		http.ServeFile(w, r, filePath)
 	})
@@ -57,3 +102,40 @@ func (s *FileServer) Run() error {
 
 	return nil
 }
+
+// resolvePath maps a file key to a path inside the upload directory,
+// rejecting anything that would escape it
+func (s *FileServer) resolvePath(fileKey string) (string, bool) {
+	if fileKey == "" || strings.ContainsRune(fileKey, 0) {
+		return "", false
+	}
+
+	filePath := filepath.Join(s.uploadDir, filepath.FromSlash(filepath.Clean("/"+fileKey)))
+
+	rel, err := filepath.Rel(s.uploadDir, filePath)
+	if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", false
+	}
+
+	return filePath, true
+}
+
+func (s *FileServer) setFileHeaders(w http.ResponseWriter, filePath string, expires int64) {
+	fileName := filepath.Base(filePath)
+	contentType := mime.TypeByExtension(filepath.Ext(fileName))
+
+	// Images and PDFs can be previewed in the browser, everything else is downloaded
+	disposition := "attachment"
+	if strings.HasPrefix(contentType, "image/") || contentType == "application/pdf" {
+		disposition = "inline"
+	}
+	w.Header().Set("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{"filename": fileName}))
+
+	// Cache privately, and never beyond the lifetime of the signature
+	maxAge := expires - time.Now().Unix()
+	if maxAge < 0 {
+		maxAge = 0
+	}
+	w.Header().Set("Cache-Control", fmt.Sprintf("private, max-age=%d", maxAge))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+}
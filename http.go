@@ -9,8 +9,16 @@ import (
 	"github.com/yuhangang/chat-app-backend/internal/db/repository"
 	"github.com/yuhangang/chat-app-backend/internal/handler"
 	"github.com/yuhangang/chat-app-backend/internal/handler/handlers"
+	"github.com/yuhangang/chat-app-backend/internal/service"
+	"github.com/yuhangang/chat-app-backend/internal/service/services/embedding_service"
+	"github.com/yuhangang/chat-app-backend/internal/service/services/event_service"
+	"github.com/yuhangang/chat-app-backend/internal/service/services/export_service"
+	"github.com/yuhangang/chat-app-backend/internal/service/services/gc_service"
 	"github.com/yuhangang/chat-app-backend/internal/service/services/gemini_service"
 	"github.com/yuhangang/chat-app-backend/internal/service/services/jwt_service"
+	"github.com/yuhangang/chat-app-backend/internal/service/services/mail_service"
+	"github.com/yuhangang/chat-app-backend/internal/service/services/oidc_service"
+	"github.com/yuhangang/chat-app-backend/internal/service/services/search_service"
 	"github.com/yuhangang/chat-app-backend/internal/service/services/storage_service"
 
 	"github.com/gorilla/mux"
@@ -22,7 +30,7 @@ type httpServer struct {
 	httpHandler *handler.Handler
 }
 
-func NewHttpServer(ctx context.Context, addr string) *httpServer {
+func NewHttpServer(ctx context.Context, addr string, fileSigner service.FileSigner) *httpServer {
 
 	conn, err := db.InitDB()
 	if err != nil {
@@ -30,43 +38,96 @@ func NewHttpServer(ctx context.Context, addr string) *httpServer {
 		panic(err)
 	}
 
+	sessionRepo := repository.NewSessionRepo(conn)
+	userRepository := repository.NewUserRepo(conn)
+
 	llmService := gemini_service.NewGeminiServiceV1(ctx)
-	jwtService, err := jwt_service.NewJwtService()
+	jwtService, err := jwt_service.NewJwtService(sessionRepo, userRepository)
 	storageService := storage_service.NewStorageServiceV1()
+	oidcService := oidc_service.NewOidcServiceV1()
 
 	if err != nil {
 		log.Fatalf("Failed to create jwt service: %v", err)
 		panic(err)
 	}
 
-	userRepository := repository.NewUserRepo(conn)
+	mailer, err := mail_service.NewMailServiceV1()
+	if err != nil {
+		log.Fatalf("Failed to create mailer: %v", err)
+	}
+
 	chatRepository := repository.NewChatRoomRepo(conn)
 	chatConfigRepository := repository.NewChatConfigRepo(conn)
 	messageRepo := repository.NewMessageRepo(conn, storageService)
-	llmRepo := repository.NewLLMRepo(conn, llmService)
+	llmRepo := repository.NewLLMRepo(conn, llmService, storageService)
+	blobRepo := repository.NewBlobRepo(conn)
+	uploadRepo := repository.NewUploadRepo(conn)
+	apiKeyRepo := repository.NewApiKeyRepo(conn)
+	auditRepo := repository.NewAuditRepo(conn)
+	mfaRepo := repository.NewMfaRepo(conn)
+	exportRepo := repository.NewExportRepo(conn)
+	searchRepo := repository.NewSearchRepo(conn)
+	embeddingRepo := repository.NewEmbeddingRepo(conn)
+	organizerRepo := repository.NewOrganizerRepo(conn)
+	shareRepo := repository.NewShareRepo(conn)
+	memberRepo := repository.NewMemberRepo(conn)
+
+	go jwtService.WatchKeys(ctx)
+
+	garbageCollector := gc_service.NewGarbageCollectorV1(blobRepo, uploadRepo, exportRepo, chatRepository, storageService)
+	go garbageCollector.Start(ctx)
+
+	embedder, err := embedding_service.NewEmbeddingServiceV1(ctx)
+	if err != nil {
+		log.Fatalf("Failed to create embedder: %v", err)
+	}
+	if embedder != nil {
+		go embedding_service.NewIndexerV1(embeddingRepo, embedder).Start(ctx)
+	}
 
-	userHandler := handlers.NewUserHandler(userRepository)
-	chatHandler := handlers.NewChatHandler(chatRepository)
-	chatConfigHandler := handlers.NewChatConfigHandler(chatConfigRepository)
-	messageHandler := handlers.NewMessageChatHandler(chatRepository, messageRepo, llmRepo)
-	authHandler := handlers.NewAuthHandler(userRepository, jwtService)
+	go search_service.NewExtractionBackfillV1(searchRepo, storageService).Start(ctx)
+
+	eventHub := event_service.NewEventHubV1()
 
-	httpHandler := handler.NewHandler(chatHandler, chatConfigHandler, messageHandler, userHandler, authHandler, jwtService)
+	exportService := export_service.NewExportServiceV1(ctx, exportRepo, userRepository, chatRepository, storageService)
+
+	userHandler := handlers.NewUserHandler(userRepository, sessionRepo, mfaRepo, chatConfigRepository, storageService, fileSigner, garbageCollector)
+	chatHandler := handlers.NewChatHandler(chatRepository, fileSigner, eventHub)
+	chatConfigHandler := handlers.NewChatConfigHandler(chatConfigRepository)
+	messageHandler := handlers.NewMessageChatHandler(chatRepository, messageRepo, llmRepo, userRepository, chatConfigRepository, uploadRepo, storageService, fileSigner, eventHub)
+	authHandler := handlers.NewAuthHandler(userRepository, mfaRepo, jwtService, mailer)
+	uploadHandler := handlers.NewUploadHandler(uploadRepo, userRepository, storageService)
+	oidcHandler := handlers.NewOidcHandler(userRepository, mfaRepo, oidcService, jwtService)
+	apiKeyHandler := handlers.NewApiKeyHandler(apiKeyRepo)
+	mfaHandler := handlers.NewMfaHandler(userRepository, mfaRepo, jwtService)
+	emailHandler := handlers.NewEmailHandler(userRepository, mfaRepo, jwtService, mailer)
+	exportHandler := handlers.NewExportHandler(exportRepo, exportService, fileSigner)
+	searchHandler := handlers.NewSearchHandler(searchRepo, embeddingRepo, embedder)
+	organizerHandler := handlers.NewOrganizerHandler(organizerRepo)
+	shareHandler := handlers.NewShareHandler(chatRepository, shareRepo, fileSigner)
+	memberHandler := handlers.NewMemberHandler(chatRepository, memberRepo, eventHub)
+	eventHandler := handlers.NewEventHandler(chatRepository, sessionRepo, apiKeyRepo, eventHub)
+	adminHandler := handlers.NewAdminHandler(userRepository, chatRepository, chatConfigRepository, auditRepo, jwtService, fileSigner)
+
+	httpHandler := handler.NewHandler(chatHandler, chatConfigHandler, messageHandler, userHandler, authHandler, uploadHandler, oidcHandler, apiKeyHandler, adminHandler, mfaHandler, emailHandler, exportHandler, searchHandler, organizerHandler, shareHandler, memberHandler, eventHandler, jwtService, apiKeyRepo)
 
 	return &httpServer{addr: addr, httpHandler: httpHandler}
 }
 
 func (s *httpServer) Run() error {
 	router := mux.NewRouter()
-	s.httpHandler.RegisterRoutes(router)
+	if err := s.httpHandler.RegisterRoutes(router); err != nil {
+		return err
+	}
 
 	log.Println("Starting server on", s.addr)
 
 	// CORS Middleware should be applied before starting the server
 	c := cors.New(cors.Options{
 		AllowedOrigins:   []string{"http://example.com", "http://localhost:3000"}, // Allow specific domains
-		AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
-		AllowedHeaders:   []string{"Authorization", "Content-Type"},
+		AllowedMethods:   []string{"GET", "POST", "PUT", "PATCH", "HEAD", "DELETE", "OPTIONS"},
+		AllowedHeaders:   []string{"Authorization", "Content-Type", "Tus-Resumable", "Upload-Length", "Upload-Offset", "Upload-Metadata"},
+		ExposedHeaders:   []string{"Location", "Tus-Resumable", "Tus-Version", "Tus-Extension", "Tus-Max-Size", "Upload-Offset", "Upload-Length", "Upload-Expires"},
 		AllowCredentials: true,
 	})
 
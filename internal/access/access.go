@@ -0,0 +1,46 @@
+package access
+
+import (
+	"github.com/yuhangang/chat-app-backend/internal/db/tables"
+)
+
+// Chat room actions, allowed by the user's member role in the room
+const (
+	ChatActionRead   = "read"   // the room, its messages, attachments and members
+	ChatActionWrite  = "write"  // sending messages
+	ChatActionManage = "manage" // renaming, organizing, sharing, deleting and inviting members
+)
+
+// memberRoles lists the member roles in a fixed order, memberRoleActions what each may do in a
+// chat room
+var memberRoles = []string{tables.MemberOwner, tables.MemberEditor, tables.MemberViewer}
+
+var memberRoleActions = map[string][]string{
+	tables.MemberOwner:  {ChatActionRead, ChatActionWrite, ChatActionManage},
+	tables.MemberEditor: {ChatActionRead, ChatActionWrite},
+	tables.MemberViewer: {ChatActionRead},
+}
+
+// ChatRoomAllows reports whether the member role may take the action in a chat room
+func ChatRoomAllows(memberRole string, action string) bool {
+	for _, allowed := range memberRoleActions[memberRole] {
+		if allowed == action {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ChatRoomRoles returns the member roles that may take the action in a chat room, for finding
+// every room a user may take it in at once
+func ChatRoomRoles(action string) []string {
+	roles := []string{}
+	for _, role := range memberRoles {
+		if ChatRoomAllows(role, action) {
+			roles = append(roles, role)
+		}
+	}
+
+	return roles
+}
@@ -0,0 +1,67 @@
+package access
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/yuhangang/chat-app-backend/internal/db/tables"
+)
+
+func TestChatRoomAllows(t *testing.T) {
+	tests := []struct {
+		role   string
+		action string
+		want   bool
+	}{
+		{tables.MemberOwner, ChatActionRead, true},
+		{tables.MemberOwner, ChatActionWrite, true},
+		{tables.MemberOwner, ChatActionManage, true},
+		{tables.MemberEditor, ChatActionRead, true},
+		{tables.MemberEditor, ChatActionWrite, true},
+		{tables.MemberEditor, ChatActionManage, false},
+		{tables.MemberViewer, ChatActionRead, true},
+		{tables.MemberViewer, ChatActionWrite, false},
+		{tables.MemberViewer, ChatActionManage, false},
+		// not a member
+		{"", ChatActionRead, false},
+		{"", ChatActionWrite, false},
+		{"", ChatActionManage, false},
+		{"admin", ChatActionRead, false},
+		{tables.MemberOwner, "delete", false},
+	}
+
+	for _, test := range tests {
+		if got := ChatRoomAllows(test.role, test.action); got != test.want {
+			t.Errorf("ChatRoomAllows(%q, %q) = %v, want %v", test.role, test.action, got, test.want)
+		}
+	}
+}
+
+func TestChatRoomRoles(t *testing.T) {
+	tests := []struct {
+		action string
+		want   []string
+	}{
+		{ChatActionRead, []string{tables.MemberOwner, tables.MemberEditor, tables.MemberViewer}},
+		{ChatActionWrite, []string{tables.MemberOwner, tables.MemberEditor}},
+		{ChatActionManage, []string{tables.MemberOwner}},
+		{"delete", []string{}},
+	}
+
+	for _, test := range tests {
+		if got := ChatRoomRoles(test.action); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("ChatRoomRoles(%q) = %v, want %v", test.action, got, test.want)
+		}
+	}
+}
+
+func TestEveryRoleIsListed(t *testing.T) {
+	if len(memberRoles) != len(memberRoleActions) {
+		t.Fatalf("%d roles listed, %d have actions", len(memberRoles), len(memberRoleActions))
+	}
+	for _, role := range memberRoles {
+		if _, ok := memberRoleActions[role]; !ok {
+			t.Errorf("role %q has no actions", role)
+		}
+	}
+}
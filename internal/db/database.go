@@ -2,9 +2,12 @@ package db
 
 import (
 	"os"
+	"strings"
+	"time"
 
 	"github.com/yuhangang/chat-app-backend/internal/db/tables"
 	"github.com/yuhangang/chat-app-backend/internal/log"
+	"github.com/yuhangang/chat-app-backend/types"
 
 	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
@@ -22,7 +25,7 @@ func InitDB() (*gorm.DB, error) {
 	}
 
 	var err error
-	db, err = gorm.Open(sqlite.Open(dbFile), &gorm.Config{})
+	db, err = gorm.Open(sqlite.Open(dbFile), &gorm.Config{TranslateError: true})
 	if err != nil {
 		log.ErrorLogger.Fatalf("Failed to connect to the database: %v", err)
 	}
@@ -30,46 +33,118 @@ func InitDB() (*gorm.DB, error) {
 	// reset the database
 	//db.Migrator().DropTable(&tables.User{}, &tables.ChatRoom{}, &tables.ChatMessage{}, &tables.ChatAttachment{})
 
+	// rooms from before read tracking count as read up to their last message
+	backfillReads := !db.Migrator().HasTable(&tables.ChatRoomRead{})
+
 	// Ensure the table exists before running queries
-	err = db.AutoMigrate(&tables.User{}, &tables.ChatRoom{}, &tables.ChatMessage{}, &tables.ChatAttachment{}, &tables.LlmModel{})
+	err = db.AutoMigrate(&tables.User{}, &tables.ChatRoom{}, &tables.ChatMessage{}, &tables.ChatAttachment{}, &tables.ChatEmbed{}, &tables.LlmModel{}, &tables.LlmPersona{}, &tables.Blob{}, &tables.Upload{}, &tables.PasswordResetToken{}, &tables.UserIdentity{}, &tables.OidcLoginState{}, &tables.Session{}, &tables.RefreshToken{}, &tables.ApiKey{}, &tables.AuditLog{}, &tables.TotpCredential{}, &tables.RecoveryCode{}, &tables.MfaChallenge{}, &tables.EmailToken{}, &tables.UserProfile{}, &tables.DataExport{}, &tables.MessageEmbedding{}, &tables.ChatFolder{}, &tables.ChatTag{}, &tables.ChatRoomTag{}, &tables.ChatShare{}, &tables.ChatShareMessage{}, &tables.ChatRoomMember{}, &tables.ChatRoomRead{})
 
 	if err != nil {
 		log.ErrorLogger.Fatalf("Failed to migrate database: %v", err)
 	}
 
+	if backfillReads {
+		if err := backfillChatRoomReads(db); err != nil {
+			log.ErrorLogger.Fatalf("Failed to backfill chat room reads: %v", err)
+		}
+	}
+
+	if err := migrateLegacyAttachments(db); err != nil {
+		log.ErrorLogger.Fatalf("Failed to migrate legacy attachments: %v", err)
+	}
+
+	if err := migrateSearch(db); err != nil {
+		log.ErrorLogger.Fatalf("Failed to set up search index: %v", err)
+	}
+
 	/// seed llm models
 	models := []tables.LlmModel{
 		{
-			ModelKey:  "gemini-2.0-flash",
-			Name:      "Gemini 2.0 Flash",
-			Creator:   "Google",
-			Available: true,
+			ModelKey:     "gemini-2.0-flash",
+			Name:         "Gemini 2.0 Flash",
+			Creator:      "Google",
+			Available:    true,
+			Capabilities: "text,vision,document,audio",
 		},
 		{
-			ModelKey:  "gemini-1.5-flash",
-			Name:      "Gemini 1.5 Flash",
-			Creator:   "OpenAI",
-			Available: true,
+			ModelKey:     "gemini-1.5-flash",
+			Name:         "Gemini 1.5 Flash",
+			Creator:      "OpenAI",
+			Available:    true,
+			Capabilities: "text,vision,document,audio",
 		},
 		{
-			ModelKey:  "gemini-2.0-flash-thinking-exp-01-21",
-			Name:      "Gemini 2.0 Flash Thinking Exp 01-21",
-			Creator:   "OpenAI",
-			Available: false,
+			ModelKey:     "gemini-2.0-flash-thinking-exp-01-21",
+			Name:         "Gemini 2.0 Flash Thinking Exp 01-21",
+			Creator:      "OpenAI",
+			Available:    false,
+			Capabilities: "text,vision,document",
 		},
 		{
-			ModelKey:  "gemini-2.0-pro-exp-02-05",
-			Name:      "Gemini 2.0 Pro Exp 02-05",
-			Creator:   "OpenAI",
-			Available: false,
+			ModelKey:     "gemini-2.0-pro-exp-02-05",
+			Name:         "Gemini 2.0 Pro Exp 02-05",
+			Creator:      "OpenAI",
+			Available:    false,
+			Capabilities: "text,vision,document",
 		},
 	}
 
-	err = db.Create(&models).Error
+	// upsert by model key so restarts don't duplicate models and capabilities stay in sync
+	for _, model := range models {
+		err = db.Where(tables.LlmModel{ModelKey: model.ModelKey}).
+			Assign(tables.LlmModel{Capabilities: model.Capabilities}).
+			FirstOrCreate(&model).Error
 
-	if err != nil {
-		log.ErrorLogger.Fatalf("Failed to seed database with llm models: %v", err)
+		if err != nil {
+			log.ErrorLogger.Fatalf("Failed to seed database with llm models: %v", err)
+		}
+	}
+
+	/// seed personas
+	personas := []tables.LlmPersona{
+		{PersonaKey: types.DefaultPersona, Name: "Assistant"},
+		{PersonaKey: "concise", Name: "Concise", Instruction: "Answer as briefly as possible, without preamble or repetition of the question."},
+		{PersonaKey: "tutor", Name: "Tutor", Instruction: "Act as a patient tutor. Explain step by step and end with a short question that checks understanding."},
+		{PersonaKey: "coder", Name: "Coder", Instruction: "Act as a senior software engineer. Prefer working code examples and point out pitfalls."},
+	}
+
+	// only created when missing, so personas edited or added in the database are kept
+	for _, persona := range personas {
+		err = db.Where(tables.LlmPersona{PersonaKey: persona.PersonaKey}).FirstOrCreate(&persona).Error
+		if err != nil {
+			log.ErrorLogger.Fatalf("Failed to seed database with personas: %v", err)
+		}
+	}
+
+	// promote the bootstrap admins, later role changes go through the admin API
+	var admins []string
+	for _, username := range strings.Split(os.Getenv("ADMIN_USERNAMES"), ",") {
+		if username = strings.TrimSpace(username); username != "" {
+			admins = append(admins, username)
+		}
+	}
+	if len(admins) > 0 {
+		err = db.Model(&tables.User{}).
+			Where("username IN ?", admins).
+			Update("role", tables.RoleAdmin).Error
+
+		if err != nil {
+			log.ErrorLogger.Fatalf("Failed to promote admin users: %v", err)
+		}
 	}
 
 	return db, nil
 }
+
+// backfillChatRoomReads marks every room read up to its last message, for its owner and its
+// members alike
+func backfillChatRoomReads(conn *gorm.DB) error {
+	return conn.Exec(`INSERT INTO chat_room_reads (chat_room_id, user_id, last_read_message_id, updated_at)
+		SELECT readers.chat_room_id, readers.user_id, MAX(chat_messages.id), ? FROM (
+			SELECT id AS chat_room_id, user_id FROM chat_rooms
+			UNION ALL
+			SELECT chat_room_id, user_id FROM chat_room_members
+		) AS readers
+		JOIN chat_messages ON chat_messages.chat_room_id = readers.chat_room_id
+		GROUP BY readers.chat_room_id, readers.user_id`, time.Now()).Error
+}
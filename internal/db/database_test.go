@@ -0,0 +1,55 @@
+package db
+
+import (
+	"testing"
+
+	"github.com/yuhangang/chat-app-backend/internal/db/tables"
+
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+func TestBackfillChatRoomReadsCoversMembers(t *testing.T) {
+	conn, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{TranslateError: true, Logger: logger.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.AutoMigrate(&tables.ChatRoom{}, &tables.ChatMessage{}, &tables.ChatRoomMember{}, &tables.ChatRoomRead{}); err != nil {
+		t.Fatal(err)
+	}
+
+	const owner, member uint = 1, 2
+	chatRoom := tables.ChatRoom{Name: "Quarterly planning", SessionID: "session", UserID: owner}
+	if err := conn.Create(&chatRoom).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.Create(&tables.ChatRoomMember{ChatRoomID: chatRoom.ID, UserID: member, Role: tables.MemberViewer, InvitedBy: owner}).Error; err != nil {
+		t.Fatal(err)
+	}
+	messages := []tables.ChatMessage{{Body: "first", ChatRoomID: chatRoom.ID}, {Body: "last", ChatRoomID: chatRoom.ID}}
+	if err := conn.Create(&messages).Error; err != nil {
+		t.Fatal(err)
+	}
+	empty := tables.ChatRoom{Name: "Empty", SessionID: "empty", UserID: owner}
+	if err := conn.Create(&empty).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	if err := backfillChatRoomReads(conn); err != nil {
+		t.Fatal(err)
+	}
+
+	var reads []tables.ChatRoomRead
+	if err := conn.Order("user_id").Find(&reads).Error; err != nil {
+		t.Fatal(err)
+	}
+	if len(reads) != 2 {
+		t.Fatalf("backfilled %d reads, want the owner's and the member's", len(reads))
+	}
+	for i, userID := range []uint{owner, member} {
+		if reads[i].UserID != userID || reads[i].ChatRoomID != chatRoom.ID || reads[i].LastReadMessageID != messages[1].ID {
+			t.Errorf("read %d = %+v, want user %d up to message %d", i, reads[i], userID, messages[1].ID)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package db
+
+import (
+	"path"
+	"strings"
+	"time"
+
+	"github.com/yuhangang/chat-app-backend/internal/db/tables"
+
+	"gorm.io/gorm"
+)
+
+// migrateLegacyAttachments moves attachments saved before signed file URLs over to storage keys.
+// Their file_path was a file server URL ending in the file's name in the upload directory, which
+// is the key. The files get blob rows counting their references, so garbage collection sees them
+// as in use.
+func migrateLegacyAttachments(conn *gorm.DB) error {
+	return conn.Transaction(func(tx *gorm.DB) error {
+		var attachments []tables.ChatAttachment
+		err := tx.Unscoped().Select("id", "file_path", "thumbnail_path").
+			Where("file_path LIKE ? OR thumbnail_path LIKE ?", "%/%", "%/%").
+			Find(&attachments).Error
+		if err != nil || len(attachments) == 0 {
+			return err
+		}
+
+		for _, attachment := range attachments {
+			err := tx.Unscoped().Model(&tables.ChatAttachment{}).Where("id = ?", attachment.ID).
+				UpdateColumns(map[string]interface{}{
+					"file_path":      legacyFileKey(attachment.FilePath),
+					"thumbnail_path": legacyFileKey(attachment.ThumbnailPath),
+				}).Error
+			if err != nil {
+				return err
+			}
+		}
+
+		// trashed attachments hold their files until the room is purged, so they count too
+		now := time.Now()
+		return tx.Exec(`INSERT INTO blobs (created_at, updated_at, file_key, size, ref_count)
+			SELECT ?, ?, refs.file_key, MAX(refs.size), COUNT(*) FROM (
+				SELECT file_path AS file_key, file_size AS size FROM chat_attachments
+				UNION ALL
+				SELECT thumbnail_path, 0 FROM chat_attachments WHERE thumbnail_path <> ''
+			) refs
+			WHERE NOT EXISTS (SELECT 1 FROM blobs WHERE blobs.file_key = refs.file_key)
+			GROUP BY refs.file_key`, now, now).Error
+	})
+}
+
+// legacyFileKey turns a file server URL into the storage key, the last path segment
+func legacyFileKey(filePath string) string {
+	if !strings.Contains(filePath, "/") {
+		return filePath
+	}
+
+	return path.Base(filePath)
+}
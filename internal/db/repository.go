@@ -2,9 +2,10 @@ package db
 
 import (
 	"context"
-	"mime/multipart"
+	"time"
 
 	"github.com/yuhangang/chat-app-backend/internal/db/tables"
+	"github.com/yuhangang/chat-app-backend/pkg/cursor"
 	"github.com/yuhangang/chat-app-backend/types"
 )
 
@@ -15,23 +16,87 @@ type Database interface {
 }
 
 type ChatRepository interface {
-	GetChatRoomsForUser(ctx context.Context, userID uint) ([]tables.ChatRoom, error)
+	GetChatRoomsForUser(ctx context.Context, userID uint, filter types.ChatRoomFilter, after cursor.Cursor, limit int) ([]tables.ChatRoom, error)
 	GetRoomByID(ctx context.Context, chatRoomID uint) (tables.ChatRoom, error)
+	GetChatMessages(ctx context.Context, chatRoomID uint, before cursor.Cursor, limit int) ([]tables.ChatMessage, error)
+	UpdateRooms(ctx context.Context, userID uint, chatRoomIDs []uint, changes types.ChatRoomChanges) (int64, error)
+	TagRooms(ctx context.Context, userID uint, chatRoomIDs []uint, tagID uint, tagged bool) (int64, error)
 	DeleteRoomByID(ctx context.Context, chatRoomID uint, userID uint) error
-	CheckChatRoomExists(ctx context.Context, chatRoomID uint) (bool, error)
+	DeleteRoomsByID(ctx context.Context, chatRoomIDs []uint, userID uint) ([]uint, error)
+	GetChatRoomsWithMessages(ctx context.Context, userID uint) ([]tables.ChatRoom, error)
+	GetDeletedChatRoomsForUser(ctx context.Context, userID uint) ([]tables.ChatRoom, error)
+	RestoreRoom(ctx context.Context, chatRoomID uint, userID uint) (tables.ChatRoom, error)
+	PurgeDeletedRooms(ctx context.Context, cutoff time.Time) ([]uint, error)
+	GetMemberRole(ctx context.Context, chatRoomID uint, userID uint) (string, error)
+	MarkRoomRead(ctx context.Context, chatRoomID uint, userID uint, messageID uint) (uint, error)
+	GetChatOptions(ctx context.Context, chatRoomID uint) (types.ChatOptions, error)
+}
+
+// OrganizerRepository keeps the folders and tags a user sorts chat rooms into
+type OrganizerRepository interface {
+	GetFolders(ctx context.Context, userID uint) ([]tables.ChatFolder, error)
+	GetFolder(ctx context.Context, folderID uint, userID uint) (tables.ChatFolder, error)
+	CreateFolder(ctx context.Context, folder tables.ChatFolder) (tables.ChatFolder, error)
+	UpdateFolder(ctx context.Context, folderID uint, userID uint, name *string, move bool, parentID *uint) (tables.ChatFolder, error)
+	DeleteFolder(ctx context.Context, folderID uint, userID uint) error
+	GetTags(ctx context.Context, userID uint) ([]tables.ChatTag, error)
+	CreateTag(ctx context.Context, tag tables.ChatTag) (tables.ChatTag, error)
+	UpdateTag(ctx context.Context, tagID uint, userID uint, name *string, color *string) (tables.ChatTag, error)
+	DeleteTag(ctx context.Context, tagID uint, userID uint) error
+}
+
+// MemberRepository keeps the users invited to chat rooms and their roles
+type MemberRepository interface {
+	GetMembers(ctx context.Context, chatRoomID uint) ([]types.ChatRoomMember, error)
+	AddMember(ctx context.Context, chatRoomID uint, username string, role string, invitedBy uint) (types.ChatRoomMember, error)
+	UpdateMember(ctx context.Context, chatRoomID uint, userID uint, role string) (types.ChatRoomMember, error)
+	RemoveMember(ctx context.Context, chatRoomID uint, userID uint) error
+}
+
+// ShareRepository keeps the public read-only links to chat rooms, looked up by the hash of their
+// slug. Links of trashed rooms and expired links are not found.
+//
+// A link pins the messages the room had when it was shared and shows only those, so messages
+// written later never leak into it. It still goes with the room: hidden while the room is in the
+// trash, deleted along with it.
+type ShareRepository interface {
+	CreateShare(ctx context.Context, share tables.ChatShare) (tables.ChatShare, error)
+	DeleteShare(ctx context.Context, chatRoomID uint, userID uint) error
+	GetSharedChat(ctx context.Context, slugHash string) (tables.ChatShare, []tables.ChatMessage, error)
+	ForkSharedChat(ctx context.Context, slugHash string, userID uint, sessionID string) (tables.ChatRoom, error)
+}
+
+// SearchRepository finds text in a user's chats: message bodies, room names and attachment
+// names and text. Trashed rooms are left out.
+type SearchRepository interface {
+	Search(ctx context.Context, userID uint, query string, limit int) ([]types.SearchResult, error)
+	GetUnextractedAttachments(ctx context.Context, limit int) ([]tables.ChatAttachment, error)
+	SetExtractedText(ctx context.Context, attachmentID uint, text string) error
+}
+
+// EmbeddingRepository stores message vectors for semantic search
+type EmbeddingRepository interface {
+	GetUnembeddedMessages(ctx context.Context, model string, afterID uint, limit int) ([]tables.ChatMessage, error)
+	SaveEmbeddings(ctx context.Context, model string, messageIDs []uint, vectors [][]float32) error
+	SearchEmbeddings(ctx context.Context, userID uint, model string, vector []float32, limit int) ([]types.SearchResult, error)
 }
 
 type ChatConfigRepository interface {
 	GetChatModels(ctx context.Context) ([]tables.LlmModel, error)
+	GetChatModelByKey(ctx context.Context, modelKey string) (tables.LlmModel, error)
+	SetChatModelAvailable(ctx context.Context, modelID uint, available bool) (tables.LlmModel, error)
+	GetPersonas(ctx context.Context) ([]tables.LlmPersona, error)
+	GetPersonaByKey(ctx context.Context, personaKey string) (tables.LlmPersona, error)
 }
 
 type MessageRepository interface {
 	GetMessagesForChatRoom(ctx context.Context, chatRoomID uint) ([]tables.ChatMessage, error)
 	CreateMessage(ctx context.Context,
 		chatRoomID uint,
+		userID uint,
 		message string,
 		response string,
-		attachment *multipart.FileHeader,
+		attachment *types.Attachment,
 	) ([]tables.ChatMessage, error)
 	CreateChatRoomWithMessage(
 		ctx context.Context,
@@ -39,7 +104,8 @@ type MessageRepository interface {
 		chatRoomName string,
 		message string,
 		response types.GeminiApiResponse,
-		attachment *multipart.FileHeader) (tables.ChatRoom, error)
+		options types.ChatOptions,
+		attachment *types.Attachment) (tables.ChatRoom, error)
 }
 
 type UserRepository interface {
@@ -47,9 +113,93 @@ type UserRepository interface {
 	GetUser(ctx context.Context, userID uint) (tables.User, error)
 	GetUserByUsername(ctx context.Context, username string) (tables.User, error)
 	BindUser(ctx context.Context, userID uint, username string) (tables.User, error)
+	GetUserByEmail(ctx context.Context, email string) (tables.User, error)
+	SetPassword(ctx context.Context, userID uint, passwordHash string, keepSessionID string) error
+	RecordLoginFailure(ctx context.Context, userID uint, maxAttempts int, lockDuration time.Duration) error
+	ClearLoginFailures(ctx context.Context, userID uint) error
+	CreatePasswordResetToken(ctx context.Context, token tables.PasswordResetToken) error
+	ResetPassword(ctx context.Context, tokenHash string, passwordHash string) (tables.User, error)
+	CreateEmailToken(ctx context.Context, token tables.EmailToken) error
+	CountEmailTokens(ctx context.Context, email string, purpose string, since time.Time) (int64, error)
+	ConsumeEmailToken(ctx context.Context, tokenHash string, purpose string) (tables.User, error)
+	GetUserByIdentity(ctx context.Context, provider string, subject string) (tables.User, error)
+	CreateUserWithIdentity(ctx context.Context, user tables.User, identity tables.UserIdentity) (tables.User, error)
+	LinkIdentity(ctx context.Context, identity tables.UserIdentity) error
+	GetIdentities(ctx context.Context, userID uint) ([]tables.UserIdentity, error)
+	CreateOidcLoginState(ctx context.Context, state tables.OidcLoginState) error
+	ConsumeOidcLoginState(ctx context.Context, state string, provider string) (tables.OidcLoginState, error)
+	GetUsers(ctx context.Context, query string, offset int, limit int) ([]tables.User, int64, error)
+	GetProfile(ctx context.Context, userID uint) (tables.UserProfile, error)
+	SaveProfile(ctx context.Context, profile tables.UserProfile, avatarSize int64) (tables.UserProfile, error)
+	DeleteUser(ctx context.Context, userID uint) ([]string, []string, error)
+	SetUserDisabled(ctx context.Context, userID uint, disabled bool) (tables.User, error)
+	SetUserRole(ctx context.Context, userID uint, role string, entry tables.AuditLog) (tables.User, error)
+	MergeGuestUser(ctx context.Context, guestID uint, targetID uint) (int64, error)
+}
+
+type MfaRepository interface {
+	GetTotpCredential(ctx context.Context, userID uint) (tables.TotpCredential, error)
+	IsMfaEnabled(ctx context.Context, userID uint) (bool, error)
+	SaveTotpCredential(ctx context.Context, credential tables.TotpCredential) error
+	ConfirmTotpCredential(ctx context.Context, userID uint, step int64, recoveryCodeHashes []string) error
+	UseTotpStep(ctx context.Context, userID uint, step int64) error
+	UseRecoveryCode(ctx context.Context, userID uint, codeHash string) error
+	ReplaceRecoveryCodes(ctx context.Context, userID uint, recoveryCodeHashes []string) error
+	DeleteTotpCredential(ctx context.Context, userID uint) error
+	CreateMfaChallenge(ctx context.Context, challenge tables.MfaChallenge) error
+	GetMfaChallenge(ctx context.Context, tokenHash string, maxAttempts int) (tables.MfaChallenge, error)
+	RecordMfaChallengeFailure(ctx context.Context, challengeID uint) error
+	ConsumeMfaChallenge(ctx context.Context, challengeID uint) error
+}
+
+type AuditRepository interface {
+	CreateAuditLog(ctx context.Context, entry tables.AuditLog) error
+	GetAuditLogs(ctx context.Context, offset int, limit int) ([]tables.AuditLog, error)
+}
+
+type SessionRepository interface {
+	CreateSession(ctx context.Context, session tables.Session, refreshToken tables.RefreshToken) error
+	RotateRefreshToken(ctx context.Context, oldTokenHash string, newToken tables.RefreshToken, client types.ClientInfo) error
+	IsSessionActive(ctx context.Context, sessionID string) (bool, error)
+	TouchSession(ctx context.Context, sessionID string) error
+	GetActiveSessions(ctx context.Context, userID uint) ([]tables.Session, error)
+	RevokeSession(ctx context.Context, sessionID string, userID uint) error
+	RevokeAllSessions(ctx context.Context, userID uint) error
+}
+
+type ApiKeyRepository interface {
+	CreateApiKey(ctx context.Context, apiKey tables.ApiKey) (tables.ApiKey, error)
+	GetApiKeys(ctx context.Context, userID uint) ([]tables.ApiKey, error)
+	RevokeApiKey(ctx context.Context, apiKeyID uint, userID uint) error
+	AuthenticateApiKey(ctx context.Context, keyHash string) (tables.ApiKey, error)
+}
+
+type BlobRepository interface {
+	GetOrphanBlobs(ctx context.Context, cutoff time.Time) ([]tables.Blob, error)
+	GetOrphanBlobsByKeys(ctx context.Context, fileKeys []string) ([]tables.Blob, error)
+	DeleteOrphanBlob(ctx context.Context, blobID uint) (bool, error)
+	GetUntrackedFileKeys(ctx context.Context, fileKeys []string) ([]string, error)
+}
+
+type ExportRepository interface {
+	CreateExport(ctx context.Context, export tables.DataExport) (tables.DataExport, bool, error)
+	GetExport(ctx context.Context, exportID string, userID uint) (tables.DataExport, error)
+	GetExports(ctx context.Context, userID uint) ([]tables.DataExport, error)
+	CompleteExport(ctx context.Context, exportID string, fileKey string, size int64) error
+	FailExport(ctx context.Context, exportID string, reason string) error
+	DeleteExpiredExports(ctx context.Context, now time.Time) ([]string, error)
+}
+
+type UploadRepository interface {
+	CreateUpload(ctx context.Context, upload tables.Upload) (tables.Upload, error)
+	GetUpload(ctx context.Context, uploadID string, userID uint) (tables.Upload, error)
+	UpdateUploadOffset(ctx context.Context, uploadID string, offset int64) error
+	CompleteUpload(ctx context.Context, uploadID string, fileKey string, size int64) error
+	DeleteUpload(ctx context.Context, uploadID string) error
+	GetExpiredUploads(ctx context.Context, cutoff time.Time) ([]tables.Upload, error)
 }
 
 type LLMRepository interface {
-	CallGemini(ctx context.Context, prompt string, chatroomId uint, files *multipart.FileHeader,
+	CallGemini(ctx context.Context, prompt string, chatroomId uint, options types.ChatOptions, attachment *types.Attachment,
 	) (types.GeminiApiResponse, error)
 }
@@ -0,0 +1,83 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/yuhangang/chat-app-backend/internal/db/tables"
+	api_errors "github.com/yuhangang/chat-app-backend/user_errors"
+
+	"gorm.io/gorm"
+)
+
+// kapiKeyTouchInterval limits last used updates to one write per key per interval
+const kapiKeyTouchInterval = 1 * time.Minute
+
+type ApiKeyRepo struct {
+	conn *gorm.DB
+}
+
+func NewApiKeyRepo(conn *gorm.DB) *ApiKeyRepo {
+	return &ApiKeyRepo{conn: conn}
+}
+
+func (repo *ApiKeyRepo) CreateApiKey(ctx context.Context, apiKey tables.ApiKey) (tables.ApiKey, error) {
+	err := repo.conn.WithContext(ctx).Create(&apiKey).Error
+
+	return apiKey, err
+}
+
+// GetApiKeys returns the user's keys that are not revoked, newest first
+func (repo *ApiKeyRepo) GetApiKeys(ctx context.Context, userID uint) ([]tables.ApiKey, error) {
+	var apiKeys []tables.ApiKey
+
+	err := repo.conn.WithContext(ctx).
+		Where("user_id = ? AND revoked_at IS NULL", userID).
+		Order("created_at DESC").
+		Find(&apiKeys).Error
+
+	return apiKeys, err
+}
+
+func (repo *ApiKeyRepo) RevokeApiKey(ctx context.Context, apiKeyID uint, userID uint) error {
+	res := repo.conn.WithContext(ctx).Model(&tables.ApiKey{}).
+		Where("id = ? AND user_id = ? AND revoked_at IS NULL", apiKeyID, userID).
+		Update("revoked_at", time.Now())
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return api_errors.ErrApiKeyNotFound
+	}
+
+	return nil
+}
+
+// AuthenticateApiKey returns the unrevoked, unexpired key with the hash and records its use.
+// Keys of disabled users never authenticate.
+func (repo *ApiKeyRepo) AuthenticateApiKey(ctx context.Context, keyHash string) (tables.ApiKey, error) {
+	var apiKey tables.ApiKey
+	now := time.Now()
+
+	err := repo.conn.WithContext(ctx).
+		Joins("JOIN users ON users.id = api_keys.user_id AND users.disabled_at IS NULL").
+		Where("api_keys.key_hash = ? AND api_keys.revoked_at IS NULL", keyHash).
+		Where("api_keys.expires_at IS NULL OR api_keys.expires_at > ?", now).
+		First(&apiKey).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return tables.ApiKey{}, api_errors.ErrInvalidToken
+	}
+	if err != nil {
+		return tables.ApiKey{}, err
+	}
+
+	if apiKey.LastUsedAt == nil || apiKey.LastUsedAt.Before(now.Add(-kapiKeyTouchInterval)) {
+		err = repo.conn.WithContext(ctx).Model(&apiKey).Update("last_used_at", now).Error
+		if err != nil {
+			return tables.ApiKey{}, err
+		}
+	}
+
+	return apiKey, nil
+}
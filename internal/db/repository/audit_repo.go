@@ -0,0 +1,30 @@
+package repository
+
+import (
+	"context"
+
+	"github.com/yuhangang/chat-app-backend/internal/db/tables"
+
+	"gorm.io/gorm"
+)
+
+type AuditRepo struct {
+	conn *gorm.DB
+}
+
+func NewAuditRepo(conn *gorm.DB) *AuditRepo {
+	return &AuditRepo{conn: conn}
+}
+
+func (repo *AuditRepo) CreateAuditLog(ctx context.Context, entry tables.AuditLog) error {
+	return repo.conn.WithContext(ctx).Create(&entry).Error
+}
+
+// GetAuditLogs pages through the audit log, newest first
+func (repo *AuditRepo) GetAuditLogs(ctx context.Context, offset int, limit int) ([]tables.AuditLog, error) {
+	var entries []tables.AuditLog
+
+	err := repo.conn.WithContext(ctx).Order("id DESC").Offset(offset).Limit(limit).Find(&entries).Error
+
+	return entries, err
+}
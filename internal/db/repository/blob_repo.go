@@ -0,0 +1,121 @@
+package repository
+
+import (
+	"context"
+	"time"
+
+	"github.com/yuhangang/chat-app-backend/internal/db/tables"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+type BlobRepo struct {
+	conn *gorm.DB
+}
+
+func NewBlobRepo(conn *gorm.DB) *BlobRepo {
+	return &BlobRepo{conn: conn}
+}
+
+// GetOrphanBlobs returns blobs whose last reference was released before the cutoff. The
+// reference count is the one record of what uses a file: attachments, their thumbnails, completed
+// uploads, avatars and data exports each take a reference with acquireBlob and drop it with
+// releaseBlobs.
+func (repo *BlobRepo) GetOrphanBlobs(ctx context.Context, cutoff time.Time) ([]tables.Blob, error) {
+	var blobs []tables.Blob
+
+	err := repo.conn.WithContext(ctx).
+		Where("ref_count = 0 AND updated_at < ?", cutoff).
+		Find(&blobs).Error
+
+	return blobs, err
+}
+
+// GetOrphanBlobsByKeys returns the blobs among the keys that nothing references anymore
+func (repo *BlobRepo) GetOrphanBlobsByKeys(ctx context.Context, fileKeys []string) ([]tables.Blob, error) {
+	if len(fileKeys) == 0 {
+		return nil, nil
+	}
+
+	var blobs []tables.Blob
+
+	err := repo.conn.WithContext(ctx).
+		Where("file_key IN ? AND ref_count = 0", fileKeys).
+		Find(&blobs).Error
+
+	return blobs, err
+}
+
+// DeleteOrphanBlob deletes the blob row only if it is still unreferenced, and reports whether it did
+func (repo *BlobRepo) DeleteOrphanBlob(ctx context.Context, blobID uint) (bool, error) {
+	res := repo.conn.WithContext(ctx).
+		Where("id = ? AND ref_count = 0", blobID).
+		Delete(&tables.Blob{})
+
+	return res.RowsAffected == 1, res.Error
+}
+
+// GetUntrackedFileKeys returns the keys without a blob row, i.e. files left behind by uploads
+// that failed before taking a reference
+func (repo *BlobRepo) GetUntrackedFileKeys(ctx context.Context, fileKeys []string) ([]string, error) {
+	if len(fileKeys) == 0 {
+		return nil, nil
+	}
+
+	var tracked []string
+	err := repo.conn.WithContext(ctx).Model(&tables.Blob{}).
+		Where("file_key IN ?", fileKeys).
+		Pluck("file_key", &tracked).Error
+	if err != nil {
+		return nil, err
+	}
+
+	known := make(map[string]bool)
+	for _, key := range tracked {
+		known[key] = true
+	}
+
+	var untracked []string
+	for _, key := range fileKeys {
+		if !known[key] {
+			untracked = append(untracked, key)
+		}
+	}
+
+	return untracked, nil
+}
+
+// acquireBlob records one more reference to the stored file, creating its blob row on first use
+func acquireBlob(ctx context.Context, tx *gorm.DB, fileKey string, size int64) error {
+	blob := tables.Blob{FileKey: fileKey, Size: size, RefCount: 1}
+
+	return tx.WithContext(ctx).Clauses(clause.OnConflict{
+		Columns: []clause.Column{{Name: "file_key"}},
+		DoUpdates: clause.Assignments(map[string]interface{}{
+			"ref_count":  gorm.Expr("blobs.ref_count + 1"),
+			"updated_at": time.Now(),
+		}),
+	}).Create(&blob).Error
+}
+
+// releaseBlobs drops one reference per key. The files stay on disk until garbage collection.
+func releaseBlobs(ctx context.Context, tx *gorm.DB, fileKeys []string) error {
+	for _, fileKey := range fileKeys {
+		if fileKey == "" {
+			continue
+		}
+
+		err := tx.WithContext(ctx).Model(&tables.Blob{}).
+			Where("file_key = ? AND ref_count > 0", fileKey).
+			Updates(map[string]interface{}{
+				"ref_count":  gorm.Expr("ref_count - 1"),
+				"updated_at": time.Now(),
+			}).Error
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -2,8 +2,11 @@ package repository
 
 import (
 	"context"
+	"errors"
 
 	"github.com/yuhangang/chat-app-backend/internal/db/tables"
+	api_errors "github.com/yuhangang/chat-app-backend/user_errors"
+
 	"gorm.io/gorm"
 )
 
@@ -22,3 +25,49 @@ func (repo *ChatConfigRepositoryImpl) GetChatModels(ctx context.Context) ([]tabl
 
 	return chatModels, err
 }
+
+func (repo *ChatConfigRepositoryImpl) GetChatModelByKey(ctx context.Context, modelKey string) (tables.LlmModel, error) {
+	var chatModel tables.LlmModel
+
+	err := repo.conn.WithContext(ctx).Where("model_key = ?", modelKey).First(&chatModel).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return tables.LlmModel{}, api_errors.ErrModelNotFound
+	}
+
+	return chatModel, err
+}
+
+func (repo *ChatConfigRepositoryImpl) SetChatModelAvailable(ctx context.Context, modelID uint, available bool) (tables.LlmModel, error) {
+	var chatModel tables.LlmModel
+
+	err := repo.conn.WithContext(ctx).Where("id = ?", modelID).First(&chatModel).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return tables.LlmModel{}, api_errors.ErrModelNotFound
+	}
+	if err != nil {
+		return tables.LlmModel{}, err
+	}
+
+	err = repo.conn.WithContext(ctx).Model(&chatModel).Update("available", available).Error
+
+	return chatModel, err
+}
+
+func (repo *ChatConfigRepositoryImpl) GetPersonas(ctx context.Context) ([]tables.LlmPersona, error) {
+	var personas []tables.LlmPersona
+
+	err := repo.conn.WithContext(ctx).Order("id").Find(&personas).Error
+
+	return personas, err
+}
+
+func (repo *ChatConfigRepositoryImpl) GetPersonaByKey(ctx context.Context, personaKey string) (tables.LlmPersona, error) {
+	var persona tables.LlmPersona
+
+	err := repo.conn.WithContext(ctx).Where("persona_key = ?", personaKey).First(&persona).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return tables.LlmPersona{}, api_errors.ErrUnknownPersona
+	}
+
+	return persona, err
+}
@@ -2,10 +2,18 @@ package repository
 
 import (
 	"context"
+	"errors"
+	"strings"
+	"time"
 
+	"github.com/yuhangang/chat-app-backend/internal/access"
 	"github.com/yuhangang/chat-app-backend/internal/db/tables"
+	"github.com/yuhangang/chat-app-backend/pkg/cursor"
+	"github.com/yuhangang/chat-app-backend/types"
+	api_errors "github.com/yuhangang/chat-app-backend/user_errors"
 
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
 type ChatRoomRepo struct {
@@ -16,37 +24,524 @@ func NewChatRoomRepo(conn *gorm.DB) *ChatRoomRepo {
 	return &ChatRoomRepo{conn: conn}
 }
 
-func (repo *ChatRoomRepo) GetChatRoomsForUser(ctx context.Context, userID uint) ([]tables.ChatRoom, error) {
+// GetChatRoomsForUser pages through the user's rooms matching the filter, most recently active
+// first, starting after the given cursor. With PinnedFirst the cursor rank is 1 while in the
+// pinned rooms. Rooms come with the user's role in them.
+func (repo *ChatRoomRepo) GetChatRoomsForUser(ctx context.Context, userID uint, filter types.ChatRoomFilter, after cursor.Cursor, limit int) ([]tables.ChatRoom, error) {
 	var chatRooms []tables.ChatRoom
 
-	err := repo.conn.WithContext(ctx).Where("user_id = ?", userID).Find(&chatRooms).Error
+	// unread are messages after the user's last read one that others wrote, replies included
+	lastRead := repo.conn.Model(&tables.ChatRoomRead{}).Select("last_read_message_id").
+		Where("chat_room_reads.chat_room_id = chat_rooms.id AND chat_room_reads.user_id = ?", userID)
+	unread := repo.conn.Model(&tables.ChatMessage{}).Select("COUNT(*)").
+		Where("chat_messages.chat_room_id = chat_rooms.id AND chat_messages.id > COALESCE((?), 0)", lastRead).
+		Where("(chat_messages.user_id IS NULL OR chat_messages.user_id <> ?)", userID)
+
+	query := repo.conn.WithContext(ctx)
+
+	if filter.Shared {
+		// pins, folders and tags are the owner's, they don't show in other members' lists
+		query = query.Select("chat_rooms.*, chat_room_members.role AS role, COALESCE((?), 0) AS last_read_id, (?) AS unread_count", lastRead, unread).
+			Joins("JOIN chat_room_members ON chat_room_members.chat_room_id = chat_rooms.id AND chat_room_members.user_id = ?", userID)
+		filter = types.ChatRoomFilter{Shared: true}
+	} else {
+		query = query.Select("chat_rooms.*, ? AS role, COALESCE((?), 0) AS last_read_id, (?) AS unread_count", tables.MemberOwner, lastRead, unread).
+			Preload("Tags").Where("chat_rooms.user_id = ? AND chat_rooms.archived = ?", userID, filter.Archived)
+	}
+
+	if filter.FolderID != nil && *filter.FolderID == 0 {
+		query = query.Where("chat_rooms.folder_id IS NULL")
+	} else if filter.FolderID != nil {
+		query = query.Where("chat_rooms.folder_id = ?", *filter.FolderID)
+	}
+	if filter.TagID != 0 {
+		query = query.Where("chat_rooms.id IN (?)", repo.conn.Model(&tables.ChatRoomTag{}).Select("chat_room_id").Where("chat_tag_id = ?", filter.TagID))
+	}
+
+	older := "chat_rooms.updated_at < ? OR (chat_rooms.updated_at = ? AND chat_rooms.id < ?)"
+	if filter.PinnedFirst {
+		if !after.IsZero() {
+			query = query.Where("chat_rooms.pinned < ? OR (chat_rooms.pinned = ? AND ("+older+"))", after.Rank == 1, after.Rank == 1, after.Time, after.Time, after.ID)
+		}
+		query = query.Order("chat_rooms.pinned DESC")
+	} else if !after.IsZero() {
+		query = query.Where(older, after.Time, after.Time, after.ID)
+	}
+
+	err := query.Order("chat_rooms.updated_at DESC, chat_rooms.id DESC").Limit(limit).Find(&chatRooms).Error
 
 	return chatRooms, err
 }
 
+// accessibleRooms is the condition on the chat rooms in table, a name or alias, that matches every
+// room in which the user's role allows the action: access.ChatRoomAllows for many rooms at once.
+// The owner's role comes from the room, everyone else's from their member row. The condition
+// uses named parameters, pass the args along with it.
+func accessibleRooms(table string, userID uint, action string) (string, map[string]interface{}) {
+	args := map[string]interface{}{"access_user": userID}
+
+	var conditions []string
+	var memberRoles []string
+	for _, role := range access.ChatRoomRoles(action) {
+		if role == tables.MemberOwner {
+			conditions = append(conditions, table+".user_id = @access_user")
+		} else {
+			memberRoles = append(memberRoles, role)
+		}
+	}
+	if len(memberRoles) > 0 {
+		conditions = append(conditions, table+".id IN (SELECT chat_room_id FROM chat_room_members WHERE user_id = @access_user AND role IN @access_roles)")
+		args["access_roles"] = memberRoles
+	}
+	if len(conditions) == 0 {
+		return "1 = 0", args
+	}
+
+	return "(" + strings.Join(conditions, " OR ") + ")", args
+}
+
+// GetMemberRole returns the role of a user invited to the room, empty when they are not a member.
+// The owner has no member row, compare with the room's UserID for that.
+func (repo *ChatRoomRepo) GetMemberRole(ctx context.Context, chatRoomID uint, userID uint) (string, error) {
+	var member tables.ChatRoomMember
+
+	err := repo.conn.WithContext(ctx).Where("chat_room_id = ? AND user_id = ?", chatRoomID, userID).Limit(1).Find(&member).Error
+
+	return member.Role, err
+}
+
+// MarkRoomRead moves the user's read position in the room up to messageID, or to the room's last
+// message when it is 0, and returns the position. It never moves back.
+func (repo *ChatRoomRepo) MarkRoomRead(ctx context.Context, chatRoomID uint, userID uint, messageID uint) (uint, error) {
+	var lastRead uint
+
+	err := repo.conn.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		// the position is capped at the room's last message, ids past it may be another room's
+		var lastMessageID uint
+		err := tx.Model(&tables.ChatMessage{}).Select("COALESCE(MAX(id), 0)").Where("chat_room_id = ?", chatRoomID).
+			Scan(&lastMessageID).Error
+		if err != nil {
+			return err
+		}
+		if messageID == 0 || messageID > lastMessageID {
+			messageID = lastMessageID
+		}
+
+		if err := markRead(tx, chatRoomID, userID, messageID); err != nil {
+			return err
+		}
+
+		return tx.Model(&tables.ChatRoomRead{}).Select("last_read_message_id").
+			Where("chat_room_id = ? AND user_id = ?", chatRoomID, userID).Scan(&lastRead).Error
+	})
+
+	return lastRead, err
+}
+
+// UpdateRooms applies the changes to those of the rooms the user may manage and returns how many
+// there were. Renaming, pinning and moving don't count as activity, updated_at is kept.
+func (repo *ChatRoomRepo) UpdateRooms(ctx context.Context, userID uint, chatRoomIDs []uint, changes types.ChatRoomChanges) (int64, error) {
+	updates := map[string]interface{}{}
+	if changes.Name != nil {
+		updates["name"] = *changes.Name
+	}
+	if changes.Pinned != nil {
+		updates["pinned"] = *changes.Pinned
+	}
+	if changes.Archived != nil {
+		updates["archived"] = *changes.Archived
+	}
+	if changes.Move {
+		updates["folder_id"] = changes.FolderID
+	}
+
+	var owned []uint
+	err := repo.conn.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if changes.Move && changes.FolderID != nil {
+			var count int64
+			err := tx.Model(&tables.ChatFolder{}).Where("id = ? AND user_id = ?", *changes.FolderID, userID).Count(&count).Error
+			if err != nil {
+				return err
+			}
+			if count == 0 {
+				return api_errors.ErrFolderNotFound
+			}
+		}
+		if changes.TagIDs != nil {
+			if err := checkTagsOwned(tx, userID, *changes.TagIDs); err != nil {
+				return err
+			}
+		}
+
+		manageable, args := accessibleRooms("chat_rooms", userID, access.ChatActionManage)
+		err := tx.Model(&tables.ChatRoom{}).Where("id IN ?", chatRoomIDs).Where(manageable, args).Pluck("id", &owned).Error
+		if err != nil || len(owned) == 0 {
+			return err
+		}
+
+		if len(updates) > 0 {
+			if err := tx.Model(&tables.ChatRoom{}).Where("id IN ?", owned).UpdateColumns(updates).Error; err != nil {
+				return err
+			}
+		}
+
+		if changes.TagIDs == nil {
+			return nil
+		}
+		if err := tx.Where("chat_room_id IN ?", owned).Delete(&tables.ChatRoomTag{}).Error; err != nil {
+			return err
+		}
+
+		var roomTags []tables.ChatRoomTag
+		for _, chatRoomID := range owned {
+			for _, tagID := range *changes.TagIDs {
+				roomTags = append(roomTags, tables.ChatRoomTag{ChatRoomID: chatRoomID, ChatTagID: tagID})
+			}
+		}
+		if len(roomTags) == 0 {
+			return nil
+		}
+
+		return tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&roomTags).Error
+	})
+
+	return int64(len(owned)), err
+}
+
+// TagRooms adds the tag to, or removes it from, those of the rooms the user may manage and
+// returns how many there were
+func (repo *ChatRoomRepo) TagRooms(ctx context.Context, userID uint, chatRoomIDs []uint, tagID uint, tagged bool) (int64, error) {
+	var owned []uint
+
+	err := repo.conn.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := checkTagsOwned(tx, userID, []uint{tagID}); err != nil {
+			return err
+		}
+
+		manageable, args := accessibleRooms("chat_rooms", userID, access.ChatActionManage)
+		err := tx.Model(&tables.ChatRoom{}).Where("id IN ?", chatRoomIDs).Where(manageable, args).Pluck("id", &owned).Error
+		if err != nil || len(owned) == 0 {
+			return err
+		}
+
+		if !tagged {
+			return tx.Where("chat_room_id IN ? AND chat_tag_id = ?", owned, tagID).Delete(&tables.ChatRoomTag{}).Error
+		}
+
+		roomTags := make([]tables.ChatRoomTag, len(owned))
+		for i, chatRoomID := range owned {
+			roomTags[i] = tables.ChatRoomTag{ChatRoomID: chatRoomID, ChatTagID: tagID}
+		}
+
+		return tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&roomTags).Error
+	})
+
+	return int64(len(owned)), err
+}
+
+// checkTagsOwned fails unless every tag belongs to the user
+func checkTagsOwned(tx *gorm.DB, userID uint, tagIDs []uint) error {
+	if len(tagIDs) == 0 {
+		return nil
+	}
+
+	var count int64
+	if err := tx.Model(&tables.ChatTag{}).Where("id IN ? AND user_id = ?", tagIDs, userID).Count(&count).Error; err != nil {
+		return err
+	}
+	if count != int64(len(tagIDs)) {
+		return api_errors.ErrTagNotFound
+	}
+
+	return nil
+}
+
+// DeleteRoomByID moves the room with its messages and attachments to the trash. They share one
+// deletion time, so a restore brings back exactly what was trashed together. The files stay
+// referenced until the room is purged.
 func (repo *ChatRoomRepo) DeleteRoomByID(ctx context.Context, chatRoomID uint, userID uint) error {
-	err := repo.conn.WithContext(ctx).Where("id = ? AND user_id = ?", chatRoomID, userID).Delete(&tables.ChatRoom{}).Error
+	deleted, err := repo.DeleteRoomsByID(ctx, []uint{chatRoomID}, userID)
+	if err != nil {
+		return err
+	}
+	if len(deleted) == 0 {
+		return api_errors.ErrChatRoomNotFound
+	}
 
-	return err
+	return nil
 }
 
-func (repo *ChatRoomRepo) CheckChatRoomExists(ctx context.Context, chatRoomID uint) (bool, error) {
+// DeleteRoomsByID moves those of the rooms the user may manage to the trash, like DeleteRoomByID,
+// and returns their ids
+func (repo *ChatRoomRepo) DeleteRoomsByID(ctx context.Context, chatRoomIDs []uint, userID uint) ([]uint, error) {
+	var owned []uint
+
+	err := repo.conn.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		now := time.Now()
+
+		manageable, args := accessibleRooms("chat_rooms", userID, access.ChatActionManage)
+		err := tx.Model(&tables.ChatRoom{}).Where("id IN ?", chatRoomIDs).Where(manageable, args).Pluck("id", &owned).Error
+		if err != nil || len(owned) == 0 {
+			return err
+		}
+
+		if err := tx.Model(&tables.ChatRoom{}).Where("id IN ?", owned).Update("deleted_at", now).Error; err != nil {
+			return err
+		}
+
+		messageIDs := tx.Model(&tables.ChatMessage{}).Select("id").Where("chat_room_id IN ?", owned)
+		err = tx.Model(&tables.ChatAttachment{}).Where("message_id IN (?)", messageIDs).Update("deleted_at", now).Error
+		if err != nil {
+			return err
+		}
+
+		return tx.Model(&tables.ChatMessage{}).Where("chat_room_id IN ?", owned).Update("deleted_at", now).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return owned, nil
+}
+
+// GetDeletedChatRoomsForUser lists the rooms in the trash the user may manage, most recently
+// deleted first
+func (repo *ChatRoomRepo) GetDeletedChatRoomsForUser(ctx context.Context, userID uint) ([]tables.ChatRoom, error) {
+	var chatRooms []tables.ChatRoom
+
+	manageable, args := accessibleRooms("chat_rooms", userID, access.ChatActionManage)
+	err := repo.conn.WithContext(ctx).Unscoped().
+		Where("deleted_at IS NOT NULL").
+		Where(manageable, args).
+		Order("deleted_at DESC").
+		Find(&chatRooms).Error
+
+	return chatRooms, err
+}
+
+// RestoreRoom takes the room out of the trash with the messages and attachments trashed with it,
+// if the user may manage it
+func (repo *ChatRoomRepo) RestoreRoom(ctx context.Context, chatRoomID uint, userID uint) (tables.ChatRoom, error) {
 	var chatRoom tables.ChatRoom
 
-	err := repo.conn.WithContext(ctx).Where("id = ?", chatRoomID).First(&chatRoom).Error
+	err := repo.conn.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		manageable, args := accessibleRooms("chat_rooms", userID, access.ChatActionManage)
+		err := tx.Unscoped().Where("id = ? AND deleted_at IS NOT NULL", chatRoomID).Where(manageable, args).First(&chatRoom).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return api_errors.ErrChatRoomNotFound
+		}
+		if err != nil {
+			return err
+		}
+
+		deletedAt := chatRoom.DeletedAt.Time
+
+		messageIDs := tx.Unscoped().Model(&tables.ChatMessage{}).Select("id").Where("chat_room_id = ?", chatRoomID)
+		err = tx.Unscoped().Model(&tables.ChatAttachment{}).
+			Where("message_id IN (?) AND deleted_at = ?", messageIDs, deletedAt).
+			Update("deleted_at", nil).Error
+		if err != nil {
+			return err
+		}
 
+		err = tx.Unscoped().Model(&tables.ChatMessage{}).
+			Where("chat_room_id = ? AND deleted_at = ?", chatRoomID, deletedAt).
+			Update("deleted_at", nil).Error
+		if err != nil {
+			return err
+		}
+
+		chatRoom.DeletedAt = gorm.DeletedAt{}
+
+		return tx.Unscoped().Model(&chatRoom).Update("deleted_at", nil).Error
+	})
+
+	return chatRoom, err
+}
+
+// PurgeDeletedRooms permanently deletes rooms trashed before the cutoff, with their messages,
+// attachments and embeds, and releases their blobs. Returns the IDs of the purged rooms.
+func (repo *ChatRoomRepo) PurgeDeletedRooms(ctx context.Context, cutoff time.Time) ([]uint, error) {
+	var chatRoomIDs []uint
+
+	err := repo.conn.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		err := tx.Unscoped().Model(&tables.ChatRoom{}).Where("deleted_at < ?", cutoff).Pluck("id", &chatRoomIDs).Error
+		if err != nil || len(chatRoomIDs) == 0 {
+			return err
+		}
+
+		fileKeys, err := deleteRoomContents(tx, chatRoomIDs)
+		if err != nil {
+			return err
+		}
+
+		if err := tx.Unscoped().Where("id IN ?", chatRoomIDs).Delete(&tables.ChatRoom{}).Error; err != nil {
+			return err
+		}
+
+		return releaseBlobs(ctx, tx, fileKeys)
+	})
+
+	return chatRoomIDs, err
+}
+
+// GetChatRoomsWithMessages returns every room the user may read, with their messages, attachments
+// and embeds, oldest first. Rooms in the trash are included for those who may manage them, as the
+// trash is theirs.
+func (repo *ChatRoomRepo) GetChatRoomsWithMessages(ctx context.Context, userID uint) ([]tables.ChatRoom, error) {
+	var chatRooms []tables.ChatRoom
+
+	readable, readArgs := accessibleRooms("chat_rooms", userID, access.ChatActionRead)
+	manageable, manageArgs := accessibleRooms("chat_rooms", userID, access.ChatActionManage)
+	trashed := repo.conn.Where("chat_rooms.deleted_at IS NULL").Or(manageable, manageArgs)
+
+	err := repo.conn.WithContext(ctx).Unscoped().
+		Preload("ChatMessages", func(db *gorm.DB) *gorm.DB { return db.Order("id") }).
+		Preload("ChatMessages.Attachments").
+		Preload("ChatMessages.Embeds").
+		Where(readable, readArgs).
+		Where(trashed).
+		Order("id").
+		Find(&chatRooms).Error
+
+	return chatRooms, err
+}
+
+// GetChatOptions returns the model and persona the chat was created with, falling back to the
+// defaults for chats from before they could be picked, and the persona's current instruction
+func (repo *ChatRoomRepo) GetChatOptions(ctx context.Context, chatRoomID uint) (types.ChatOptions, error) {
+	var chatRoom tables.ChatRoom
+
+	err := repo.conn.WithContext(ctx).Select("model_key", "persona").Where("id = ?", chatRoomID).First(&chatRoom).Error
+	if err != nil {
+		return types.ChatOptions{}, err
+	}
+
+	options := types.ChatOptions{ModelKey: chatRoom.ModelKey, Persona: chatRoom.Persona}
+	if options.ModelKey == "" {
+		options.ModelKey = types.DefaultModelKey
+	}
+	if options.Persona == "" {
+		options.Persona = types.DefaultPersona
+	}
+
+	// a persona removed since the chat was created leaves it without an instruction
+	var persona tables.LlmPersona
+	err = repo.conn.WithContext(ctx).Where("persona_key = ?", options.Persona).Limit(1).Find(&persona).Error
 	if err != nil {
-		return false, err
+		return types.ChatOptions{}, err
 	}
+	options.Instruction = persona.Instruction
 
-	return true, nil
+	return options, nil
 }
 
+// GetRoomByID returns the room without its messages, page through them with GetChatMessages
 func (repo *ChatRoomRepo) GetRoomByID(ctx context.Context, chatRoomID uint) (tables.ChatRoom, error) {
 	var chatRoom tables.ChatRoom
 
-	repo.conn.Preload("ChatMessages.Attachments").First(&chatRoom, chatRoomID)
-	err := repo.conn.WithContext(ctx).Where("id = ?", chatRoomID).First(&chatRoom).Error
+	err := repo.conn.WithContext(ctx).Preload("Tags").Where("id = ?", chatRoomID).First(&chatRoom).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return chatRoom, api_errors.ErrChatRoomNotFound
+	}
 
 	return chatRoom, err
 }
+
+// GetChatMessages pages through the room's messages with their attachments, newest first,
+// starting before the given cursor
+func (repo *ChatRoomRepo) GetChatMessages(ctx context.Context, chatRoomID uint, before cursor.Cursor, limit int) ([]tables.ChatMessage, error) {
+	var chatMessages []tables.ChatMessage
+
+	query := repo.conn.WithContext(ctx).Preload("Attachments").Where("chat_room_id = ?", chatRoomID)
+	if !before.IsZero() {
+		query = query.Where("id < ?", before.ID)
+	}
+
+	err := query.Order("id DESC").Limit(limit).Find(&chatMessages).Error
+
+	return chatMessages, err
+}
+
+// markRead moves the user's read position in the room up to messageID, keeping it if it is
+// already further
+func markRead(tx *gorm.DB, chatRoomID uint, userID uint, messageID uint) error {
+	return tx.Clauses(clause.OnConflict{
+		Columns: []clause.Column{{Name: "chat_room_id"}, {Name: "user_id"}},
+		DoUpdates: clause.Assignments(map[string]interface{}{
+			"last_read_message_id": gorm.Expr("CASE WHEN excluded.last_read_message_id > chat_room_reads.last_read_message_id THEN excluded.last_read_message_id ELSE chat_room_reads.last_read_message_id END"),
+			"updated_at":           gorm.Expr("excluded.updated_at"),
+		}),
+	}).Create(&tables.ChatRoomRead{ChatRoomID: chatRoomID, UserID: userID, LastReadMessageID: messageID}).Error
+}
+
+// deleteRoomContents permanently deletes the messages, attachments, embeds, embeddings, tag links,
+// shares, members and read positions of the rooms, trashed or not, and returns the file keys of
+// the deleted attachments and thumbnails for the caller to release
+func deleteRoomContents(tx *gorm.DB, chatRoomIDs []uint) ([]string, error) {
+	if len(chatRoomIDs) == 0 {
+		return nil, nil
+	}
+
+	tx = tx.Unscoped().Session(&gorm.Session{})
+	messageIDs := tx.Model(&tables.ChatMessage{}).Select("id").Where("chat_room_id IN ?", chatRoomIDs)
+
+	var attachments []tables.ChatAttachment
+	err := tx.Where("message_id IN (?)", messageIDs).Find(&attachments).Error
+	if err != nil {
+		return nil, err
+	}
+
+	var fileKeys []string
+	for _, attachment := range attachments {
+		fileKeys = append(fileKeys, attachment.FilePath, attachment.ThumbnailPath)
+	}
+
+	err = tx.Where("message_id IN (?)", messageIDs).Delete(&tables.ChatAttachment{}).Error
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.Where("message_id IN (?)", messageIDs).Delete(&tables.ChatEmbed{}).Error
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.Where("message_id IN (?)", messageIDs).Delete(&tables.MessageEmbedding{}).Error
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.Where("chat_room_id IN ?", chatRoomIDs).Delete(&tables.ChatRoomTag{}).Error
+	if err != nil {
+		return nil, err
+	}
+
+	shareIDs := tx.Model(&tables.ChatShare{}).Select("id").Where("chat_room_id IN ?", chatRoomIDs)
+	err = tx.Where("share_id IN (?)", shareIDs).Delete(&tables.ChatShareMessage{}).Error
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.Where("chat_room_id IN ?", chatRoomIDs).Delete(&tables.ChatShare{}).Error
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.Where("chat_room_id IN ?", chatRoomIDs).Delete(&tables.ChatRoomMember{}).Error
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.Where("chat_room_id IN ?", chatRoomIDs).Delete(&tables.ChatRoomRead{}).Error
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.Where("chat_room_id IN ?", chatRoomIDs).Delete(&tables.ChatMessage{}).Error
+	if err != nil {
+		return nil, err
+	}
+
+	return fileKeys, nil
+}
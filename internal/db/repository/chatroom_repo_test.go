@@ -0,0 +1,161 @@
+package repository
+
+import (
+	"context"
+	"testing"
+
+	"github.com/yuhangang/chat-app-backend/internal/db/tables"
+
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+const (
+	testOwner uint = iota + 1
+	testEditor
+	testViewer
+	testStranger
+)
+
+// newSharedRoom opens a database with one room of testOwner, shared with testEditor and
+// testViewer, holding a single message
+func newSharedRoom(t *testing.T) (*gorm.DB, tables.ChatRoom, tables.ChatMessage) {
+	t.Helper()
+
+	conn, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{TranslateError: true, Logger: logger.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = conn.AutoMigrate(&tables.ChatRoom{}, &tables.ChatMessage{}, &tables.ChatAttachment{}, &tables.ChatEmbed{},
+		&tables.ChatRoomMember{}, &tables.ChatTag{}, &tables.ChatRoomTag{}, &tables.ChatFolder{}, &tables.MessageEmbedding{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	chatRoom := tables.ChatRoom{Name: "Quarterly planning", SessionID: "session", UserID: testOwner}
+	if err := conn.Create(&chatRoom).Error; err != nil {
+		t.Fatal(err)
+	}
+	members := []tables.ChatRoomMember{
+		{ChatRoomID: chatRoom.ID, UserID: testEditor, Role: tables.MemberEditor, InvitedBy: testOwner},
+		{ChatRoomID: chatRoom.ID, UserID: testViewer, Role: tables.MemberViewer, InvitedBy: testOwner},
+	}
+	if err := conn.Create(&members).Error; err != nil {
+		t.Fatal(err)
+	}
+	message := tables.ChatMessage{Body: "the budget is approved", ChatRoomID: chatRoom.ID, IsUser: true}
+	if err := conn.Create(&message).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	return conn, chatRoom, message
+}
+
+func TestSearchCoversRoomsTheUserMayRead(t *testing.T) {
+	conn, chatRoom, message := newSharedRoom(t)
+	ctx := context.Background()
+
+	embeddingRepo := NewEmbeddingRepo(conn)
+	vector := []float32{1, 0}
+	if err := embeddingRepo.SaveEmbeddings(ctx, "test", []uint{message.ID}, [][]float32{vector}); err != nil {
+		t.Fatal(err)
+	}
+
+	searchRepo := NewSearchRepo(conn)
+	tests := []struct {
+		userID uint
+		want   bool
+	}{
+		{testOwner, true},
+		{testEditor, true},
+		{testViewer, true},
+		{testStranger, false},
+	}
+
+	for _, test := range tests {
+		results, err := searchRepo.Search(ctx, test.userID, "budget", 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if found := len(results) == 1 && results[0].ChatRoomID == chatRoom.ID; found != test.want {
+			t.Errorf("user %d: full-text results = %+v, want found = %v", test.userID, results, test.want)
+		}
+
+		results, err = embeddingRepo.SearchEmbeddings(ctx, test.userID, "test", vector, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if found := len(results) == 1 && results[0].ChatRoomID == chatRoom.ID; found != test.want {
+			t.Errorf("user %d: semantic results = %+v, want found = %v", test.userID, results, test.want)
+		}
+	}
+}
+
+func TestOnlyManagersTrashAndRestoreRooms(t *testing.T) {
+	conn, chatRoom, _ := newSharedRoom(t)
+	ctx := context.Background()
+	repo := NewChatRoomRepo(conn)
+
+	for _, userID := range []uint{testEditor, testViewer, testStranger} {
+		deleted, err := repo.DeleteRoomsByID(ctx, []uint{chatRoom.ID}, userID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(deleted) != 0 {
+			t.Fatalf("user %d trashed the room", userID)
+		}
+	}
+
+	deleted, err := repo.DeleteRoomsByID(ctx, []uint{chatRoom.ID}, testOwner)
+	if err != nil || len(deleted) != 1 {
+		t.Fatalf("owner trashed %d rooms: %v", len(deleted), err)
+	}
+
+	for _, userID := range []uint{testEditor, testViewer, testStranger} {
+		trash, err := repo.GetDeletedChatRoomsForUser(ctx, userID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(trash) != 0 {
+			t.Errorf("user %d sees %d rooms in the trash", userID, len(trash))
+		}
+		if _, err := repo.RestoreRoom(ctx, chatRoom.ID, userID); err == nil {
+			t.Errorf("user %d restored the room", userID)
+		}
+	}
+
+	if _, err := repo.RestoreRoom(ctx, chatRoom.ID, testOwner); err != nil {
+		t.Fatalf("owner could not restore the room: %v", err)
+	}
+}
+
+func TestExportCoversRoomsTheUserMayRead(t *testing.T) {
+	conn, chatRoom, _ := newSharedRoom(t)
+	ctx := context.Background()
+	repo := NewChatRoomRepo(conn)
+
+	count := func(userID uint) int {
+		chatRooms, err := repo.GetChatRoomsWithMessages(ctx, userID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(chatRooms)
+	}
+
+	for userID, want := range map[uint]int{testOwner: 1, testEditor: 1, testViewer: 1, testStranger: 0} {
+		if got := count(userID); got != want {
+			t.Errorf("user %d exports %d rooms, want %d", userID, got, want)
+		}
+	}
+
+	// the trash is the owner's
+	if _, err := repo.DeleteRoomsByID(ctx, []uint{chatRoom.ID}, testOwner); err != nil {
+		t.Fatal(err)
+	}
+	for userID, want := range map[uint]int{testOwner: 1, testEditor: 0, testViewer: 0} {
+		if got := count(userID); got != want {
+			t.Errorf("user %d exports %d trashed rooms, want %d", userID, got, want)
+		}
+	}
+}
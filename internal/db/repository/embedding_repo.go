@@ -0,0 +1,212 @@
+package repository
+
+import (
+	"context"
+	"encoding/binary"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/yuhangang/chat-app-backend/internal/access"
+	"github.com/yuhangang/chat-app-backend/internal/db/tables"
+	"github.com/yuhangang/chat-app-backend/types"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+type EmbeddingRepo struct {
+	conn *gorm.DB
+}
+
+func NewEmbeddingRepo(conn *gorm.DB) *EmbeddingRepo {
+	return &EmbeddingRepo{conn: conn}
+}
+
+// GetUnembeddedMessages returns messages after afterID with text that have no embedding from the
+// model yet, oldest first
+func (repo *EmbeddingRepo) GetUnembeddedMessages(ctx context.Context, model string, afterID uint, limit int) ([]tables.ChatMessage, error) {
+	var chatMessages []tables.ChatMessage
+
+	err := repo.conn.WithContext(ctx).
+		Where("id > ?", afterID).
+		Where("body <> ''").
+		Where("NOT EXISTS (SELECT 1 FROM message_embeddings e WHERE e.message_id = chat_messages.id AND e.model = ?)", model).
+		Order("id").
+		Limit(limit).
+		Find(&chatMessages).Error
+
+	return chatMessages, err
+}
+
+// SaveEmbeddings stores the vectors of the messages, replacing ones from another model
+func (repo *EmbeddingRepo) SaveEmbeddings(ctx context.Context, model string, messageIDs []uint, vectors [][]float32) error {
+	if len(messageIDs) == 0 {
+		return nil
+	}
+
+	embeddings := make([]tables.MessageEmbedding, len(messageIDs))
+	for i, messageID := range messageIDs {
+		embeddings[i] = tables.MessageEmbedding{MessageID: messageID, Model: model, Vector: encodeVector(vectors[i])}
+	}
+
+	return repo.conn.WithContext(ctx).Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "message_id"}},
+		DoUpdates: clause.AssignmentColumns([]string{"created_at", "model", "vector"}),
+	}).Create(&embeddings).Error
+}
+
+// SearchEmbeddings returns the messages the user may read closest to the vector by cosine
+// similarity, best first. Trashed rooms and messages with no similarity are left out.
+func (repo *EmbeddingRepo) SearchEmbeddings(ctx context.Context, userID uint, model string, vector []float32, limit int) ([]types.SearchResult, error) {
+	query := normalize(vector)
+
+	type scored struct {
+		messageID uint
+		score     float64
+	}
+
+	// scan every vector the user may read and keep the best, only those are loaded in full
+	readable, args := accessibleRooms("r", userID, access.ChatActionRead)
+	rows, err := repo.conn.WithContext(ctx).Table("message_embeddings e").
+		Select("e.message_id, e.vector").
+		Joins("JOIN chat_messages m ON m.id = e.message_id").
+		Joins("JOIN chat_rooms r ON r.id = m.chat_room_id").
+		Where("e.model = ? AND r.deleted_at IS NULL AND m.deleted_at IS NULL", model).
+		Where(readable, args).
+		Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var best []scored
+	for rows.Next() {
+		var messageID uint
+		var data []byte
+		if err := rows.Scan(&messageID, &data); err != nil {
+			return nil, err
+		}
+
+		// unrelated texts score around zero, they are no match at all
+		score := dot(query, decodeVector(data))
+		if score <= 0 || len(best) == limit && score <= best[len(best)-1].score {
+			continue
+		}
+
+		i := sort.Search(len(best), func(i int) bool { return best[i].score < score })
+		best = append(best, scored{})
+		copy(best[i+1:], best[i:])
+		best[i] = scored{messageID: messageID, score: score}
+		if len(best) > limit {
+			best = best[:limit]
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	results := []types.SearchResult{}
+	if len(best) == 0 {
+		return results, nil
+	}
+
+	messageIDs := make([]uint, len(best))
+	for i, match := range best {
+		messageIDs[i] = match.messageID
+	}
+
+	var matches []struct {
+		ID           uint
+		ChatRoomID   uint
+		ChatRoomName string
+		Body         string
+		CreatedAt    time.Time
+	}
+	err = repo.conn.WithContext(ctx).Table("chat_messages m").
+		Select("m.id, m.chat_room_id, r.name AS chat_room_name, m.body, m.created_at").
+		Joins("JOIN chat_rooms r ON r.id = m.chat_room_id").
+		Where("m.id IN ?", messageIDs).
+		Scan(&matches).Error
+	if err != nil {
+		return nil, err
+	}
+
+	byID := make(map[uint]int, len(matches))
+	for i, match := range matches {
+		byID[match.ID] = i
+	}
+
+	for _, match := range best {
+		i, ok := byID[match.messageID]
+		if !ok {
+			continue
+		}
+
+		messageID := matches[i].ID
+		results = append(results, types.SearchResult{
+			Kind:         types.SearchKindMessage,
+			ChatRoomID:   matches[i].ChatRoomID,
+			ChatRoomName: matches[i].ChatRoomName,
+			MessageID:    &messageID,
+			Snippet:      highlight(markTerms(matches[i].Body, nil)),
+			Score:        match.score,
+			CreatedAt:    matches[i].CreatedAt,
+		})
+	}
+
+	return results, nil
+}
+
+// encodeVector stores the vector at unit length, so cosine similarity is a dot product
+func encodeVector(vector []float32) []byte {
+	vector = normalize(vector)
+
+	data := make([]byte, 4*len(vector))
+	for i, value := range vector {
+		binary.LittleEndian.PutUint32(data[4*i:], math.Float32bits(value))
+	}
+
+	return data
+}
+
+func decodeVector(data []byte) []float32 {
+	vector := make([]float32, len(data)/4)
+	for i := range vector {
+		vector[i] = math.Float32frombits(binary.LittleEndian.Uint32(data[4*i:]))
+	}
+
+	return vector
+}
+
+func normalize(vector []float32) []float32 {
+	var norm float64
+	for _, value := range vector {
+		norm += float64(value) * float64(value)
+	}
+	if norm == 0 {
+		return vector
+	}
+
+	scale := 1 / math.Sqrt(norm)
+	normalized := make([]float32, len(vector))
+	for i, value := range vector {
+		normalized[i] = float32(float64(value) * scale)
+	}
+
+	return normalized
+}
+
+// dot is zero for vectors of different lengths, which come from different models
+func dot(a []float32, b []float32) float64 {
+	if len(a) != len(b) {
+		return 0
+	}
+
+	var sum float64
+	for i := range a {
+		sum += float64(a[i]) * float64(b[i])
+	}
+
+	return sum
+}
@@ -0,0 +1,142 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/yuhangang/chat-app-backend/internal/db/tables"
+	api_errors "github.com/yuhangang/chat-app-backend/user_errors"
+
+	"gorm.io/gorm"
+)
+
+type ExportRepo struct {
+	conn *gorm.DB
+}
+
+func NewExportRepo(conn *gorm.DB) *ExportRepo {
+	return &ExportRepo{conn: conn}
+}
+
+// kabandonedExportAge is well past the build timeout, an export still pending by then was
+// interrupted, e.g. by a restart
+const kabandonedExportAge = 1 * time.Hour
+
+// CreateExport stores a new pending export, unless the user already has one pending, which is
+// returned instead so repeated requests don't pile up work. Reports whether it created one.
+func (repo *ExportRepo) CreateExport(ctx context.Context, export tables.DataExport) (tables.DataExport, bool, error) {
+	created := false
+
+	err := repo.conn.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(&tables.DataExport{}).
+			Where("user_id = ? AND status = ? AND created_at < ?", export.UserID, tables.ExportPending, time.Now().Add(-kabandonedExportAge)).
+			Updates(map[string]interface{}{
+				"status":       tables.ExportFailed,
+				"error":        "export was interrupted",
+				"completed_at": time.Now(),
+			}).Error
+		if err != nil {
+			return err
+		}
+
+		var pending tables.DataExport
+		err = tx.Where("user_id = ? AND status = ?", export.UserID, tables.ExportPending).Limit(1).Find(&pending).Error
+		if err != nil {
+			return err
+		}
+		if pending.ID != "" {
+			export = pending
+			return nil
+		}
+
+		export.Status = tables.ExportPending
+		created = true
+
+		return tx.Create(&export).Error
+	})
+
+	return export, created, err
+}
+
+func (repo *ExportRepo) GetExport(ctx context.Context, exportID string, userID uint) (tables.DataExport, error) {
+	var export tables.DataExport
+
+	err := repo.conn.WithContext(ctx).Where("id = ? AND user_id = ?", exportID, userID).First(&export).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return tables.DataExport{}, api_errors.ErrExportNotFound
+	}
+
+	return export, err
+}
+
+func (repo *ExportRepo) GetExports(ctx context.Context, userID uint) ([]tables.DataExport, error) {
+	var exports []tables.DataExport
+
+	err := repo.conn.WithContext(ctx).Where("user_id = ?", userID).Order("created_at DESC").Find(&exports).Error
+
+	return exports, err
+}
+
+// CompleteExport records the stored ZIP and takes a blob reference on it until the export expires
+func (repo *ExportRepo) CompleteExport(ctx context.Context, exportID string, fileKey string, size int64) error {
+	return repo.conn.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		res := tx.Model(&tables.DataExport{}).
+			Where("id = ? AND status = ?", exportID, tables.ExportPending).
+			Updates(map[string]interface{}{
+				"status":       tables.ExportReady,
+				"file_key":     fileKey,
+				"size":         size,
+				"completed_at": time.Now(),
+			})
+		if res.Error != nil {
+			return res.Error
+		}
+		// the user was deleted while the export was being built
+		if res.RowsAffected == 0 {
+			return api_errors.ErrExportNotFound
+		}
+
+		return acquireBlob(ctx, tx, fileKey, size)
+	})
+}
+
+func (repo *ExportRepo) FailExport(ctx context.Context, exportID string, reason string) error {
+	return repo.conn.WithContext(ctx).Model(&tables.DataExport{}).
+		Where("id = ? AND status = ?", exportID, tables.ExportPending).
+		Updates(map[string]interface{}{
+			"status":       tables.ExportFailed,
+			"error":        reason,
+			"completed_at": time.Now(),
+		}).Error
+}
+
+// DeleteExpiredExports deletes exports past their expiry and releases their files, returning
+// the IDs of the deleted exports
+func (repo *ExportRepo) DeleteExpiredExports(ctx context.Context, now time.Time) ([]string, error) {
+	var exportIDs []string
+
+	err := repo.conn.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var exports []tables.DataExport
+		if err := tx.Where("expires_at < ?", now).Find(&exports).Error; err != nil {
+			return err
+		}
+		if len(exports) == 0 {
+			return nil
+		}
+
+		var fileKeys []string
+		for _, export := range exports {
+			exportIDs = append(exportIDs, export.ID)
+			fileKeys = append(fileKeys, export.FileKey)
+		}
+
+		if err := tx.Where("id IN ?", exportIDs).Delete(&tables.DataExport{}).Error; err != nil {
+			return err
+		}
+
+		return releaseBlobs(ctx, tx, fileKeys)
+	})
+
+	return exportIDs, err
+}
@@ -1,29 +1,32 @@
 package repository
 
 import (
+	"bytes"
 	"context"
 	"fmt"
 	"io"
-	"mime/multipart"
 	"os"
+	"path/filepath"
 
 	"github.com/google/generative-ai-go/genai"
 	"github.com/google/uuid"
 	"github.com/yuhangang/chat-app-backend/internal/db/tables"
+	"github.com/yuhangang/chat-app-backend/internal/service"
 	"github.com/yuhangang/chat-app-backend/types"
 	"gorm.io/gorm"
 )
 
 type LLMRepo struct {
-	conn       *gorm.DB
-	llmService types.HttpServiceV1
+	conn           *gorm.DB
+	llmService     types.HttpServiceV1
+	storageService service.StorageService
 }
 
-func NewLLMRepo(conn *gorm.DB, llmService types.HttpServiceV1) *LLMRepo {
-	return &LLMRepo{conn: conn, llmService: llmService}
+func NewLLMRepo(conn *gorm.DB, llmService types.HttpServiceV1, storageService service.StorageService) *LLMRepo {
+	return &LLMRepo{conn: conn, llmService: llmService, storageService: storageService}
 }
 
-func (r *LLMRepo) CallGemini(ctx context.Context, prompt string, chatroomId uint, file *multipart.FileHeader,
+func (r *LLMRepo) CallGemini(ctx context.Context, prompt string, chatroomId uint, options types.ChatOptions, attachment *types.Attachment,
 ) (types.GeminiApiResponse, error) {
 	var history []*genai.Content
 	var err error
@@ -40,36 +43,43 @@ func (r *LLMRepo) CallGemini(ctx context.Context, prompt string, chatroomId uint
 		}
 	}
 
-	if file != nil {
-		tempFilePath, err := saveUploadedFile(file)
+	if attachment != nil {
+		tempFilePath, err := r.saveTempFile(attachment)
 
 		if err != nil {
 			return types.GeminiApiResponse{}, err
 		}
 		defer os.Remove(tempFilePath)
 
-		return r.llmService.SendFileWithText(ctx, sessionId, prompt, history, tempFilePath)
+		return r.llmService.SendFileWithText(ctx, sessionId, prompt, history, tempFilePath, options)
 	}
 
-	return r.llmService.CallGemini(ctx, sessionId, prompt, history)
+	return r.llmService.CallGemini(ctx, sessionId, prompt, history, options)
 }
 
-func saveUploadedFile(fileHeader *multipart.FileHeader) (string, error) {
-	file, err := fileHeader.Open()
-	if err != nil {
-		return "", fmt.Errorf("failed to open file: %w", err)
+// saveTempFile writes the attachment to a temp file for the LLM upload, copying stored files
+// without loading them
+func (r *LLMRepo) saveTempFile(attachment *types.Attachment) (string, error) {
+	src := io.Reader(bytes.NewReader(attachment.Data))
+	if attachment.FileKey != "" {
+		file, err := r.storageService.OpenFile(attachment.FileKey)
+		if err != nil {
+			return "", err
+		}
+		defer file.Close()
+		src = file
 	}
-	defer file.Close()
 
-	tempFile, err := os.CreateTemp("", fileHeader.Filename)
+	// keep the extension last so the LLM upload can infer the MIME type from it
+	tempFile, err := os.CreateTemp("", "*_"+filepath.Base(attachment.FileName))
 	if err != nil {
 		return "", fmt.Errorf("failed to create temp file: %w", err)
 	}
 	defer tempFile.Close()
 
-	_, err = io.Copy(tempFile, file)
-	if err != nil {
-		return "", fmt.Errorf("failed to copy file to temp file: %w", err)
+	if _, err := io.Copy(tempFile, src); err != nil {
+		os.Remove(tempFile.Name())
+		return "", fmt.Errorf("failed to write temp file: %w", err)
 	}
 
 	return tempFile.Name(), nil
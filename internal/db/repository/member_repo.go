@@ -0,0 +1,132 @@
+package repository
+
+import (
+	"context"
+	"errors"
+
+	"github.com/yuhangang/chat-app-backend/internal/db/tables"
+	"github.com/yuhangang/chat-app-backend/types"
+	api_errors "github.com/yuhangang/chat-app-backend/user_errors"
+
+	"gorm.io/gorm"
+)
+
+type MemberRepo struct {
+	conn *gorm.DB
+}
+
+func NewMemberRepo(conn *gorm.DB) *MemberRepo {
+	return &MemberRepo{conn: conn}
+}
+
+// GetMembers lists the room's owner followed by its members in the order they joined
+func (repo *MemberRepo) GetMembers(ctx context.Context, chatRoomID uint) ([]types.ChatRoomMember, error) {
+	members := []types.ChatRoomMember{}
+
+	var owner types.ChatRoomMember
+	err := repo.conn.WithContext(ctx).Model(&tables.ChatRoom{}).
+		Select("users.id AS user_id, users.username, ? AS role, chat_rooms.created_at, COALESCE(chat_room_reads.last_read_message_id, 0) AS last_read_message_id", tables.MemberOwner).
+		Joins("JOIN users ON users.id = chat_rooms.user_id").
+		Joins("LEFT JOIN chat_room_reads ON chat_room_reads.chat_room_id = chat_rooms.id AND chat_room_reads.user_id = chat_rooms.user_id").
+		Where("chat_rooms.id = ?", chatRoomID).Scan(&owner).Error
+	if err != nil {
+		return nil, err
+	}
+	if owner.UserID != 0 {
+		members = append(members, owner)
+	}
+
+	var invited []types.ChatRoomMember
+	err = repo.memberQuery(ctx).Where("chat_room_members.chat_room_id = ?", chatRoomID).
+		Order("chat_room_members.id").Scan(&invited).Error
+	if err != nil {
+		return nil, err
+	}
+
+	return append(members, invited...), nil
+}
+
+// AddMember gives the user with the username a role in the room
+func (repo *MemberRepo) AddMember(ctx context.Context, chatRoomID uint, username string, role string, invitedBy uint) (types.ChatRoomMember, error) {
+	var member types.ChatRoomMember
+
+	err := repo.conn.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var user tables.User
+		err := tx.Where("username = ?", username).First(&user).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return api_errors.ErrUserNotFound
+		}
+		if err != nil {
+			return err
+		}
+
+		var chatRoom tables.ChatRoom
+		if err := tx.Select("id", "user_id").Where("id = ?", chatRoomID).First(&chatRoom).Error; err != nil {
+			return err
+		}
+		if chatRoom.UserID == user.ID {
+			return api_errors.ErrAlreadyMember
+		}
+
+		row := tables.ChatRoomMember{ChatRoomID: chatRoomID, UserID: user.ID, Role: role, InvitedBy: invitedBy}
+		err = tx.Create(&row).Error
+		if errors.Is(err, gorm.ErrDuplicatedKey) {
+			return api_errors.ErrAlreadyMember
+		}
+		if err != nil {
+			return err
+		}
+
+		member = types.ChatRoomMember{UserID: user.ID, Username: user.Username, Role: role, CreatedAt: row.CreatedAt}
+
+		return nil
+	})
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return member, api_errors.ErrChatRoomNotFound
+	}
+
+	return member, err
+}
+
+// UpdateMember changes the member's role, the owner's role can't change
+func (repo *MemberRepo) UpdateMember(ctx context.Context, chatRoomID uint, userID uint, role string) (types.ChatRoomMember, error) {
+	var member types.ChatRoomMember
+
+	res := repo.conn.WithContext(ctx).Model(&tables.ChatRoomMember{}).
+		Where("chat_room_id = ? AND user_id = ?", chatRoomID, userID).Update("role", role)
+	if res.Error != nil {
+		return member, res.Error
+	}
+	if res.RowsAffected == 0 {
+		return member, api_errors.ErrMemberNotFound
+	}
+
+	err := repo.memberQuery(ctx).
+		Where("chat_room_members.chat_room_id = ? AND chat_room_members.user_id = ?", chatRoomID, userID).
+		Scan(&member).Error
+
+	return member, err
+}
+
+// RemoveMember takes the member out of the room along with their read position, the owner can't
+// be removed
+func (repo *MemberRepo) RemoveMember(ctx context.Context, chatRoomID uint, userID uint) error {
+	return repo.conn.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		res := tx.Where("chat_room_id = ? AND user_id = ?", chatRoomID, userID).Delete(&tables.ChatRoomMember{})
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return api_errors.ErrMemberNotFound
+		}
+
+		return tx.Where("chat_room_id = ? AND user_id = ?", chatRoomID, userID).Delete(&tables.ChatRoomRead{}).Error
+	})
+}
+
+func (repo *MemberRepo) memberQuery(ctx context.Context) *gorm.DB {
+	return repo.conn.WithContext(ctx).Model(&tables.ChatRoomMember{}).
+		Select("chat_room_members.user_id, users.username, chat_room_members.role, chat_room_members.created_at, COALESCE(chat_room_reads.last_read_message_id, 0) AS last_read_message_id").
+		Joins("JOIN users ON users.id = chat_room_members.user_id").
+		Joins("LEFT JOIN chat_room_reads ON chat_room_reads.chat_room_id = chat_room_members.chat_room_id AND chat_room_reads.user_id = chat_room_members.user_id")
+}
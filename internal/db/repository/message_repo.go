@@ -2,7 +2,9 @@ package repository
 
 import (
 	"context"
-	"mime/multipart"
+	"path/filepath"
+	"strings"
+	"time"
 
 	"github.com/yuhangang/chat-app-backend/internal/db/tables"
 	"github.com/yuhangang/chat-app-backend/internal/service"
@@ -31,14 +33,16 @@ func (repo *MessageRepo) GetMessagesForChatRoom(ctx context.Context, chatRoomID
 func (repo *MessageRepo) CreateMessage(
 	ctx context.Context,
 	chatRoomID uint,
+	userID uint,
 	message string,
 	response string,
-	attachment *multipart.FileHeader) ([]tables.ChatMessage, error) {
+	attachment *types.Attachment) ([]tables.ChatMessage, error) {
 	// Create the chat message for the user
 	chatMessage := tables.ChatMessage{
 		ChatRoomID:     chatRoomID,
 		Body:           message,
 		IsUser:         true,
+		UserID:         &userID,
 		HasAttachments: attachment != nil,
 	}
 
@@ -67,41 +71,22 @@ func (repo *MessageRepo) CreateMessage(
 		}
 
 		if attachment != nil {
-			file, err := attachment.Open()
-			if err != nil {
-				tx.Rollback()
-				return err
-			}
-			defer file.Close()
-
-			// Save the file to disk or cloud storage
-			filePath, err := repo.storageService.SaveFile(attachment)
+			chatAttachment, err := repo.createAttachment(ctx, tx, chatMessage.ID, attachment)
 			if err != nil {
 				tx.Rollback()
 				return err
 			}
 
-			// Create the attachment record
-			attachment := tables.ChatAttachment{
-				FileName: attachment.Filename,
-				FileType: attachment.Header.Get("Content-Type"),
-				FileSize: attachment.Size,
-				// TODO: upload to cloud storage and get the URL
-				FilePath:  "http://localhost:3002/" + filePath,
-				MessageID: chatMessage.ID, // Attach to the user's message
-			}
-
-			// Save the attachment to the database
-			err = tx.WithContext(ctx).Create(&attachment).Error
-			if err != nil {
-				tx.Rollback()
-				return err
-			}
+			chatMessage.Attachments = append(chatMessage.Attachments, chatAttachment)
+		}
 
-			chatMessage.Attachments = append(chatMessage.Attachments, attachment)
+		// the sender has read everything up to the reply they get back
+		if err := markRead(tx.WithContext(ctx), chatRoomID, userID, chatResponse.ID); err != nil {
+			return err
 		}
 
-		return nil
+		// the room moves to the top of the chat list
+		return tx.WithContext(ctx).Model(&tables.ChatRoom{}).Where("id = ?", chatRoomID).Update("updated_at", time.Now()).Error
 	})
 
 	if err != nil {
@@ -118,12 +103,15 @@ func (repo *MessageRepo) CreateChatRoomWithMessage(
 	chatRoomName string,
 	message string,
 	response types.GeminiApiResponse,
-	attachment *multipart.FileHeader) (tables.ChatRoom, error) {
+	options types.ChatOptions,
+	attachment *types.Attachment) (tables.ChatRoom, error) {
 	// Create the chat room
 	chatRoom := tables.ChatRoom{
 		UserID:    userID,
 		Name:      chatRoomName,
 		SessionID: response.SessionID,
+		ModelKey:  options.ModelKey,
+		Persona:   options.Persona,
 	}
 
 	// Start a transaction to ensure both message and attachments are saved atomically
@@ -140,6 +128,7 @@ func (repo *MessageRepo) CreateChatRoomWithMessage(
 			ChatRoomID:     chatRoom.ID,
 			Body:           message,
 			IsUser:         true,
+			UserID:         &userID,
 			HasAttachments: attachment != nil,
 		}
 
@@ -164,43 +153,68 @@ func (repo *MessageRepo) CreateChatRoomWithMessage(
 		}
 
 		if attachment != nil {
-			file, err := attachment.Open()
-			if err != nil {
-				tx.Rollback()
-				return err
-			}
-			defer file.Close()
-
-			// Save the file to disk or cloud storage
-			filePath, err := repo.storageService.SaveFile(attachment)
-			if err != nil {
-				tx.Rollback()
-				return err
-			}
-
-			// Create the attachment record
-			attachment := tables.ChatAttachment{
-				FileName:  attachment.Filename,
-				FileType:  attachment.Header.Get("Content-Type"),
-				FileSize:  attachment.Size,
-				FilePath:  "http://localhost:3002/" + filePath,
-				MessageID: chatMessage.ID, // Attach to the user's message
-			}
-
-			// Save the attachment to the database
-			err = tx.WithContext(ctx).Create(&attachment).Error
+			chatAttachment, err := repo.createAttachment(ctx, tx, chatMessage.ID, attachment)
 			if err != nil {
 				tx.Rollback()
 				return err
 			}
 
-			chatMessage.Attachments = append(chatMessage.Attachments, attachment)
+			chatMessage.Attachments = append(chatMessage.Attachments, chatAttachment)
 		}
 
 		chatRoom.ChatMessages = append(chatRoom.ChatMessages, chatMessage, chatResponse)
 
-		return nil
+		return markRead(tx.WithContext(ctx), chatRoom.ID, userID, chatResponse.ID)
 	})
 
 	return chatRoom, err
 }
+
+// createAttachment stores the file, and its thumbnail for images, takes a blob reference on
+// each and records the attachment against the user's message. A file stored already, by a
+// resumable upload, is only referenced.
+func (repo *MessageRepo) createAttachment(ctx context.Context, tx *gorm.DB, messageID uint, attachment *types.Attachment) (tables.ChatAttachment, error) {
+	var err error
+
+	filePath := attachment.FileKey
+	if filePath == "" {
+		// Save the file to disk or cloud storage
+		filePath, err = repo.storageService.SaveFile(attachment.FileName, attachment.Data)
+		if err != nil {
+			return tables.ChatAttachment{}, err
+		}
+	}
+	if err := acquireBlob(ctx, tx, filePath, attachment.Size); err != nil {
+		return tables.ChatAttachment{}, err
+	}
+
+	var thumbnailPath string
+	if attachment.Thumbnail != nil {
+		thumbnailPath, err = repo.storageService.SaveFile(thumbnailFileName(attachment.FileName), attachment.Thumbnail)
+		if err != nil {
+			return tables.ChatAttachment{}, err
+		}
+		if err := acquireBlob(ctx, tx, thumbnailPath, int64(len(attachment.Thumbnail))); err != nil {
+			return tables.ChatAttachment{}, err
+		}
+	}
+
+	chatAttachment := tables.ChatAttachment{
+		FileName:      attachment.FileName,
+		FileType:      attachment.ContentType,
+		FileSize:      attachment.Size,
+		FilePath:      filePath,
+		ThumbnailPath: thumbnailPath,
+		MessageID:     messageID,
+		ExtractedText: attachment.Text,
+	}
+
+	// Save the attachment to the database
+	err = tx.WithContext(ctx).Create(&chatAttachment).Error
+
+	return chatAttachment, err
+}
+
+func thumbnailFileName(fileName string) string {
+	return "thumb_" + strings.TrimSuffix(fileName, filepath.Ext(fileName)) + ".jpg"
+}
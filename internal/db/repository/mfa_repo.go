@@ -0,0 +1,189 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/yuhangang/chat-app-backend/internal/db/tables"
+	api_errors "github.com/yuhangang/chat-app-backend/user_errors"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+type MfaRepo struct {
+	conn *gorm.DB
+}
+
+func NewMfaRepo(conn *gorm.DB) *MfaRepo {
+	return &MfaRepo{conn: conn}
+}
+
+// GetTotpCredential returns the user's authenticator, confirmed or not, or ErrMfaNotEnabled
+func (repo *MfaRepo) GetTotpCredential(ctx context.Context, userID uint) (tables.TotpCredential, error) {
+	var credential tables.TotpCredential
+
+	err := repo.conn.WithContext(ctx).Where("user_id = ?", userID).First(&credential).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return tables.TotpCredential{}, api_errors.ErrMfaNotEnabled
+	}
+
+	return credential, err
+}
+
+func (repo *MfaRepo) IsMfaEnabled(ctx context.Context, userID uint) (bool, error) {
+	var count int64
+
+	err := repo.conn.WithContext(ctx).Model(&tables.TotpCredential{}).
+		Where("user_id = ? AND confirmed_at IS NOT NULL", userID).
+		Count(&count).Error
+
+	return count > 0, err
+}
+
+// SaveTotpCredential stores a new unconfirmed secret, replacing an earlier unfinished enrolment.
+// A confirmed authenticator has to be disabled first.
+func (repo *MfaRepo) SaveTotpCredential(ctx context.Context, credential tables.TotpCredential) error {
+	return repo.conn.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var existing tables.TotpCredential
+		err := tx.Where("user_id = ?", credential.UserID).First(&existing).Error
+		if err == nil && existing.ConfirmedAt != nil {
+			return api_errors.ErrMfaAlreadyEnabled
+		}
+		if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+			return err
+		}
+
+		credential.ConfirmedAt = nil
+		credential.LastUsedStep = 0
+
+		return tx.Clauses(clause.OnConflict{UpdateAll: true}).Create(&credential).Error
+	})
+}
+
+// ConfirmTotpCredential turns on two-factor authentication with the step of the first code and
+// the hashes of a fresh set of recovery codes
+func (repo *MfaRepo) ConfirmTotpCredential(ctx context.Context, userID uint, step int64, recoveryCodeHashes []string) error {
+	return repo.conn.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		res := tx.Model(&tables.TotpCredential{}).
+			Where("user_id = ? AND confirmed_at IS NULL", userID).
+			Updates(map[string]interface{}{
+				"confirmed_at":   time.Now(),
+				"last_used_step": step,
+			})
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return api_errors.ErrMfaAlreadyEnabled
+		}
+
+		return replaceRecoveryCodes(tx, userID, recoveryCodeHashes)
+	})
+}
+
+// UseTotpStep records a code as used. A step at or before the last used one is a replay and
+// gets ErrInvalidMfaCode, the condition also catches two logins racing with the same code.
+func (repo *MfaRepo) UseTotpStep(ctx context.Context, userID uint, step int64) error {
+	res := repo.conn.WithContext(ctx).Model(&tables.TotpCredential{}).
+		Where("user_id = ? AND confirmed_at IS NOT NULL AND last_used_step < ?", userID, step).
+		Update("last_used_step", step)
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return api_errors.ErrInvalidMfaCode
+	}
+
+	return nil
+}
+
+// UseRecoveryCode consumes one of the user's unused recovery codes
+func (repo *MfaRepo) UseRecoveryCode(ctx context.Context, userID uint, codeHash string) error {
+	res := repo.conn.WithContext(ctx).Model(&tables.RecoveryCode{}).
+		Where("user_id = ? AND code_hash = ? AND used_at IS NULL", userID, codeHash).
+		Update("used_at", time.Now())
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return api_errors.ErrInvalidMfaCode
+	}
+
+	return nil
+}
+
+// ReplaceRecoveryCodes invalidates every recovery code of the user in favour of a new set
+func (repo *MfaRepo) ReplaceRecoveryCodes(ctx context.Context, userID uint, recoveryCodeHashes []string) error {
+	return repo.conn.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		return replaceRecoveryCodes(tx, userID, recoveryCodeHashes)
+	})
+}
+
+// DeleteTotpCredential turns two-factor authentication off, dropping the recovery codes with it
+func (repo *MfaRepo) DeleteTotpCredential(ctx context.Context, userID uint) error {
+	return repo.conn.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("user_id = ?", userID).Delete(&tables.RecoveryCode{}).Error; err != nil {
+			return err
+		}
+
+		return tx.Where("user_id = ?", userID).Delete(&tables.TotpCredential{}).Error
+	})
+}
+
+// CreateMfaChallenge stores a pending second step, clearing out abandoned ones on the way
+func (repo *MfaRepo) CreateMfaChallenge(ctx context.Context, challenge tables.MfaChallenge) error {
+	err := repo.conn.WithContext(ctx).Where("expires_at < ?", time.Now()).Delete(&tables.MfaChallenge{}).Error
+	if err != nil {
+		return err
+	}
+
+	return repo.conn.WithContext(ctx).Create(&challenge).Error
+}
+
+// GetMfaChallenge returns the unexpired challenge with the hash that has attempts left
+func (repo *MfaRepo) GetMfaChallenge(ctx context.Context, tokenHash string, maxAttempts int) (tables.MfaChallenge, error) {
+	var challenge tables.MfaChallenge
+
+	err := repo.conn.WithContext(ctx).
+		Where("token_hash = ? AND expires_at > ? AND attempts < ?", tokenHash, time.Now(), maxAttempts).
+		First(&challenge).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return tables.MfaChallenge{}, api_errors.ErrInvalidToken
+	}
+
+	return challenge, err
+}
+
+func (repo *MfaRepo) RecordMfaChallengeFailure(ctx context.Context, challengeID uint) error {
+	return repo.conn.WithContext(ctx).Model(&tables.MfaChallenge{}).
+		Where("id = ?", challengeID).
+		Update("attempts", gorm.Expr("attempts + 1")).Error
+}
+
+// ConsumeMfaChallenge deletes the challenge, so each one signs in at most once
+func (repo *MfaRepo) ConsumeMfaChallenge(ctx context.Context, challengeID uint) error {
+	res := repo.conn.WithContext(ctx).Where("id = ?", challengeID).Delete(&tables.MfaChallenge{})
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return api_errors.ErrInvalidToken
+	}
+
+	return nil
+}
+
+func replaceRecoveryCodes(tx *gorm.DB, userID uint, recoveryCodeHashes []string) error {
+	if err := tx.Where("user_id = ?", userID).Delete(&tables.RecoveryCode{}).Error; err != nil {
+		return err
+	}
+
+	codes := make([]tables.RecoveryCode, 0, len(recoveryCodeHashes))
+	for _, hash := range recoveryCodeHashes {
+		codes = append(codes, tables.RecoveryCode{UserID: userID, CodeHash: hash})
+	}
+
+	return tx.Create(&codes).Error
+}
@@ -0,0 +1,250 @@
+package repository
+
+import (
+	"context"
+	"errors"
+
+	"github.com/yuhangang/chat-app-backend/internal/db/tables"
+	api_errors "github.com/yuhangang/chat-app-backend/user_errors"
+
+	"gorm.io/gorm"
+)
+
+// kmaxFolderDepth bounds how deeply folders nest, a top level folder is at depth 1
+const kmaxFolderDepth = 5
+
+type OrganizerRepo struct {
+	conn *gorm.DB
+}
+
+func NewOrganizerRepo(conn *gorm.DB) *OrganizerRepo {
+	return &OrganizerRepo{conn: conn}
+}
+
+func (repo *OrganizerRepo) GetFolders(ctx context.Context, userID uint) ([]tables.ChatFolder, error) {
+	folders := []tables.ChatFolder{}
+
+	err := repo.conn.WithContext(ctx).Where("user_id = ?", userID).Order("name, id").Find(&folders).Error
+
+	return folders, err
+}
+
+func (repo *OrganizerRepo) GetFolder(ctx context.Context, folderID uint, userID uint) (tables.ChatFolder, error) {
+	return getFolder(repo.conn.WithContext(ctx), folderID, userID)
+}
+
+// CreateFolder stores the folder under its parent, which has to be one of the user's folders
+func (repo *OrganizerRepo) CreateFolder(ctx context.Context, folder tables.ChatFolder) (tables.ChatFolder, error) {
+	err := repo.conn.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if folder.ParentID != nil {
+			depth, err := folderDepth(tx, *folder.ParentID, folder.UserID)
+			if err != nil {
+				return err
+			}
+			if depth >= kmaxFolderDepth {
+				return api_errors.ErrInvalidFolderParent
+			}
+		}
+
+		return tx.Create(&folder).Error
+	})
+
+	return folder, err
+}
+
+// UpdateFolder renames the folder and, with move set, moves it under parentID, or to the top
+// level when that is nil. A folder can't be moved under itself or one of its subfolders.
+func (repo *OrganizerRepo) UpdateFolder(ctx context.Context, folderID uint, userID uint, name *string, move bool, parentID *uint) (tables.ChatFolder, error) {
+	var folder tables.ChatFolder
+
+	err := repo.conn.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var err error
+		folder, err = getFolder(tx, folderID, userID)
+		if err != nil {
+			return err
+		}
+
+		updates := map[string]interface{}{}
+		if name != nil {
+			updates["name"] = *name
+		}
+
+		if move {
+			if parentID != nil {
+				if err := checkFolderMove(tx, folderID, *parentID, userID); err != nil {
+					return err
+				}
+			}
+			updates["parent_id"] = parentID
+		}
+
+		if len(updates) == 0 {
+			return nil
+		}
+		if err := tx.Model(&folder).Updates(updates).Error; err != nil {
+			return err
+		}
+
+		return tx.Where("id = ?", folderID).First(&folder).Error
+	})
+
+	return folder, err
+}
+
+// DeleteFolder deletes the folder. Its subfolders and rooms, trashed ones included, move up to
+// its parent rather than being deleted with it.
+func (repo *OrganizerRepo) DeleteFolder(ctx context.Context, folderID uint, userID uint) error {
+	return repo.conn.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		folder, err := getFolder(tx, folderID, userID)
+		if err != nil {
+			return err
+		}
+
+		err = tx.Model(&tables.ChatFolder{}).Where("parent_id = ?", folderID).Update("parent_id", folder.ParentID).Error
+		if err != nil {
+			return err
+		}
+
+		err = tx.Unscoped().Model(&tables.ChatRoom{}).Where("folder_id = ?", folderID).UpdateColumn("folder_id", folder.ParentID).Error
+		if err != nil {
+			return err
+		}
+
+		return tx.Delete(&folder).Error
+	})
+}
+
+func (repo *OrganizerRepo) GetTags(ctx context.Context, userID uint) ([]tables.ChatTag, error) {
+	tags := []tables.ChatTag{}
+
+	err := repo.conn.WithContext(ctx).Where("user_id = ?", userID).Order("name").Find(&tags).Error
+
+	return tags, err
+}
+
+func (repo *OrganizerRepo) CreateTag(ctx context.Context, tag tables.ChatTag) (tables.ChatTag, error) {
+	err := repo.conn.WithContext(ctx).Create(&tag).Error
+	if errors.Is(err, gorm.ErrDuplicatedKey) {
+		return tables.ChatTag{}, api_errors.ErrTagExists
+	}
+
+	return tag, err
+}
+
+func (repo *OrganizerRepo) UpdateTag(ctx context.Context, tagID uint, userID uint, name *string, color *string) (tables.ChatTag, error) {
+	var tag tables.ChatTag
+
+	err := repo.conn.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("id = ? AND user_id = ?", tagID, userID).First(&tag).Error; err != nil {
+			return err
+		}
+
+		updates := map[string]interface{}{}
+		if name != nil {
+			updates["name"] = *name
+		}
+		if color != nil {
+			updates["color"] = *color
+		}
+		if len(updates) == 0 {
+			return nil
+		}
+
+		return tx.Model(&tag).Updates(updates).Error
+	})
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return tables.ChatTag{}, api_errors.ErrTagNotFound
+	}
+	if errors.Is(err, gorm.ErrDuplicatedKey) {
+		return tables.ChatTag{}, api_errors.ErrTagExists
+	}
+
+	return tag, err
+}
+
+// DeleteTag deletes the tag and takes it off every room
+func (repo *OrganizerRepo) DeleteTag(ctx context.Context, tagID uint, userID uint) error {
+	return repo.conn.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		res := tx.Where("id = ? AND user_id = ?", tagID, userID).Delete(&tables.ChatTag{})
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return api_errors.ErrTagNotFound
+		}
+
+		return tx.Where("chat_tag_id = ?", tagID).Delete(&tables.ChatRoomTag{}).Error
+	})
+}
+
+func getFolder(conn *gorm.DB, folderID uint, userID uint) (tables.ChatFolder, error) {
+	var folder tables.ChatFolder
+
+	err := conn.Where("id = ? AND user_id = ?", folderID, userID).First(&folder).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return tables.ChatFolder{}, api_errors.ErrFolderNotFound
+	}
+
+	return folder, err
+}
+
+// folderDepth returns how deep the user's folder is nested, 1 for a top level folder
+func folderDepth(tx *gorm.DB, folderID uint, userID uint) (int, error) {
+	depth := 0
+
+	for id := &folderID; id != nil; depth++ {
+		// a cycle can't be stored, the bound only guards against looping on corrupt data
+		if depth > kmaxFolderDepth {
+			return depth, nil
+		}
+
+		folder, err := getFolder(tx, *id, userID)
+		if err != nil {
+			return 0, err
+		}
+		id = folder.ParentID
+	}
+
+	return depth, nil
+}
+
+// checkFolderMove fails unless the folder, with its subfolders, fits under the parent within
+// kmaxFolderDepth and the parent isn't the folder itself or inside it
+func checkFolderMove(tx *gorm.DB, folderID uint, parentID uint, userID uint) error {
+	// walk up from the parent, meeting the folder means it would end up inside itself
+	depth := 0
+	for id := &parentID; id != nil; depth++ {
+		if *id == folderID || depth >= kmaxFolderDepth {
+			return api_errors.ErrInvalidFolderParent
+		}
+
+		folder, err := getFolder(tx, *id, userID)
+		if err != nil {
+			return err
+		}
+		id = folder.ParentID
+	}
+
+	// then down from the folder, the deepest subfolder has to stay within the bound
+	height := 1
+	level := []uint{folderID}
+	for {
+		var children []uint
+		err := tx.Model(&tables.ChatFolder{}).Where("parent_id IN ?", level).Pluck("id", &children).Error
+		if err != nil {
+			return err
+		}
+		if len(children) == 0 {
+			break
+		}
+
+		height++
+		level = children
+	}
+
+	if depth+height > kmaxFolderDepth {
+		return api_errors.ErrInvalidFolderParent
+	}
+
+	return nil
+}
@@ -0,0 +1,276 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+	"html"
+	"strings"
+	"unicode"
+
+	"github.com/yuhangang/chat-app-backend/internal/access"
+	"github.com/yuhangang/chat-app-backend/internal/db/tables"
+	"github.com/yuhangang/chat-app-backend/types"
+
+	"gorm.io/gorm"
+)
+
+// Markers around matched terms in snippets. They can't be typed, so they survive escaping the
+// snippet and are then replaced with <mark> tags.
+const kmarkStart = "\ue000"
+const kmarkEnd = "\ue001"
+
+// kmaxSearchTerms bounds how many words of a query are searched for
+const kmaxSearchTerms = 10
+
+// ksnippetLength and ksnippetContext are in characters, for snippets built without an index
+const ksnippetLength = 160
+const ksnippetContext = 40
+
+// ksqliteSearch is formatted with the condition on the rooms r the user may read
+const ksqliteSearch = `
+SELECT 'message' AS kind, r.id AS chat_room_id, r.name AS chat_room_name, m.id AS message_id, NULL AS attachment_id,
+	snippet(chat_messages_fts, 0, @start, @end, '…', 24) AS snippet, m.created_at AS created_at, bm25(chat_messages_fts) AS rank
+FROM chat_messages_fts
+JOIN chat_messages m ON m.id = chat_messages_fts.rowid
+JOIN chat_rooms r ON r.id = m.chat_room_id
+WHERE chat_messages_fts MATCH @query AND %[1]s AND r.deleted_at IS NULL AND m.deleted_at IS NULL
+UNION ALL
+SELECT 'room', r.id, r.name, NULL, NULL,
+	highlight(chat_rooms_fts, 0, @start, @end), r.created_at, bm25(chat_rooms_fts)
+FROM chat_rooms_fts
+JOIN chat_rooms r ON r.id = chat_rooms_fts.rowid
+WHERE chat_rooms_fts MATCH @query AND %[1]s AND r.deleted_at IS NULL
+UNION ALL
+SELECT 'attachment', r.id, r.name, m.id, a.id,
+	snippet(chat_attachments_fts, -1, @start, @end, '…', 24), a.created_at, bm25(chat_attachments_fts)
+FROM chat_attachments_fts
+JOIN chat_attachments a ON a.id = chat_attachments_fts.rowid
+JOIN chat_messages m ON m.id = a.message_id
+JOIN chat_rooms r ON r.id = m.chat_room_id
+WHERE chat_attachments_fts MATCH @query AND %[1]s AND r.deleted_at IS NULL AND a.deleted_at IS NULL
+ORDER BY rank
+LIMIT @limit`
+
+// kpostgresSearch is formatted with the condition on the rooms r the user may read
+const kpostgresSearch = `
+WITH q AS (SELECT websearch_to_tsquery('simple', @query) AS query)
+SELECT 'message' AS kind, r.id AS chat_room_id, r.name AS chat_room_name, m.id AS message_id, NULL::bigint AS attachment_id,
+	ts_headline('simple', m.body, q.query, @options) AS snippet, m.created_at AS created_at, ts_rank(m.search_vector, q.query) AS rank
+FROM q, chat_messages m
+JOIN chat_rooms r ON r.id = m.chat_room_id
+WHERE m.search_vector @@ q.query AND %[1]s AND r.deleted_at IS NULL AND m.deleted_at IS NULL
+UNION ALL
+SELECT 'room', r.id, r.name, NULL, NULL,
+	ts_headline('simple', r.name, q.query, @options), r.created_at, ts_rank(r.search_vector, q.query)
+FROM q, chat_rooms r
+WHERE r.search_vector @@ q.query AND %[1]s AND r.deleted_at IS NULL
+UNION ALL
+SELECT 'attachment', r.id, r.name, m.id, a.id,
+	ts_headline('simple', a.file_name || ' ' || coalesce(a.extracted_text, ''), q.query, @options), a.created_at, ts_rank(a.search_vector, q.query)
+FROM q, chat_attachments a
+JOIN chat_messages m ON m.id = a.message_id
+JOIN chat_rooms r ON r.id = m.chat_room_id
+WHERE a.search_vector @@ q.query AND %[1]s AND r.deleted_at IS NULL AND a.deleted_at IS NULL
+ORDER BY rank DESC
+LIMIT @limit`
+
+// SearchRepo searches the full-text index set up by db.migrateSearch: FTS5 on SQLite and
+// tsvector on Postgres. SQLite built without FTS5 has no index, there it falls back to LIKE.
+type SearchRepo struct {
+	conn     *gorm.DB
+	postgres bool
+	fts5     bool
+}
+
+func NewSearchRepo(conn *gorm.DB) *SearchRepo {
+	postgres := conn.Dialector.Name() == "postgres"
+
+	return &SearchRepo{
+		conn:     conn,
+		postgres: postgres,
+		fts5:     !postgres && conn.Migrator().HasTable("chat_messages_fts"),
+	}
+}
+
+// Search returns up to limit matches for every word of the query in the rooms the user may read,
+// best first
+func (repo *SearchRepo) Search(ctx context.Context, userID uint, query string, limit int) ([]types.SearchResult, error) {
+	terms := strings.Fields(query)
+	if len(terms) > kmaxSearchTerms {
+		terms = terms[:kmaxSearchTerms]
+	}
+
+	results := []types.SearchResult{}
+	if len(terms) == 0 {
+		return results, nil
+	}
+
+	var err error
+	switch {
+	case repo.postgres:
+		readable, args := accessibleRooms("r", userID, access.ChatActionRead)
+		args["query"] = strings.Join(terms, " ")
+		args["options"] = fmt.Sprintf("StartSel=%s, StopSel=%s, MaxWords=24, MinWords=8, MaxFragments=1", kmarkStart, kmarkEnd)
+		args["limit"] = limit
+
+		err = repo.conn.WithContext(ctx).Raw(fmt.Sprintf(kpostgresSearch, readable), args).Scan(&results).Error
+	case repo.fts5:
+		readable, args := accessibleRooms("r", userID, access.ChatActionRead)
+		args["query"] = ftsQuery(terms)
+		args["start"] = kmarkStart
+		args["end"] = kmarkEnd
+		args["limit"] = limit
+
+		err = repo.conn.WithContext(ctx).Raw(fmt.Sprintf(ksqliteSearch, readable), args).Scan(&results).Error
+	default:
+		results, err = repo.searchLike(ctx, userID, terms, limit)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range results {
+		results[i].Snippet = highlight(results[i].Snippet)
+	}
+
+	return results, nil
+}
+
+// GetUnextractedAttachments returns attachments, trashed ones included, stored before their text
+// was extracted on upload. Extraction always leaves text, if only an empty one.
+func (repo *SearchRepo) GetUnextractedAttachments(ctx context.Context, limit int) ([]tables.ChatAttachment, error) {
+	var attachments []tables.ChatAttachment
+
+	err := repo.conn.WithContext(ctx).Unscoped().
+		Where("extracted_text IS NULL").
+		Order("id").
+		Limit(limit).
+		Find(&attachments).Error
+
+	return attachments, err
+}
+
+// SetExtractedText stores the text of an attachment, the index triggers pick it up
+func (repo *SearchRepo) SetExtractedText(ctx context.Context, attachmentID uint, text string) error {
+	return repo.conn.WithContext(ctx).Unscoped().Model(&tables.ChatAttachment{}).
+		Where("id = ?", attachmentID).
+		Update("extracted_text", text).Error
+}
+
+// searchLike scans the tables without an index, newest first, building the snippets itself
+func (repo *SearchRepo) searchLike(ctx context.Context, userID uint, terms []string, limit int) ([]types.SearchResult, error) {
+	readable, args := accessibleRooms("r", userID, access.ChatActionRead)
+	args["limit"] = limit
+
+	var messageWhere, roomWhere, attachmentWhere []string
+	for i, term := range terms {
+		name := fmt.Sprintf("p%d", i)
+		args[name] = "%" + escapeLike(term) + "%"
+
+		messageWhere = append(messageWhere, fmt.Sprintf(`m.body LIKE @%s ESCAPE '\'`, name))
+		roomWhere = append(roomWhere, fmt.Sprintf(`r.name LIKE @%s ESCAPE '\'`, name))
+		attachmentWhere = append(attachmentWhere, fmt.Sprintf(`(a.file_name LIKE @%[1]s ESCAPE '\' OR a.extracted_text LIKE @%[1]s ESCAPE '\')`, name))
+	}
+
+	query := fmt.Sprintf(`
+SELECT 'message' AS kind, r.id AS chat_room_id, r.name AS chat_room_name, m.id AS message_id, NULL AS attachment_id,
+	m.body AS snippet, m.created_at AS created_at
+FROM chat_messages m
+JOIN chat_rooms r ON r.id = m.chat_room_id
+WHERE %[2]s AND %[1]s AND r.deleted_at IS NULL AND m.deleted_at IS NULL
+UNION ALL
+SELECT 'room', r.id, r.name, NULL, NULL, r.name, r.created_at
+FROM chat_rooms r
+WHERE %[3]s AND %[1]s AND r.deleted_at IS NULL
+UNION ALL
+SELECT 'attachment', r.id, r.name, m.id, a.id, a.file_name || ' ' || coalesce(a.extracted_text, ''), a.created_at
+FROM chat_attachments a
+JOIN chat_messages m ON m.id = a.message_id
+JOIN chat_rooms r ON r.id = m.chat_room_id
+WHERE %[4]s AND %[1]s AND r.deleted_at IS NULL AND a.deleted_at IS NULL
+ORDER BY created_at DESC
+LIMIT @limit`, readable, strings.Join(messageWhere, " AND "), strings.Join(roomWhere, " AND "), strings.Join(attachmentWhere, " AND "))
+
+	results := []types.SearchResult{}
+	err := repo.conn.WithContext(ctx).Raw(query, args).Scan(&results).Error
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range results {
+		results[i].Snippet = markTerms(results[i].Snippet, terms)
+	}
+
+	return results, nil
+}
+
+// ftsQuery quotes every term so FTS5 syntax in the query is searched for rather than parsed,
+// and matches terms as prefixes so results show up while typing
+func ftsQuery(terms []string) string {
+	quoted := make([]string, len(terms))
+	for i, term := range terms {
+		quoted[i] = `"` + strings.ReplaceAll(term, `"`, `""`) + `"*`
+	}
+
+	return strings.Join(quoted, " ")
+}
+
+// markTerms cuts a snippet around the first match in the text and puts markers around every
+// match in it, ignoring case
+func markTerms(text string, terms []string) string {
+	runes := []rune(text)
+	lower := make([]rune, len(runes))
+	for i, r := range runes {
+		lower[i] = unicode.ToLower(r)
+	}
+
+	matched := make([]bool, len(runes))
+	first := -1
+	for _, term := range terms {
+		needle := []rune(strings.ToLower(term))
+		for i := 0; i+len(needle) <= len(lower); i++ {
+			if string(lower[i:i+len(needle)]) != string(needle) {
+				continue
+			}
+			for j := i; j < i+len(needle); j++ {
+				matched[j] = true
+			}
+			if first == -1 || i < first {
+				first = i
+			}
+		}
+	}
+
+	start := 0
+	if first > ksnippetContext {
+		start = first - ksnippetContext
+	}
+	end := start + ksnippetLength
+	if end > len(runes) {
+		end = len(runes)
+	}
+
+	var builder strings.Builder
+	if start > 0 {
+		builder.WriteString("…")
+	}
+	for i := start; i < end; i++ {
+		if matched[i] && (i == start || !matched[i-1]) {
+			builder.WriteString(kmarkStart)
+		}
+		builder.WriteRune(runes[i])
+		if matched[i] && (i == end-1 || !matched[i+1]) {
+			builder.WriteString(kmarkEnd)
+		}
+	}
+	if end < len(runes) {
+		builder.WriteString("…")
+	}
+
+	return builder.String()
+}
+
+// highlight escapes the snippet for HTML and turns the markers into <mark> tags
+func highlight(snippet string) string {
+	return strings.NewReplacer(kmarkStart, "<mark>", kmarkEnd, "</mark>").Replace(html.EscapeString(snippet))
+}
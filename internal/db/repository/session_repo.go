@@ -0,0 +1,165 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/yuhangang/chat-app-backend/internal/db/tables"
+	"github.com/yuhangang/chat-app-backend/types"
+	api_errors "github.com/yuhangang/chat-app-backend/user_errors"
+
+	"gorm.io/gorm"
+)
+
+// ksessionTouchInterval limits last seen updates to one write per session per interval
+const ksessionTouchInterval = 1 * time.Minute
+
+// errRefreshTokenReused rolls back a rotation whose token was already rotated once
+var errRefreshTokenReused = errors.New("refresh token reused")
+
+type SessionRepo struct {
+	conn *gorm.DB
+}
+
+func NewSessionRepo(conn *gorm.DB) *SessionRepo {
+	return &SessionRepo{conn: conn}
+}
+
+// CreateSession starts a session with its first refresh token
+func (repo *SessionRepo) CreateSession(ctx context.Context, session tables.Session, refreshToken tables.RefreshToken) error {
+	return repo.conn.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&session).Error; err != nil {
+			return err
+		}
+
+		refreshToken.SessionID = session.ID
+		return tx.Create(&refreshToken).Error
+	})
+}
+
+// RotateRefreshToken marks the old refresh token used, stores its replacement in the same session
+// and extends the session to the new token's expiry. Presenting an already used token revokes the
+// whole session, since either the client or an attacker is holding a stolen copy.
+func (repo *SessionRepo) RotateRefreshToken(ctx context.Context, oldTokenHash string, newToken tables.RefreshToken, client types.ClientInfo) error {
+	var sessionID string
+
+	err := repo.conn.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var token tables.RefreshToken
+		err := tx.Where("token_hash = ? AND expires_at > ?", oldTokenHash, time.Now()).First(&token).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return api_errors.ErrInvalidToken
+		}
+		if err != nil {
+			return err
+		}
+		sessionID = token.SessionID
+
+		var session tables.Session
+		err = tx.Where("id = ? AND revoked_at IS NULL", token.SessionID).First(&session).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return api_errors.ErrInvalidToken
+		}
+		if err != nil {
+			return err
+		}
+
+		if token.UsedAt != nil {
+			return errRefreshTokenReused
+		}
+
+		// the condition catches two requests rotating the same token at once
+		res := tx.Model(&tables.RefreshToken{}).
+			Where("id = ? AND used_at IS NULL", token.ID).
+			Update("used_at", time.Now())
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return errRefreshTokenReused
+		}
+
+		newToken.SessionID = token.SessionID
+		if err := tx.Create(&newToken).Error; err != nil {
+			return err
+		}
+
+		return tx.Model(&session).Updates(map[string]interface{}{
+			"user_agent":   client.UserAgent,
+			"ip_address":   client.IPAddress,
+			"last_seen_at": time.Now(),
+			"expires_at":   newToken.ExpiresAt,
+		}).Error
+	})
+
+	if errors.Is(err, errRefreshTokenReused) {
+		log.Printf("Refresh token reused, revoking session %s", sessionID)
+		if err := repo.revokeSessions(ctx, repo.conn.Where("id = ?", sessionID)); err != nil {
+			return err
+		}
+		return api_errors.ErrInvalidToken
+	}
+
+	return err
+}
+
+// IsSessionActive reports whether the session is neither revoked nor past its last refresh token
+func (repo *SessionRepo) IsSessionActive(ctx context.Context, sessionID string) (bool, error) {
+	var count int64
+
+	err := repo.conn.WithContext(ctx).Model(&tables.Session{}).
+		Where("id = ? AND revoked_at IS NULL AND expires_at > ?", sessionID, time.Now()).
+		Count(&count).Error
+
+	return count > 0, err
+}
+
+// TouchSession records that the session was just used, at most once per ksessionTouchInterval
+func (repo *SessionRepo) TouchSession(ctx context.Context, sessionID string) error {
+	now := time.Now()
+
+	return repo.conn.WithContext(ctx).Model(&tables.Session{}).
+		Where("id = ? AND last_seen_at < ?", sessionID, now.Add(-ksessionTouchInterval)).
+		Update("last_seen_at", now).Error
+}
+
+// GetActiveSessions returns the user's signed in devices, most recently used first
+func (repo *SessionRepo) GetActiveSessions(ctx context.Context, userID uint) ([]tables.Session, error) {
+	var sessions []tables.Session
+
+	err := repo.conn.WithContext(ctx).
+		Where("user_id = ? AND revoked_at IS NULL AND expires_at > ?", userID, time.Now()).
+		Order("last_seen_at DESC").
+		Find(&sessions).Error
+
+	return sessions, err
+}
+
+// RevokeSession revokes one of the user's sessions
+func (repo *SessionRepo) RevokeSession(ctx context.Context, sessionID string, userID uint) error {
+	var count int64
+	err := repo.conn.WithContext(ctx).Model(&tables.Session{}).
+		Where("id = ? AND user_id = ?", sessionID, userID).
+		Count(&count).Error
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return api_errors.ErrSessionNotFound
+	}
+
+	return repo.revokeSessions(ctx, repo.conn.Where("id = ? AND user_id = ?", sessionID, userID))
+}
+
+// RevokeAllSessions signs the user out everywhere
+func (repo *SessionRepo) RevokeAllSessions(ctx context.Context, userID uint) error {
+	return repo.revokeSessions(ctx, repo.conn.Where("user_id = ?", userID))
+}
+
+func (repo *SessionRepo) revokeSessions(ctx context.Context, scope *gorm.DB) error {
+	return repo.conn.WithContext(ctx).Model(&tables.Session{}).
+		Where(scope).
+		Where("revoked_at IS NULL").
+		Update("revoked_at", time.Now()).Error
+}
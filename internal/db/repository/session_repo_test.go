@@ -0,0 +1,76 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/yuhangang/chat-app-backend/internal/db/tables"
+	"github.com/yuhangang/chat-app-backend/types"
+	api_errors "github.com/yuhangang/chat-app-backend/user_errors"
+
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+func TestRotateRefreshTokenRevokesSessionOnReuse(t *testing.T) {
+	conn, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{TranslateError: true, Logger: logger.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.AutoMigrate(&tables.Session{}, &tables.RefreshToken{}); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	sessionRepo := NewSessionRepo(conn)
+	expiresAt := time.Now().Add(time.Hour)
+	newToken := func(hash string) tables.RefreshToken {
+		return tables.RefreshToken{TokenHash: hash, ExpiresAt: expiresAt}
+	}
+
+	session := tables.Session{ID: "session", UserID: 1, UserAgent: "laptop", ExpiresAt: expiresAt}
+	if err := sessionRepo.CreateSession(ctx, session, newToken("first")); err != nil {
+		t.Fatal(err)
+	}
+
+	phone := types.ClientInfo{UserAgent: "phone", IPAddress: "192.0.2.1"}
+	if err := sessionRepo.RotateRefreshToken(ctx, "first", newToken("second"), phone); err != nil {
+		t.Fatal(err)
+	}
+
+	var rotated tables.Session
+	if err := conn.First(&rotated, "id = ?", session.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+	if rotated.UserAgent != phone.UserAgent || rotated.IPAddress != phone.IPAddress {
+		t.Errorf("session client = %q %q after rotation, want the rotating client", rotated.UserAgent, rotated.IPAddress)
+	}
+	if err := sessionRepo.RotateRefreshToken(ctx, "unknown", newToken("other"), phone); !errors.Is(err, api_errors.ErrInvalidToken) {
+		t.Errorf("unknown token: err = %v, want ErrInvalidToken", err)
+	}
+	if active, err := sessionRepo.IsSessionActive(ctx, session.ID); err != nil || !active {
+		t.Fatalf("session active = %v, %v after rotation, want true", active, err)
+	}
+
+	// the first token again means a copy of it is out there
+	if err := sessionRepo.RotateRefreshToken(ctx, "first", newToken("third"), phone); !errors.Is(err, api_errors.ErrInvalidToken) {
+		t.Fatalf("reused token: err = %v, want ErrInvalidToken", err)
+	}
+	if active, err := sessionRepo.IsSessionActive(ctx, session.ID); err != nil || active {
+		t.Fatalf("session active = %v, %v after a reused token, want revoked", active, err)
+	}
+
+	// the legitimate holder of the current token is logged out too
+	if err := sessionRepo.RotateRefreshToken(ctx, "second", newToken("fourth"), phone); !errors.Is(err, api_errors.ErrInvalidToken) {
+		t.Errorf("current token of the revoked session: err = %v, want ErrInvalidToken", err)
+	}
+
+	var stored int64
+	conn.Model(&tables.RefreshToken{}).Where("token_hash IN ?", []string{"third", "fourth"}).Count(&stored)
+	if stored != 0 {
+		t.Errorf("%d tokens stored by failed rotations, want 0", stored)
+	}
+}
@@ -0,0 +1,199 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/yuhangang/chat-app-backend/internal/db/tables"
+	api_errors "github.com/yuhangang/chat-app-backend/user_errors"
+
+	"gorm.io/gorm"
+)
+
+type ShareRepo struct {
+	conn *gorm.DB
+}
+
+func NewShareRepo(conn *gorm.DB) *ShareRepo {
+	return &ShareRepo{conn: conn}
+}
+
+// CreateShare shares the user's room as it is now, pinning its current messages, and replaces
+// the room's previous link
+func (repo *ShareRepo) CreateShare(ctx context.Context, share tables.ChatShare) (tables.ChatShare, error) {
+	err := repo.conn.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var chatRoom tables.ChatRoom
+		err := tx.Where("id = ? AND user_id = ?", share.ChatRoomID, share.UserID).First(&chatRoom).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return api_errors.ErrChatRoomNotFound
+		}
+		if err != nil {
+			return err
+		}
+		share.Name = chatRoom.Name
+
+		if err := deleteShare(tx, chatRoom.ID); err != nil {
+			return err
+		}
+		if err := tx.Create(&share).Error; err != nil {
+			return err
+		}
+
+		var messageIDs []uint
+		if err := tx.Model(&tables.ChatMessage{}).Where("chat_room_id = ?", chatRoom.ID).Pluck("id", &messageIDs).Error; err != nil {
+			return err
+		}
+		if len(messageIDs) == 0 {
+			return nil
+		}
+
+		pins := make([]tables.ChatShareMessage, 0, len(messageIDs))
+		for _, messageID := range messageIDs {
+			pins = append(pins, tables.ChatShareMessage{ShareID: share.ID, MessageID: messageID})
+		}
+
+		return tx.CreateInBatches(&pins, 500).Error
+	})
+
+	return share, err
+}
+
+// DeleteShare revokes the link of the user's room
+func (repo *ShareRepo) DeleteShare(ctx context.Context, chatRoomID uint, userID uint) error {
+	return repo.conn.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		err := tx.Where("chat_room_id = ? AND user_id = ?", chatRoomID, userID).First(&tables.ChatShare{}).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return api_errors.ErrShareNotFound
+		}
+		if err != nil {
+			return err
+		}
+
+		return deleteShare(tx, chatRoomID)
+	})
+}
+
+// GetSharedChat returns the share with the messages it covers, oldest first
+func (repo *ShareRepo) GetSharedChat(ctx context.Context, slugHash string) (tables.ChatShare, []tables.ChatMessage, error) {
+	conn := repo.conn.WithContext(ctx)
+
+	share, _, err := getLiveShare(conn, slugHash)
+	if err != nil {
+		return tables.ChatShare{}, nil, err
+	}
+
+	messages, err := sharedMessages(conn, share)
+
+	return share, messages, err
+}
+
+// ForkSharedChat copies the shared messages into a new room of the user, so the conversation
+// can be continued there. The copies reference the same files as the originals.
+func (repo *ShareRepo) ForkSharedChat(ctx context.Context, slugHash string, userID uint, sessionID string) (tables.ChatRoom, error) {
+	var chatRoom tables.ChatRoom
+
+	err := repo.conn.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		share, source, err := getLiveShare(tx, slugHash)
+		if err != nil {
+			return err
+		}
+
+		messages, err := sharedMessages(tx, share)
+		if err != nil {
+			return err
+		}
+
+		chatRoom = tables.ChatRoom{
+			UserID:    userID,
+			Name:      share.Name,
+			SessionID: sessionID,
+			ModelKey:  source.ModelKey,
+			Persona:   source.Persona,
+		}
+		if err := tx.Create(&chatRoom).Error; err != nil {
+			return err
+		}
+
+		var lastMessageID uint
+		for _, message := range messages {
+			fork := tables.ChatMessage{
+				CreatedAt:      message.CreatedAt,
+				Body:           message.Body,
+				ChatRoomID:     chatRoom.ID,
+				IsUser:         message.IsUser,
+				HasAttachments: message.HasAttachments,
+			}
+
+			for _, attachment := range message.Attachments {
+				if err := acquireBlob(ctx, tx, attachment.FilePath, attachment.FileSize); err != nil {
+					return err
+				}
+				if attachment.ThumbnailPath != "" {
+					// the thumbnail's blob exists already, only its reference count goes up
+					if err := acquireBlob(ctx, tx, attachment.ThumbnailPath, 0); err != nil {
+						return err
+					}
+				}
+
+				attachment.ID = 0
+				attachment.MessageID = 0
+				fork.Attachments = append(fork.Attachments, attachment)
+			}
+
+			for _, embed := range message.Embeds {
+				embed.ID = 0
+				embed.MessageID = 0
+				fork.Embeds = append(fork.Embeds, embed)
+			}
+
+			if err := tx.Create(&fork).Error; err != nil {
+				return err
+			}
+			lastMessageID = fork.ID
+		}
+
+		// the copy was read on the share page
+		return markRead(tx, chatRoom.ID, userID, lastMessageID)
+	})
+
+	return chatRoom, err
+}
+
+// getLiveShare finds the share by the hash of its slug, unless it expired or its room is in the trash
+func getLiveShare(conn *gorm.DB, slugHash string) (tables.ChatShare, tables.ChatRoom, error) {
+	var share tables.ChatShare
+	var chatRoom tables.ChatRoom
+
+	err := conn.Where("slug_hash = ? AND (expires_at IS NULL OR expires_at > ?)", slugHash, time.Now()).First(&share).Error
+	if err == nil {
+		err = conn.Where("id = ?", share.ChatRoomID).First(&chatRoom).Error
+	}
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return tables.ChatShare{}, tables.ChatRoom{}, api_errors.ErrShareNotFound
+	}
+
+	return share, chatRoom, err
+}
+
+// sharedMessages returns the messages pinned to the share, oldest first
+func sharedMessages(conn *gorm.DB, share tables.ChatShare) ([]tables.ChatMessage, error) {
+	var messages []tables.ChatMessage
+
+	pinned := conn.Model(&tables.ChatShareMessage{}).Select("message_id").Where("share_id = ?", share.ID)
+	err := conn.Preload("Attachments").Preload("Embeds").
+		Where("id IN (?)", pinned).
+		Order("id").Find(&messages).Error
+
+	return messages, err
+}
+
+// deleteShare deletes the room's share, if any, with its pins
+func deleteShare(tx *gorm.DB, chatRoomID uint) error {
+	shareIDs := tx.Model(&tables.ChatShare{}).Select("id").Where("chat_room_id = ?", chatRoomID)
+	if err := tx.Where("share_id IN (?)", shareIDs).Delete(&tables.ChatShareMessage{}).Error; err != nil {
+		return err
+	}
+
+	return tx.Where("chat_room_id = ?", chatRoomID).Delete(&tables.ChatShare{}).Error
+}
@@ -0,0 +1,71 @@
+package repository
+
+import (
+	"context"
+	"testing"
+
+	"github.com/yuhangang/chat-app-backend/internal/db/tables"
+)
+
+func TestShareCoversOnlyMessagesWrittenBeforeSharing(t *testing.T) {
+	conn, chatRoom, message := newSharedRoom(t)
+	if err := conn.AutoMigrate(&tables.ChatShare{}, &tables.ChatShareMessage{}, &tables.ChatRoomRead{}); err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	shareRepo := NewShareRepo(conn)
+
+	share, err := shareRepo.CreateShare(ctx, tables.ChatShare{SlugHash: "first", ChatRoomID: chatRoom.ID, UserID: testOwner})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	later := tables.ChatMessage{Body: "the budget is cut again", ChatRoomID: chatRoom.ID, IsUser: true}
+	if err := conn.Create(&later).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	_, messages, err := shareRepo.GetSharedChat(ctx, share.SlugHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 1 || messages[0].ID != message.ID {
+		t.Fatalf("share shows %d messages, want only the one written before sharing", len(messages))
+	}
+
+	fork, err := shareRepo.ForkSharedChat(ctx, share.SlugHash, testStranger, "fork-session")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var forked int64
+	conn.Model(&tables.ChatMessage{}).Where("chat_room_id = ?", fork.ID).Count(&forked)
+	if forked != 1 {
+		t.Errorf("fork has %d messages, want 1", forked)
+	}
+
+	// sharing again replaces the link and pins the room as it is now
+	share, err = shareRepo.CreateShare(ctx, tables.ChatShare{SlugHash: "second", ChatRoomID: chatRoom.ID, UserID: testOwner})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, messages, err = shareRepo.GetSharedChat(ctx, share.SlugHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 2 {
+		t.Errorf("new share shows %d messages, want 2", len(messages))
+	}
+	var pins int64
+	conn.Model(&tables.ChatShareMessage{}).Count(&pins)
+	if pins != 2 {
+		t.Errorf("%d pins left, want only the new share's 2", pins)
+	}
+
+	if err := shareRepo.DeleteShare(ctx, chatRoom.ID, testOwner); err != nil {
+		t.Fatal(err)
+	}
+	conn.Model(&tables.ChatShareMessage{}).Count(&pins)
+	if pins != 0 {
+		t.Errorf("%d pins left after revoking the share, want 0", pins)
+	}
+}
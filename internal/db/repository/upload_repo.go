@@ -0,0 +1,91 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/yuhangang/chat-app-backend/internal/db/tables"
+	api_errors "github.com/yuhangang/chat-app-backend/user_errors"
+
+	"gorm.io/gorm"
+)
+
+type UploadRepo struct {
+	conn *gorm.DB
+}
+
+func NewUploadRepo(conn *gorm.DB) *UploadRepo {
+	return &UploadRepo{conn: conn}
+}
+
+func (repo *UploadRepo) CreateUpload(ctx context.Context, upload tables.Upload) (tables.Upload, error) {
+	err := repo.conn.WithContext(ctx).Create(&upload).Error
+
+	return upload, err
+}
+
+// GetUpload returns an unexpired upload owned by the user
+func (repo *UploadRepo) GetUpload(ctx context.Context, uploadID string, userID uint) (tables.Upload, error) {
+	var upload tables.Upload
+
+	err := repo.conn.WithContext(ctx).
+		Where("id = ? AND user_id = ? AND expires_at > ?", uploadID, userID, time.Now()).
+		First(&upload).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return tables.Upload{}, api_errors.ErrUploadNotFound
+	}
+
+	return upload, err
+}
+
+func (repo *UploadRepo) UpdateUploadOffset(ctx context.Context, uploadID string, offset int64) error {
+	return repo.conn.WithContext(ctx).Model(&tables.Upload{}).
+		Where("id = ?", uploadID).
+		Update("upload_offset", offset).Error
+}
+
+// CompleteUpload records the stored file and takes a blob reference on it, so it survives
+// garbage collection until the upload expires
+func (repo *UploadRepo) CompleteUpload(ctx context.Context, uploadID string, fileKey string, size int64) error {
+	return repo.conn.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(&tables.Upload{}).
+			Where("id = ?", uploadID).
+			Updates(map[string]interface{}{
+				"upload_offset": size,
+				"file_key":      fileKey,
+				"completed":     true,
+			}).Error
+		if err != nil {
+			return err
+		}
+
+		return acquireBlob(ctx, tx, fileKey, size)
+	})
+}
+
+// DeleteUpload removes the upload and releases its blob reference, if it was completed
+func (repo *UploadRepo) DeleteUpload(ctx context.Context, uploadID string) error {
+	return repo.conn.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var upload tables.Upload
+		err := tx.Where("id = ?", uploadID).First(&upload).Error
+		if err != nil {
+			return err
+		}
+
+		err = tx.Delete(&upload).Error
+		if err != nil {
+			return err
+		}
+
+		return releaseBlobs(ctx, tx, []string{upload.FileKey})
+	})
+}
+
+func (repo *UploadRepo) GetExpiredUploads(ctx context.Context, cutoff time.Time) ([]tables.Upload, error) {
+	var uploads []tables.Upload
+
+	err := repo.conn.WithContext(ctx).Where("expires_at < ?", cutoff).Find(&uploads).Error
+
+	return uploads, err
+}
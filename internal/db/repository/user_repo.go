@@ -4,11 +4,14 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"strings"
+	"time"
 
 	"github.com/yuhangang/chat-app-backend/internal/db/tables"
 	api_errors "github.com/yuhangang/chat-app-backend/user_errors"
 
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
 type UserRepo struct {
@@ -21,7 +24,9 @@ func NewUserRepo(conn *gorm.DB) *UserRepo {
 
 func (repo *UserRepo) CreateUser(ctx context.Context, user tables.User) (tables.User, error) {
 	res := repo.conn.WithContext(ctx).Create(&user)
-
+	if errors.Is(res.Error, gorm.ErrDuplicatedKey) {
+		return tables.User{}, repo.duplicateUserError(ctx, user)
+	}
 	if res.Error != nil {
 		return tables.User{}, repo.handlUserRepoError(res.Error)
 	}
@@ -62,7 +67,708 @@ func (repo *UserRepo) BindUser(ctx context.Context, userID uint, username string
 	return user, nil
 }
 
+func (repo *UserRepo) GetUserByEmail(ctx context.Context, email string) (tables.User, error) {
+	var user tables.User
+
+	err := repo.conn.WithContext(ctx).Where("email = ?", email).First(&user).Error
+
+	return user, repo.handlUserRepoError(err)
+}
+
+// SetPassword stores a new password hash, clears any login lockout and signs the user out of
+// every session except keepSessionID, whose refresh tokens stop working with it
+func (repo *UserRepo) SetPassword(ctx context.Context, userID uint, passwordHash string, keepSessionID string) error {
+	err := repo.conn.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(&tables.User{}).
+			Where("id = ?", userID).
+			Updates(map[string]interface{}{
+				"password_hash":         passwordHash,
+				"password_changed_at":   time.Now(),
+				"failed_login_attempts": 0,
+				"locked_until":          nil,
+			}).Error
+		if err != nil {
+			return err
+		}
+
+		return tx.Model(&tables.Session{}).
+			Where("user_id = ? AND id <> ? AND revoked_at IS NULL", userID, keepSessionID).
+			Update("revoked_at", time.Now()).Error
+	})
+
+	return repo.handlUserRepoError(err)
+}
+
+// RecordLoginFailure counts a failed login and locks the account for lockDuration once
+// maxAttempts consecutive failures are reached
+func (repo *UserRepo) RecordLoginFailure(ctx context.Context, userID uint, maxAttempts int, lockDuration time.Duration) error {
+	err := repo.conn.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var user tables.User
+		if err := tx.Where("id = ?", userID).First(&user).Error; err != nil {
+			return err
+		}
+
+		updates := map[string]interface{}{"failed_login_attempts": user.FailedLoginAttempts + 1}
+		if user.FailedLoginAttempts+1 >= maxAttempts {
+			updates["failed_login_attempts"] = 0
+			updates["locked_until"] = time.Now().Add(lockDuration)
+		}
+
+		return tx.Model(&user).Updates(updates).Error
+	})
+
+	return repo.handlUserRepoError(err)
+}
+
+func (repo *UserRepo) ClearLoginFailures(ctx context.Context, userID uint) error {
+	err := repo.conn.WithContext(ctx).Model(&tables.User{}).
+		Where("id = ?", userID).
+		Updates(map[string]interface{}{
+			"failed_login_attempts": 0,
+			"locked_until":          nil,
+		}).Error
+
+	return repo.handlUserRepoError(err)
+}
+
+func (repo *UserRepo) CreatePasswordResetToken(ctx context.Context, token tables.PasswordResetToken) error {
+	err := repo.conn.WithContext(ctx).Create(&token).Error
+
+	return repo.handlUserRepoError(err)
+}
+
+// ResetPassword consumes an unused, unexpired reset token and sets the new password hash
+func (repo *UserRepo) ResetPassword(ctx context.Context, tokenHash string, passwordHash string) (tables.User, error) {
+	var user tables.User
+
+	err := repo.conn.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var token tables.PasswordResetToken
+		err := tx.Where("token_hash = ? AND used_at IS NULL AND expires_at > ?", tokenHash, time.Now()).
+			First(&token).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return api_errors.ErrInvalidToken
+		}
+		if err != nil {
+			return err
+		}
+
+		// mark it used first, the condition guards against a concurrent reset with the same token
+		res := tx.Model(&tables.PasswordResetToken{}).
+			Where("id = ? AND used_at IS NULL", token.ID).
+			Update("used_at", time.Now())
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return api_errors.ErrInvalidToken
+		}
+
+		err = tx.Model(&tables.User{}).
+			Where("id = ?", token.UserID).
+			Updates(map[string]interface{}{
+				"password_hash":         passwordHash,
+				"password_changed_at":   time.Now(),
+				"failed_login_attempts": 0,
+				"locked_until":          nil,
+			}).Error
+		if err != nil {
+			return err
+		}
+
+		return tx.Where("id = ?", token.UserID).First(&user).Error
+	})
+
+	return user, repo.handlUserRepoError(err)
+}
+
+// CreateEmailToken stores the token and retires the user's unused tokens with the same purpose,
+// so only the most recently mailed link works
+func (repo *UserRepo) CreateEmailToken(ctx context.Context, token tables.EmailToken) error {
+	err := repo.conn.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(&tables.EmailToken{}).
+			Where("user_id = ? AND purpose = ? AND used_at IS NULL", token.UserID, token.Purpose).
+			Update("used_at", time.Now()).Error
+		if err != nil {
+			return err
+		}
+
+		return tx.Create(&token).Error
+	})
+
+	return repo.handlUserRepoError(err)
+}
+
+// CountEmailTokens counts the tokens with the purpose mailed to the address since the given time
+func (repo *UserRepo) CountEmailTokens(ctx context.Context, email string, purpose string, since time.Time) (int64, error) {
+	var count int64
+
+	err := repo.conn.WithContext(ctx).Model(&tables.EmailToken{}).
+		Where("email = ? AND purpose = ? AND created_at > ?", email, purpose, since).
+		Count(&count).Error
+
+	return count, repo.handlUserRepoError(err)
+}
+
+// ConsumeEmailToken uses up an unused, unexpired token with the purpose and returns its user.
+// Following any emailed link proves the address, so the email is marked verified as well.
+func (repo *UserRepo) ConsumeEmailToken(ctx context.Context, tokenHash string, purpose string) (tables.User, error) {
+	var user tables.User
+
+	err := repo.conn.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var token tables.EmailToken
+		err := tx.Where("token_hash = ? AND purpose = ? AND used_at IS NULL AND expires_at > ?", tokenHash, purpose, time.Now()).
+			First(&token).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return api_errors.ErrInvalidToken
+		}
+		if err != nil {
+			return err
+		}
+
+		res := tx.Model(&tables.EmailToken{}).
+			Where("id = ? AND used_at IS NULL", token.ID).
+			Update("used_at", time.Now())
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return api_errors.ErrInvalidToken
+		}
+
+		if err := tx.Where("id = ?", token.UserID).First(&user).Error; err != nil {
+			return err
+		}
+		// the user changed their email since the token was sent
+		if user.Email == nil || *user.Email != token.Email {
+			return api_errors.ErrInvalidToken
+		}
+
+		if user.EmailVerifiedAt == nil {
+			now := time.Now()
+			user.EmailVerifiedAt = &now
+			return tx.Model(&user).Update("email_verified_at", now).Error
+		}
+
+		return nil
+	})
+
+	return user, repo.handlUserRepoError(err)
+}
+
+func (repo *UserRepo) GetUserByIdentity(ctx context.Context, provider string, subject string) (tables.User, error) {
+	var user tables.User
+
+	err := repo.conn.WithContext(ctx).
+		Joins("JOIN user_identities ON user_identities.user_id = users.id").
+		Where("user_identities.provider = ? AND user_identities.subject = ?", provider, subject).
+		First(&user).Error
+
+	return user, repo.handlUserRepoError(err)
+}
+
+// CreateUserWithIdentity creates a user signing in with a provider for the first time
+func (repo *UserRepo) CreateUserWithIdentity(ctx context.Context, user tables.User, identity tables.UserIdentity) (tables.User, error) {
+	err := repo.conn.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&user).Error; err != nil {
+			return err
+		}
+
+		identity.UserID = user.ID
+		err := tx.Create(&identity).Error
+		if errors.Is(err, gorm.ErrDuplicatedKey) {
+			return api_errors.ErrIdentityLinked
+		}
+
+		return err
+	})
+	if errors.Is(err, gorm.ErrDuplicatedKey) {
+		return tables.User{}, repo.duplicateUserError(ctx, user)
+	}
+	if err != nil {
+		return tables.User{}, repo.handlUserRepoError(err)
+	}
+
+	return user, nil
+}
+
+// LinkIdentity attaches a provider identity to an existing user. Linking the same identity
+// to the same user again is a no-op, linking it to a second user is a conflict.
+func (repo *UserRepo) LinkIdentity(ctx context.Context, identity tables.UserIdentity) error {
+	var existing tables.UserIdentity
+	err := repo.conn.WithContext(ctx).
+		Where("provider = ? AND subject = ?", identity.Provider, identity.Subject).
+		First(&existing).Error
+	if err == nil {
+		if existing.UserID != identity.UserID {
+			return api_errors.ErrIdentityLinked
+		}
+		return nil
+	}
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return repo.handlUserRepoError(err)
+	}
+
+	err = repo.conn.WithContext(ctx).Create(&identity).Error
+	if errors.Is(err, gorm.ErrDuplicatedKey) {
+		return api_errors.ErrIdentityLinked
+	}
+
+	return repo.handlUserRepoError(err)
+}
+
+func (repo *UserRepo) GetIdentities(ctx context.Context, userID uint) ([]tables.UserIdentity, error) {
+	var identities []tables.UserIdentity
+
+	err := repo.conn.WithContext(ctx).Where("user_id = ?", userID).Order("id").Find(&identities).Error
+
+	return identities, repo.handlUserRepoError(err)
+}
+
+// CreateOidcLoginState stores a pending login, clearing out abandoned ones on the way
+func (repo *UserRepo) CreateOidcLoginState(ctx context.Context, state tables.OidcLoginState) error {
+	err := repo.conn.WithContext(ctx).Where("expires_at < ?", time.Now()).Delete(&tables.OidcLoginState{}).Error
+	if err != nil {
+		return repo.handlUserRepoError(err)
+	}
+
+	err = repo.conn.WithContext(ctx).Create(&state).Error
+
+	return repo.handlUserRepoError(err)
+}
+
+// ConsumeOidcLoginState deletes and returns an unexpired login state for the provider, so each
+// state is accepted by exactly one callback
+func (repo *UserRepo) ConsumeOidcLoginState(ctx context.Context, state string, provider string) (tables.OidcLoginState, error) {
+	var loginState tables.OidcLoginState
+
+	err := repo.conn.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		err := tx.Where("state = ? AND provider = ? AND expires_at > ?", state, provider, time.Now()).
+			First(&loginState).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return api_errors.ErrInvalidToken
+		}
+		if err != nil {
+			return err
+		}
+
+		res := tx.Where("state = ?", state).Delete(&tables.OidcLoginState{})
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return api_errors.ErrInvalidToken
+		}
+
+		return nil
+	})
+
+	return loginState, repo.handlUserRepoError(err)
+}
+
+// GetUsers pages through users whose username or email contains the query, oldest first,
+// and returns the total number of matches
+func (repo *UserRepo) GetUsers(ctx context.Context, query string, offset int, limit int) ([]tables.User, int64, error) {
+	var users []tables.User
+	var total int64
+
+	scope := repo.conn.WithContext(ctx).Model(&tables.User{})
+	if query != "" {
+		pattern := "%" + escapeLike(query) + "%"
+		scope = scope.Where(`username LIKE ? ESCAPE '\' OR email LIKE ? ESCAPE '\'`, pattern, pattern)
+	}
+
+	if err := scope.Count(&total).Error; err != nil {
+		return nil, 0, repo.handlUserRepoError(err)
+	}
+
+	err := scope.Order("id").Offset(offset).Limit(limit).Find(&users).Error
+
+	return users, total, repo.handlUserRepoError(err)
+}
+
+// escapeLike escapes the LIKE wildcards of a term, for use with ESCAPE '\'
+func escapeLike(term string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(term)
+}
+
+func (repo *UserRepo) SetUserDisabled(ctx context.Context, userID uint, disabled bool) (tables.User, error) {
+	var disabledAt *time.Time
+	if disabled {
+		now := time.Now()
+		disabledAt = &now
+	}
+
+	return repo.updateUser(ctx, userID, map[string]interface{}{"disabled_at": disabledAt})
+}
+
+// SetUserRole changes the user's role and ends their sessions, so tokens carrying the old role
+// stop working. The audit entry is written in the same transaction.
+func (repo *UserRepo) SetUserRole(ctx context.Context, userID uint, role string, entry tables.AuditLog) (tables.User, error) {
+	var user tables.User
+
+	err := repo.conn.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		res := tx.Model(&tables.User{}).Where("id = ?", userID).Update("role", role)
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return api_errors.ErrUserNotFound
+		}
+
+		err := tx.Model(&tables.Session{}).
+			Where("user_id = ? AND revoked_at IS NULL", userID).
+			Update("revoked_at", time.Now()).Error
+		if err != nil {
+			return err
+		}
+
+		if err := tx.Create(&entry).Error; err != nil {
+			return err
+		}
+
+		return tx.Where("id = ?", userID).First(&user).Error
+	})
+
+	return user, repo.handlUserRepoError(err)
+}
+
+// MergeGuestUser moves everything a guest account owns to the target account and retires the
+// guest, all in one transaction. Chat rooms carry their messages and attachments with them.
+// Returns the number of chat rooms moved.
+func (repo *UserRepo) MergeGuestUser(ctx context.Context, guestID uint, targetID uint) (int64, error) {
+	var movedRooms int64
+
+	err := repo.conn.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var guest tables.User
+		if err := tx.Where("id = ?", guestID).First(&guest).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("id = ?", targetID).First(&tables.User{}).Error; err != nil {
+			return err
+		}
+
+		// a guest has neither a password nor a provider login, anything else is a real account
+		var identities int64
+		if err := tx.Model(&tables.UserIdentity{}).Where("user_id = ?", guestID).Count(&identities).Error; err != nil {
+			return err
+		}
+		if guestID == targetID || guest.HasPassword() || identities > 0 {
+			return api_errors.ErrNotGuestAccount
+		}
+
+		// trashed rooms move too, so they can still be restored
+		res := tx.Unscoped().Model(&tables.ChatRoom{}).Where("user_id = ?", guestID).Update("user_id", targetID)
+		if res.Error != nil {
+			return res.Error
+		}
+		movedRooms = res.RowsAffected
+
+		// share links stay live, now revocable by the new owner
+		if err := tx.Model(&tables.ChatShare{}).Where("user_id = ?", guestID).Update("user_id", targetID).Error; err != nil {
+			return err
+		}
+
+		if err := mergeMemberships(tx, guestID, targetID); err != nil {
+			return err
+		}
+
+		if err := mergeOrganizers(tx, guestID, targetID); err != nil {
+			return err
+		}
+
+		// uploads still in progress, so a resumed upload lands with the new owner
+		err := tx.Model(&tables.Upload{}).Where("user_id = ?", guestID).Update("user_id", targetID).Error
+		if err != nil {
+			return err
+		}
+
+		// everything else of the guest goes, so its tokens stop working. The target keeps its own
+		// profile, the guest's avatar and exports are released.
+		fileKeys, err := deleteAccountRows(tx, guestID)
+		if err != nil {
+			return err
+		}
+		if err := releaseBlobs(ctx, tx, fileKeys); err != nil {
+			return err
+		}
+
+		return tx.Delete(&guest).Error
+	})
+	if err != nil {
+		return 0, repo.handlUserRepoError(err)
+	}
+
+	return movedRooms, nil
+}
+
+// deleteAccountRows deletes what belongs to the account rather than to its chats: sessions and
+// their refresh tokens, keys, logins, second factors, tokens, exports, the profile, organizers,
+// memberships, read positions and uploads. Returns the file keys of the exports and the avatar
+// for the caller to release.
+func deleteAccountRows(tx *gorm.DB, userID uint) ([]string, error) {
+	var fileKeys []string
+
+	var exports []tables.DataExport
+	if err := tx.Where("user_id = ?", userID).Find(&exports).Error; err != nil {
+		return nil, err
+	}
+	for _, export := range exports {
+		fileKeys = append(fileKeys, export.FileKey)
+	}
+
+	var profile tables.UserProfile
+	if err := tx.Where("user_id = ?", userID).Limit(1).Find(&profile).Error; err != nil {
+		return nil, err
+	}
+	fileKeys = append(fileKeys, profile.AvatarKey)
+
+	sessionIDs := tx.Model(&tables.Session{}).Select("id").Where("user_id = ?", userID)
+	if err := tx.Where("session_id IN (?)", sessionIDs).Delete(&tables.RefreshToken{}).Error; err != nil {
+		return nil, err
+	}
+	if err := tx.Where("link_user_id = ?", userID).Delete(&tables.OidcLoginState{}).Error; err != nil {
+		return nil, err
+	}
+
+	for _, model := range []interface{}{
+		&tables.Upload{}, &tables.DataExport{}, &tables.UserProfile{}, &tables.Session{},
+		&tables.ApiKey{}, &tables.UserIdentity{}, &tables.PasswordResetToken{}, &tables.EmailToken{},
+		&tables.TotpCredential{}, &tables.RecoveryCode{}, &tables.MfaChallenge{},
+		&tables.ChatFolder{}, &tables.ChatTag{}, &tables.ChatRoomMember{}, &tables.ChatRoomRead{},
+	} {
+		if err := tx.Where("user_id = ?", userID).Delete(model).Error; err != nil {
+			return nil, err
+		}
+	}
+
+	return fileKeys, nil
+}
+
+// mergeMemberships hands the guest's memberships in other users' rooms, their read positions and
+// the messages they wrote to the target. Where the target already owns or is a member of the
+// room, the guest's membership is dropped and the target keeps their own role.
+func mergeMemberships(tx *gorm.DB, guestID uint, targetID uint) error {
+	// rooms the target owns now, the guest's rooms included
+	ownedRooms := tx.Model(&tables.ChatRoom{}).Unscoped().Select("id").Where("user_id = ?", targetID)
+	targetRooms := tx.Model(&tables.ChatRoomMember{}).Select("chat_room_id").Where("user_id = ?", targetID)
+
+	err := tx.Where("user_id = ? AND (chat_room_id IN (?) OR chat_room_id IN (?))", guestID, ownedRooms, targetRooms).
+		Delete(&tables.ChatRoomMember{}).Error
+	if err != nil {
+		return err
+	}
+	if err := tx.Where("user_id = ? AND chat_room_id IN (?)", targetID, ownedRooms).Delete(&tables.ChatRoomMember{}).Error; err != nil {
+		return err
+	}
+	if err := tx.Model(&tables.ChatRoomMember{}).Where("user_id = ?", guestID).Update("user_id", targetID).Error; err != nil {
+		return err
+	}
+
+	// where both have read the room, the target's position is kept
+	targetReads := tx.Model(&tables.ChatRoomRead{}).Select("chat_room_id").Where("user_id = ?", targetID)
+	if err := tx.Where("user_id = ? AND chat_room_id IN (?)", guestID, targetReads).Delete(&tables.ChatRoomRead{}).Error; err != nil {
+		return err
+	}
+	if err := tx.Model(&tables.ChatRoomRead{}).Where("user_id = ?", guestID).Update("user_id", targetID).Error; err != nil {
+		return err
+	}
+
+	return tx.Unscoped().Model(&tables.ChatMessage{}).Where("user_id = ?", guestID).Update("user_id", targetID).Error
+}
+
+// mergeOrganizers hands the guest's folders and tags to the target. A guest tag named like one
+// of the target's is folded into it, since tag names are unique per user.
+func mergeOrganizers(tx *gorm.DB, guestID uint, targetID uint) error {
+	if err := tx.Model(&tables.ChatFolder{}).Where("user_id = ?", guestID).Update("user_id", targetID).Error; err != nil {
+		return err
+	}
+
+	var guestTags []tables.ChatTag
+	if err := tx.Where("user_id = ?", guestID).Find(&guestTags).Error; err != nil {
+		return err
+	}
+
+	for _, tag := range guestTags {
+		var existing tables.ChatTag
+		err := tx.Where("user_id = ? AND name = ?", targetID, tag.Name).Limit(1).Find(&existing).Error
+		if err != nil {
+			return err
+		}
+
+		if existing.ID == 0 {
+			if err := tx.Model(&tag).Update("user_id", targetID).Error; err != nil {
+				return err
+			}
+			continue
+		}
+
+		var chatRoomIDs []uint
+		err = tx.Model(&tables.ChatRoomTag{}).Where("chat_tag_id = ?", tag.ID).Pluck("chat_room_id", &chatRoomIDs).Error
+		if err != nil {
+			return err
+		}
+		if len(chatRoomIDs) > 0 {
+			roomTags := make([]tables.ChatRoomTag, len(chatRoomIDs))
+			for i, chatRoomID := range chatRoomIDs {
+				roomTags[i] = tables.ChatRoomTag{ChatRoomID: chatRoomID, ChatTagID: existing.ID}
+			}
+			if err := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&roomTags).Error; err != nil {
+				return err
+			}
+		}
+
+		if err := tx.Where("chat_tag_id = ?", tag.ID).Delete(&tables.ChatRoomTag{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Delete(&tag).Error; err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// GetProfile returns the user's profile, or an empty one with the default theme if the user
+// never saved one
+func (repo *UserRepo) GetProfile(ctx context.Context, userID uint) (tables.UserProfile, error) {
+	profile := tables.UserProfile{UserID: userID, Theme: tables.ThemeSystem}
+
+	err := repo.conn.WithContext(ctx).Where("user_id = ?", userID).Limit(1).Find(&profile).Error
+
+	return profile, err
+}
+
+// SaveProfile stores the whole profile. A new avatar key takes a blob reference of avatarSize
+// bytes, and the replaced avatar gives its reference up.
+func (repo *UserRepo) SaveProfile(ctx context.Context, profile tables.UserProfile, avatarSize int64) (tables.UserProfile, error) {
+	err := repo.conn.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var previous tables.UserProfile
+		if err := tx.Where("user_id = ?", profile.UserID).Limit(1).Find(&previous).Error; err != nil {
+			return err
+		}
+
+		if profile.AvatarKey != previous.AvatarKey {
+			if profile.AvatarKey != "" {
+				if err := acquireBlob(ctx, tx, profile.AvatarKey, avatarSize); err != nil {
+					return err
+				}
+			}
+			if err := releaseBlobs(ctx, tx, []string{previous.AvatarKey}); err != nil {
+				return err
+			}
+		}
+
+		return tx.Clauses(clause.OnConflict{UpdateAll: true}).Create(&profile).Error
+	})
+	if err != nil {
+		return tables.UserProfile{}, repo.handlUserRepoError(err)
+	}
+
+	return profile, nil
+}
+
+// DeleteUser hard-deletes the user and everything they own: rooms with their messages,
+// attachments and embeds, folders and tags, memberships, uploads, exports, profile, credentials, sessions and API keys.
+// Returns the released file keys, for purging the files right away, and the IDs of the
+// uploads, whose partial files the caller has to delete.
+func (repo *UserRepo) DeleteUser(ctx context.Context, userID uint) ([]string, []string, error) {
+	var fileKeys []string
+	var uploadIDs []string
+
+	err := repo.conn.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		res := tx.Where("id = ?", userID).Delete(&tables.User{})
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return api_errors.ErrUserNotFound
+		}
+
+		var chatRoomIDs []uint
+		if err := tx.Unscoped().Model(&tables.ChatRoom{}).Where("user_id = ?", userID).Pluck("id", &chatRoomIDs).Error; err != nil {
+			return err
+		}
+		roomFileKeys, err := deleteRoomContents(tx, chatRoomIDs)
+		if err != nil {
+			return err
+		}
+		fileKeys = append(fileKeys, roomFileKeys...)
+		if err := tx.Unscoped().Where("user_id = ?", userID).Delete(&tables.ChatRoom{}).Error; err != nil {
+			return err
+		}
+
+		var uploads []tables.Upload
+		if err := tx.Where("user_id = ?", userID).Find(&uploads).Error; err != nil {
+			return err
+		}
+		for _, upload := range uploads {
+			uploadIDs = append(uploadIDs, upload.ID)
+			fileKeys = append(fileKeys, upload.FileKey)
+		}
+
+		// messages written in other users' rooms stay, without an author
+		if err := tx.Unscoped().Model(&tables.ChatMessage{}).Where("user_id = ?", userID).Update("user_id", nil).Error; err != nil {
+			return err
+		}
+
+		accountFileKeys, err := deleteAccountRows(tx, userID)
+		if err != nil {
+			return err
+		}
+		fileKeys = append(fileKeys, accountFileKeys...)
+
+		return releaseBlobs(ctx, tx, fileKeys)
+	})
+	if err != nil {
+		return nil, nil, repo.handlUserRepoError(err)
+	}
+
+	return fileKeys, uploadIDs, nil
+}
+
+func (repo *UserRepo) updateUser(ctx context.Context, userID uint, updates map[string]interface{}) (tables.User, error) {
+	var user tables.User
+
+	res := repo.conn.WithContext(ctx).Model(&tables.User{}).Where("id = ?", userID).Updates(updates)
+	if res.Error != nil {
+		return tables.User{}, repo.handlUserRepoError(res.Error)
+	}
+	if res.RowsAffected == 0 {
+		return tables.User{}, api_errors.ErrUserNotFound
+	}
+
+	err := repo.conn.WithContext(ctx).Where("id = ?", userID).First(&user).Error
+
+	return user, repo.handlUserRepoError(err)
+}
+
+// duplicateUserError tells which unique field of the user is already taken, the database only
+// reports that one of them is
+func (repo *UserRepo) duplicateUserError(ctx context.Context, user tables.User) error {
+	if user.Email != nil {
+		var count int64
+		err := repo.conn.WithContext(ctx).Model(&tables.User{}).
+			Where("email = ? AND id <> ?", *user.Email, user.ID).
+			Count(&count).Error
+		if err != nil {
+			return repo.handlUserRepoError(err)
+		}
+		if count > 0 {
+			return api_errors.ErrEmailExists
+		}
+	}
+
+	return api_errors.ErrUsernameExists
+}
+
 func (repo *UserRepo) handlUserRepoError(err error) error {
+	if err == nil {
+		return nil
+	}
+	var userErr *api_errors.UserError
+	if errors.As(err, &userErr) {
+		return err
+	}
 	if errors.Is(err, gorm.ErrRecordNotFound) {
 		return api_errors.ErrUserNotFound
 	}
@@ -0,0 +1,133 @@
+package repository
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/yuhangang/chat-app-backend/internal/db/tables"
+)
+
+func TestMergeGuestUserMovesChatsAndDropsTheRest(t *testing.T) {
+	conn, chatRoom, _ := newSharedRoom(t)
+	err := conn.AutoMigrate(&tables.User{}, &tables.UserIdentity{}, &tables.ChatShare{}, &tables.ChatRoomRead{},
+		&tables.Upload{}, &tables.Blob{}, &tables.Session{}, &tables.RefreshToken{}, &tables.ApiKey{},
+		&tables.OidcLoginState{}, &tables.UserProfile{}, &tables.DataExport{}, &tables.EmailToken{},
+		&tables.PasswordResetToken{}, &tables.TotpCredential{}, &tables.RecoveryCode{}, &tables.MfaChallenge{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	userRepo := NewUserRepo(conn)
+
+	// the room's members are made up IDs, the accounts are kept clear of them
+	target, err := userRepo.CreateUser(ctx, tables.User{ID: 10, Username: "ada", PasswordHash: "hash"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	guest, err := userRepo.CreateUser(ctx, tables.User{ID: 11, Username: "guest-1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	guestRoom := tables.ChatRoom{Name: "Holiday plans", SessionID: "guest-session", UserID: guest.ID}
+	if err := conn.Create(&guestRoom).Error; err != nil {
+		t.Fatal(err)
+	}
+	membership := tables.ChatRoomMember{ChatRoomID: chatRoom.ID, UserID: guest.ID, Role: tables.MemberEditor, InvitedBy: testOwner}
+	if err := conn.Create(&membership).Error; err != nil {
+		t.Fatal(err)
+	}
+	guestTag := tables.ChatTag{UserID: guest.ID, Name: "travel", Color: "#0000ff"}
+	targetTag := tables.ChatTag{UserID: target.ID, Name: "travel", Color: "#ff0000"}
+	if err := conn.Create(&[]tables.ChatTag{guestTag, targetTag}).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.Where("user_id = ?", guest.ID).First(&guestTag).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.Create(&tables.ChatRoomTag{ChatRoomID: guestRoom.ID, ChatTagID: guestTag.ID}).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.Create(&tables.ChatFolder{UserID: guest.ID, Name: "Trips"}).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	// what belongs to the guest account itself
+	session := tables.Session{ID: "guest-session", UserID: guest.ID, ExpiresAt: time.Now().Add(time.Hour)}
+	if err := conn.Create(&session).Error; err != nil {
+		t.Fatal(err)
+	}
+	leftovers := []interface{}{
+		&tables.RefreshToken{SessionID: session.ID, TokenHash: "refresh", ExpiresAt: time.Now().Add(time.Hour)},
+		&tables.DataExport{ID: "export", UserID: guest.ID, Status: "ready", FileKey: "export.zip", ExpiresAt: time.Now().Add(time.Hour)},
+		&tables.EmailToken{UserID: guest.ID, TokenHash: "email", ExpiresAt: time.Now().Add(time.Hour)},
+		&tables.PasswordResetToken{UserID: guest.ID, TokenHash: "reset", ExpiresAt: time.Now().Add(time.Hour)},
+		&tables.ApiKey{UserID: guest.ID, KeyHash: "key"},
+		&tables.Blob{FileKey: "export.zip", Size: 10, RefCount: 1},
+	}
+	for _, row := range leftovers {
+		if err := conn.Create(row).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	moved, err := userRepo.MergeGuestUser(ctx, guest.ID, target.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if moved != 1 {
+		t.Errorf("moved %d rooms, want 1", moved)
+	}
+
+	if err := conn.First(&guestRoom, guestRoom.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+	if guestRoom.UserID != target.ID {
+		t.Errorf("guest room belongs to %d, want %d", guestRoom.UserID, target.ID)
+	}
+
+	var role string
+	conn.Model(&tables.ChatRoomMember{}).Where("chat_room_id = ? AND user_id = ?", chatRoom.ID, target.ID).Pluck("role", &role)
+	if role != tables.MemberEditor {
+		t.Errorf("target's role in the shared room = %q, want the guest's %q", role, tables.MemberEditor)
+	}
+
+	var roomTags []tables.ChatRoomTag
+	conn.Where("chat_room_id = ?", guestRoom.ID).Find(&roomTags)
+	if err := conn.Where("user_id = ? AND name = ?", target.ID, "travel").First(&targetTag).Error; err != nil {
+		t.Fatal(err)
+	}
+	if len(roomTags) != 1 || roomTags[0].ChatTagID != targetTag.ID {
+		t.Errorf("guest room tags %v, want only the target's own travel tag %d", roomTags, targetTag.ID)
+	}
+	var folders int64
+	conn.Model(&tables.ChatFolder{}).Where("user_id = ?", target.ID).Count(&folders)
+	if folders != 1 {
+		t.Errorf("target has %d folders, want the guest's 1", folders)
+	}
+
+	for _, model := range []interface{}{
+		&tables.User{}, &tables.Session{}, &tables.DataExport{}, &tables.EmailToken{},
+		&tables.PasswordResetToken{}, &tables.ApiKey{}, &tables.ChatTag{}, &tables.ChatFolder{}, &tables.ChatRoomMember{},
+	} {
+		var count int64
+		conn.Model(model).Where("user_id = ?", guest.ID).Count(&count)
+		if count != 0 {
+			t.Errorf("%T: %d rows of the guest left", model, count)
+		}
+	}
+	var refreshTokens int64
+	conn.Model(&tables.RefreshToken{}).Where("session_id = ?", session.ID).Count(&refreshTokens)
+	if refreshTokens != 0 {
+		t.Errorf("%d refresh tokens of the guest left", refreshTokens)
+	}
+
+	var blob tables.Blob
+	if err := conn.Where("file_key = ?", "export.zip").First(&blob).Error; err != nil {
+		t.Fatal(err)
+	}
+	if blob.RefCount != 0 {
+		t.Errorf("export blob ref count = %d, want 0 after the guest's export went", blob.RefCount)
+	}
+}
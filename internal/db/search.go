@@ -0,0 +1,115 @@
+package db
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/yuhangang/chat-app-backend/internal/log"
+
+	"gorm.io/gorm"
+)
+
+// searchSource is a table whose text columns are indexed for full-text search
+type searchSource struct {
+	table   string
+	columns []string
+}
+
+var searchSources = []searchSource{
+	{table: "chat_messages", columns: []string{"body"}},
+	{table: "chat_rooms", columns: []string{"name"}},
+	{table: "chat_attachments", columns: []string{"file_name", "extracted_text"}},
+}
+
+// migrateSearch sets up the full-text index the search repository reads. On SQLite every source
+// gets an FTS5 table named <table>_fts, kept in sync by triggers. On Postgres every source gets a
+// generated search_vector column with a GIN index.
+func migrateSearch(conn *gorm.DB) error {
+	switch conn.Dialector.Name() {
+	case "sqlite":
+		return migrateSqliteSearch(conn)
+	case "postgres":
+		return migratePostgresSearch(conn)
+	}
+
+	return nil
+}
+
+func migrateSqliteSearch(conn *gorm.DB) error {
+	// FTS5 is only compiled in with the sqlite_fts5 build tag, search falls back to LIKE without it
+	var fts5 bool
+	if err := conn.Raw("SELECT sqlite_compileoption_used('ENABLE_FTS5')").Scan(&fts5).Error; err != nil {
+		return err
+	}
+	if !fts5 {
+		log.InfoLogger.Println("SQLite was built without FTS5, search falls back to LIKE queries")
+		return nil
+	}
+
+	for _, source := range searchSources {
+		ftsTable := source.table + "_fts"
+		columns := strings.Join(source.columns, ", ")
+		newValues := "new." + strings.Join(source.columns, ", new.")
+		oldValues := "old." + strings.Join(source.columns, ", old.")
+
+		created := !conn.Migrator().HasTable(ftsTable)
+		if created {
+			// external content, the text is read back from the source table for snippets
+			err := conn.Exec(fmt.Sprintf(
+				"CREATE VIRTUAL TABLE %s USING fts5(%s, content='%s', content_rowid='id', tokenize='unicode61 remove_diacritics 2')",
+				ftsTable, columns, source.table)).Error
+			if err != nil {
+				return err
+			}
+		}
+
+		statements := []string{
+			fmt.Sprintf(`CREATE TRIGGER IF NOT EXISTS %[1]s_insert AFTER INSERT ON %[2]s BEGIN
+				INSERT INTO %[1]s(rowid, %[3]s) VALUES (new.id, %[4]s);
+			END`, ftsTable, source.table, columns, newValues),
+			fmt.Sprintf(`CREATE TRIGGER IF NOT EXISTS %[1]s_delete AFTER DELETE ON %[2]s BEGIN
+				INSERT INTO %[1]s(%[1]s, rowid, %[3]s) VALUES ('delete', old.id, %[4]s);
+			END`, ftsTable, source.table, columns, oldValues),
+			fmt.Sprintf(`CREATE TRIGGER IF NOT EXISTS %[1]s_update AFTER UPDATE OF %[3]s ON %[2]s BEGIN
+				INSERT INTO %[1]s(%[1]s, rowid, %[3]s) VALUES ('delete', old.id, %[4]s);
+				INSERT INTO %[1]s(rowid, %[3]s) VALUES (new.id, %[5]s);
+			END`, ftsTable, source.table, columns, oldValues, newValues),
+		}
+		for _, statement := range statements {
+			if err := conn.Exec(statement).Error; err != nil {
+				return err
+			}
+		}
+
+		// index the rows written before the index existed
+		if created {
+			if err := conn.Exec(fmt.Sprintf("INSERT INTO %[1]s(%[1]s) VALUES ('rebuild')", ftsTable)).Error; err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func migratePostgresSearch(conn *gorm.DB) error {
+	for _, source := range searchSources {
+		var document []string
+		for _, column := range source.columns {
+			document = append(document, fmt.Sprintf("coalesce(%s, '')", column))
+		}
+
+		statements := []string{
+			fmt.Sprintf("ALTER TABLE %s ADD COLUMN IF NOT EXISTS search_vector tsvector GENERATED ALWAYS AS (to_tsvector('simple', %s)) STORED",
+				source.table, strings.Join(document, " || ' ' || ")),
+			fmt.Sprintf("CREATE INDEX IF NOT EXISTS idx_%[1]s_search_vector ON %[1]s USING GIN (search_vector)", source.table),
+		}
+		for _, statement := range statements {
+			if err := conn.Exec(statement).Error; err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
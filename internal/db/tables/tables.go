@@ -1,45 +1,393 @@
 package tables
 
 import (
+	"strings"
 	"time"
+
+	"gorm.io/gorm"
 )
 
 type User struct {
+	ID                  uint       `gorm:"primaryKey" json:"id"`
+	CreatedAt           time.Time  `gorm:"autoCreateTime" json:"created_at"`
+	Username            string     `gorm:"type:varchar(100);not null;uniqueIndex" json:"username"`
+	Email               *string    `gorm:"type:varchar(255);uniqueIndex" json:"email,omitempty"`
+	EmailVerifiedAt     *time.Time `json:"email_verified_at,omitempty"` // Set once a link mailed to the current email is followed
+	PasswordHash        string     `gorm:"type:varchar(255)" json:"-"`  // bcrypt, empty for guest accounts
+	PasswordChangedAt   *time.Time `json:"-"`
+	FailedLoginAttempts int        `gorm:"not null;default:0" json:"-"`
+	LockedUntil         *time.Time `json:"-"`
+	MaxUploadSize       int64      `gorm:"default:0" json:"max_upload_size"` // Per-user upload limit in bytes, 0 uses the global limit
+	Role                string     `gorm:"type:varchar(20);not null;default:'user'" json:"role"`
+	DisabledAt          *time.Time `json:"disabled_at,omitempty"` // Disabled accounts can't sign in or use their API keys
+	ChatRooms           []ChatRoom `gorm:"foreignKey:UserID" json:"chat_rooms"`
+}
+
+// User roles, see handler.HasPermission for what each may do
+const (
+	RoleUser    = "user"
+	RoleSupport = "support"
+	RoleAdmin   = "admin"
+)
+
+// IsValidRole reports whether role is one of the known roles
+func IsValidRole(role string) bool {
+	return role == RoleUser || role == RoleSupport || role == RoleAdmin
+}
+
+// HasPassword reports whether the account can log in with a password, guests cannot
+func (u User) HasPassword() bool {
+	return u.PasswordHash != ""
+}
+
+// Themes a user can pick for the UI
+const (
+	ThemeSystem = "system"
+	ThemeLight  = "light"
+	ThemeDark   = "dark"
+)
+
+// UserProfile holds a user's display settings and the defaults new chats start with
+type UserProfile struct {
+	UserID         uint      `gorm:"primaryKey" json:"user_id"`
+	UpdatedAt      time.Time `gorm:"autoUpdateTime" json:"updated_at"`
+	DisplayName    string    `gorm:"type:varchar(100)" json:"display_name"`
+	AvatarKey      string    `gorm:"type:varchar(255);index" json:"-"` // Storage key of the avatar image
+	Locale         string    `gorm:"type:varchar(35)" json:"locale"`   // BCP 47 language tag, e.g. en-GB
+	Timezone       string    `gorm:"type:varchar(64)" json:"timezone"` // IANA name, e.g. Asia/Singapore
+	DefaultModel   string    `gorm:"type:varchar(100)" json:"default_model"`
+	DefaultPersona string    `gorm:"type:varchar(50)" json:"default_persona"`
+	Theme          string    `gorm:"type:varchar(10);not null;default:'system'" json:"theme"`
+	AvatarURL      string    `gorm:"-" json:"avatar_url,omitempty"` // Signed file server URL, filled in per request
+}
+
+// Data export states
+const (
+	ExportPending = "pending"
+	ExportReady   = "ready"
+	ExportFailed  = "failed"
+)
+
+// DataExport is a ZIP of everything a user stored, built in the background on request
+type DataExport struct {
+	ID          string     `gorm:"type:varchar(36);primaryKey" json:"id"` // UUID
+	CreatedAt   time.Time  `gorm:"autoCreateTime" json:"created_at"`
+	UserID      uint       `gorm:"not null;index" json:"user_id"`
+	Status      string     `gorm:"type:varchar(10);not null" json:"status"`
+	FileKey     string     `gorm:"type:varchar(255)" json:"-"` // Storage key of the ZIP once ready
+	Size        int64      `gorm:"not null;default:0" json:"size"`
+	Error       string     `gorm:"type:text" json:"error,omitempty"`
+	CompletedAt *time.Time `json:"completed_at,omitempty"`
+	ExpiresAt   time.Time  `gorm:"not null;index" json:"expires_at"` // The export and its file are deleted after this
+	DownloadURL string     `gorm:"-" json:"download_url,omitempty"`  // Signed file server URL, filled in per request
+}
+
+// AuditLog records an action taken through the admin API
+type AuditLog struct {
+	ID         uint      `gorm:"primaryKey" json:"id"`
+	CreatedAt  time.Time `gorm:"autoCreateTime;index" json:"created_at"`
+	ActorID    uint      `gorm:"not null;index" json:"actor_id"` // User who took the action
+	Action     string    `gorm:"type:varchar(100);not null" json:"action"`
+	TargetType string    `gorm:"type:varchar(50);not null" json:"target_type"` // e.g. user, model, chat_room
+	TargetID   string    `gorm:"type:varchar(100);not null" json:"target_id"`
+	Details    string    `gorm:"type:text" json:"details"`
+	IPAddress  string    `gorm:"type:varchar(45)" json:"ip_address"`
+}
+
+// PasswordResetToken is a one-time password reset token, stored as a SHA-256 hash
+type PasswordResetToken struct {
+	ID        uint       `gorm:"primaryKey" json:"id"`
+	CreatedAt time.Time  `gorm:"autoCreateTime" json:"created_at"`
+	UserID    uint       `gorm:"not null;index" json:"user_id"`
+	TokenHash string     `gorm:"type:varchar(64);not null;uniqueIndex" json:"-"`
+	ExpiresAt time.Time  `gorm:"not null" json:"expires_at"`
+	UsedAt    *time.Time `json:"used_at"`
+}
+
+// Email token purposes
+const (
+	EmailTokenVerify    = "verify_email"
+	EmailTokenMagicLink = "magic_link"
+)
+
+// EmailToken is a one-time token mailed to a user, stored as a SHA-256 hash. It is only valid
+// while the user still has the email it was sent to.
+type EmailToken struct {
+	ID        uint       `gorm:"primaryKey" json:"id"`
+	CreatedAt time.Time  `gorm:"autoCreateTime" json:"created_at"`
+	UserID    uint       `gorm:"not null;index" json:"user_id"`
+	Purpose   string     `gorm:"type:varchar(20);not null" json:"purpose"`
+	Email     string     `gorm:"type:varchar(255);not null" json:"email"`
+	TokenHash string     `gorm:"type:varchar(64);not null;uniqueIndex" json:"-"`
+	ExpiresAt time.Time  `gorm:"not null;index" json:"expires_at"`
+	UsedAt    *time.Time `json:"used_at"`
+}
+
+// TotpCredential is a user's authenticator app secret. Two-factor authentication is only on once
+// the first code from the app has confirmed it.
+type TotpCredential struct {
+	UserID       uint       `gorm:"primaryKey" json:"user_id"`
+	CreatedAt    time.Time  `gorm:"autoCreateTime" json:"created_at"`
+	Secret       string     `gorm:"type:varchar(64);not null" json:"-"` // Base32 RFC 6238 secret
+	ConfirmedAt  *time.Time `json:"confirmed_at"`
+	LastUsedStep int64      `gorm:"not null;default:0" json:"-"` // Time step of the last accepted code, codes can't be reused
+}
+
+// RecoveryCode is a one-time code for signing in without the authenticator app, stored as a SHA-256 hash
+type RecoveryCode struct {
 	ID        uint       `gorm:"primaryKey" json:"id"`
 	CreatedAt time.Time  `gorm:"autoCreateTime" json:"created_at"`
-	Username  string     `gorm:"type:varchar(100);not null;uniqueIndex" json:"username"`
-	ChatRooms []ChatRoom `gorm:"foreignKey:UserID" json:"chat_rooms"`
+	UserID    uint       `gorm:"not null;index" json:"user_id"`
+	CodeHash  string     `gorm:"type:varchar(64);not null;uniqueIndex" json:"-"`
+	UsedAt    *time.Time `json:"used_at"`
+}
+
+// MfaChallenge is a login that passed the first factor and waits for a code, stored as a SHA-256 hash
+type MfaChallenge struct {
+	ID        uint      `gorm:"primaryKey" json:"id"`
+	CreatedAt time.Time `gorm:"autoCreateTime" json:"created_at"`
+	UserID    uint      `gorm:"not null;index" json:"user_id"`
+	TokenHash string    `gorm:"type:varchar(64);not null;uniqueIndex" json:"-"`
+	ExpiresAt time.Time `gorm:"not null;index" json:"expires_at"`
+	Attempts  int       `gorm:"not null;default:0" json:"attempts"` // Wrong codes entered so far
+	GuestID   *uint     `json:"guest_id"`                           // Guest to merge into the user once the second factor passed
+}
+
+// Session is one login of a user. Every refresh token issued for it shares the session ID,
+// so revoking the session invalidates the whole token family.
+type Session struct {
+	ID         string     `gorm:"type:varchar(36);primaryKey" json:"id"` // UUID, the sid claim of its tokens
+	CreatedAt  time.Time  `gorm:"autoCreateTime" json:"created_at"`
+	UserID     uint       `gorm:"not null;index" json:"user_id"`
+	UserAgent  string     `gorm:"type:varchar(255)" json:"user_agent"`
+	IPAddress  string     `gorm:"type:varchar(45)" json:"ip_address"`
+	LastSeenAt time.Time  `json:"last_seen_at"`
+	ExpiresAt  time.Time  `gorm:"index" json:"expires_at"` // Expiry of the latest refresh token
+	RevokedAt  *time.Time `json:"revoked_at"`
+	Current    bool       `gorm:"-" json:"current"` // Whether the request was made with this session, filled in per request
+}
+
+// RefreshToken is an issued refresh token, stored as a SHA-256 hash. Each one can be used
+// once, using it again means it was stolen and revokes its session.
+type RefreshToken struct {
+	ID        uint       `gorm:"primaryKey" json:"id"`
+	CreatedAt time.Time  `gorm:"autoCreateTime" json:"created_at"`
+	SessionID string     `gorm:"type:varchar(36);not null;index" json:"session_id"`
+	TokenHash string     `gorm:"type:varchar(64);not null;uniqueIndex" json:"-"`
+	ExpiresAt time.Time  `gorm:"not null" json:"expires_at"`
+	UsedAt    *time.Time `json:"used_at"`
+}
+
+// ApiKey lets a backend service call the API as its owner, limited to the key's scopes.
+// Only the SHA-256 hash of the key is stored, the prefix identifies it in listings.
+type ApiKey struct {
+	ID         uint       `gorm:"primaryKey" json:"id"`
+	CreatedAt  time.Time  `gorm:"autoCreateTime" json:"created_at"`
+	UserID     uint       `gorm:"not null;index" json:"user_id"` // Owner, the user requests are made on behalf of
+	Name       string     `gorm:"type:varchar(100);not null" json:"name"`
+	Prefix     string     `gorm:"type:varchar(16);not null" json:"prefix"`
+	KeyHash    string     `gorm:"type:varchar(64);not null;uniqueIndex" json:"-"`
+	Scopes     string     `gorm:"type:varchar(255);not null" json:"scopes"` // Comma separated, e.g. chats:read,chats:write
+	ExpiresAt  *time.Time `json:"expires_at"`                               // Never expires when nil
+	LastUsedAt *time.Time `json:"last_used_at"`
+	RevokedAt  *time.Time `json:"revoked_at"`
+}
+
+// HasScope reports whether the key was granted the scope
+func (k ApiKey) HasScope(scope string) bool {
+	for _, granted := range strings.Split(k.Scopes, ",") {
+		if granted == scope {
+			return true
+		}
+	}
+
+	return false
+}
+
+// UserIdentity links a user to an account at an external identity provider
+type UserIdentity struct {
+	ID        uint      `gorm:"primaryKey" json:"id"`
+	CreatedAt time.Time `gorm:"autoCreateTime" json:"created_at"`
+	UserID    uint      `gorm:"not null;index" json:"user_id"`
+	Provider  string    `gorm:"type:varchar(50);not null;uniqueIndex:idx_identity_provider_subject" json:"provider"`
+	Subject   string    `gorm:"type:varchar(255);not null;uniqueIndex:idx_identity_provider_subject" json:"subject"` // Stable user ID at the provider
+	Email     string    `gorm:"type:varchar(255)" json:"email"`
+}
+
+// OidcLoginState is a pending provider login, consumed once by the callback
+type OidcLoginState struct {
+	State        string    `gorm:"type:varchar(64);primaryKey" json:"-"`
+	CreatedAt    time.Time `gorm:"autoCreateTime" json:"created_at"`
+	Provider     string    `gorm:"type:varchar(50);not null" json:"provider"`
+	Nonce        string    `gorm:"type:varchar(64);not null" json:"-"`
+	CodeVerifier string    `gorm:"type:varchar(128);not null" json:"-"` // PKCE verifier
+	LinkUserID   *uint     `json:"link_user_id"`                        // Set when linking to a signed in user instead of logging in
+	ExpiresAt    time.Time `gorm:"not null;index" json:"expires_at"`
 }
 
 type ChatRoom struct {
-	ID           uint          `gorm:"primaryKey" json:"id"`
-	CreatedAt    time.Time     `gorm:"autoCreateTime" json:"created_at"`
-	SessionID    string        `gorm:"type:varchar(100);not null;uniqueIndex" json:"session_id"`
-	UpdatedAt    time.Time     `gorm:"autoUpdateTime" json:"updated_at"`
-	Name         string        `gorm:"type:varchar(100)" json:"name"`
-	UserID       uint          `gorm:"not null;index" json:"user_id"`
-	ChatMessages []ChatMessage `gorm:"foreignKey:ChatRoomID" json:"chat_messages"`
+	ID           uint           `gorm:"primaryKey;index:idx_chat_rooms_user_updated,priority:3" json:"id"`
+	CreatedAt    time.Time      `gorm:"autoCreateTime" json:"created_at"`
+	SessionID    string         `gorm:"type:varchar(100);not null;uniqueIndex" json:"session_id"`
+	UpdatedAt    time.Time      `gorm:"autoUpdateTime;index:idx_chat_rooms_user_updated,priority:2" json:"updated_at"` // Bumped by every new message
+	Name         string         `gorm:"type:varchar(100)" json:"name"`
+	UserID       uint           `gorm:"not null;index:idx_chat_rooms_user_updated,priority:1" json:"user_id"`
+	ModelKey     string         `gorm:"type:varchar(100)" json:"model_key"` // Empty for chats from before models could be picked, i.e. the default
+	Persona      string         `gorm:"type:varchar(50)" json:"persona"`
+	FolderID     *uint          `gorm:"index" json:"folder_id"` // Nil outside any folder
+	Pinned       bool           `gorm:"not null;default:false" json:"pinned"`
+	Archived     bool           `gorm:"not null;default:false" json:"archived"`
+	DeletedAt    gorm.DeletedAt `gorm:"index" json:"deleted_at"`                    // Set while the room is in the trash
+	Role         string         `gorm:"->;-:migration" json:"role,omitempty"`       // The requesting user's member role, filled in per request
+	LastReadID   uint           `gorm:"->;-:migration" json:"last_read_message_id"` // The requesting user's, filled in for chat lists
+	UnreadCount  int64          `gorm:"->;-:migration" json:"unread_count"`         // Messages by others after LastReadID, filled in for chat lists
+	Tags         []ChatTag      `gorm:"many2many:chat_room_tags" json:"tags"`
+	ChatMessages []ChatMessage  `gorm:"foreignKey:ChatRoomID" json:"chat_messages"`
+}
+
+// HideOrganizer clears the owner's own folder, pin, archive and tags, for showing the room to
+// its members
+func (c *ChatRoom) HideOrganizer() {
+	c.FolderID = nil
+	c.Pinned = false
+	c.Archived = false
+	c.Tags = nil
+}
+
+// ChatRoomMember gives another user a role in a chat room. The room's owner is its UserID and
+// has no member row.
+type ChatRoomMember struct {
+	ID         uint      `gorm:"primaryKey" json:"id"`
+	CreatedAt  time.Time `gorm:"autoCreateTime" json:"created_at"`
+	ChatRoomID uint      `gorm:"not null;uniqueIndex:idx_chat_room_members_room_user,priority:1" json:"chat_room_id"`
+	UserID     uint      `gorm:"not null;uniqueIndex:idx_chat_room_members_room_user,priority:2;index" json:"user_id"`
+	Role       string    `gorm:"type:varchar(20);not null" json:"role"`
+	InvitedBy  uint      `gorm:"not null" json:"invited_by"`
+}
+
+// ChatRoomRead is how far a user, owner or member, has read a chat room
+type ChatRoomRead struct {
+	ChatRoomID        uint      `gorm:"primaryKey;autoIncrement:false" json:"chat_room_id"`
+	UserID            uint      `gorm:"primaryKey;autoIncrement:false;index" json:"user_id"`
+	LastReadMessageID uint      `gorm:"not null" json:"last_read_message_id"`
+	UpdatedAt         time.Time `gorm:"autoUpdateTime" json:"updated_at"`
+}
+
+// Chat room member roles, see access.ChatRoomAllows for what each may do
+const (
+	MemberOwner  = "owner"
+	MemberEditor = "editor"
+	MemberViewer = "viewer"
+)
+
+// IsValidMemberRole reports whether role can be given to an invited member, there is one owner
+func IsValidMemberRole(role string) bool {
+	return role == MemberEditor || role == MemberViewer
+}
+
+// ChatFolder groups a user's chat rooms, folders nest through ParentID
+type ChatFolder struct {
+	ID        uint      `gorm:"primaryKey" json:"id"`
+	CreatedAt time.Time `gorm:"autoCreateTime" json:"created_at"`
+	UserID    uint      `gorm:"not null;index" json:"user_id"`
+	ParentID  *uint     `gorm:"index" json:"parent_id"` // Nil for top level folders
+	Name      string    `gorm:"type:varchar(100);not null" json:"name"`
+}
+
+// ChatTag labels a user's chat rooms, a room can have several
+type ChatTag struct {
+	ID        uint      `gorm:"primaryKey" json:"id"`
+	CreatedAt time.Time `gorm:"autoCreateTime" json:"created_at"`
+	UserID    uint      `gorm:"not null;uniqueIndex:idx_chat_tags_user_name,priority:1" json:"user_id"`
+	Name      string    `gorm:"type:varchar(50);not null;uniqueIndex:idx_chat_tags_user_name,priority:2" json:"name"`
+	Color     string    `gorm:"type:varchar(7);not null" json:"color"` // #rrggbb
+}
+
+// ChatRoomTag is the join table of ChatRoom.Tags
+type ChatRoomTag struct {
+	ChatRoomID uint `gorm:"primaryKey"`
+	ChatTagID  uint `gorm:"primaryKey;index"`
+}
+
+// ChatShare is a public read-only link to a chat room as it was when shared. The messages it
+// covers are pinned by ChatShareMessage rows, messages written later aren't part of it.
+type ChatShare struct {
+	ID         uint       `gorm:"primaryKey" json:"id"`
+	CreatedAt  time.Time  `gorm:"autoCreateTime" json:"created_at"`
+	SlugHash   string     `gorm:"type:varchar(64);not null;uniqueIndex" json:"-"`
+	ChatRoomID uint       `gorm:"not null;uniqueIndex" json:"chat_room_id"` // One link per room, sharing again replaces it
+	UserID     uint       `gorm:"not null;index" json:"user_id"`
+	Name       string     `gorm:"type:varchar(100)" json:"name"` // Room name when shared
+	ExpiresAt  *time.Time `json:"expires_at"`                    // Never expires when nil
+	Slug       string     `gorm:"-" json:"slug,omitempty"`       // Only known when the link is created
+	URL        string     `gorm:"-" json:"url,omitempty"`        // Public page of the share, filled in when created
+}
+
+// ChatShareMessage pins one of the messages a share covers
+type ChatShareMessage struct {
+	ShareID   uint `gorm:"primaryKey;autoIncrement:false" json:"share_id"`
+	MessageID uint `gorm:"primaryKey;autoIncrement:false;index" json:"message_id"`
 }
 
 type ChatMessage struct {
-	ID             uint             `gorm:"primaryKey" json:"id"`
+	ID             uint             `gorm:"primaryKey;index:idx_chat_messages_room_id,priority:2" json:"id"`
 	CreatedAt      time.Time        `gorm:"autoCreateTime" json:"created_at"`
 	Body           string           `gorm:"type:text;not null" json:"body"`
-	ChatRoomID     uint             `gorm:"not null;index" json:"chat_room_id"`
+	ChatRoomID     uint             `gorm:"not null;index:idx_chat_messages_room_id,priority:1" json:"chat_room_id"`
 	IsUser         bool             `gorm:"not null" json:"is_user"`
+	UserID         *uint            `gorm:"index" json:"user_id"` // Who wrote it, nil for replies, forked copies and messages from before rooms had members
 	HasAttachments bool             `gorm:"default:false" json:"has_attachments"`
+	DeletedAt      gorm.DeletedAt   `gorm:"index" json:"-"` // Trashed along with the room
 	Attachments    []ChatAttachment `gorm:"foreignKey:MessageID" json:"attachments"`
 	Embeds         []ChatEmbed      `gorm:"foreignKey:MessageID" json:"embeds"`
 }
 
 type ChatAttachment struct {
+	ID            uint           `gorm:"primaryKey" json:"id"`
+	CreatedAt     time.Time      `gorm:"autoCreateTime" json:"created_at"`
+	FileName      string         `gorm:"type:varchar(255);not null" json:"file_name"`
+	FileType      string         `gorm:"type:varchar(50);not null" json:"file_type"`  // e.g., image/png, application/pdf
+	FileSize      int64          `gorm:"not null" json:"file_size"`                   // File size in bytes
+	FilePath      string         `gorm:"type:varchar(255);not null" json:"file_path"` // Storage key, relative to the upload directory
+	ThumbnailPath string         `gorm:"type:varchar(255)" json:"thumbnail_path"`     // Storage key of the JPEG thumbnail, images only
+	MessageID     uint           `gorm:"not null;index" json:"message_id"`            // Foreign key to ChatMessage
+	ExtractedText string         `gorm:"type:text" json:"-"`                          // Text of documents, indexed for search
+	DeletedAt     gorm.DeletedAt `gorm:"index" json:"-"`                              // Trashed along with the room, the file stays referenced until purged
+	URL           string         `gorm:"-" json:"url"`                                // Signed file server URL, filled in per request
+	ThumbnailURL  string         `gorm:"-" json:"thumbnail_url,omitempty"`            // Signed thumbnail URL, filled in per request
+}
+
+// MessageEmbedding is the vector of a message's body, for semantic search
+type MessageEmbedding struct {
 	ID        uint      `gorm:"primaryKey" json:"id"`
 	CreatedAt time.Time `gorm:"autoCreateTime" json:"created_at"`
-	FileName  string    `gorm:"type:varchar(255);not null" json:"file_name"`
-	FileType  string    `gorm:"type:varchar(50);not null" json:"file_type"`  // e.g., image/png, application/pdf
-	FileSize  int64     `gorm:"not null" json:"file_size"`                   // File size in bytes
-	FilePath  string    `gorm:"type:varchar(255);not null" json:"file_path"` // Path or URL to the file
-	MessageID uint      `gorm:"not null;index" json:"message_id"`            // Foreign key to ChatMessage
+	MessageID uint      `gorm:"not null;uniqueIndex" json:"message_id"`
+	Model     string    `gorm:"type:varchar(100);not null;index" json:"model"` // Embedder model, the message is embedded again when it changes
+	Vector    []byte    `gorm:"not null" json:"-"`                             // Unit length float32 values, little endian
+}
+
+// Blob is a content-addressed stored file, shared by every attachment with the same content
+type Blob struct {
+	ID        uint      `gorm:"primaryKey" json:"id"`
+	CreatedAt time.Time `gorm:"autoCreateTime" json:"created_at"`
+	UpdatedAt time.Time `gorm:"autoUpdateTime" json:"updated_at"`
+	FileKey   string    `gorm:"type:varchar(255);not null;uniqueIndex" json:"file_key"` // SHA-256 of the content plus extension
+	Size      int64     `gorm:"not null" json:"size"`
+	RefCount  int       `gorm:"not null;default:0;index" json:"ref_count"` // Number of attachments, thumbnails, uploads, avatars and exports using the file
+}
+
+// Upload is a resumable tus upload, referenced by ID from the chat endpoints once complete
+type Upload struct {
+	ID           string    `gorm:"type:varchar(36);primaryKey" json:"id"` // UUID, also names the partial file
+	CreatedAt    time.Time `gorm:"autoCreateTime" json:"created_at"`
+	UpdatedAt    time.Time `gorm:"autoUpdateTime" json:"updated_at"`
+	ExpiresAt    time.Time `gorm:"not null;index" json:"expires_at"`
+	UserID       uint      `gorm:"not null;index" json:"user_id"`
+	FileName     string    `gorm:"type:varchar(255);not null" json:"file_name"`
+	Length       int64     `gorm:"not null" json:"length"`            // Declared total size in bytes
+	UploadOffset int64     `gorm:"not null;default:0" json:"offset"`  // Bytes received so far
+	FileKey      string    `gorm:"type:varchar(255)" json:"file_key"` // Storage key once the upload is complete
+	Completed    bool      `gorm:"default:false" json:"completed"`
 }
 
 type ChatEmbed struct {
@@ -52,10 +400,21 @@ type ChatEmbed struct {
 }
 
 type LlmModel struct {
-	ID        uint      `gorm:"primaryKey" json:"id"`
-	CreatedAt time.Time `gorm:"autoCreateTime" json:"created_at"`
-	ModelKey  string    `gorm:"type:varchar(100);not null" json:"model_key"`
-	Name      string    `gorm:"type:varchar(100);not null" json:"name"`
-	Creator   string    `gorm:"type:varchar(100);not null" json:"creator"`
-	Available bool      `gorm:"default:true" json:"available"`
+	ID           uint      `gorm:"primaryKey" json:"id"`
+	CreatedAt    time.Time `gorm:"autoCreateTime" json:"created_at"`
+	ModelKey     string    `gorm:"type:varchar(100);not null" json:"model_key"`
+	Name         string    `gorm:"type:varchar(100);not null" json:"name"`
+	Creator      string    `gorm:"type:varchar(100);not null" json:"creator"`
+	Available    bool      `gorm:"default:true" json:"available"`
+	Capabilities string    `gorm:"type:varchar(100);default:'text'" json:"capabilities"` // Comma separated, e.g. text,vision,document
+}
+
+// LlmPersona is a system instruction chats can be created with, seeded on startup and kept as
+// edited in the database afterwards
+type LlmPersona struct {
+	ID          uint      `gorm:"primaryKey" json:"id"`
+	CreatedAt   time.Time `gorm:"autoCreateTime" json:"created_at"`
+	PersonaKey  string    `gorm:"type:varchar(50);not null;uniqueIndex" json:"persona_key"`
+	Name        string    `gorm:"type:varchar(100);not null" json:"name"`
+	Instruction string    `gorm:"type:text" json:"-"` // Empty for none
 }
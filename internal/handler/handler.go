@@ -3,10 +3,15 @@ package handler
 import (
 	"context"
 	"errors"
+	"fmt"
 	"net/http"
+	"slices"
 	"strings"
 
+	"github.com/yuhangang/chat-app-backend/internal/db"
+	"github.com/yuhangang/chat-app-backend/internal/db/tables"
 	"github.com/yuhangang/chat-app-backend/pkg/ctxkey"
+	"github.com/yuhangang/chat-app-backend/pkg/securetoken"
 	"github.com/yuhangang/chat-app-backend/types"
 
 	"github.com/gorilla/mux"
@@ -18,44 +23,170 @@ type Handler struct {
 	messageHandler    MessageHandler
 	userHandler       UserHandler
 	authHandler       AuthHandler
+	uploadHandler     UploadHandler
+	oidcHandler       OidcHandler
+	apiKeyHandler     ApiKeyHandler
+	adminHandler      AdminHandler
+	mfaHandler        MfaHandler
+	emailHandler      EmailHandler
+	exportHandler     ExportHandler
+	searchHandler     SearchHandler
+	organizerHandler  OrganizerHandler
+	shareHandler      ShareHandler
+	memberHandler     MemberHandler
+	eventHandler      EventHandler
 	jwtService        types.JwtService
+	apiKeyRepository  db.ApiKeyRepository
 }
 
-func NewHandler(chatHandler ChatHandler, chatConfigHandler ChatConfigHandler, messageHandler MessageHandler, userHandler UserHandler, authHandler AuthHandler, jwtService types.JwtService) *Handler {
+func NewHandler(chatHandler ChatHandler, chatConfigHandler ChatConfigHandler, messageHandler MessageHandler, userHandler UserHandler, authHandler AuthHandler, uploadHandler UploadHandler, oidcHandler OidcHandler, apiKeyHandler ApiKeyHandler, adminHandler AdminHandler, mfaHandler MfaHandler, emailHandler EmailHandler, exportHandler ExportHandler, searchHandler SearchHandler, organizerHandler OrganizerHandler, shareHandler ShareHandler, memberHandler MemberHandler, eventHandler EventHandler, jwtService types.JwtService, apiKeyRepository db.ApiKeyRepository) *Handler {
 	return &Handler{
 		chatHandler:       chatHandler,
 		chatConfigHandler: chatConfigHandler,
 		messageHandler:    messageHandler,
 		userHandler:       userHandler,
 		authHandler:       authHandler,
+		uploadHandler:     uploadHandler,
+		oidcHandler:       oidcHandler,
+		apiKeyHandler:     apiKeyHandler,
+		adminHandler:      adminHandler,
+		mfaHandler:        mfaHandler,
+		emailHandler:      emailHandler,
+		exportHandler:     exportHandler,
+		searchHandler:     searchHandler,
+		organizerHandler:  organizerHandler,
+		shareHandler:      shareHandler,
+		memberHandler:     memberHandler,
+		eventHandler:      eventHandler,
 		jwtService:        jwtService,
+		apiKeyRepository:  apiKeyRepository,
 	}
 }
 
-func (h *Handler) RegisterRoutes(router *mux.Router) {
-	// Only JWT required
-	jwtProtectedRoutes := map[string]func(http.ResponseWriter, *http.Request){
-		"POST /chats":        h.messageHandler.CreateChatRoomWithMessage,
-		"GET /chats":         h.chatHandler.GetChatRooms,
-		"GET /chats/{id}":    h.chatHandler.GetChatRoom,
-		"DELETE /chats/{id}": h.chatHandler.DeleteChatRoom,
-		"POST /chats/{id}":   h.messageHandler.CreateMessage,
-		"GET /user":          h.userHandler.GetUser,
+// RegisterRoutes adds every route to the router. It fails when a JWT protected route does not
+// declare which API key scope may call it.
+func (h *Handler) RegisterRoutes(router *mux.Router) error {
+	// JWT required, and callable with an API key holding the scope unless it is ScopeNone,
+	// see apiKeyAuthMiddleware
+	jwtProtectedRoutes := map[string]struct {
+		handler func(http.ResponseWriter, *http.Request)
+		scope   string
+	}{
+		"POST /chats":                     {h.messageHandler.CreateChatRoomWithMessage, ScopeChatsWrite},
+		"GET /chats":                      {h.chatHandler.GetChatRooms, ScopeChatsRead},
+		"GET /chats/{id:[0-9]+}":          {h.chatHandler.GetChatRoom, ScopeChatsRead},
+		"GET /chats/{id:[0-9]+}/messages": {h.chatHandler.GetMessages, ScopeChatsRead},
+		"DELETE /chats/{id:[0-9]+}":       {h.chatHandler.DeleteChatRoom, ScopeChatsWrite},
+		"POST /chats/{id:[0-9]+}":         {h.messageHandler.CreateMessage, ScopeChatsWrite},
+		"GET /chats/trash":                {h.chatHandler.GetDeletedChatRooms, ScopeChatsRead},
+		"POST /chats/{id:[0-9]+}/restore": {h.chatHandler.RestoreChatRoom, ScopeChatsWrite},
+		"PATCH /chats/{id:[0-9]+}":        {h.chatHandler.UpdateChatRoom, ScopeChatsWrite},
+		"POST /chats/bulk":                {h.chatHandler.BulkUpdateChatRooms, ScopeChatsWrite},
+		"POST /chats/{id:[0-9]+}/share":   {h.shareHandler.CreateShare, ScopeChatsWrite},
+		"DELETE /chats/{id:[0-9]+}/share": {h.shareHandler.DeleteShare, ScopeChatsWrite},
+		"POST /share/{slug}/fork":         {h.shareHandler.ForkSharedChat, ScopeChatsWrite},
+		"GET /folders":                    {h.organizerHandler.GetFolders, ScopeChatsRead},
+		"POST /folders":                   {h.organizerHandler.CreateFolder, ScopeChatsWrite},
+		"PATCH /folders/{id}":             {h.organizerHandler.UpdateFolder, ScopeChatsWrite},
+		"DELETE /folders/{id}":            {h.organizerHandler.DeleteFolder, ScopeChatsWrite},
+		"GET /tags":                       {h.organizerHandler.GetTags, ScopeChatsRead},
+		"POST /tags":                      {h.organizerHandler.CreateTag, ScopeChatsWrite},
+		"PATCH /tags/{id}":                {h.organizerHandler.UpdateTag, ScopeChatsWrite},
+		"DELETE /tags/{id}":               {h.organizerHandler.DeleteTag, ScopeChatsWrite},
+		"GET /search":                     {h.searchHandler.Search, ScopeChatsRead},
+		"GET /search/semantic":            {h.searchHandler.SemanticSearch, ScopeChatsRead},
+		"GET /user":                       {h.userHandler.GetUser, ScopeNone},
+		"DELETE /user":                    {h.userHandler.DeleteUser, ScopeNone},
+		"POST /user/password":             {h.userHandler.ChangePassword, ScopeNone},
+		"GET /user/profile":               {h.userHandler.GetProfile, ScopeNone},
+		"PATCH /user/profile":             {h.userHandler.UpdateProfile, ScopeNone},
+		"POST /user/export":               {h.exportHandler.RequestExport, ScopeNone},
+		"GET /user/export":                {h.exportHandler.GetExports, ScopeNone},
+		"GET /user/export/{id}":           {h.exportHandler.GetExport, ScopeNone},
+		"GET /user/sessions":              {h.userHandler.GetSessions, ScopeNone},
+		"DELETE /user/sessions/{id}":      {h.userHandler.DeleteSession, ScopeNone},
+		"POST /user/api-keys":             {h.apiKeyHandler.CreateApiKey, ScopeNone},
+		"GET /user/api-keys":              {h.apiKeyHandler.GetApiKeys, ScopeNone},
+		"DELETE /user/api-keys/{id}":      {h.apiKeyHandler.RevokeApiKey, ScopeNone},
+		"POST /user/mfa/totp":             {h.mfaHandler.EnrollTotp, ScopeNone},
+		"POST /user/mfa/totp/verify":      {h.mfaHandler.ConfirmTotp, ScopeNone},
+		"DELETE /user/mfa/totp":           {h.mfaHandler.DisableTotp, ScopeNone},
+		"POST /user/mfa/recovery-codes":   {h.mfaHandler.RegenerateRecoveryCodes, ScopeNone},
+		"POST /user/email/verify":         {h.emailHandler.RequestEmailVerification, ScopeNone},
+		"POST /files":                     {h.uploadHandler.CreateUpload, ScopeChatsWrite},
+		"HEAD /files/{id}":                {h.uploadHandler.GetUploadOffset, ScopeChatsWrite},
+		"PATCH /files/{id}":               {h.uploadHandler.AppendUpload, ScopeChatsWrite},
+		"DELETE /files/{id}":              {h.uploadHandler.DeleteUpload, ScopeChatsWrite},
+
+		"GET /chats/{id:[0-9]+}/members":                    {h.memberHandler.GetMembers, ScopeChatsRead},
+		"POST /chats/{id:[0-9]+}/members":                   {h.memberHandler.AddMember, ScopeChatsWrite},
+		"PATCH /chats/{id:[0-9]+}/members/{userID:[0-9]+}":  {h.memberHandler.UpdateMember, ScopeChatsWrite},
+		"DELETE /chats/{id:[0-9]+}/members/{userID:[0-9]+}": {h.memberHandler.RemoveMember, ScopeChatsWrite},
+		"GET /chats/{id:[0-9]+}/events":                     {h.eventHandler.StreamEvents, ScopeChatsRead},
+		"POST /chats/{id:[0-9]+}/typing":                    {h.eventHandler.SetTyping, ScopeChatsWrite},
+		"POST /chats/{id:[0-9]+}/read":                      {h.eventHandler.MarkRead, ScopeChatsWrite},
+
+		"POST /auth/logout":               {h.authHandler.Logout, ScopeNone},
+		"POST /auth/logout-all":           {h.authHandler.LogoutAll, ScopeNone},
+		"POST /auth/upgrade":              {h.authHandler.UpgradeGuest, ScopeNone},
+		"POST /auth/oidc/{provider}/link": {h.oidcHandler.StartLink, ScopeNone},
 	}
 
 	// No protection
 	publicRoutes := map[string]func(http.ResponseWriter, *http.Request){
-		"POST /auth":           h.authHandler.CreateUser,
-		"POST /auth/login":     h.authHandler.Login,
-		"POST /auth/refresh":   h.authHandler.RefreshToken,
-		"POST /auth/bind-user": h.authHandler.BindUser,
-		"GET /chat/models":     h.chatConfigHandler.GetChatModels,
+		"POST /auth":                   h.authHandler.CreateUser,
+		"POST /auth/register":          h.authHandler.Register,
+		"POST /auth/login":             h.authHandler.Login,
+		"POST /auth/password/forgot":   h.authHandler.ForgotPassword,
+		"POST /auth/password/reset":    h.authHandler.ResetPassword,
+		"POST /auth/refresh":           h.authHandler.RefreshToken,
+		"POST /auth/mfa":               h.mfaHandler.VerifyMfa,
+		"POST /auth/email/verify":      h.emailHandler.VerifyEmail,
+		"POST /auth/magic-link":        h.emailHandler.RequestMagicLink,
+		"POST /auth/magic-link/verify": h.emailHandler.MagicLinkLogin,
+		"GET /.well-known/jwks.json":   h.authHandler.GetJWKS,
+		"POST /auth/bind-user":         h.authHandler.BindUser,
+		"GET /chat/models":             h.chatConfigHandler.GetChatModels,
+		"GET /chat/personas":           h.chatConfigHandler.GetPersonas,
+		"OPTIONS /files":               h.uploadHandler.UploadOptions,
+		"GET /share/{slug}":            h.shareHandler.GetSharedChat,
+
+		"GET /auth/oidc/providers":            h.oidcHandler.GetProviders,
+		"GET /auth/oidc/{provider}/start":     h.oidcHandler.StartLogin,
+		"POST /auth/oidc/{provider}/callback": h.oidcHandler.Callback,
+	}
+
+	// JWT and a role holding the permission required
+	adminRoutes := map[string]struct {
+		handler    func(http.ResponseWriter, *http.Request)
+		permission string
+	}{
+		"GET /admin/users":               {h.adminHandler.GetUsers, PermissionUsersRead},
+		"POST /admin/users/{id}/disable": {h.adminHandler.DisableUser, PermissionUsersManage},
+		"POST /admin/users/{id}/enable":  {h.adminHandler.EnableUser, PermissionUsersManage},
+		"POST /admin/users/{id}/role":    {h.adminHandler.SetUserRole, PermissionUsersManage},
+		"PATCH /admin/models/{id}":       {h.adminHandler.SetModelAvailable, PermissionModelsManage},
+		"GET /admin/chats/{id:[0-9]+}":   {h.adminHandler.GetChatRoom, PermissionChatsReadAny},
+		"GET /admin/audit-logs":          {h.adminHandler.GetAuditLogs, PermissionAuditRead},
 	}
 
-	for route, handler := range jwtProtectedRoutes {
+	for route, protected := range jwtProtectedRoutes {
 		parts := strings.Split(route, " ")
 		method, path := parts[0], parts[1]
-		router.HandleFunc(path, h.jwtAuthMiddleware(handler, true)).Methods(method)
+		switch {
+		case protected.scope == ScopeNone:
+			router.HandleFunc(path, h.jwtAuthMiddleware(protected.handler, true)).Methods(method)
+		case slices.Contains(Scopes, protected.scope):
+			router.HandleFunc(path, h.apiKeyAuthMiddleware(protected.handler, protected.scope)).Methods(method)
+		default:
+			return fmt.Errorf("route %s has no valid api key scope: %q", route, protected.scope)
+		}
+	}
+
+	for route, admin := range adminRoutes {
+		parts := strings.Split(route, " ")
+		method, path := parts[0], parts[1]
+		router.HandleFunc(path, h.jwtAuthMiddleware(h.permissionMiddleware(admin.handler, admin.permission), true)).Methods(method)
 	}
 
 	for route, handler := range publicRoutes {
@@ -64,21 +195,52 @@ func (h *Handler) RegisterRoutes(router *mux.Router) {
 		router.HandleFunc(path, h.jwtAuthMiddleware(handler, false)).Methods(method)
 	}
 
+	return nil
 }
 
-/*
-func (h *Handler) fullAuthMiddleware(next http.HandlerFunc) http.HandlerFunc {
+// permissionMiddleware only lets through users whose role holds the permission. It runs after
+// jwtAuthMiddleware, which puts the role from the access token into the context.
+func (h *Handler) permissionMiddleware(next http.HandlerFunc, permission string) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		serverKey := r.Header.Get("X-Server-Key")
-		if serverKey != h.jwtService.serverKey {
-			http.Error(w, "Invalid server key", http.StatusUnauthorized)
+		role, _ := r.Context().Value(ctxkey.RoleKey).(string)
+		if !HasPermission(role, permission) {
+			http.Error(w, "Permission denied", http.StatusForbidden)
 			return
 		}
 
-		h.jwtAuthMiddleware(next)(w, r)
+		next.ServeHTTP(w, r)
+	}
+}
+
+// apiKeyAuthMiddleware lets server to server calls in with an X-Api-Key header instead of a JWT.
+// The request runs as the key's owner, and only if the key holds the route's scope. Requests
+// without the header need a JWT as usual.
+func (h *Handler) apiKeyAuthMiddleware(next http.HandlerFunc, scope string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("X-Api-Key")
+		if key == "" {
+			h.jwtAuthMiddleware(next, true)(w, r)
+			return
+		}
+
+		apiKey, err := h.apiKeyRepository.AuthenticateApiKey(r.Context(), securetoken.Hash(key))
+		if err != nil {
+			http.Error(w, "Invalid api key", http.StatusUnauthorized)
+			return
+		}
+
+		if !apiKey.HasScope(scope) {
+			http.Error(w, "Api key is missing scope "+scope, http.StatusForbidden)
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), ctxkey.UserIDKey, apiKey.UserID)
+		ctx = context.WithValue(ctx, ctxkey.SessionIDKey, "")
+		ctx = context.WithValue(ctx, ctxkey.RoleKey, "")
+
+		next.ServeHTTP(w, r.WithContext(ctx))
 	}
 }
-*/
 
 func (h *Handler) jwtAuthMiddleware(next http.HandlerFunc, requireJwt bool) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -90,14 +252,20 @@ func (h *Handler) jwtAuthMiddleware(next http.HandlerFunc, requireJwt bool) http
 		}
 
 		tokenString = strings.TrimPrefix(tokenString, "Bearer ")
-		claims, err := h.jwtService.ValidateAccessToken(tokenString)
+		claims, err := h.jwtService.ValidateAccessToken(r.Context(), tokenString)
 
+		if requireJwt && errors.Is(err, ErrRevokedToken) {
+			http.Error(w, "Session has been revoked", http.StatusUnauthorized)
+			return
+		}
 		if requireJwt && err != nil {
 			http.Error(w, "Invalid token", http.StatusUnauthorized)
 			return
 		}
 
 		ctx := context.WithValue(r.Context(), ctxkey.UserIDKey, claims.UserID)
+		ctx = context.WithValue(ctx, ctxkey.SessionIDKey, claims.SessionID)
+		ctx = context.WithValue(ctx, ctxkey.RoleKey, claims.Role)
 
 		next.ServeHTTP(w, r.WithContext(ctx))
 	}
@@ -105,16 +273,70 @@ func (h *Handler) jwtAuthMiddleware(next http.HandlerFunc, requireJwt bool) http
 
 type ChatConfigHandler interface {
 	GetChatModels(http.ResponseWriter, *http.Request)
+	GetPersonas(http.ResponseWriter, *http.Request)
+}
+
+type SearchHandler interface {
+	Search(http.ResponseWriter, *http.Request)
+	SemanticSearch(http.ResponseWriter, *http.Request)
 }
 
 type ChatHandler interface {
 	GetChatRoom(http.ResponseWriter, *http.Request)
 	GetChatRooms(http.ResponseWriter, *http.Request)
+	GetMessages(http.ResponseWriter, *http.Request)
 	DeleteChatRoom(http.ResponseWriter, *http.Request)
+	GetDeletedChatRooms(http.ResponseWriter, *http.Request)
+	RestoreChatRoom(http.ResponseWriter, *http.Request)
+	UpdateChatRoom(http.ResponseWriter, *http.Request)
+	BulkUpdateChatRooms(http.ResponseWriter, *http.Request)
+}
+
+type ShareHandler interface {
+	CreateShare(http.ResponseWriter, *http.Request)
+	DeleteShare(http.ResponseWriter, *http.Request)
+	GetSharedChat(http.ResponseWriter, *http.Request)
+	ForkSharedChat(http.ResponseWriter, *http.Request)
+}
+
+type MemberHandler interface {
+	GetMembers(http.ResponseWriter, *http.Request)
+	AddMember(http.ResponseWriter, *http.Request)
+	UpdateMember(http.ResponseWriter, *http.Request)
+	RemoveMember(http.ResponseWriter, *http.Request)
+}
+
+type EventHandler interface {
+	StreamEvents(http.ResponseWriter, *http.Request)
+	SetTyping(http.ResponseWriter, *http.Request)
+	MarkRead(http.ResponseWriter, *http.Request)
+}
+
+type OrganizerHandler interface {
+	GetFolders(http.ResponseWriter, *http.Request)
+	CreateFolder(http.ResponseWriter, *http.Request)
+	UpdateFolder(http.ResponseWriter, *http.Request)
+	DeleteFolder(http.ResponseWriter, *http.Request)
+	GetTags(http.ResponseWriter, *http.Request)
+	CreateTag(http.ResponseWriter, *http.Request)
+	UpdateTag(http.ResponseWriter, *http.Request)
+	DeleteTag(http.ResponseWriter, *http.Request)
 }
 
 type UserHandler interface {
 	GetUser(http.ResponseWriter, *http.Request)
+	ChangePassword(http.ResponseWriter, *http.Request)
+	GetSessions(http.ResponseWriter, *http.Request)
+	DeleteSession(http.ResponseWriter, *http.Request)
+	GetProfile(http.ResponseWriter, *http.Request)
+	UpdateProfile(http.ResponseWriter, *http.Request)
+	DeleteUser(http.ResponseWriter, *http.Request)
+}
+
+type ExportHandler interface {
+	RequestExport(http.ResponseWriter, *http.Request)
+	GetExports(http.ResponseWriter, *http.Request)
+	GetExport(http.ResponseWriter, *http.Request)
 }
 
 type MessageHandler interface {
@@ -122,15 +344,110 @@ type MessageHandler interface {
 	CreateMessage(http.ResponseWriter, *http.Request)
 }
 
+type UploadHandler interface {
+	UploadOptions(http.ResponseWriter, *http.Request)
+	CreateUpload(http.ResponseWriter, *http.Request)
+	GetUploadOffset(http.ResponseWriter, *http.Request)
+	AppendUpload(http.ResponseWriter, *http.Request)
+	DeleteUpload(http.ResponseWriter, *http.Request)
+}
+
+type OidcHandler interface {
+	GetProviders(http.ResponseWriter, *http.Request)
+	StartLogin(http.ResponseWriter, *http.Request)
+	StartLink(http.ResponseWriter, *http.Request)
+	Callback(http.ResponseWriter, *http.Request)
+}
+
+type ApiKeyHandler interface {
+	CreateApiKey(http.ResponseWriter, *http.Request)
+	GetApiKeys(http.ResponseWriter, *http.Request)
+	RevokeApiKey(http.ResponseWriter, *http.Request)
+}
+
+type MfaHandler interface {
+	EnrollTotp(http.ResponseWriter, *http.Request)
+	ConfirmTotp(http.ResponseWriter, *http.Request)
+	DisableTotp(http.ResponseWriter, *http.Request)
+	RegenerateRecoveryCodes(http.ResponseWriter, *http.Request)
+	VerifyMfa(http.ResponseWriter, *http.Request)
+}
+
+type EmailHandler interface {
+	RequestEmailVerification(http.ResponseWriter, *http.Request)
+	VerifyEmail(http.ResponseWriter, *http.Request)
+	RequestMagicLink(http.ResponseWriter, *http.Request)
+	MagicLinkLogin(http.ResponseWriter, *http.Request)
+}
+
+type AdminHandler interface {
+	GetUsers(http.ResponseWriter, *http.Request)
+	DisableUser(http.ResponseWriter, *http.Request)
+	EnableUser(http.ResponseWriter, *http.Request)
+	SetUserRole(http.ResponseWriter, *http.Request)
+	SetModelAvailable(http.ResponseWriter, *http.Request)
+	GetChatRoom(http.ResponseWriter, *http.Request)
+	GetAuditLogs(http.ResponseWriter, *http.Request)
+}
+
 type AuthHandler interface {
+	Register(http.ResponseWriter, *http.Request)
 	Login(http.ResponseWriter, *http.Request)
+	ForgotPassword(http.ResponseWriter, *http.Request)
+	ResetPassword(http.ResponseWriter, *http.Request)
 	CreateUser(http.ResponseWriter, *http.Request)
 	RefreshToken(http.ResponseWriter, *http.Request)
+	GetJWKS(http.ResponseWriter, *http.Request)
+	Logout(http.ResponseWriter, *http.Request)
+	LogoutAll(http.ResponseWriter, *http.Request)
+	UpgradeGuest(http.ResponseWriter, *http.Request)
 	BindUser(http.ResponseWriter, *http.Request)
 }
 
+// API key scopes
+const (
+	ScopeChatsRead  = "chats:read"
+	ScopeChatsWrite = "chats:write"
+
+	// ScopeNone marks routes only a JWT can call, it is never granted to a key
+	ScopeNone = "none"
+)
+
+// Scopes lists every scope an API key can be granted
+var Scopes = []string{ScopeChatsRead, ScopeChatsWrite}
+
+// Admin API permissions
+const (
+	PermissionUsersRead    = "users:read"
+	PermissionUsersManage  = "users:manage"
+	PermissionModelsManage = "models:manage"
+	PermissionChatsReadAny = "chats:read_any"
+	PermissionAuditRead    = "audit:read"
+)
+
+// rolePermissions lists what each role may do through the admin API, plain users nothing
+var rolePermissions = map[string][]string{
+	tables.RoleSupport: {PermissionUsersRead, PermissionChatsReadAny},
+	tables.RoleAdmin: {
+		PermissionUsersRead, PermissionUsersManage, PermissionModelsManage,
+		PermissionChatsReadAny, PermissionAuditRead,
+	},
+}
+
+// HasPermission reports whether the role holds the permission
+func HasPermission(role string, permission string) bool {
+	for _, granted := range rolePermissions[role] {
+		if granted == permission {
+			return true
+		}
+	}
+
+	return false
+}
+
 var (
 	ErrInvalidToken     = errors.New("invalid token")
 	ErrExpiredToken     = errors.New("token has expired")
+	ErrRevokedToken     = errors.New("token has been revoked")
 	ErrMissingJWTSecret = errors.New("missing JWT secrets in environment")
 )
@@ -0,0 +1,284 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/yuhangang/chat-app-backend/internal/db"
+	"github.com/yuhangang/chat-app-backend/internal/db/tables"
+	"github.com/yuhangang/chat-app-backend/internal/service"
+	"github.com/yuhangang/chat-app-backend/pkg/ctxkey"
+	"github.com/yuhangang/chat-app-backend/types"
+)
+
+const kdefaultPageSize = 50
+const kmaxPageSize = 200
+
+// AdminHandlerImpl serves the admin API. Access is checked by the permission middleware,
+// and every action, reads included, is written to the audit log.
+type AdminHandlerImpl struct {
+	userRepository       db.UserRepository
+	chatRepository       db.ChatRepository
+	chatConfigRepository db.ChatConfigRepository
+	auditRepository      db.AuditRepository
+	jwtService           types.JwtService
+	fileSigner           service.FileSigner
+}
+
+func NewAdminHandler(
+	userRepository db.UserRepository,
+	chatRepository db.ChatRepository,
+	chatConfigRepository db.ChatConfigRepository,
+	auditRepository db.AuditRepository,
+	jwtService types.JwtService,
+	fileSigner service.FileSigner,
+) *AdminHandlerImpl {
+	return &AdminHandlerImpl{
+		userRepository:       userRepository,
+		chatRepository:       chatRepository,
+		chatConfigRepository: chatConfigRepository,
+		auditRepository:      auditRepository,
+		jwtService:           jwtService,
+		fileSigner:           fileSigner,
+	}
+}
+
+type UsersResponse struct {
+	Users []tables.User `json:"users"`
+	Total int64         `json:"total"`
+}
+
+// GetUsers pages through users, optionally filtered by a username or email substring q
+func (h *AdminHandlerImpl) GetUsers(w http.ResponseWriter, r *http.Request) {
+	offset, limit := parsePagination(r)
+	query := r.URL.Query().Get("q")
+
+	users, total, err := h.userRepository.GetUsers(r.Context(), query, offset, limit)
+	if err != nil {
+		http.Error(w, err.Error(), httpStatusForError(err))
+		return
+	}
+
+	h.audit(r, "users.list", "user", "*", fmt.Sprintf("q=%q offset=%d limit=%d", query, offset, limit))
+
+	writeJSON(w, http.StatusOK, UsersResponse{Users: users, Total: total})
+}
+
+// DisableUser blocks the account from signing in, ends its sessions and stops its API keys
+func (h *AdminHandlerImpl) DisableUser(w http.ResponseWriter, r *http.Request) {
+	h.setUserDisabled(w, r, true)
+}
+
+func (h *AdminHandlerImpl) EnableUser(w http.ResponseWriter, r *http.Request) {
+	h.setUserDisabled(w, r, false)
+}
+
+func (h *AdminHandlerImpl) setUserDisabled(w http.ResponseWriter, r *http.Request, disabled bool) {
+	targetID, ok := h.targetUserID(w, r)
+	if !ok {
+		return
+	}
+
+	user, err := h.userRepository.SetUserDisabled(r.Context(), targetID, disabled)
+	if err != nil {
+		http.Error(w, err.Error(), httpStatusForError(err))
+		return
+	}
+
+	action := "users.enable"
+	if disabled {
+		action = "users.disable"
+		if err := h.jwtService.RevokeAllSessions(r.Context(), targetID); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	h.audit(r, action, "user", strconv.FormatUint(uint64(targetID), 10), "")
+
+	writeJSON(w, http.StatusOK, user)
+}
+
+// SetUserRole changes the role of a user and signs them out everywhere, so the new role takes
+// effect at their next login
+func (h *AdminHandlerImpl) SetUserRole(w http.ResponseWriter, r *http.Request) {
+	targetID, ok := h.targetUserID(w, r)
+	if !ok {
+		return
+	}
+
+	role := r.FormValue("role")
+	if !tables.IsValidRole(role) {
+		http.Error(w, "role must be one of user, support, admin", http.StatusBadRequest)
+		return
+	}
+
+	entry := auditEntry(r, "users.set_role", "user", strconv.FormatUint(uint64(targetID), 10), "role="+role)
+	user, err := h.userRepository.SetUserRole(r.Context(), targetID, role, entry)
+	if err != nil {
+		http.Error(w, err.Error(), httpStatusForError(err))
+		return
+	}
+
+	writeJSON(w, http.StatusOK, user)
+}
+
+// SetModelAvailable toggles whether a model can be picked for chats
+func (h *AdminHandlerImpl) SetModelAvailable(w http.ResponseWriter, r *http.Request) {
+	modelID, ok := pathID(w, r, 3)
+	if !ok {
+		return
+	}
+
+	available, err := strconv.ParseBool(r.FormValue("available"))
+	if err != nil {
+		http.Error(w, "available must be true or false", http.StatusBadRequest)
+		return
+	}
+
+	model, err := h.chatConfigRepository.SetChatModelAvailable(r.Context(), modelID, available)
+	if err != nil {
+		http.Error(w, err.Error(), httpStatusForError(err))
+		return
+	}
+
+	h.audit(r, "models.set_available", "model", model.ModelKey, "available="+strconv.FormatBool(available))
+
+	writeJSON(w, http.StatusOK, model)
+}
+
+// GetChatRoom returns any user's chat room with a page of its messages, for support
+func (h *AdminHandlerImpl) GetChatRoom(w http.ResponseWriter, r *http.Request) {
+	chatRoomID, ok := pathID(w, r, 3)
+	if !ok {
+		return
+	}
+
+	before, limit, ok := parseMessagePage(w, r)
+	if !ok {
+		return
+	}
+
+	chatRoom, err := h.chatRepository.GetRoomByID(r.Context(), chatRoomID)
+	if err != nil {
+		http.Error(w, "chat room not found", http.StatusNotFound)
+		return
+	}
+
+	messages, nextCursor, err := messagePage(r.Context(), h.chatRepository, chatRoomID, before, limit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	h.audit(r, "chats.view", "chat_room", strconv.FormatUint(uint64(chatRoomID), 10),
+		fmt.Sprintf("owner=%d", chatRoom.UserID))
+
+	userID := r.Context().Value(ctxkey.UserIDKey).(uint)
+	signAttachmentURLs(h.fileSigner, userID, messages)
+	chatRoom.ChatMessages = messages
+
+	writeJSON(w, http.StatusOK, ChatRoomResponse{ChatRoom: chatRoom, NextCursor: nextCursor})
+}
+
+func (h *AdminHandlerImpl) GetAuditLogs(w http.ResponseWriter, r *http.Request) {
+	offset, limit := parsePagination(r)
+
+	entries, err := h.auditRepository.GetAuditLogs(r.Context(), offset, limit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, entries)
+}
+
+// targetUserID reads the user ID from /admin/users/{id}/..., refusing the caller's own account
+// so an admin can't lock themselves out
+func (h *AdminHandlerImpl) targetUserID(w http.ResponseWriter, r *http.Request) (uint, bool) {
+	targetID, ok := pathID(w, r, 3)
+	if !ok {
+		return 0, false
+	}
+
+	if targetID == r.Context().Value(ctxkey.UserIDKey).(uint) {
+		http.Error(w, "cannot change your own account", http.StatusBadRequest)
+		return 0, false
+	}
+
+	return targetID, true
+}
+
+func (h *AdminHandlerImpl) audit(r *http.Request, action string, targetType string, targetID string, details string) {
+	entry := auditEntry(r, action, targetType, targetID, details)
+	if err := h.auditRepository.CreateAuditLog(r.Context(), entry); err != nil {
+		log.Printf("Failed to write audit log %+v: %v", entry, err)
+	}
+}
+
+// auditEntry describes an action the admin making the request took
+func auditEntry(r *http.Request, action string, targetType string, targetID string, details string) tables.AuditLog {
+	return tables.AuditLog{
+		ActorID:    r.Context().Value(ctxkey.UserIDKey).(uint),
+		Action:     action,
+		TargetType: targetType,
+		TargetID:   targetID,
+		Details:    details,
+		IPAddress:  clientInfo(r).IPAddress,
+	}
+}
+
+// pathID parses the numeric ID at the given index of the URL path
+func pathID(w http.ResponseWriter, r *http.Request, index int) (uint, bool) {
+	parts := strings.Split(r.URL.Path, "/")
+	if len(parts) <= index {
+		http.Error(w, "missing id", http.StatusBadRequest)
+		return 0, false
+	}
+
+	id, err := strconv.ParseUint(parts[index], 10, 32)
+	if err != nil {
+		http.Error(w, "invalid id", http.StatusBadRequest)
+		return 0, false
+	}
+
+	return uint(id), true
+}
+
+// parsePagination reads offset and limit from the query, limit defaulting to
+// kdefaultPageSize and capped at kmaxPageSize
+func parsePagination(r *http.Request) (int, int) {
+	offset, err := strconv.Atoi(r.URL.Query().Get("offset"))
+	if err != nil || offset < 0 {
+		offset = 0
+	}
+
+	return offset, parseLimit(r)
+}
+
+// parseLimit reads the page size from the query, defaulting to kdefaultPageSize and capped at
+// kmaxPageSize
+func parseLimit(r *http.Request) int {
+	limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+	if err != nil || limit <= 0 {
+		limit = kdefaultPageSize
+	}
+	if limit > kmaxPageSize {
+		limit = kmaxPageSize
+	}
+
+	return limit
+}
+
+func writeJSON(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	if err := json.NewEncoder(w).Encode(value); err != nil {
+		log.Printf("Failed to write response: %v", err)
+	}
+}
@@ -0,0 +1,159 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/yuhangang/chat-app-backend/internal/db"
+	"github.com/yuhangang/chat-app-backend/internal/db/tables"
+	"github.com/yuhangang/chat-app-backend/internal/handler"
+	"github.com/yuhangang/chat-app-backend/pkg/ctxkey"
+	"github.com/yuhangang/chat-app-backend/pkg/securetoken"
+)
+
+const kapiKeyPrefix = "sk_"
+const kmaxApiKeyLife = 365 * 24 * time.Hour
+
+type ApiKeyHandlerImpl struct {
+	apiKeyRepository db.ApiKeyRepository
+}
+
+func NewApiKeyHandler(apiKeyRepo db.ApiKeyRepository) *ApiKeyHandlerImpl {
+	return &ApiKeyHandlerImpl{
+		apiKeyRepository: apiKeyRepo,
+	}
+}
+
+type CreateApiKeyResponse struct {
+	Key    string        `json:"key"` // Only ever shown here
+	ApiKey tables.ApiKey `json:"api_key"`
+}
+
+// CreateApiKey issues a key for the user with the comma separated scopes, expiring after
+// expires_in_days if given. The plain key is in the response only.
+func (h *ApiKeyHandlerImpl) CreateApiKey(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(ctxkey.UserIDKey).(uint)
+	name := r.FormValue("name")
+
+	if name == "" {
+		http.Error(w, "missing name", http.StatusBadRequest)
+		return
+	}
+
+	scopes, ok := parseScopes(r.FormValue("scopes"))
+	if !ok {
+		http.Error(w, "scopes must be some of "+strings.Join(handler.Scopes, ", "), http.StatusBadRequest)
+		return
+	}
+
+	apiKey := tables.ApiKey{
+		UserID: userID,
+		Name:   name,
+		Scopes: strings.Join(scopes, ","),
+	}
+
+	if value := r.FormValue("expires_in_days"); value != "" {
+		days, err := strconv.Atoi(value)
+		life := time.Duration(days) * 24 * time.Hour
+		if err != nil || days <= 0 || life > kmaxApiKeyLife {
+			http.Error(w, "expires_in_days must be between 1 and 365", http.StatusBadRequest)
+			return
+		}
+		expiresAt := time.Now().Add(life)
+		apiKey.ExpiresAt = &expiresAt
+	}
+
+	token, _, err := securetoken.Generate(32)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	key := kapiKeyPrefix + token
+	apiKey.KeyHash = securetoken.Hash(key)
+	apiKey.Prefix = key[:len(kapiKeyPrefix)+8]
+
+	apiKey, err = h.apiKeyRepository.CreateApiKey(r.Context(), apiKey)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+
+	if err := json.NewEncoder(w).Encode(CreateApiKeyResponse{Key: key, ApiKey: apiKey}); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func (h *ApiKeyHandlerImpl) GetApiKeys(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(ctxkey.UserIDKey).(uint)
+
+	apiKeys, err := h.apiKeyRepository.GetApiKeys(r.Context(), userID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+
+	if err := json.NewEncoder(w).Encode(apiKeys); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func (h *ApiKeyHandlerImpl) RevokeApiKey(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(ctxkey.UserIDKey).(uint)
+
+	// get api key ID from URL path, /user/api-keys/{id}
+	parts := strings.Split(r.URL.Path, "/")
+	if len(parts) < 4 {
+		http.Error(w, "missing api key id", http.StatusBadRequest)
+		return
+	}
+
+	apiKeyID, err := strconv.ParseUint(parts[3], 10, 32)
+	if err != nil {
+		http.Error(w, "invalid api key id", http.StatusBadRequest)
+		return
+	}
+
+	if err := h.apiKeyRepository.RevokeApiKey(r.Context(), uint(apiKeyID), userID); err != nil {
+		http.Error(w, err.Error(), httpStatusForError(err))
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// parseScopes splits and checks a comma separated scope list, at least one scope is required
+func parseScopes(value string) ([]string, bool) {
+	var scopes []string
+	seen := make(map[string]bool)
+
+	for _, scope := range strings.Split(value, ",") {
+		scope = strings.TrimSpace(scope)
+		if scope == "" || seen[scope] {
+			continue
+		}
+
+		known := false
+		for _, valid := range handler.Scopes {
+			if scope == valid {
+				known = true
+			}
+		}
+		if !known {
+			return nil, false
+		}
+
+		seen[scope] = true
+		scopes = append(scopes, scope)
+	}
+
+	return scopes, len(scopes) > 0
+}
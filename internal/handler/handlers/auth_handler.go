@@ -1,31 +1,51 @@
 package handlers
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
+	"net"
 	"net/http"
+	"os"
+	"strings"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/yuhangang/chat-app-backend/internal/db"
 	"github.com/yuhangang/chat-app-backend/internal/db/tables"
 	"github.com/yuhangang/chat-app-backend/internal/handler"
+	"github.com/yuhangang/chat-app-backend/internal/service"
+	"github.com/yuhangang/chat-app-backend/internal/service/password"
 	"github.com/yuhangang/chat-app-backend/pkg/ctxkey"
+	"github.com/yuhangang/chat-app-backend/pkg/securetoken"
 	"github.com/yuhangang/chat-app-backend/types"
+	"github.com/yuhangang/chat-app-backend/user_errors"
 )
 
+const kmaxLoginAttempts = 5
+const kloginLockDuration = 15 * time.Minute
+const kpasswordResetLife = 30 * time.Minute
+
 type AuthHandlerImpl struct {
 	userRepository db.UserRepository
+	mfaRepository  db.MfaRepository
 	jwtService     types.JwtService
+	mailer         service.Mailer
 }
 
-func NewAuthHandler(userRepo db.UserRepository, jwtService types.JwtService) *AuthHandlerImpl {
+func NewAuthHandler(userRepo db.UserRepository, mfaRepo db.MfaRepository, jwtService types.JwtService, mailer service.Mailer) *AuthHandlerImpl {
 	return &AuthHandlerImpl{
 		userRepository: userRepo,
+		mfaRepository:  mfaRepo,
 		jwtService:     jwtService,
+		mailer:         mailer,
 	}
 }
 
-// RefreshToken is a handler that refreshes the access token
+// RefreshToken rotates the refresh token, returning a new access and refresh token pair.
+// The presented refresh token can't be used again.
 func (h *AuthHandlerImpl) RefreshToken(w http.ResponseWriter, r *http.Request) {
 	// Extract refresh token from Authorization header
 	authHeader := r.Header.Get("Authorization")
@@ -47,8 +67,8 @@ func (h *AuthHandlerImpl) RefreshToken(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Get new access token
-	accessToken, err := h.jwtService.RefreshAccessToken(refreshToken)
+	// Rotate into a new token pair
+	jwtPayload, err := h.jwtService.RefreshTokens(r.Context(), refreshToken, clientInfo(r))
 
 	if err != nil {
 		switch err {
@@ -56,19 +76,16 @@ func (h *AuthHandlerImpl) RefreshToken(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, "refresh token expired", http.StatusUnauthorized)
 		case handler.ErrInvalidToken:
 			http.Error(w, "invalid refresh token", http.StatusUnauthorized)
+		case user_errors.ErrAccountDisabled:
+			http.Error(w, err.Error(), http.StatusForbidden)
 		default:
 			http.Error(w, "internal server error", http.StatusInternalServerError)
 		}
 		return
 	}
 
-	// Create response
-	response := map[string]string{
-		"access_token": accessToken,
-	}
-
 	// Convert to JSON and write response
-	jsonResponse, err := json.Marshal(response)
+	jsonResponse, err := json.Marshal(jwtPayload)
 	if err != nil {
 		http.Error(w, "failed to create response", http.StatusInternalServerError)
 		return
@@ -79,6 +96,42 @@ func (h *AuthHandlerImpl) RefreshToken(w http.ResponseWriter, r *http.Request) {
 	w.Write(jsonResponse)
 }
 
+// GetJWKS publishes the public keys access tokens are signed with, for other services to verify them
+func (h *AuthHandlerImpl) GetJWKS(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	w.WriteHeader(http.StatusOK)
+
+	if err := json.NewEncoder(w).Encode(h.jwtService.PublicKeys()); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// Logout revokes the session of the access token, invalidating its refresh token too
+func (h *AuthHandlerImpl) Logout(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(ctxkey.UserIDKey).(uint)
+	sessionID := r.Context().Value(ctxkey.SessionIDKey).(string)
+
+	if err := h.jwtService.RevokeSession(r.Context(), userID, sessionID); err != nil {
+		http.Error(w, err.Error(), httpStatusForError(err))
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// LogoutAll revokes every session of the user, on all devices
+func (h *AuthHandlerImpl) LogoutAll(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(ctxkey.UserIDKey).(uint)
+
+	if err := h.jwtService.RevokeAllSessions(r.Context(), userID); err != nil {
+		http.Error(w, err.Error(), httpStatusForError(err))
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
 func (h *AuthHandlerImpl) CreateUser(w http.ResponseWriter, r *http.Request) {
 	// Get username or generate one if empty
 	username := r.FormValue("username")
@@ -97,10 +150,10 @@ func (h *AuthHandlerImpl) CreateUser(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Generate JWT
-	jwtPayload, err := h.jwtService.GenerateTokens(userCreated.ID)
+	jwtPayload, err := h.jwtService.GenerateTokens(r.Context(), userCreated.ID, clientInfo(r))
 
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(w, err.Error(), httpStatusForError(err))
 		return
 	}
 
@@ -120,49 +173,91 @@ func (h *AuthHandlerImpl) CreateUser(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func (h *AuthHandlerImpl) Login(w http.ResponseWriter, r *http.Request) {
-	// Get username or generate one if empty
+// Register creates an account with a password, and optionally an email for password resets
+func (h *AuthHandlerImpl) Register(w http.ResponseWriter, r *http.Request) {
 	username := r.FormValue("username")
-	if username == "" {
-		http.Error(w, "missing username", http.StatusBadRequest)
+	plainPassword := r.FormValue("password")
+	email := r.FormValue("email")
+
+	if username == "" || plainPassword == "" {
+		http.Error(w, "missing username or password", http.StatusBadRequest)
 		return
 	}
 
-	var user tables.User
-	var err error
+	if err := password.CheckStrength(plainPassword, username); err != nil {
+		http.Error(w, err.Error(), httpStatusForError(err))
+		return
+	}
 
-	user, err = h.userRepository.GetUserByUsername(r.Context(), username)
+	passwordHash, err := password.Hash(plainPassword)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	if user.ID == 0 {
-		user := tables.User{
-			Username: username,
-		}
+	now := time.Now()
+	user := tables.User{
+		Username:          username,
+		PasswordHash:      passwordHash,
+		PasswordChangedAt: &now,
+	}
+	if email != "" {
+		user.Email = &email
+	}
 
-		userCreated, err := h.userRepository.CreateUser(r.Context(), user)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
+	userCreated, err := h.userRepository.CreateUser(r.Context(), user)
+	if err != nil {
+		http.Error(w, err.Error(), httpStatusForError(err))
+		return
+	}
 
-		user = userCreated
+	// the account works unverified, it can ask for a new link later
+	if userCreated.Email != nil {
+		if err := sendVerificationEmail(r.Context(), h.userRepository, h.mailer, userCreated); err != nil {
+			log.Println("failed to send verification email", err)
+		}
 	}
 
 	// Generate JWT
-	jwtPayload, err := h.jwtService.GenerateTokens(user.ID)
+	jwtPayload, err := h.jwtService.GenerateTokens(r.Context(), userCreated.ID, clientInfo(r))
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(w, err.Error(), httpStatusForError(err))
 		return
 	}
 
-	// Return JWT and user as JSON
 	jwtPayloadResponse := UserResponse{
 		AccessToken:  jwtPayload.AccessToken,
 		RefreshToken: jwtPayload.RefreshToken,
-		User:         user,
+		User:         userCreated,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+
+	if err := json.NewEncoder(w).Encode(jwtPayloadResponse); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func (h *AuthHandlerImpl) Login(w http.ResponseWriter, r *http.Request) {
+	username := r.FormValue("username")
+	plainPassword := r.FormValue("password")
+	if username == "" || plainPassword == "" {
+		http.Error(w, "missing username or password", http.StatusBadRequest)
+		return
+	}
+
+	user, err := h.authenticate(r, username, plainPassword)
+	if err != nil {
+		http.Error(w, err.Error(), httpStatusForError(err))
+		return
+	}
+
+	// Generate JWT, or a challenge when the user has two-factor authentication
+	jwtPayloadResponse, err := newLoginResponse(r.Context(), h.jwtService, h.mfaRepository, user, clientInfo(r))
+	if err != nil {
+		http.Error(w, err.Error(), httpStatusForError(err))
+		return
 	}
 
 	w.Header().Set("Content-Type", "application/json") // Correct header order
@@ -174,6 +269,199 @@ func (h *AuthHandlerImpl) Login(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+type UpgradeResponse struct {
+	UserResponse
+	MergedChatRooms int64 `json:"merged_chat_rooms"`
+}
+
+// UpgradeGuest logs a guest into an existing account with its username and password, moving the
+// guest's chats over to it. The guest account is deleted and its tokens stop working, the
+// response carries tokens for the existing account. Accounts with two-factor authentication get
+// their MFA challenge instead and the guest is only merged once VerifyMfa passed.
+func (h *AuthHandlerImpl) UpgradeGuest(w http.ResponseWriter, r *http.Request) {
+	guestID := r.Context().Value(ctxkey.UserIDKey).(uint)
+	username := r.FormValue("username")
+	plainPassword := r.FormValue("password")
+	if username == "" || plainPassword == "" {
+		http.Error(w, "missing username or password", http.StatusBadRequest)
+		return
+	}
+
+	guest, err := isGuestAccount(r.Context(), h.userRepository, guestID)
+	if err != nil {
+		http.Error(w, err.Error(), httpStatusForError(err))
+		return
+	}
+	if !guest {
+		http.Error(w, user_errors.ErrNotGuestAccount.Error(), httpStatusForError(user_errors.ErrNotGuestAccount))
+		return
+	}
+
+	user, err := h.authenticate(r, username, plainPassword)
+	if err != nil {
+		http.Error(w, err.Error(), httpStatusForError(err))
+		return
+	}
+	if user.DisabledAt != nil {
+		http.Error(w, user_errors.ErrAccountDisabled.Error(), http.StatusForbidden)
+		return
+	}
+
+	response, err := newUpgradeResponse(r.Context(), h.userRepository, h.jwtService, h.mfaRepository, guestID, user, clientInfo(r))
+	if err != nil {
+		http.Error(w, err.Error(), httpStatusForError(err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// authenticate checks a username and password, counting failures towards the account lockout.
+// Returns ErrInvalidCredentials or ErrAccountLocked on failure.
+func (h *AuthHandlerImpl) authenticate(r *http.Request, username string, plainPassword string) (tables.User, error) {
+	user, err := h.userRepository.GetUserByUsername(r.Context(), username)
+	if errors.Is(err, user_errors.ErrUserNotFound) {
+		// still pay for a hash comparison, so unknown usernames can't be told apart by timing
+		password.Verify("", plainPassword)
+		return tables.User{}, user_errors.ErrInvalidCredentials
+	}
+	if err != nil {
+		return tables.User{}, err
+	}
+
+	if user.LockedUntil != nil && time.Now().Before(*user.LockedUntil) {
+		return tables.User{}, user_errors.ErrAccountLocked
+	}
+
+	// guest accounts have no password hash and never match
+	if !password.Verify(user.PasswordHash, plainPassword) {
+		if user.HasPassword() {
+			if err := h.userRepository.RecordLoginFailure(r.Context(), user.ID, kmaxLoginAttempts, kloginLockDuration); err != nil {
+				log.Println("failed to record login failure", err)
+			}
+		}
+		return tables.User{}, user_errors.ErrInvalidCredentials
+	}
+
+	if user.FailedLoginAttempts > 0 || user.LockedUntil != nil {
+		if err := h.userRepository.ClearLoginFailures(r.Context(), user.ID); err != nil {
+			log.Println("failed to clear login failures", err)
+		}
+	}
+
+	return user, nil
+}
+
+// isGuestAccount reports whether the user is a guest, with neither a password nor a provider
+// login, and so may be merged into another account
+func isGuestAccount(ctx context.Context, userRepository db.UserRepository, userID uint) (bool, error) {
+	user, err := userRepository.GetUser(ctx, userID)
+	if err != nil {
+		return false, err
+	}
+	if user.HasPassword() {
+		return false, nil
+	}
+
+	identities, err := userRepository.GetIdentities(ctx, userID)
+	if err != nil {
+		return false, err
+	}
+
+	return len(identities) == 0, nil
+}
+
+// ForgotPassword issues a one-time reset token for the account with the given username or email.
+// The response is the same whether or not the account exists.
+func (h *AuthHandlerImpl) ForgotPassword(w http.ResponseWriter, r *http.Request) {
+	username := r.FormValue("username")
+	email := r.FormValue("email")
+	if username == "" && email == "" {
+		http.Error(w, "missing username or email", http.StatusBadRequest)
+		return
+	}
+
+	var user tables.User
+	var err error
+	if email != "" {
+		user, err = h.userRepository.GetUserByEmail(r.Context(), email)
+	} else {
+		user, err = h.userRepository.GetUserByUsername(r.Context(), username)
+	}
+
+	// a reset link can only be mailed to accounts with an email
+	if err == nil && user.HasPassword() && user.Email != nil {
+		token, tokenHash, err := securetoken.Generate(32)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		err = h.userRepository.CreatePasswordResetToken(r.Context(), tables.PasswordResetToken{
+			UserID:    user.ID,
+			TokenHash: tokenHash,
+			ExpiresAt: time.Now().Add(kpasswordResetLife),
+		})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		deliverMail(h.mailer, service.MailMessage{
+			To:      *user.Email,
+			Subject: "Reset your password",
+			Body: fmt.Sprintf("Someone asked to reset the password of %s. Choose a new one by opening this link:\n\n"+
+				"%s/reset-password?token=%s\n\nThe link expires in 30 minutes. If it wasn't you, you can ignore this email.\n",
+				user.Username, appURL(), token),
+		})
+	} else if err != nil && !errors.Is(err, user_errors.ErrUserNotFound) {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// ResetPassword sets a new password using a token from ForgotPassword
+func (h *AuthHandlerImpl) ResetPassword(w http.ResponseWriter, r *http.Request) {
+	token := r.FormValue("token")
+	newPassword := r.FormValue("new_password")
+	if token == "" || newPassword == "" {
+		http.Error(w, "missing token or new password", http.StatusBadRequest)
+		return
+	}
+
+	if err := password.CheckStrength(newPassword, ""); err != nil {
+		http.Error(w, err.Error(), httpStatusForError(err))
+		return
+	}
+
+	passwordHash, err := password.Hash(newPassword)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	user, err := h.userRepository.ResetPassword(r.Context(), securetoken.Hash(token), passwordHash)
+	if err != nil {
+		http.Error(w, err.Error(), httpStatusForError(err))
+		return
+	}
+
+	// whoever knew the old password may still be signed in
+	if err := h.jwtService.RevokeAllSessions(r.Context(), user.ID); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
 func (h *AuthHandlerImpl) BindUser(w http.ResponseWriter, r *http.Request) {
 	userID := r.Context().Value(ctxkey.UserIDKey).(uint)
 	username := r.FormValue("username")
@@ -191,10 +479,10 @@ func (h *AuthHandlerImpl) BindUser(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Generate JWT
-	jwtPayload, err := h.jwtService.GenerateTokens(user.ID)
+	jwtPayload, err := h.jwtService.GenerateTokens(r.Context(), user.ID, clientInfo(r))
 	if err != nil {
 		log.Println("error1", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(w, err.Error(), httpStatusForError(err))
 		return
 	}
 
@@ -213,3 +501,36 @@ func (h *AuthHandlerImpl) BindUser(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 	}
 }
+
+// clientInfo describes the device making the request, for the session list. X-Forwarded-For is
+// only trusted when TRUST_PROXY is set, i.e. when a proxy we run overwrites it.
+func clientInfo(r *http.Request) types.ClientInfo {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	if os.Getenv("TRUST_PROXY") == "true" {
+		if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+			ip = strings.TrimSpace(strings.Split(forwarded, ",")[0])
+		}
+	}
+
+	userAgent := r.UserAgent()
+	if len(userAgent) > 255 {
+		userAgent = userAgent[:255]
+	}
+
+	return types.ClientInfo{
+		UserAgent: userAgent,
+		IPAddress: ip,
+	}
+}
+
+// appURL is the frontend base URL used in links sent to users
+func appURL() string {
+	if url := os.Getenv("APP_URL"); url != "" {
+		return url
+	}
+
+	return "http://localhost:3000"
+}
@@ -26,3 +26,15 @@ func (h *ChatConfigHandlerImpl) GetChatModels(w http.ResponseWriter, r *http.Req
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(chatModels)
 }
+
+func (h *ChatConfigHandlerImpl) GetPersonas(w http.ResponseWriter, r *http.Request) {
+	personas, err := h.chatConfigRepo.GetPersonas(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(personas)
+}
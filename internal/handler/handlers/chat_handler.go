@@ -1,126 +1,489 @@
 package handlers
 
 import (
-	"encoding/json"
+	"context"
+	"errors"
+	"fmt"
 	"net/http"
+	"slices"
 	"strconv"
 	"strings"
 
+	"github.com/yuhangang/chat-app-backend/internal/access"
 	"github.com/yuhangang/chat-app-backend/internal/db"
 	"github.com/yuhangang/chat-app-backend/internal/db/tables"
+	"github.com/yuhangang/chat-app-backend/internal/service"
 	"github.com/yuhangang/chat-app-backend/pkg/ctxkey"
+	"github.com/yuhangang/chat-app-backend/pkg/cursor"
+	"github.com/yuhangang/chat-app-backend/types"
+	"github.com/yuhangang/chat-app-backend/user_errors"
 )
 
+// kmaxBulkRooms bounds how many rooms one bulk request changes
+const kmaxBulkRooms = 100
+
+const kmaxChatRoomNameLength = 100
+
+// kmaxFormMemory bounds the form of requests without files
+const kmaxFormMemory = 1 << 20
+
 type ChatHandlerImpl struct {
 	chatRepository db.ChatRepository
+	fileSigner     service.FileSigner
+	eventHub       service.EventHub
 }
 
 func NewChatHandler(
 	chatRepository db.ChatRepository,
+	fileSigner service.FileSigner,
+	eventHub service.EventHub,
 ) *ChatHandlerImpl {
 	return &ChatHandlerImpl{
 		chatRepository: chatRepository,
+		fileSigner:     fileSigner,
+		eventHub:       eventHub,
 	}
 }
 
-func (h *ChatHandlerImpl) GetChatRoom(w http.ResponseWriter, r *http.Request) {
+// ChatRoomResponse is the room with a page of its messages, oldest first. next_cursor is left
+// out when there are no older messages.
+type ChatRoomResponse struct {
+	tables.ChatRoom
+	NextCursor string `json:"next_cursor,omitempty"`
+}
 
-	// get chat room ID from URL path
-	parts := strings.Split(r.URL.Path, "/")
-	if len(parts) < 3 {
-		http.Error(w, "chatID is required", http.StatusBadRequest)
-	}
+// ChatRoomsResponse is a page of rooms. next_cursor is left out on the last page.
+type ChatRoomsResponse struct {
+	ChatRooms  []tables.ChatRoom `json:"chat_rooms"`
+	NextCursor string            `json:"next_cursor,omitempty"`
+}
 
-	chatRoomIDStr := parts[2]
+// MessagesResponse is a page of messages, oldest first. next_cursor is left out when there are
+// no older messages.
+type MessagesResponse struct {
+	Messages   []tables.ChatMessage `json:"messages"`
+	NextCursor string               `json:"next_cursor,omitempty"`
+}
 
-	if chatRoomIDStr == "" {
-		http.Error(w, "chatID is required", http.StatusBadRequest)
+// GetChatRoom returns the room with its latest messages, or the ones before the before cursor
+func (h *ChatHandlerImpl) GetChatRoom(w http.ResponseWriter, r *http.Request) {
+	chatRoom, ok := h.authorizedChatRoom(w, r, access.ChatActionRead)
+	if !ok {
 		return
 	}
 
-	chatRoomID, err := strconv.ParseUint(chatRoomIDStr, 10, 64)
-	if err != nil {
-		http.Error(w, "invalid chatID", http.StatusBadRequest)
+	before, limit, ok := parseMessagePage(w, r)
+	if !ok {
 		return
 	}
 
-	chatRoom, err := h.chatRepository.GetRoomByID(r.Context(), uint(chatRoomID))
-
+	messages, nextCursor, err := messagePage(r.Context(), h.chatRepository, chatRoom.ID, before, limit)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
 
-	userID := r.Context().Value(ctxkey.UserIDKey).(uint)
-	hasAcessToChatRoom := h.userHasAccessToChatRoom(userID, chatRoom)
+	signAttachmentURLs(h.fileSigner, r.Context().Value(ctxkey.UserIDKey).(uint), messages)
+	chatRoom.ChatMessages = messages
 
-	if !hasAcessToChatRoom {
-		http.Error(w, "user does not have access to chat room", http.StatusForbidden)
+	writeJSON(w, http.StatusOK, ChatRoomResponse{ChatRoom: chatRoom, NextCursor: nextCursor})
+}
+
+// GetMessages pages back through the room's messages, pass next_cursor as before to get the
+// page before
+func (h *ChatHandlerImpl) GetMessages(w http.ResponseWriter, r *http.Request) {
+	chatRoom, ok := h.authorizedChatRoom(w, r, access.ChatActionRead)
+	if !ok {
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
+	before, limit, ok := parseMessagePage(w, r)
+	if !ok {
+		return
+	}
 
-	w.WriteHeader(http.StatusOK)
-	response, err := json.Marshal(chatRoom)
+	messages, nextCursor, err := messagePage(r.Context(), h.chatRepository, chatRoom.ID, before, limit)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	w.Write(response)
+
+	signAttachmentURLs(h.fileSigner, r.Context().Value(ctxkey.UserIDKey).(uint), messages)
+
+	writeJSON(w, http.StatusOK, MessagesResponse{Messages: messages, NextCursor: nextCursor})
 }
 
+// GetChatRooms pages through the user's rooms, most recently active first. Pass next_cursor as
+// cursor to get the next page. folder_id (0 for rooms outside any folder), tag_id and
+// archived=true narrow the list, archived rooms are left out otherwise. pinned_first=true lists
+// pinned rooms ahead of the rest. shared=true lists the rooms other users invited the user to
+// instead.
 func (h *ChatHandlerImpl) GetChatRooms(w http.ResponseWriter, r *http.Request) {
-	// get all chat rooms for the user
 	userID := r.Context().Value(ctxkey.UserIDKey).(uint)
-	chatRooms, err := h.chatRepository.GetChatRoomsForUser(r.Context(), userID)
+	query := r.URL.Query()
 
+	after, err := cursor.Decode(query.Get("cursor"))
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
+	limit := parseLimit(r)
 
-	w.Header().Set("Content-Type", "application/json")
+	var filter types.ChatRoomFilter
+	if value := query.Get("folder_id"); value != "" {
+		folderID, err := strconv.ParseUint(value, 10, 32)
+		if err != nil {
+			http.Error(w, "invalid folder_id", http.StatusBadRequest)
+			return
+		}
+		id := uint(folderID)
+		filter.FolderID = &id
+	}
+	if value := query.Get("tag_id"); value != "" {
+		tagID, err := strconv.ParseUint(value, 10, 32)
+		if err != nil {
+			http.Error(w, "invalid tag_id", http.StatusBadRequest)
+			return
+		}
+		filter.TagID = uint(tagID)
+	}
+	filter.Archived, _ = strconv.ParseBool(query.Get("archived"))
+	filter.PinnedFirst, _ = strconv.ParseBool(query.Get("pinned_first"))
+	filter.Shared, _ = strconv.ParseBool(query.Get("shared"))
 
-	w.WriteHeader(http.StatusOK)
-	response, err := json.Marshal(chatRooms)
+	// one extra row tells whether there is a next page
+	chatRooms, err := h.chatRepository.GetChatRoomsForUser(r.Context(), userID, filter, after, limit+1)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	w.Write(response)
+
+	response := ChatRoomsResponse{ChatRooms: chatRooms}
+	if len(chatRooms) > limit {
+		last := chatRooms[limit-1]
+		response.ChatRooms = chatRooms[:limit]
+
+		next := cursor.Cursor{Time: last.UpdatedAt, ID: last.ID}
+		if filter.PinnedFirst && last.Pinned {
+			next.Rank = 1
+		}
+		response.NextCursor = next.Encode()
+	}
+
+	writeJSON(w, http.StatusOK, response)
+}
+
+// UpdateChatRoom changes the room's name, pinned, archived, folder_id (empty for none) and
+// tag_ids (comma separated, empty for none). Fields left out of the form are kept.
+func (h *ChatHandlerImpl) UpdateChatRoom(w http.ResponseWriter, r *http.Request) {
+	chatRoom, ok := h.authorizedChatRoom(w, r, access.ChatActionManage)
+	if !ok {
+		return
+	}
+
+	if err := r.ParseMultipartForm(kmaxFormMemory); err != nil && !errors.Is(err, http.ErrNotMultipart) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	changes, ok := parseChatRoomChanges(w, r)
+	if !ok {
+		return
+	}
+
+	if value, ok := formField(r, "tag_ids"); ok {
+		tagIDs, ok := parseIDList(w, value, "tag_ids")
+		if !ok {
+			return
+		}
+		changes.TagIDs = &tagIDs
+	}
+
+	// the fields and the tags change together or not at all
+	if changes != (types.ChatRoomChanges{}) {
+		if _, err := h.chatRepository.UpdateRooms(r.Context(), chatRoom.UserID, []uint{chatRoom.ID}, changes); err != nil {
+			http.Error(w, err.Error(), httpStatusForError(err))
+			return
+		}
+	}
+
+	chatRoom, err := h.chatRepository.GetRoomByID(r.Context(), chatRoom.ID)
+	if err != nil {
+		http.Error(w, err.Error(), httpStatusForError(err))
+		return
+	}
+
+	writeJSON(w, http.StatusOK, chatRoom)
 }
 
-func (h *ChatHandlerImpl) userHasAccessToChatRoom(userID uint, chatRoom tables.ChatRoom) bool {
-	return chatRoom.UserID == userID
+// BulkUpdateChatRooms applies one action to the rooms in ids (comma separated): pin, unpin,
+// archive, unarchive, move (to folder_id, empty for none), tag or untag (with tag_id), or delete.
+// Rooms of other users are skipped, the response counts the rooms changed.
+func (h *ChatHandlerImpl) BulkUpdateChatRooms(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(ctxkey.UserIDKey).(uint)
+
+	chatRoomIDs, ok := parseIDList(w, r.FormValue("ids"), "ids")
+	if !ok {
+		return
+	}
+	if len(chatRoomIDs) == 0 || len(chatRoomIDs) > kmaxBulkRooms {
+		http.Error(w, fmt.Sprintf("ids must list 1 to %d chat rooms", kmaxBulkRooms), http.StatusBadRequest)
+		return
+	}
+
+	var updated int64
+	var err error
+	switch action := r.FormValue("action"); action {
+	case "pin", "unpin":
+		pinned := action == "pin"
+		updated, err = h.chatRepository.UpdateRooms(r.Context(), userID, chatRoomIDs, types.ChatRoomChanges{Pinned: &pinned})
+	case "archive", "unarchive":
+		archived := action == "archive"
+		updated, err = h.chatRepository.UpdateRooms(r.Context(), userID, chatRoomIDs, types.ChatRoomChanges{Archived: &archived})
+	case "move":
+		folderID, ok := parseOptionalID(w, r.FormValue("folder_id"), "folder_id")
+		if !ok {
+			return
+		}
+		updated, err = h.chatRepository.UpdateRooms(r.Context(), userID, chatRoomIDs, types.ChatRoomChanges{Move: true, FolderID: folderID})
+	case "tag", "untag":
+		tagID, ok := parseOptionalID(w, r.FormValue("tag_id"), "tag_id")
+		if !ok {
+			return
+		}
+		if tagID == nil {
+			http.Error(w, "tag_id is required", http.StatusBadRequest)
+			return
+		}
+		updated, err = h.chatRepository.TagRooms(r.Context(), userID, chatRoomIDs, *tagID, action == "tag")
+	case "delete":
+		var deleted []uint
+		deleted, err = h.chatRepository.DeleteRoomsByID(r.Context(), chatRoomIDs, userID)
+		for _, chatRoomID := range deleted {
+			h.eventHub.DisconnectRoom(chatRoomID)
+		}
+		updated = int64(len(deleted))
+	default:
+		http.Error(w, "action must be one of pin, unpin, archive, unarchive, move, tag, untag, delete", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), httpStatusForError(err))
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]int64{"updated": updated})
 }
 
-func (h *ChatHandlerImpl) DeleteChatRoom(w http.ResponseWriter, r *http.Request) {
+// parseChatRoomChanges reads the name, pinned, archived and folder_id fields of the form
+func parseChatRoomChanges(w http.ResponseWriter, r *http.Request) (types.ChatRoomChanges, bool) {
+	var changes types.ChatRoomChanges
 
-	// get chat room ID from URL path
-	parts := strings.Split(r.URL.Path, "/")
-	if len(parts) < 3 {
-		http.Error(w, "chatID is required", http.StatusBadRequest)
+	if value, ok := formField(r, "name"); ok {
+		name, ok := parseName(w, value, kmaxChatRoomNameLength)
+		if !ok {
+			return changes, false
+		}
+		changes.Name = &name
 	}
 
-	chatRoomIDStr := parts[2]
+	for key, field := range map[string]**bool{"pinned": &changes.Pinned, "archived": &changes.Archived} {
+		value, ok := formField(r, key)
+		if !ok {
+			continue
+		}
+		flag, err := strconv.ParseBool(value)
+		if err != nil {
+			http.Error(w, "invalid "+key, http.StatusBadRequest)
+			return changes, false
+		}
+		*field = &flag
+	}
+
+	if value, ok := formField(r, "folder_id"); ok {
+		folderID, ok := parseOptionalID(w, value, "folder_id")
+		if !ok {
+			return changes, false
+		}
+		changes.Move = true
+		changes.FolderID = folderID
+	}
 
-	if chatRoomIDStr == "" {
-		http.Error(w, "chatID is required", http.StatusBadRequest)
+	return changes, true
+}
+
+// parseOptionalID parses an ID form field, empty meaning none
+func parseOptionalID(w http.ResponseWriter, value string, key string) (*uint, bool) {
+	if value == "" {
+		return nil, true
+	}
+
+	id, err := strconv.ParseUint(value, 10, 32)
+	if err != nil || id == 0 {
+		http.Error(w, "invalid "+key, http.StatusBadRequest)
+		return nil, false
+	}
+
+	result := uint(id)
+	return &result, true
+}
+
+// parseIDList parses a comma separated list of IDs, dropping duplicates
+func parseIDList(w http.ResponseWriter, value string, key string) ([]uint, bool) {
+	ids := []uint{}
+	if strings.TrimSpace(value) == "" {
+		return ids, true
+	}
+
+	for _, part := range strings.Split(value, ",") {
+		id, err := strconv.ParseUint(strings.TrimSpace(part), 10, 32)
+		if err != nil || id == 0 {
+			http.Error(w, "invalid "+key, http.StatusBadRequest)
+			return nil, false
+		}
+		if !slices.Contains(ids, uint(id)) {
+			ids = append(ids, uint(id))
+		}
+	}
+
+	return ids, true
+}
+
+// authorizedChatRoom loads the room from /chats/{id}/... if the user may take the action in it
+func (h *ChatHandlerImpl) authorizedChatRoom(w http.ResponseWriter, r *http.Request, action string) (tables.ChatRoom, bool) {
+	chatRoomID, ok := pathID(w, r, 2)
+	if !ok {
+		return tables.ChatRoom{}, false
+	}
+
+	userID := r.Context().Value(ctxkey.UserIDKey).(uint)
+
+	chatRoom, err := authorizeChatRoom(r.Context(), h.chatRepository, userID, chatRoomID, action)
+	if err != nil {
+		http.Error(w, err.Error(), httpStatusForError(err))
+		return tables.ChatRoom{}, false
+	}
+
+	return chatRoom, true
+}
+
+// authorizeChatRoom is the access policy for chat rooms and everything in them, messages,
+// attachments and members. It loads the room and fails unless the user's role in it allows the
+// action, see access.ChatRoomAllows. The room comes with the user's role.
+func authorizeChatRoom(ctx context.Context, chatRepository db.ChatRepository, userID uint, chatRoomID uint, action string) (tables.ChatRoom, error) {
+	chatRoom, err := chatRepository.GetRoomByID(ctx, chatRoomID)
+	if err != nil {
+		return tables.ChatRoom{}, err
+	}
+
+	role := tables.MemberOwner
+	if chatRoom.UserID != userID {
+		role, err = chatRepository.GetMemberRole(ctx, chatRoomID, userID)
+		if err != nil {
+			return tables.ChatRoom{}, err
+		}
+
+		chatRoom.HideOrganizer()
+	}
+
+	if !access.ChatRoomAllows(role, action) {
+		return tables.ChatRoom{}, user_errors.ErrChatRoomAccessDenied
+	}
+	chatRoom.Role = role
+
+	return chatRoom, nil
+}
+
+// parseMessagePage reads the before cursor and limit of a page of messages
+func parseMessagePage(w http.ResponseWriter, r *http.Request) (cursor.Cursor, int, bool) {
+	before, err := cursor.Decode(r.URL.Query().Get("before"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return cursor.Cursor{}, 0, false
+	}
+
+	return before, parseLimit(r), true
+}
+
+// messagePage returns up to limit of the room's messages before the cursor, oldest first, and
+// the cursor for the page before them, empty when there is none
+func messagePage(ctx context.Context, chatRepository db.ChatRepository, chatRoomID uint, before cursor.Cursor, limit int) ([]tables.ChatMessage, string, error) {
+	// one extra row tells whether there are older messages
+	messages, err := chatRepository.GetChatMessages(ctx, chatRoomID, before, limit+1)
+	if err != nil {
+		return nil, "", err
+	}
+
+	var nextCursor string
+	if len(messages) > limit {
+		messages = messages[:limit]
+		nextCursor = cursor.Cursor{ID: messages[limit-1].ID}.Encode()
+	}
+
+	slices.Reverse(messages)
+
+	return messages, nextCursor, nil
+}
+
+// signAttachmentURLs fills in short-lived, user-bound file server URLs for every attachment
+func signAttachmentURLs(fileSigner service.FileSigner, userID uint, messages []tables.ChatMessage) {
+	for i := range messages {
+		for j := range messages[i].Attachments {
+			attachment := &messages[i].Attachments[j]
+			attachment.URL = fileSigner.SignFileURL(attachment.FilePath, userID)
+			if attachment.ThumbnailPath != "" {
+				attachment.ThumbnailURL = fileSigner.SignFileURL(attachment.ThumbnailPath, userID)
+			}
+		}
+	}
+}
+
+// DeleteChatRoom moves the room to its owner's trash
+func (h *ChatHandlerImpl) DeleteChatRoom(w http.ResponseWriter, r *http.Request) {
+	chatRoom, ok := h.authorizedChatRoom(w, r, access.ChatActionManage)
+	if !ok {
 		return
 	}
 
-	chatRoomID, err := strconv.ParseUint(chatRoomIDStr, 10, 64)
+	err := h.chatRepository.DeleteRoomByID(r.Context(), chatRoom.ID, chatRoom.UserID)
 	if err != nil {
-		http.Error(w, "invalid chatID", http.StatusBadRequest)
+		http.Error(w, err.Error(), httpStatusForError(err))
 		return
 	}
 
+	// nobody may watch a room in the trash
+	h.eventHub.DisconnectRoom(chatRoom.ID)
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// GetDeletedChatRooms lists the rooms in the user's trash
+func (h *ChatHandlerImpl) GetDeletedChatRooms(w http.ResponseWriter, r *http.Request) {
 	userID := r.Context().Value(ctxkey.UserIDKey).(uint)
-	err = h.chatRepository.DeleteRoomByID(r.Context(), uint(chatRoomID), userID)
 
+	chatRooms, err := h.chatRepository.GetDeletedChatRoomsForUser(r.Context(), userID)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	w.WriteHeader(http.StatusOK)
+	writeJSON(w, http.StatusOK, chatRooms)
+}
+
+// RestoreChatRoom takes a room out of the trash
+func (h *ChatHandlerImpl) RestoreChatRoom(w http.ResponseWriter, r *http.Request) {
+	chatRoomID, ok := pathID(w, r, 2)
+	if !ok {
+		return
+	}
+
+	userID := r.Context().Value(ctxkey.UserIDKey).(uint)
+
+	chatRoom, err := h.chatRepository.RestoreRoom(r.Context(), chatRoomID, userID)
+	if err != nil {
+		http.Error(w, err.Error(), httpStatusForError(err))
+		return
+	}
+
+	writeJSON(w, http.StatusOK, chatRoom)
 }
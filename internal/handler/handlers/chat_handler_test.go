@@ -0,0 +1,110 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/yuhangang/chat-app-backend/internal/access"
+	"github.com/yuhangang/chat-app-backend/internal/db/repository"
+	"github.com/yuhangang/chat-app-backend/internal/db/tables"
+	"github.com/yuhangang/chat-app-backend/internal/service/services/event_service"
+	"github.com/yuhangang/chat-app-backend/pkg/ctxkey"
+
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+func TestAuthorizeChatRoomHidesOrganizerFromMembers(t *testing.T) {
+	conn, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{TranslateError: true, Logger: logger.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = conn.AutoMigrate(&tables.ChatRoom{}, &tables.ChatRoomMember{}, &tables.ChatTag{}, &tables.ChatRoomTag{}, &tables.ChatFolder{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const owner, viewer uint = 1, 2
+	folder := tables.ChatFolder{UserID: owner, Name: "Work"}
+	if err := conn.Create(&folder).Error; err != nil {
+		t.Fatal(err)
+	}
+	chatRoom := tables.ChatRoom{
+		Name: "Quarterly planning", SessionID: "session", UserID: owner,
+		FolderID: &folder.ID, Pinned: true, Archived: true,
+		Tags: []tables.ChatTag{{UserID: owner, Name: "finance", Color: "#00aa00"}},
+	}
+	if err := conn.Create(&chatRoom).Error; err != nil {
+		t.Fatal(err)
+	}
+	member := tables.ChatRoomMember{ChatRoomID: chatRoom.ID, UserID: viewer, Role: tables.MemberViewer, InvitedBy: owner}
+	if err := conn.Create(&member).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	chatRepo := repository.NewChatRoomRepo(conn)
+
+	got, err := authorizeChatRoom(ctx, chatRepo, owner, chatRoom.ID, access.ChatActionRead)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.FolderID == nil || !got.Pinned || !got.Archived || len(got.Tags) != 1 {
+		t.Errorf("owner sees folder %v, pinned %v, archived %v, %d tags, want their own organizer", got.FolderID, got.Pinned, got.Archived, len(got.Tags))
+	}
+
+	got, err = authorizeChatRoom(ctx, chatRepo, viewer, chatRoom.ID, access.ChatActionRead)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.FolderID != nil || got.Pinned || got.Archived || len(got.Tags) != 0 {
+		t.Errorf("member sees folder %v, pinned %v, archived %v, %d tags, want none of the owner's", got.FolderID, got.Pinned, got.Archived, len(got.Tags))
+	}
+	if got.Role != tables.MemberViewer {
+		t.Errorf("member role = %q, want %q", got.Role, tables.MemberViewer)
+	}
+}
+
+func TestDeleteChatRoomDisconnectsWatchers(t *testing.T) {
+	conn, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{TranslateError: true, Logger: logger.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = conn.AutoMigrate(&tables.ChatRoom{}, &tables.ChatMessage{}, &tables.ChatAttachment{}, &tables.ChatRoomMember{}, &tables.ChatTag{}, &tables.ChatRoomTag{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const owner, viewer uint = 1, 2
+	chatRoom := tables.ChatRoom{Name: "Quarterly planning", SessionID: "session", UserID: owner}
+	if err := conn.Create(&chatRoom).Error; err != nil {
+		t.Fatal(err)
+	}
+	member := tables.ChatRoomMember{ChatRoomID: chatRoom.ID, UserID: viewer, Role: tables.MemberViewer, InvitedBy: owner}
+	if err := conn.Create(&member).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	eventHub := event_service.NewEventHubV1()
+	events, unsubscribe := eventHub.Subscribe(chatRoom.ID, viewer)
+	defer unsubscribe()
+
+	h := NewChatHandler(repository.NewChatRoomRepo(conn), nil, eventHub)
+
+	r := httptest.NewRequest(http.MethodDelete, fmt.Sprintf("/chats/%d", chatRoom.ID), nil)
+	r = r.WithContext(context.WithValue(r.Context(), ctxkey.UserIDKey, owner))
+	w := httptest.NewRecorder()
+	h.DeleteChatRoom(w, r)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", w.Code, http.StatusOK)
+	}
+
+	// the stream still holds the room's state from subscribing, it must end after that
+	for range events {
+	}
+}
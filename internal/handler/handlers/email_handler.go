@@ -0,0 +1,204 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/yuhangang/chat-app-backend/internal/db"
+	"github.com/yuhangang/chat-app-backend/internal/db/tables"
+	"github.com/yuhangang/chat-app-backend/internal/service"
+	"github.com/yuhangang/chat-app-backend/pkg/ctxkey"
+	"github.com/yuhangang/chat-app-backend/pkg/securetoken"
+	"github.com/yuhangang/chat-app-backend/types"
+	"github.com/yuhangang/chat-app-backend/user_errors"
+)
+
+const kemailVerificationLife = 24 * time.Hour
+const kmagicLinkLife = 15 * time.Minute
+
+// at most kmaxMagicLinks login links are mailed to an address per kmagicLinkWindow
+const kmaxMagicLinks = 3
+const kmagicLinkWindow = 15 * time.Minute
+
+type EmailHandlerImpl struct {
+	userRepository db.UserRepository
+	mfaRepository  db.MfaRepository
+	jwtService     types.JwtService
+	mailer         service.Mailer
+}
+
+func NewEmailHandler(userRepo db.UserRepository, mfaRepo db.MfaRepository, jwtService types.JwtService, mailer service.Mailer) *EmailHandlerImpl {
+	return &EmailHandlerImpl{
+		userRepository: userRepo,
+		mfaRepository:  mfaRepo,
+		jwtService:     jwtService,
+		mailer:         mailer,
+	}
+}
+
+// RequestEmailVerification mails the signed in user a link to verify their email
+func (h *EmailHandlerImpl) RequestEmailVerification(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(ctxkey.UserIDKey).(uint)
+
+	user, err := h.userRepository.GetUser(r.Context(), userID)
+	if err != nil {
+		http.Error(w, err.Error(), httpStatusForError(err))
+		return
+	}
+
+	if user.Email == nil {
+		http.Error(w, "account has no email", http.StatusBadRequest)
+		return
+	}
+	if user.EmailVerifiedAt != nil {
+		http.Error(w, "email is already verified", http.StatusConflict)
+		return
+	}
+
+	if err := sendVerificationEmail(r.Context(), h.userRepository, h.mailer, user); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// VerifyEmail marks the email verified with the token from the verification link. It works
+// signed out, since the link may be opened on another device.
+func (h *EmailHandlerImpl) VerifyEmail(w http.ResponseWriter, r *http.Request) {
+	token := r.FormValue("token")
+	if token == "" {
+		http.Error(w, "missing token", http.StatusBadRequest)
+		return
+	}
+
+	user, err := h.userRepository.ConsumeEmailToken(r.Context(), securetoken.Hash(token), tables.EmailTokenVerify)
+	if err != nil {
+		http.Error(w, err.Error(), httpStatusForError(err))
+		return
+	}
+
+	writeJSON(w, http.StatusOK, user)
+}
+
+// RequestMagicLink mails a one-time login link to the account with the given verified email,
+// replacing any earlier link. The response is the same whether or not the account exists, and
+// whether or not the address has had too many links lately.
+func (h *EmailHandlerImpl) RequestMagicLink(w http.ResponseWriter, r *http.Request) {
+	email := r.FormValue("email")
+	if email == "" {
+		http.Error(w, "missing email", http.StatusBadRequest)
+		return
+	}
+
+	user, err := h.userRepository.GetUserByEmail(r.Context(), email)
+	if err != nil && !errors.Is(err, user_errors.ErrUserNotFound) {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// unverified emails could belong to someone else, disabled users can't sign in anyway
+	if err == nil && user.EmailVerifiedAt != nil && user.DisabledAt == nil {
+		sent, err := h.userRepository.CountEmailTokens(r.Context(), *user.Email, tables.EmailTokenMagicLink, time.Now().Add(-kmagicLinkWindow))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if sent >= kmaxMagicLinks {
+			w.WriteHeader(http.StatusAccepted)
+			return
+		}
+
+		token, err := createEmailToken(r.Context(), h.userRepository, user, tables.EmailTokenMagicLink, kmagicLinkLife)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		deliverMail(h.mailer, service.MailMessage{
+			To:      *user.Email,
+			Subject: "Your login link",
+			Body: fmt.Sprintf("Open this link to log in as %s:\n\n%s/magic-link?token=%s\n\n"+
+				"The link expires in 15 minutes and works once. If you didn't ask for it, you can ignore this email.\n",
+				user.Username, appURL(), token),
+		})
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// MagicLinkLogin exchanges the token from a login link for tokens, or an MFA challenge when the
+// user has two-factor authentication
+func (h *EmailHandlerImpl) MagicLinkLogin(w http.ResponseWriter, r *http.Request) {
+	token := r.FormValue("token")
+	if token == "" {
+		http.Error(w, "missing token", http.StatusBadRequest)
+		return
+	}
+
+	user, err := h.userRepository.ConsumeEmailToken(r.Context(), securetoken.Hash(token), tables.EmailTokenMagicLink)
+	if err != nil {
+		http.Error(w, err.Error(), httpStatusForError(err))
+		return
+	}
+
+	response, err := newLoginResponse(r.Context(), h.jwtService, h.mfaRepository, user, clientInfo(r))
+	if err != nil {
+		http.Error(w, err.Error(), httpStatusForError(err))
+		return
+	}
+
+	writeJSON(w, http.StatusOK, response)
+}
+
+// sendVerificationEmail mails a verification link to the user's current email
+func sendVerificationEmail(ctx context.Context, userRepository db.UserRepository, mailer service.Mailer, user tables.User) error {
+	token, err := createEmailToken(ctx, userRepository, user, tables.EmailTokenVerify, kemailVerificationLife)
+	if err != nil {
+		return err
+	}
+
+	deliverMail(mailer, service.MailMessage{
+		To:      *user.Email,
+		Subject: "Verify your email address",
+		Body: fmt.Sprintf("Confirm this email address for %s by opening this link:\n\n%s/verify-email?token=%s\n\n"+
+			"The link expires in 24 hours. If you didn't create an account, you can ignore this email.\n",
+			user.Username, appURL(), token),
+	})
+
+	return nil
+}
+
+// createEmailToken stores a new token for the user's current email and returns it
+func createEmailToken(ctx context.Context, userRepository db.UserRepository, user tables.User, purpose string, life time.Duration) (string, error) {
+	token, tokenHash, err := securetoken.Generate(32)
+	if err != nil {
+		return "", err
+	}
+
+	err = userRepository.CreateEmailToken(ctx, tables.EmailToken{
+		UserID:    user.ID,
+		Purpose:   purpose,
+		Email:     *user.Email,
+		TokenHash: tokenHash,
+		ExpiresAt: time.Now().Add(life),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return token, nil
+}
+
+// deliverMail sends in the background, so response times don't reveal whether a mail went out
+func deliverMail(mailer service.Mailer, message service.MailMessage) {
+	go func() {
+		if err := mailer.Send(context.Background(), message); err != nil {
+			log.Printf("Failed to send mail %q: %v", message.Subject, err)
+		}
+	}()
+}
@@ -0,0 +1,167 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/yuhangang/chat-app-backend/internal/db/repository"
+	"github.com/yuhangang/chat-app-backend/internal/db/tables"
+	"github.com/yuhangang/chat-app-backend/internal/service/services/mail_service"
+	"github.com/yuhangang/chat-app-backend/types"
+
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+var magicLinkToken = regexp.MustCompile(`magic-link\?token=([A-Za-z0-9_-]+)`)
+
+// mailLog collects what the console mailer logs, mails are sent in the background
+type mailLog struct {
+	mu     sync.Mutex
+	buffer bytes.Buffer
+}
+
+func (l *mailLog) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.buffer.Write(p)
+}
+
+// tokens waits until want login links were mailed and returns them in the order they were logged
+func (l *mailLog) tokens(t *testing.T, want int) []string {
+	t.Helper()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		l.mu.Lock()
+		matches := magicLinkToken.FindAllStringSubmatch(l.buffer.String(), -1)
+		l.mu.Unlock()
+
+		if len(matches) >= want || time.Now().After(deadline) {
+			// give mails that should not have been sent a moment to show up
+			time.Sleep(50 * time.Millisecond)
+
+			l.mu.Lock()
+			matches = magicLinkToken.FindAllStringSubmatch(l.buffer.String(), -1)
+			l.mu.Unlock()
+
+			tokens := make([]string, 0, len(matches))
+			for _, match := range matches {
+				tokens = append(tokens, match[1])
+			}
+			if len(tokens) != want {
+				t.Fatalf("%d login links were mailed, want %d", len(tokens), want)
+			}
+
+			return tokens
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// fakeJwtService hands out fixed tokens, the rest of the interface is not used here
+type fakeJwtService struct {
+	types.JwtService
+}
+
+func (s *fakeJwtService) GenerateTokens(ctx context.Context, userID uint, client types.ClientInfo) (types.JwtPayload, error) {
+	return types.JwtPayload{AccessToken: "access", RefreshToken: "refresh"}, nil
+}
+
+func newTestEmailHandler(t *testing.T) (*EmailHandlerImpl, *mailLog) {
+	t.Helper()
+
+	conn, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{TranslateError: true, Logger: logger.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.AutoMigrate(&tables.User{}, &tables.EmailToken{}, &tables.TotpCredential{}); err != nil {
+		t.Fatal(err)
+	}
+
+	userRepo := repository.NewUserRepo(conn)
+	email := "ada@example.com"
+	now := time.Now()
+	_, err = userRepo.CreateUser(context.Background(), tables.User{Username: "ada", Email: &email, EmailVerifiedAt: &now})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mails := &mailLog{}
+	log.SetOutput(mails)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	h := NewEmailHandler(userRepo, repository.NewMfaRepo(conn), &fakeJwtService{}, mail_service.NewConsoleMailerV1("no-reply@example.com"))
+
+	return h, mails
+}
+
+func postForm(handler http.HandlerFunc, path string, form url.Values) int {
+	r := httptest.NewRequest(http.MethodPost, path, strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	w := httptest.NewRecorder()
+	handler(w, r)
+
+	return w.Code
+}
+
+func TestMagicLinkReplacesEarlierLinks(t *testing.T) {
+	h, mails := newTestEmailHandler(t)
+
+	request := func() {
+		if status := postForm(h.RequestMagicLink, "/auth/magic-link", url.Values{"email": {"ada@example.com"}}); status != http.StatusAccepted {
+			t.Fatalf("RequestMagicLink status = %d, want %d", status, http.StatusAccepted)
+		}
+	}
+
+	// one at a time, so the log order is the order the links were issued in
+	request()
+	mails.tokens(t, 1)
+	request()
+	tokens := mails.tokens(t, 2)
+
+	if status := postForm(h.MagicLinkLogin, "/auth/magic-link/verify", url.Values{"token": {tokens[0]}}); status != http.StatusBadRequest {
+		t.Errorf("first link status = %d, want %d", status, http.StatusBadRequest)
+	}
+	if status := postForm(h.MagicLinkLogin, "/auth/magic-link/verify", url.Values{"token": {tokens[1]}}); status != http.StatusOK {
+		t.Errorf("latest link status = %d, want %d", status, http.StatusOK)
+	}
+	if status := postForm(h.MagicLinkLogin, "/auth/magic-link/verify", url.Values{"token": {tokens[1]}}); status != http.StatusBadRequest {
+		t.Errorf("reused link status = %d, want %d", status, http.StatusBadRequest)
+	}
+}
+
+func TestMagicLinkThrottledPerAddress(t *testing.T) {
+	h, mails := newTestEmailHandler(t)
+
+	for i := 0; i < kmaxMagicLinks+2; i++ {
+		if status := postForm(h.RequestMagicLink, "/auth/magic-link", url.Values{"email": {"ada@example.com"}}); status != http.StatusAccepted {
+			t.Fatalf("request %d: status = %d, want %d", i+1, status, http.StatusAccepted)
+		}
+	}
+
+	mails.tokens(t, kmaxMagicLinks)
+}
+
+func TestMagicLinkUnknownAddress(t *testing.T) {
+	h, mails := newTestEmailHandler(t)
+
+	if status := postForm(h.RequestMagicLink, "/auth/magic-link", url.Values{"email": {"nobody@example.com"}}); status != http.StatusAccepted {
+		t.Fatalf("status = %d, want %d", status, http.StatusAccepted)
+	}
+
+	mails.tokens(t, 0)
+}
@@ -0,0 +1,204 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/yuhangang/chat-app-backend/internal/access"
+	"github.com/yuhangang/chat-app-backend/internal/db"
+	"github.com/yuhangang/chat-app-backend/internal/handler"
+	"github.com/yuhangang/chat-app-backend/internal/service"
+	"github.com/yuhangang/chat-app-backend/pkg/ctxkey"
+	"github.com/yuhangang/chat-app-backend/pkg/securetoken"
+)
+
+// kheartbeatInterval keeps idle event streams from being closed by proxies, and is how often a
+// stream checks that its user may still watch the room
+const kheartbeatInterval = 25 * time.Second
+
+// EventHandlerImpl serves the live side of chat rooms: who is viewing and typing, when the
+// assistant is replying, new messages and how far each member has read
+type EventHandlerImpl struct {
+	chatRepository    db.ChatRepository
+	sessionRepository db.SessionRepository
+	apiKeyRepository  db.ApiKeyRepository
+	eventHub          service.EventHub
+	heartbeatInterval time.Duration
+}
+
+func NewEventHandler(chatRepo db.ChatRepository, sessionRepo db.SessionRepository, apiKeyRepo db.ApiKeyRepository, eventHub service.EventHub) *EventHandlerImpl {
+	return &EventHandlerImpl{
+		chatRepository:    chatRepo,
+		sessionRepository: sessionRepo,
+		apiKeyRepository:  apiKeyRepo,
+		eventHub:          eventHub,
+		heartbeatInterval: kheartbeatInterval,
+	}
+}
+
+// StreamEvents streams the room's events as server sent events, starting with who is viewing,
+// typing and waiting on the assistant. The user counts as viewing the room while connected. The
+// stream ends when the client falls behind, it should reconnect. It also ends at the next
+// heartbeat once the user may no longer watch the room: the session was revoked or logged out,
+// the API key revoked, the account disabled or merged, or the user removed from the room.
+func (h *EventHandlerImpl) StreamEvents(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(ctxkey.UserIDKey).(uint)
+	sessionID := r.Context().Value(ctxkey.SessionIDKey).(string)
+
+	chatRoomID, ok := pathID(w, r, 2)
+	if !ok {
+		return
+	}
+
+	if _, err := authorizeChatRoom(r.Context(), h.chatRepository, userID, chatRoomID, access.ChatActionRead); err != nil {
+		http.Error(w, err.Error(), httpStatusForError(err))
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+
+	events, unsubscribe := h.eventHub.Subscribe(chatRoomID, userID)
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(h.heartbeatInterval)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-heartbeat.C:
+			if err := h.authorizeStream(r.Context(), r.Header.Get("X-Api-Key"), sessionID, userID, chatRoomID); err != nil {
+				return
+			}
+			if _, err := fmt.Fprint(w, ": heartbeat\n\n"); err != nil {
+				return
+			}
+		case event, open := <-events:
+			if !open {
+				return
+			}
+			data, err := json.Marshal(event)
+			if err != nil {
+				return
+			}
+			if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, data); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
+
+// authorizeStream checks again what the auth middleware and StreamEvents checked when the stream
+// opened. Streams opened with an API key have no session, the key is checked instead.
+func (h *EventHandlerImpl) authorizeStream(ctx context.Context, apiKey string, sessionID string, userID uint, chatRoomID uint) error {
+	if sessionID == "" {
+		if _, err := h.apiKeyRepository.AuthenticateApiKey(ctx, securetoken.Hash(apiKey)); err != nil {
+			return err
+		}
+	} else {
+		active, err := h.sessionRepository.IsSessionActive(ctx, sessionID)
+		if err != nil {
+			return err
+		}
+		if !active {
+			return handler.ErrRevokedToken
+		}
+	}
+
+	_, err := authorizeChatRoom(ctx, h.chatRepository, userID, chatRoomID, access.ChatActionRead)
+
+	return err
+}
+
+// SetTyping marks the user typing in the room, or stopped with typing=false. Clients renew it
+// every few seconds while the user types, it stops by itself otherwise.
+func (h *EventHandlerImpl) SetTyping(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(ctxkey.UserIDKey).(uint)
+
+	chatRoomID, ok := pathID(w, r, 2)
+	if !ok {
+		return
+	}
+
+	typing := true
+	if value := r.FormValue("typing"); value != "" {
+		parsed, err := strconv.ParseBool(value)
+		if err != nil {
+			http.Error(w, "typing must be a boolean", http.StatusBadRequest)
+			return
+		}
+		typing = parsed
+	}
+
+	if _, err := authorizeChatRoom(r.Context(), h.chatRepository, userID, chatRoomID, access.ChatActionWrite); err != nil {
+		http.Error(w, err.Error(), httpStatusForError(err))
+		return
+	}
+
+	h.eventHub.SetTyping(chatRoomID, userID, typing)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// MarkRead records that the user has read the room up to message_id, or all of it when left
+// out, and tells the others in the room
+func (h *EventHandlerImpl) MarkRead(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(ctxkey.UserIDKey).(uint)
+
+	chatRoomID, ok := pathID(w, r, 2)
+	if !ok {
+		return
+	}
+
+	if err := r.ParseMultipartForm(kmaxFormMemory); err != nil && !errors.Is(err, http.ErrNotMultipart) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	messageID, ok := parseOptionalID(w, r.FormValue("message_id"), "message_id")
+	if !ok {
+		return
+	}
+
+	if _, err := authorizeChatRoom(r.Context(), h.chatRepository, userID, chatRoomID, access.ChatActionRead); err != nil {
+		http.Error(w, err.Error(), httpStatusForError(err))
+		return
+	}
+
+	var upTo uint
+	if messageID != nil {
+		upTo = *messageID
+	}
+
+	lastRead, err := h.chatRepository.MarkRoomRead(r.Context(), chatRoomID, userID, upTo)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	h.eventHub.Publish(service.RoomEvent{
+		Type:       service.RoomEventRead,
+		ChatRoomID: chatRoomID,
+		UserID:     userID,
+		MessageID:  lastRead,
+	})
+
+	writeJSON(w, http.StatusOK, map[string]uint{"last_read_message_id": lastRead})
+}
@@ -0,0 +1,125 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/yuhangang/chat-app-backend/internal/db/repository"
+	"github.com/yuhangang/chat-app-backend/internal/db/tables"
+	"github.com/yuhangang/chat-app-backend/internal/handler"
+	"github.com/yuhangang/chat-app-backend/internal/service/services/event_service"
+	"github.com/yuhangang/chat-app-backend/pkg/ctxkey"
+	"github.com/yuhangang/chat-app-backend/pkg/securetoken"
+
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+func TestStreamEventsEndsOnceAccessIsLost(t *testing.T) {
+	const apiKey = "cak_streaming"
+
+	cases := map[string]struct {
+		sessionID string
+		revoke    func(t *testing.T, conn *gorm.DB, chatRoom tables.ChatRoom, member tables.User)
+	}{
+		"session revoked": {
+			sessionID: "member-session",
+			revoke: func(t *testing.T, conn *gorm.DB, chatRoom tables.ChatRoom, member tables.User) {
+				if err := repository.NewSessionRepo(conn).RevokeSession(context.Background(), "member-session", member.ID); err != nil {
+					t.Fatal(err)
+				}
+			},
+		},
+		"api key revoked": {
+			revoke: func(t *testing.T, conn *gorm.DB, chatRoom tables.ChatRoom, member tables.User) {
+				if err := conn.Model(&tables.ApiKey{}).Where("user_id = ?", member.ID).Update("revoked_at", time.Now()).Error; err != nil {
+					t.Fatal(err)
+				}
+			},
+		},
+		"removed from the room": {
+			sessionID: "member-session",
+			revoke: func(t *testing.T, conn *gorm.DB, chatRoom tables.ChatRoom, member tables.User) {
+				if err := repository.NewMemberRepo(conn).RemoveMember(context.Background(), chatRoom.ID, member.ID); err != nil {
+					t.Fatal(err)
+				}
+			},
+		},
+	}
+
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			conn, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{TranslateError: true, Logger: logger.Discard})
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = conn.AutoMigrate(&tables.User{}, &tables.Session{}, &tables.ApiKey{}, &tables.ChatRoom{}, &tables.ChatRoomMember{},
+				&tables.ChatRoomRead{}, &tables.ChatTag{}, &tables.ChatRoomTag{})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			owner := tables.User{Username: "ada"}
+			member := tables.User{Username: "grace"}
+			if err := conn.Create(&owner).Error; err != nil {
+				t.Fatal(err)
+			}
+			if err := conn.Create(&member).Error; err != nil {
+				t.Fatal(err)
+			}
+			chatRoom := tables.ChatRoom{Name: "Quarterly planning", SessionID: "session", UserID: owner.ID}
+			if err := conn.Create(&chatRoom).Error; err != nil {
+				t.Fatal(err)
+			}
+			rows := []any{
+				&tables.ChatRoomMember{ChatRoomID: chatRoom.ID, UserID: member.ID, Role: tables.MemberViewer, InvitedBy: owner.ID},
+				&tables.Session{ID: "member-session", UserID: member.ID, LastSeenAt: time.Now(), ExpiresAt: time.Now().Add(time.Hour)},
+				&tables.ApiKey{UserID: member.ID, Name: "bot", Prefix: "cak_", KeyHash: securetoken.Hash(apiKey), Scopes: handler.ScopeChatsRead},
+			}
+			for _, row := range rows {
+				if err := conn.Create(row).Error; err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			h := NewEventHandler(repository.NewChatRoomRepo(conn), repository.NewSessionRepo(conn), repository.NewApiKeyRepo(conn),
+				event_service.NewEventHubV1())
+			h.heartbeatInterval = 10 * time.Millisecond
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			ctx = context.WithValue(ctx, ctxkey.UserIDKey, member.ID)
+			ctx = context.WithValue(ctx, ctxkey.SessionIDKey, c.sessionID)
+			r := httptest.NewRequest(http.MethodGet, fmt.Sprintf("/chats/%d/events", chatRoom.ID), nil).WithContext(ctx)
+			if c.sessionID == "" {
+				r.Header.Set("X-Api-Key", apiKey)
+			}
+			w := httptest.NewRecorder()
+
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				h.StreamEvents(w, r)
+			}()
+
+			select {
+			case <-done:
+				t.Fatalf("stream ended while the member still had access: %d %s", w.Code, w.Body)
+			case <-time.After(50 * time.Millisecond):
+			}
+
+			c.revoke(t, conn, chatRoom, member)
+
+			select {
+			case <-done:
+			case <-time.After(time.Second):
+				t.Fatal("stream kept running after access was lost")
+			}
+		})
+	}
+}
@@ -0,0 +1,108 @@
+package handlers
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/yuhangang/chat-app-backend/internal/db"
+	"github.com/yuhangang/chat-app-backend/internal/db/tables"
+	"github.com/yuhangang/chat-app-backend/internal/service"
+	"github.com/yuhangang/chat-app-backend/pkg/ctxkey"
+)
+
+const kexportLife = 7 * 24 * time.Hour
+const kexportLinkLife = 1 * time.Hour
+
+type ExportHandlerImpl struct {
+	exportRepository db.ExportRepository
+	dataExporter     service.DataExporter
+	fileSigner       service.FileSigner
+}
+
+func NewExportHandler(exportRepo db.ExportRepository, dataExporter service.DataExporter, fileSigner service.FileSigner) *ExportHandlerImpl {
+	return &ExportHandlerImpl{
+		exportRepository: exportRepo,
+		dataExporter:     dataExporter,
+		fileSigner:       fileSigner,
+	}
+}
+
+// RequestExport starts building a ZIP of everything the user stored. The response is the
+// pending export, poll GetExport until it is ready to download. While one export is pending,
+// asking again returns that one.
+func (h *ExportHandlerImpl) RequestExport(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(ctxkey.UserIDKey).(uint)
+
+	export, created, err := h.exportRepository.CreateExport(r.Context(), tables.DataExport{
+		ID:        uuid.New().String(),
+		UserID:    userID,
+		ExpiresAt: time.Now().Add(kexportLife),
+	})
+	if err != nil {
+		http.Error(w, err.Error(), httpStatusForError(err))
+		return
+	}
+
+	if created {
+		h.dataExporter.Start(export.ID, userID)
+	}
+
+	writeJSON(w, http.StatusAccepted, export)
+}
+
+func (h *ExportHandlerImpl) GetExports(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(ctxkey.UserIDKey).(uint)
+
+	exports, err := h.exportRepository.GetExports(r.Context(), userID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	for i := range exports {
+		h.signDownloadURL(&exports[i])
+	}
+
+	writeJSON(w, http.StatusOK, exports)
+}
+
+// GetExport returns the export's status, with a short-lived download link once it is ready
+func (h *ExportHandlerImpl) GetExport(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(ctxkey.UserIDKey).(uint)
+
+	// get export ID from URL path, /user/export/{id}
+	parts := strings.Split(r.URL.Path, "/")
+	if len(parts) < 4 || parts[3] == "" {
+		http.Error(w, "missing export id", http.StatusBadRequest)
+		return
+	}
+
+	export, err := h.exportRepository.GetExport(r.Context(), parts[3], userID)
+	if err != nil {
+		http.Error(w, err.Error(), httpStatusForError(err))
+		return
+	}
+
+	h.signDownloadURL(&export)
+
+	writeJSON(w, http.StatusOK, export)
+}
+
+func (h *ExportHandlerImpl) signDownloadURL(export *tables.DataExport) {
+	if export.Status != tables.ExportReady || export.FileKey == "" {
+		return
+	}
+
+	// the link must not outlive the export itself
+	life := time.Until(export.ExpiresAt)
+	if life > kexportLinkLife {
+		life = kexportLinkLife
+	}
+	if life <= 0 {
+		return
+	}
+
+	export.DownloadURL = h.fileSigner.SignFileURLWithTTL(export.FileKey, export.UserID, life)
+}
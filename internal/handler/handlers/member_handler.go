@@ -0,0 +1,177 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/yuhangang/chat-app-backend/internal/access"
+	"github.com/yuhangang/chat-app-backend/internal/db"
+	"github.com/yuhangang/chat-app-backend/internal/db/tables"
+	"github.com/yuhangang/chat-app-backend/internal/service"
+	"github.com/yuhangang/chat-app-backend/pkg/ctxkey"
+)
+
+// MemberHandlerImpl manages who besides the owner can open a chat room and what they can do in
+// it. Roles are checked by authorizeChatRoom.
+type MemberHandlerImpl struct {
+	chatRepository   db.ChatRepository
+	memberRepository db.MemberRepository
+	eventHub         service.EventHub
+}
+
+func NewMemberHandler(chatRepo db.ChatRepository, memberRepo db.MemberRepository, eventHub service.EventHub) *MemberHandlerImpl {
+	return &MemberHandlerImpl{
+		chatRepository:   chatRepo,
+		memberRepository: memberRepo,
+		eventHub:         eventHub,
+	}
+}
+
+// GetMembers lists the room's owner and members with how far each has read, anyone in the room
+// can see them
+func (h *MemberHandlerImpl) GetMembers(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(ctxkey.UserIDKey).(uint)
+
+	chatRoomID, ok := pathID(w, r, 2)
+	if !ok {
+		return
+	}
+
+	if _, err := authorizeChatRoom(r.Context(), h.chatRepository, userID, chatRoomID, access.ChatActionRead); err != nil {
+		http.Error(w, err.Error(), httpStatusForError(err))
+		return
+	}
+
+	members, err := h.memberRepository.GetMembers(r.Context(), chatRoomID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, members)
+}
+
+// AddMember invites the user with username into the room as role, viewer if left out
+func (h *MemberHandlerImpl) AddMember(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(ctxkey.UserIDKey).(uint)
+
+	chatRoomID, ok := pathID(w, r, 2)
+	if !ok {
+		return
+	}
+
+	if err := r.ParseMultipartForm(kmaxFormMemory); err != nil && !errors.Is(err, http.ErrNotMultipart) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	username := strings.TrimSpace(r.FormValue("username"))
+	if username == "" {
+		http.Error(w, "username is required", http.StatusBadRequest)
+		return
+	}
+
+	role := r.FormValue("role")
+	if role == "" {
+		role = tables.MemberViewer
+	}
+	if !tables.IsValidMemberRole(role) {
+		http.Error(w, "role must be editor or viewer", http.StatusBadRequest)
+		return
+	}
+
+	chatRoom, err := authorizeChatRoom(r.Context(), h.chatRepository, userID, chatRoomID, access.ChatActionManage)
+	if err != nil {
+		http.Error(w, err.Error(), httpStatusForError(err))
+		return
+	}
+
+	member, err := h.memberRepository.AddMember(r.Context(), chatRoom.ID, username, role, userID)
+	if err != nil {
+		http.Error(w, err.Error(), httpStatusForError(err))
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, member)
+}
+
+// UpdateMember changes the member's role
+func (h *MemberHandlerImpl) UpdateMember(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(ctxkey.UserIDKey).(uint)
+
+	chatRoomID, ok := pathID(w, r, 2)
+	if !ok {
+		return
+	}
+	memberID, ok := pathID(w, r, 4)
+	if !ok {
+		return
+	}
+
+	if err := r.ParseMultipartForm(kmaxFormMemory); err != nil && !errors.Is(err, http.ErrNotMultipart) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	role := r.FormValue("role")
+	if !tables.IsValidMemberRole(role) {
+		http.Error(w, "role must be editor or viewer", http.StatusBadRequest)
+		return
+	}
+
+	chatRoom, err := authorizeChatRoom(r.Context(), h.chatRepository, userID, chatRoomID, access.ChatActionManage)
+	if err != nil {
+		http.Error(w, err.Error(), httpStatusForError(err))
+		return
+	}
+
+	member, err := h.memberRepository.UpdateMember(r.Context(), chatRoom.ID, memberID, role)
+	if err != nil {
+		http.Error(w, err.Error(), httpStatusForError(err))
+		return
+	}
+
+	// a member who may no longer write stops typing
+	if !access.ChatRoomAllows(role, access.ChatActionWrite) {
+		h.eventHub.SetTyping(chatRoom.ID, memberID, false)
+	}
+
+	writeJSON(w, http.StatusOK, member)
+}
+
+// RemoveMember takes the member out of the room. Members can remove themselves to leave a room
+// they were invited to.
+func (h *MemberHandlerImpl) RemoveMember(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(ctxkey.UserIDKey).(uint)
+
+	chatRoomID, ok := pathID(w, r, 2)
+	if !ok {
+		return
+	}
+	memberID, ok := pathID(w, r, 4)
+	if !ok {
+		return
+	}
+
+	action := access.ChatActionManage
+	if memberID == userID {
+		action = access.ChatActionRead
+	}
+
+	chatRoom, err := authorizeChatRoom(r.Context(), h.chatRepository, userID, chatRoomID, action)
+	if err != nil {
+		http.Error(w, err.Error(), httpStatusForError(err))
+		return
+	}
+
+	if err := h.memberRepository.RemoveMember(r.Context(), chatRoom.ID, memberID); err != nil {
+		http.Error(w, err.Error(), httpStatusForError(err))
+		return
+	}
+
+	// their open event streams go with their access
+	h.eventHub.Disconnect(chatRoom.ID, memberID)
+
+	w.WriteHeader(http.StatusNoContent)
+}
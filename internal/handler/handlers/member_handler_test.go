@@ -0,0 +1,78 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/yuhangang/chat-app-backend/internal/db/repository"
+	"github.com/yuhangang/chat-app-backend/internal/db/tables"
+	"github.com/yuhangang/chat-app-backend/internal/service"
+	"github.com/yuhangang/chat-app-backend/internal/service/services/event_service"
+	"github.com/yuhangang/chat-app-backend/pkg/ctxkey"
+
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+func TestUpdateMemberToViewerStopsTyping(t *testing.T) {
+	conn, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{TranslateError: true, Logger: logger.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = conn.AutoMigrate(&tables.User{}, &tables.ChatRoom{}, &tables.ChatRoomMember{}, &tables.ChatRoomRead{}, &tables.ChatTag{}, &tables.ChatRoomTag{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	owner := tables.User{Username: "ada"}
+	editor := tables.User{Username: "grace"}
+	if err := conn.Create(&owner).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.Create(&editor).Error; err != nil {
+		t.Fatal(err)
+	}
+	chatRoom := tables.ChatRoom{Name: "Quarterly planning", SessionID: "session", UserID: owner.ID}
+	if err := conn.Create(&chatRoom).Error; err != nil {
+		t.Fatal(err)
+	}
+	member := tables.ChatRoomMember{ChatRoomID: chatRoom.ID, UserID: editor.ID, Role: tables.MemberEditor, InvitedBy: owner.ID}
+	if err := conn.Create(&member).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	eventHub := event_service.NewEventHubV1()
+	eventHub.SetTyping(chatRoom.ID, editor.ID, true)
+	events, unsubscribe := eventHub.Subscribe(chatRoom.ID, owner.ID)
+	defer unsubscribe()
+
+	h := NewMemberHandler(repository.NewChatRoomRepo(conn), repository.NewMemberRepo(conn), eventHub)
+
+	form := url.Values{"role": {tables.MemberViewer}}
+	r := httptest.NewRequest(http.MethodPatch, fmt.Sprintf("/chats/%d/members/%d", chatRoom.ID, editor.ID), strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r = r.WithContext(context.WithValue(r.Context(), ctxkey.UserIDKey, owner.ID))
+	w := httptest.NewRecorder()
+	h.UpdateMember(w, r)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+	}
+
+	for {
+		select {
+		case event := <-events:
+			if event.Type == service.RoomEventTyping && event.UserID == editor.ID && !event.Active {
+				return
+			}
+		default:
+			t.Fatal("the demoted member is still typing")
+		}
+	}
+}
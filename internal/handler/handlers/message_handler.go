@@ -1,42 +1,92 @@
 package handlers
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"mime/multipart"
 	"net/http"
-	"strconv"
 	"strings"
 
+	"github.com/yuhangang/chat-app-backend/internal/access"
 	"github.com/yuhangang/chat-app-backend/internal/db"
+	"github.com/yuhangang/chat-app-backend/internal/service"
+	"github.com/yuhangang/chat-app-backend/internal/service/image_processing"
+	"github.com/yuhangang/chat-app-backend/internal/service/text_extraction"
+	"github.com/yuhangang/chat-app-backend/internal/service/upload_validation"
 	"github.com/yuhangang/chat-app-backend/pkg/ctxkey"
+	"github.com/yuhangang/chat-app-backend/types"
+	"github.com/yuhangang/chat-app-backend/user_errors"
 )
 
+// multipartOverhead leaves room for the prompt and multipart boundaries on top of the file itself
+const multipartOverhead = 1 << 20
+
 type MessageHandlerImpl struct {
-	messageRepository db.MessageRepository
-	chatRepository    db.ChatRepository
-	llmRepository     db.LLMRepository
+	messageRepository    db.MessageRepository
+	chatRepository       db.ChatRepository
+	llmRepository        db.LLMRepository
+	userRepository       db.UserRepository
+	chatConfigRepository db.ChatConfigRepository
+	uploadRepository     db.UploadRepository
+	storageService       service.StorageService
+	fileSigner           service.FileSigner
+	eventHub             service.EventHub
 }
 
 func NewMessageChatHandler(
 	chatRepository db.ChatRepository,
 	messageRepository db.MessageRepository,
 	llmRepository db.LLMRepository,
+	userRepository db.UserRepository,
+	chatConfigRepository db.ChatConfigRepository,
+	uploadRepository db.UploadRepository,
+	storageService service.StorageService,
+	fileSigner service.FileSigner,
+	eventHub service.EventHub,
 ) *MessageHandlerImpl {
 	return &MessageHandlerImpl{
-		chatRepository:    chatRepository,
-		messageRepository: messageRepository,
-		llmRepository:     llmRepository,
+		chatRepository:       chatRepository,
+		messageRepository:    messageRepository,
+		llmRepository:        llmRepository,
+		userRepository:       userRepository,
+		chatConfigRepository: chatConfigRepository,
+		uploadRepository:     uploadRepository,
+		storageService:       storageService,
+		fileSigner:           fileSigner,
+		eventHub:             eventHub,
 	}
 }
 
 func (h *MessageHandlerImpl) CreateChatRoomWithMessage(w http.ResponseWriter, r *http.Request) {
 	var err error
+	userId := r.Context().Value(ctxkey.UserIDKey).(uint)
+
+	maxSize, err := h.parseMessageForm(w, r, userId)
+	if err != nil {
+		http.Error(w, err.Error(), httpStatusForError(err))
+		return
+	}
+
+	options, err := h.newChatOptions(r, userId)
+	if err != nil {
+		http.Error(w, err.Error(), httpStatusForError(err))
+		return
+	}
+
+	attachment, err := h.parseAttachment(r, userId, maxSize, options.ModelKey)
+	if err != nil {
+		http.Error(w, err.Error(), httpStatusForError(err))
+		return
+	}
+
 	// read the request ['prompt'] from the request
 	prompt := r.FormValue("prompt")
-	_, fileHeader, _ := r.FormFile("attachment")
-
-	userId := r.Context().Value(ctxkey.UserIDKey).(uint)
 
-	geminiResponse, err := h.llmRepository.CallGemini(r.Context(), prompt, 0, fileHeader)
+	geminiResponse, err := h.llmRepository.CallGemini(r.Context(), prompt, 0, options, attachment)
 
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -52,12 +102,14 @@ func (h *MessageHandlerImpl) CreateChatRoomWithMessage(w http.ResponseWriter, r
 		chatRoomName = strings.Join(words[:10], " ")
 		chatRoomName = chatRoomName + "..."
 	}
-	chatRoom, err := h.messageRepository.CreateChatRoomWithMessage(r.Context(), userId, chatRoomName, prompt, geminiResponse, fileHeader)
+	chatRoom, err := h.messageRepository.CreateChatRoomWithMessage(r.Context(), userId, chatRoomName, prompt, geminiResponse, options, attachment)
 
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 	}
 
+	signAttachmentURLs(h.fileSigner, userId, chatRoom.ChatMessages)
+
 	w.Header().Set("Content-Type", "application/json")
 
 	w.WriteHeader(http.StatusCreated)
@@ -69,50 +121,70 @@ func (h *MessageHandlerImpl) CreateChatRoomWithMessage(w http.ResponseWriter, r
 	w.Write(response)
 }
 
+// CreateMessage sends a message to the assistant in a room the user may write in
 func (h *MessageHandlerImpl) CreateMessage(w http.ResponseWriter, r *http.Request) {
-	prompt := r.FormValue("prompt")
+	chatRoomID, ok := pathID(w, r, 2)
+	if !ok {
+		return
+	}
 
-	// Get chat room ID from URL path
-	parts := strings.Split(r.URL.Path, "/")
-	if len(parts) < 3 {
-		http.Error(w, "chatID is required", http.StatusBadRequest)
+	userID := r.Context().Value(ctxkey.UserIDKey).(uint)
+
+	if _, err := authorizeChatRoom(r.Context(), h.chatRepository, userID, chatRoomID, access.ChatActionWrite); err != nil {
+		http.Error(w, err.Error(), httpStatusForError(err))
 		return
 	}
-	chatRoomIDStr := parts[2]
-	chatRoomID, err := strconv.ParseUint(chatRoomIDStr, 10, 64)
+
+	maxSize, err := h.parseMessageForm(w, r, userID)
 	if err != nil {
-		http.Error(w, "invalid chatID", http.StatusBadRequest)
+		http.Error(w, err.Error(), httpStatusForError(err))
 		return
 	}
 
-	// Check if chat room exists
-	exists, err := h.chatRepository.CheckChatRoomExists(r.Context(), uint(chatRoomID))
+	// the chat keeps the model and persona it was created with
+	options, err := h.chatRepository.GetChatOptions(r.Context(), chatRoomID)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		log.Printf("Failed to load options of chat %d, using the defaults: %v", chatRoomID, err)
+		options = types.ChatOptions{ModelKey: types.DefaultModelKey, Persona: types.DefaultPersona}
 	}
-	if !exists {
-		http.Error(w, "chat room does not exist", http.StatusBadRequest)
+
+	// Get the uploaded files (attachments)
+	attachment, err := h.parseAttachment(r, userID, maxSize, options.ModelKey)
+	if err != nil {
+		http.Error(w, err.Error(), httpStatusForError(err))
 		return
 	}
 
-	// Get the uploaded files (attachments)
-	_, fileHeader, _ := r.FormFile("attachment")
+	prompt := r.FormValue("prompt")
+
+	// the others in the room see the message is sent and the assistant replying
+	h.eventHub.SetTyping(chatRoomID, userID, false)
+	h.eventHub.SetThinking(chatRoomID, userID, true)
 
 	// Call Gemini for a response based on the prompt
-	geminiResponse, err := h.llmRepository.CallGemini(r.Context(), prompt, uint(chatRoomID), fileHeader)
+	geminiResponse, err := h.llmRepository.CallGemini(r.Context(), prompt, chatRoomID, options, attachment)
+	h.eventHub.SetThinking(chatRoomID, userID, false)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
 	// Create message and attachments in the repository
-	createdMessage, err := h.messageRepository.CreateMessage(r.Context(), uint(chatRoomID), prompt, geminiResponse.Response, fileHeader)
+	createdMessage, err := h.messageRepository.CreateMessage(r.Context(), chatRoomID, userID, prompt, geminiResponse.Response, attachment)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
+	h.eventHub.Publish(service.RoomEvent{
+		Type:       service.RoomEventMessage,
+		ChatRoomID: chatRoomID,
+		UserID:     userID,
+		MessageID:  createdMessage[len(createdMessage)-1].ID,
+	})
+
+	signAttachmentURLs(h.fileSigner, userID, createdMessage)
+
 	// Send response
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
@@ -123,3 +195,220 @@ func (h *MessageHandlerImpl) CreateMessage(w http.ResponseWriter, r *http.Reques
 	}
 	w.Write(response)
 }
+
+// parseMessageForm reads the multipart form under the user's upload size limit and returns the limit
+func (h *MessageHandlerImpl) parseMessageForm(w http.ResponseWriter, r *http.Request, userID uint) (int64, error) {
+	user, err := h.userRepository.GetUser(r.Context(), userID)
+	if err != nil {
+		return 0, err
+	}
+	maxSize := upload_validation.EffectiveMaxUploadSize(user.MaxUploadSize)
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxSize+multipartOverhead)
+	if err := r.ParseMultipartForm(32 << 20); err != nil && !errors.Is(err, http.ErrNotMultipart) {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			return 0, user_errors.ErrFileTooLarge
+		}
+		return 0, err
+	}
+
+	return maxSize, nil
+}
+
+// newChatOptions picks the model and persona for a new chat: the ones in the form, else the
+// user's profile defaults, else the global defaults. A profile default that is no longer
+// available falls back quietly, one asked for in the form is an error.
+func (h *MessageHandlerImpl) newChatOptions(r *http.Request, userID uint) (types.ChatOptions, error) {
+	profile, err := h.userRepository.GetProfile(r.Context(), userID)
+	if err != nil {
+		return types.ChatOptions{}, err
+	}
+
+	options := types.ChatOptions{ModelKey: types.DefaultModelKey, Persona: types.DefaultPersona}
+
+	if modelKey := r.FormValue("model"); modelKey != "" {
+		if err := checkChatModel(r.Context(), h.chatConfigRepository, modelKey); err != nil {
+			return types.ChatOptions{}, err
+		}
+		options.ModelKey = modelKey
+	} else if profile.DefaultModel != "" {
+		if err := checkChatModel(r.Context(), h.chatConfigRepository, profile.DefaultModel); err == nil {
+			options.ModelKey = profile.DefaultModel
+		}
+	}
+
+	if personaKey := r.FormValue("persona"); personaKey != "" {
+		persona, err := h.chatConfigRepository.GetPersonaByKey(r.Context(), personaKey)
+		if err != nil {
+			return types.ChatOptions{}, err
+		}
+		options.Persona, options.Instruction = persona.PersonaKey, persona.Instruction
+	} else if persona, err := h.chatConfigRepository.GetPersonaByKey(r.Context(), profile.DefaultPersona); err == nil {
+		options.Persona, options.Instruction = persona.PersonaKey, persona.Instruction
+	} else if persona, err := h.chatConfigRepository.GetPersonaByKey(r.Context(), types.DefaultPersona); err == nil {
+		options.Instruction = persona.Instruction
+	}
+
+	return options, nil
+}
+
+// parseAttachment validates the optional attachment of the parsed form, sent inline or
+// referenced by upload_id, against the chat model. The content type is sniffed, not taken from
+// the client, and images go through the processing pipeline before anything else sees them.
+func (h *MessageHandlerImpl) parseAttachment(r *http.Request, userID uint, maxSize int64, modelKey string) (*types.Attachment, error) {
+	uploadID := r.FormValue("upload_id")
+
+	var fileHeader *multipart.FileHeader
+	if uploadID == "" {
+		var err error
+		_, fileHeader, err = r.FormFile("attachment")
+		if errors.Is(err, http.ErrMissingFile) || errors.Is(err, http.ErrNotMultipart) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	model, err := h.chatConfigRepository.GetChatModelByKey(r.Context(), modelKey)
+	if err != nil {
+		return nil, err
+	}
+	capabilities := upload_validation.ParseCapabilities(model.Capabilities)
+
+	if uploadID != "" {
+		// the file was already sent through a resumable upload
+		return h.uploadAttachment(r, uploadID, userID, capabilities)
+	}
+
+	data, err := readFileHeader(fileHeader, maxSize)
+	if err != nil {
+		return nil, err
+	}
+
+	return newAttachment(fileHeader.Filename, data, capabilities)
+}
+
+// newAttachment checks the content type of an attachment held in memory and processes images
+func newAttachment(fileName string, data []byte, capabilities []string) (*types.Attachment, error) {
+	contentType, err := upload_validation.DetectContentType(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	if err := upload_validation.CheckContentType(contentType, capabilities); err != nil {
+		return nil, err
+	}
+
+	attachment := &types.Attachment{
+		FileName:    fileName,
+		ContentType: contentType,
+		Size:        int64(len(data)),
+		Data:        data,
+		Text:        text_extraction.Extract(contentType, data),
+	}
+
+	if image_processing.IsProcessable(contentType) {
+		processed, err := image_processing.Process(data, contentType, fileName,
+			image_processing.MaxDimension(), image_processing.ThumbnailDimension())
+		if err != nil {
+			return nil, imageProcessingError(err)
+		}
+
+		attachment.FileName = processed.FileName
+		attachment.ContentType = processed.ContentType
+		attachment.Size = int64(len(processed.Data))
+		attachment.Data = processed.Data
+		attachment.Thumbnail = processed.Thumbnail
+	}
+
+	return attachment, nil
+}
+
+// imageProcessingError reports an image that is too large as such and any other failure as an
+// image that could not be processed
+func imageProcessingError(err error) error {
+	if errors.Is(err, image_processing.ErrImageTooLarge) {
+		return user_errors.Wrap(err, user_errors.ErrCodeFileTooLarge, "image dimensions exceed the maximum")
+	}
+
+	return user_errors.Wrap(err, user_errors.ErrCodeUnsupportedMediaType, "image could not be processed")
+}
+
+func readFileHeader(fileHeader *multipart.FileHeader, maxSize int64) ([]byte, error) {
+	if err := upload_validation.CheckSize(fileHeader.Size, maxSize); err != nil {
+		return nil, err
+	}
+
+	file, err := fileHeader.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return io.ReadAll(file)
+}
+
+// uploadAttachment attaches a completed resumable upload owned by the user. The stored file is
+// referenced rather than read, only images are loaded to be processed.
+func (h *MessageHandlerImpl) uploadAttachment(r *http.Request, uploadID string, userID uint, capabilities []string) (*types.Attachment, error) {
+	upload, err := h.uploadRepository.GetUpload(r.Context(), uploadID, userID)
+	if err != nil {
+		return nil, err
+	}
+	if !upload.Completed {
+		return nil, user_errors.New(user_errors.ErrCodeUploadNotFound, "upload is not complete")
+	}
+
+	file, err := h.storageService.OpenFile(upload.FileKey)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	// the sniffed header is kept for the text extraction to read again
+	var header bytes.Buffer
+	contentType, err := upload_validation.DetectContentType(io.TeeReader(file, &header))
+	if err != nil {
+		return nil, err
+	}
+
+	if image_processing.IsProcessable(contentType) {
+		data, err := h.storageService.ReadFile(upload.FileKey)
+		if err != nil {
+			return nil, err
+		}
+
+		return newAttachment(upload.FileName, data, capabilities)
+	}
+
+	if err := upload_validation.CheckContentType(contentType, capabilities); err != nil {
+		return nil, err
+	}
+
+	text, err := text_extraction.ExtractFrom(contentType, io.MultiReader(&header, file))
+	if err != nil {
+		return nil, err
+	}
+
+	return &types.Attachment{
+		FileName:    upload.FileName,
+		ContentType: contentType,
+		Size:        upload.Length,
+		FileKey:     upload.FileKey,
+		Text:        text,
+	}, nil
+}
+
+// checkChatModel makes sure the model exists and can currently be picked for chats
+func checkChatModel(ctx context.Context, chatConfigRepository db.ChatConfigRepository, modelKey string) error {
+	model, err := chatConfigRepository.GetChatModelByKey(ctx, modelKey)
+	if err != nil {
+		return err
+	}
+	if !model.Available {
+		return user_errors.ErrModelUnavailable
+	}
+
+	return nil
+}
@@ -0,0 +1,425 @@
+package handlers
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base32"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/yuhangang/chat-app-backend/internal/db"
+	"github.com/yuhangang/chat-app-backend/internal/db/tables"
+	"github.com/yuhangang/chat-app-backend/pkg/ctxkey"
+	"github.com/yuhangang/chat-app-backend/pkg/securetoken"
+	"github.com/yuhangang/chat-app-backend/pkg/totp"
+	"github.com/yuhangang/chat-app-backend/types"
+	"github.com/yuhangang/chat-app-backend/user_errors"
+
+	"github.com/skip2/go-qrcode"
+)
+
+const kmfaChallengeLife = 5 * time.Minute
+const kmaxMfaAttempts = 5
+const krecoveryCodeCount = 10
+const kqrCodeSize = 256
+const kdefaultTotpIssuer = "Chat App"
+
+type MfaHandlerImpl struct {
+	userRepository db.UserRepository
+	mfaRepository  db.MfaRepository
+	jwtService     types.JwtService
+}
+
+func NewMfaHandler(userRepo db.UserRepository, mfaRepo db.MfaRepository, jwtService types.JwtService) *MfaHandlerImpl {
+	return &MfaHandlerImpl{
+		userRepository: userRepo,
+		mfaRepository:  mfaRepo,
+		jwtService:     jwtService,
+	}
+}
+
+type TotpEnrolmentResponse struct {
+	Secret          string `json:"secret"`
+	ProvisioningURI string `json:"provisioning_uri"`
+	QrPng           []byte `json:"qr_png"` // PNG of the provisioning URI, base64 in JSON
+}
+
+type RecoveryCodesResponse struct {
+	RecoveryCodes []string `json:"recovery_codes"`
+}
+
+// EnrollTotp starts authenticator app enrolment. Two-factor authentication stays off until the
+// first code is verified with ConfirmTotp. Guests have nothing to protect and can't enrol.
+func (h *MfaHandlerImpl) EnrollTotp(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(ctxkey.UserIDKey).(uint)
+
+	user, err := h.userRepository.GetUser(r.Context(), userID)
+	if err != nil {
+		http.Error(w, err.Error(), httpStatusForError(err))
+		return
+	}
+
+	if !user.HasPassword() {
+		identities, err := h.userRepository.GetIdentities(r.Context(), userID)
+		if err != nil {
+			http.Error(w, err.Error(), httpStatusForError(err))
+			return
+		}
+		if len(identities) == 0 {
+			http.Error(w, "set a password or link an identity provider first", http.StatusForbidden)
+			return
+		}
+	}
+
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	err = h.mfaRepository.SaveTotpCredential(r.Context(), tables.TotpCredential{UserID: userID, Secret: secret})
+	if err != nil {
+		http.Error(w, err.Error(), httpStatusForError(err))
+		return
+	}
+
+	provisioningURI := totp.ProvisioningURI(totpIssuer(), user.Username, secret)
+
+	qrPng, err := qrcode.Encode(provisioningURI, qrcode.Medium, kqrCodeSize)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, TotpEnrolmentResponse{
+		Secret:          secret,
+		ProvisioningURI: provisioningURI,
+		QrPng:           qrPng,
+	})
+}
+
+// ConfirmTotp turns two-factor authentication on with the first code from the app, and returns
+// the recovery codes. They are shown this once.
+func (h *MfaHandlerImpl) ConfirmTotp(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(ctxkey.UserIDKey).(uint)
+
+	credential, err := h.mfaRepository.GetTotpCredential(r.Context(), userID)
+	if err != nil {
+		http.Error(w, err.Error(), httpStatusForError(err))
+		return
+	}
+	if credential.ConfirmedAt != nil {
+		http.Error(w, user_errors.ErrMfaAlreadyEnabled.Error(), http.StatusConflict)
+		return
+	}
+
+	step, ok := totp.Validate(credential.Secret, r.FormValue("code"), time.Now(), 0)
+	if !ok {
+		http.Error(w, user_errors.ErrInvalidMfaCode.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	codes, hashes, err := generateRecoveryCodes()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err := h.mfaRepository.ConfirmTotpCredential(r.Context(), userID, step, hashes); err != nil {
+		http.Error(w, err.Error(), httpStatusForError(err))
+		return
+	}
+
+	writeJSON(w, http.StatusOK, RecoveryCodesResponse{RecoveryCodes: codes})
+}
+
+// DisableTotp turns two-factor authentication off, given a current code or a recovery code
+func (h *MfaHandlerImpl) DisableTotp(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(ctxkey.UserIDKey).(uint)
+
+	user, err := h.userRepository.GetUser(r.Context(), userID)
+	if err != nil {
+		http.Error(w, err.Error(), httpStatusForError(err))
+		return
+	}
+
+	if err := verifySecondFactor(r, h.userRepository, h.mfaRepository, user); err != nil {
+		http.Error(w, err.Error(), httpStatusForError(err))
+		return
+	}
+
+	if err := h.mfaRepository.DeleteTotpCredential(r.Context(), userID); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// RegenerateRecoveryCodes replaces all recovery codes, given a current code or a recovery code
+func (h *MfaHandlerImpl) RegenerateRecoveryCodes(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(ctxkey.UserIDKey).(uint)
+
+	user, err := h.userRepository.GetUser(r.Context(), userID)
+	if err != nil {
+		http.Error(w, err.Error(), httpStatusForError(err))
+		return
+	}
+
+	if err := verifySecondFactor(r, h.userRepository, h.mfaRepository, user); err != nil {
+		http.Error(w, err.Error(), httpStatusForError(err))
+		return
+	}
+
+	codes, hashes, err := generateRecoveryCodes()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err := h.mfaRepository.ReplaceRecoveryCodes(r.Context(), userID, hashes); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, RecoveryCodesResponse{RecoveryCodes: codes})
+}
+
+// VerifyMfa is the second login step. It exchanges the challenge token from the first step and
+// an authenticator or recovery code for real tokens. Wrong codes count towards both the
+// challenge's attempts and, like every second factor check, the account lockout.
+func (h *MfaHandlerImpl) VerifyMfa(w http.ResponseWriter, r *http.Request) {
+	mfaToken := r.FormValue("mfa_token")
+	if mfaToken == "" {
+		http.Error(w, "missing mfa_token", http.StatusBadRequest)
+		return
+	}
+
+	challenge, err := h.mfaRepository.GetMfaChallenge(r.Context(), securetoken.Hash(mfaToken), kmaxMfaAttempts)
+	if err != nil {
+		http.Error(w, err.Error(), httpStatusForError(err))
+		return
+	}
+
+	user, err := h.userRepository.GetUser(r.Context(), challenge.UserID)
+	if err != nil {
+		http.Error(w, err.Error(), httpStatusForError(err))
+		return
+	}
+
+	err = verifySecondFactor(r, h.userRepository, h.mfaRepository, user)
+	if errors.Is(err, user_errors.ErrInvalidMfaCode) {
+		if err := h.mfaRepository.RecordMfaChallengeFailure(r.Context(), challenge.ID); err != nil {
+			log.Println("failed to record mfa failure", err)
+		}
+	}
+	if err != nil {
+		http.Error(w, err.Error(), httpStatusForError(err))
+		return
+	}
+
+	if err := h.mfaRepository.ConsumeMfaChallenge(r.Context(), challenge.ID); err != nil {
+		http.Error(w, err.Error(), httpStatusForError(err))
+		return
+	}
+
+	// a guest logging into the account is only merged now that the second factor passed
+	var mergedChatRooms int64
+	if challenge.GuestID != nil {
+		mergedChatRooms, err = h.userRepository.MergeGuestUser(r.Context(), *challenge.GuestID, user.ID)
+		if err != nil {
+			http.Error(w, err.Error(), httpStatusForError(err))
+			return
+		}
+	}
+
+	response, err := newTokenResponse(r.Context(), h.jwtService, user, clientInfo(r))
+	if err != nil {
+		http.Error(w, err.Error(), httpStatusForError(err))
+		return
+	}
+
+	if challenge.GuestID != nil {
+		writeJSON(w, http.StatusOK, UpgradeResponse{UserResponse: response, MergedChatRooms: mergedChatRooms})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, response)
+}
+
+// verifySecondFactor checks the request's recovery_code, or failing that its code, against the
+// user's confirmed authenticator. Either is used up on success. Wrong codes count towards the
+// account lockout wherever they are entered, so a stolen session can't guess codes either.
+func verifySecondFactor(r *http.Request, userRepository db.UserRepository, mfaRepository db.MfaRepository, user tables.User) error {
+	if user.LockedUntil != nil && time.Now().Before(*user.LockedUntil) {
+		return user_errors.ErrAccountLocked
+	}
+
+	err := checkSecondFactor(r, mfaRepository, user.ID)
+	if errors.Is(err, user_errors.ErrInvalidMfaCode) {
+		if err := userRepository.RecordLoginFailure(r.Context(), user.ID, kmaxLoginAttempts, kloginLockDuration); err != nil {
+			log.Println("failed to record login failure", err)
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	if user.FailedLoginAttempts > 0 {
+		if err := userRepository.ClearLoginFailures(r.Context(), user.ID); err != nil {
+			log.Println("failed to clear login failures", err)
+		}
+	}
+
+	return nil
+}
+
+func checkSecondFactor(r *http.Request, mfaRepository db.MfaRepository, userID uint) error {
+	if recoveryCode := r.FormValue("recovery_code"); recoveryCode != "" {
+		return mfaRepository.UseRecoveryCode(r.Context(), userID, securetoken.Hash(normalizeRecoveryCode(recoveryCode)))
+	}
+
+	credential, err := mfaRepository.GetTotpCredential(r.Context(), userID)
+	if err != nil {
+		return err
+	}
+	if credential.ConfirmedAt == nil {
+		return user_errors.ErrMfaNotEnabled
+	}
+
+	step, ok := totp.Validate(credential.Secret, r.FormValue("code"), time.Now(), credential.LastUsedStep)
+	if !ok {
+		return user_errors.ErrInvalidMfaCode
+	}
+
+	return mfaRepository.UseTotpStep(r.Context(), userID, step)
+}
+
+// newLoginResponse finishes a login that passed the first factor. Users with two-factor
+// authentication get a challenge token for VerifyMfa instead of their tokens.
+func newLoginResponse(
+	ctx context.Context,
+	jwtService types.JwtService,
+	mfaRepository db.MfaRepository,
+	user tables.User,
+	client types.ClientInfo,
+) (UserResponse, error) {
+	mfaEnabled, err := mfaRepository.IsMfaEnabled(ctx, user.ID)
+	if err != nil {
+		return UserResponse{}, err
+	}
+
+	if mfaEnabled {
+		return newMfaChallenge(ctx, mfaRepository, user, nil)
+	}
+
+	return newTokenResponse(ctx, jwtService, user, client)
+}
+
+// newUpgradeResponse is newLoginResponse for a guest logging into an existing account. Without
+// two-factor authentication the guest is merged into the account right away, otherwise the
+// challenge remembers the guest and VerifyMfa merges it once the second factor passed.
+func newUpgradeResponse(
+	ctx context.Context,
+	userRepository db.UserRepository,
+	jwtService types.JwtService,
+	mfaRepository db.MfaRepository,
+	guestID uint,
+	user tables.User,
+	client types.ClientInfo,
+) (UpgradeResponse, error) {
+	mfaEnabled, err := mfaRepository.IsMfaEnabled(ctx, user.ID)
+	if err != nil {
+		return UpgradeResponse{}, err
+	}
+
+	if mfaEnabled {
+		response, err := newMfaChallenge(ctx, mfaRepository, user, &guestID)
+		return UpgradeResponse{UserResponse: response}, err
+	}
+
+	mergedChatRooms, err := userRepository.MergeGuestUser(ctx, guestID, user.ID)
+	if err != nil {
+		return UpgradeResponse{}, err
+	}
+
+	response, err := newTokenResponse(ctx, jwtService, user, client)
+	if err != nil {
+		return UpgradeResponse{}, err
+	}
+
+	return UpgradeResponse{UserResponse: response, MergedChatRooms: mergedChatRooms}, nil
+}
+
+// newMfaChallenge starts the second login step, guestID is the guest to merge once it passed
+func newMfaChallenge(ctx context.Context, mfaRepository db.MfaRepository, user tables.User, guestID *uint) (UserResponse, error) {
+	mfaToken, mfaTokenHash, err := securetoken.Generate(32)
+	if err != nil {
+		return UserResponse{}, err
+	}
+
+	err = mfaRepository.CreateMfaChallenge(ctx, tables.MfaChallenge{
+		UserID:    user.ID,
+		TokenHash: mfaTokenHash,
+		ExpiresAt: time.Now().Add(kmfaChallengeLife),
+		GuestID:   guestID,
+	})
+	if err != nil {
+		return UserResponse{}, err
+	}
+
+	return UserResponse{User: user, MfaRequired: true, MfaToken: mfaToken}, nil
+}
+
+func newTokenResponse(ctx context.Context, jwtService types.JwtService, user tables.User, client types.ClientInfo) (UserResponse, error) {
+	jwtPayload, err := jwtService.GenerateTokens(ctx, user.ID, client)
+	if err != nil {
+		return UserResponse{}, err
+	}
+
+	return UserResponse{
+		AccessToken:  jwtPayload.AccessToken,
+		RefreshToken: jwtPayload.RefreshToken,
+		User:         user,
+	}, nil
+}
+
+// generateRecoveryCodes returns a set of recovery codes formatted as xxxx-xxxx-xxxx-xxxx and
+// their hashes to store
+func generateRecoveryCodes() ([]string, []string, error) {
+	codes := make([]string, 0, krecoveryCodeCount)
+	hashes := make([]string, 0, krecoveryCodeCount)
+
+	for i := 0; i < krecoveryCodeCount; i++ {
+		buffer := make([]byte, 10)
+		if _, err := rand.Read(buffer); err != nil {
+			return nil, nil, err
+		}
+
+		raw := strings.ToLower(base32.StdEncoding.EncodeToString(buffer))
+		codes = append(codes, raw[0:4]+"-"+raw[4:8]+"-"+raw[8:12]+"-"+raw[12:16])
+		hashes = append(hashes, securetoken.Hash(raw))
+	}
+
+	return codes, hashes, nil
+}
+
+// normalizeRecoveryCode ignores case, dashes and spaces, so codes can be typed loosely
+func normalizeRecoveryCode(code string) string {
+	code = strings.ToLower(code)
+	code = strings.ReplaceAll(code, "-", "")
+
+	return strings.ReplaceAll(code, " ", "")
+}
+
+func totpIssuer() string {
+	if issuer := os.Getenv("TOTP_ISSUER"); issuer != "" {
+		return issuer
+	}
+
+	return kdefaultTotpIssuer
+}
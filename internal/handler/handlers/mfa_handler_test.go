@@ -0,0 +1,207 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/yuhangang/chat-app-backend/internal/db/repository"
+	"github.com/yuhangang/chat-app-backend/internal/db/tables"
+	"github.com/yuhangang/chat-app-backend/internal/service/password"
+	"github.com/yuhangang/chat-app-backend/pkg/ctxkey"
+	"github.com/yuhangang/chat-app-backend/pkg/totp"
+
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+func TestDisableTotpLocksAfterWrongCodes(t *testing.T) {
+	conn, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{TranslateError: true, Logger: logger.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.AutoMigrate(&tables.User{}, &tables.TotpCredential{}, &tables.RecoveryCode{}); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	userRepo := repository.NewUserRepo(conn)
+	mfaRepo := repository.NewMfaRepo(conn)
+
+	user, err := userRepo.CreateUser(ctx, tables.User{Username: "ada", PasswordHash: "hash"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mfaRepo.SaveTotpCredential(ctx, tables.TotpCredential{UserID: user.ID, Secret: secret}); err != nil {
+		t.Fatal(err)
+	}
+	// confirmed at an earlier step, so the current code is still unused
+	if err := mfaRepo.ConfirmTotpCredential(ctx, user.ID, totp.Step(time.Now())-2, []string{"unused"}); err != nil {
+		t.Fatal(err)
+	}
+
+	h := NewMfaHandler(userRepo, mfaRepo, nil)
+	disable := func(code string) int {
+		query := url.Values{"code": {code}}
+		r := httptest.NewRequest(http.MethodDelete, "/user/mfa/totp?"+query.Encode(), nil)
+		r = r.WithContext(context.WithValue(r.Context(), ctxkey.UserIDKey, user.ID))
+
+		w := httptest.NewRecorder()
+		h.DisableTotp(w, r)
+
+		return w.Code
+	}
+
+	for i := 0; i < kmaxLoginAttempts; i++ {
+		if status := disable("000000"); status != http.StatusUnauthorized {
+			t.Fatalf("wrong code %d: status = %d, want %d", i+1, status, http.StatusUnauthorized)
+		}
+	}
+
+	code, err := totp.Code(secret, totp.Step(time.Now()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status := disable(code); status != http.StatusTooManyRequests {
+		t.Fatalf("correct code while locked: status = %d, want %d", status, http.StatusTooManyRequests)
+	}
+
+	enabled, err := mfaRepo.IsMfaEnabled(ctx, user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !enabled {
+		t.Fatal("two-factor authentication was disabled while the account was locked")
+	}
+}
+
+func TestUpgradeGuestMergesOnlyAfterSecondFactor(t *testing.T) {
+	conn, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{TranslateError: true, Logger: logger.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = conn.AutoMigrate(&tables.User{}, &tables.UserIdentity{}, &tables.TotpCredential{}, &tables.RecoveryCode{},
+		&tables.MfaChallenge{}, &tables.ChatRoom{}, &tables.ChatMessage{}, &tables.ChatShare{}, &tables.ChatRoomMember{},
+		&tables.ChatRoomRead{}, &tables.ChatFolder{}, &tables.ChatTag{}, &tables.ChatRoomTag{}, &tables.Upload{},
+		&tables.Session{}, &tables.RefreshToken{}, &tables.ApiKey{}, &tables.OidcLoginState{}, &tables.UserProfile{},
+		&tables.Blob{}, &tables.DataExport{}, &tables.EmailToken{}, &tables.PasswordResetToken{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	userRepo := repository.NewUserRepo(conn)
+	mfaRepo := repository.NewMfaRepo(conn)
+
+	passwordHash, err := password.Hash("correct horse battery")
+	if err != nil {
+		t.Fatal(err)
+	}
+	user, err := userRepo.CreateUser(ctx, tables.User{Username: "ada", PasswordHash: passwordHash})
+	if err != nil {
+		t.Fatal(err)
+	}
+	guest, err := userRepo.CreateUser(ctx, tables.User{Username: "guest-1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	chatRoom := tables.ChatRoom{Name: "Holiday plans", SessionID: "session", UserID: guest.ID}
+	if err := conn.Create(&chatRoom).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mfaRepo.SaveTotpCredential(ctx, tables.TotpCredential{UserID: user.ID, Secret: secret}); err != nil {
+		t.Fatal(err)
+	}
+	if err := mfaRepo.ConfirmTotpCredential(ctx, user.ID, totp.Step(time.Now())-2, []string{"unused"}); err != nil {
+		t.Fatal(err)
+	}
+
+	authHandler := NewAuthHandler(userRepo, mfaRepo, &fakeJwtService{}, nil)
+	form := url.Values{"username": {"ada"}, "password": {"correct horse battery"}}
+	r := httptest.NewRequest(http.MethodPost, "/auth/upgrade", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r = r.WithContext(context.WithValue(r.Context(), ctxkey.UserIDKey, guest.ID))
+	w := httptest.NewRecorder()
+	authHandler.UpgradeGuest(w, r)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("upgrade: status = %d, want %d", w.Code, http.StatusOK)
+	}
+	var challenge UpgradeResponse
+	if err := json.NewDecoder(w.Body).Decode(&challenge); err != nil {
+		t.Fatal(err)
+	}
+	if !challenge.MfaRequired || challenge.AccessToken != "" {
+		t.Fatalf("upgrade answered with tokens, want an MFA challenge")
+	}
+
+	var owner tables.ChatRoom
+	if err := conn.First(&owner, chatRoom.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+	if owner.UserID != guest.ID {
+		t.Fatal("guest was merged with the password alone")
+	}
+
+	mfaHandler := NewMfaHandler(userRepo, mfaRepo, &fakeJwtService{})
+	verify := func(code string) *httptest.ResponseRecorder {
+		form := url.Values{"mfa_token": {challenge.MfaToken}, "code": {code}}
+		r := httptest.NewRequest(http.MethodPost, "/auth/mfa", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		mfaHandler.VerifyMfa(w, r)
+
+		return w
+	}
+
+	if w := verify("000000"); w.Code != http.StatusUnauthorized {
+		t.Fatalf("wrong code: status = %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+	if err := conn.First(&owner, chatRoom.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+	if owner.UserID != guest.ID {
+		t.Fatal("guest was merged after a wrong code")
+	}
+
+	code, err := totp.Code(secret, totp.Step(time.Now()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w = verify(code)
+	if w.Code != http.StatusOK {
+		t.Fatalf("correct code: status = %d, want %d", w.Code, http.StatusOK)
+	}
+	var upgraded UpgradeResponse
+	if err := json.NewDecoder(w.Body).Decode(&upgraded); err != nil {
+		t.Fatal(err)
+	}
+	if upgraded.AccessToken == "" || upgraded.MergedChatRooms != 1 {
+		t.Errorf("verify answered with %d merged rooms and token %q, want 1 and tokens", upgraded.MergedChatRooms, upgraded.AccessToken)
+	}
+
+	if err := conn.First(&owner, chatRoom.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+	if owner.UserID != user.ID {
+		t.Errorf("room belongs to user %d after the second factor, want %d", owner.UserID, user.ID)
+	}
+	if _, err := userRepo.GetUser(ctx, guest.ID); err == nil {
+		t.Error("guest account still exists after the upgrade")
+	}
+}
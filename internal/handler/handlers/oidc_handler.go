@@ -0,0 +1,272 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/yuhangang/chat-app-backend/internal/db"
+	"github.com/yuhangang/chat-app-backend/internal/db/tables"
+	"github.com/yuhangang/chat-app-backend/internal/service"
+	"github.com/yuhangang/chat-app-backend/pkg/ctxkey"
+	"github.com/yuhangang/chat-app-backend/pkg/securetoken"
+	"github.com/yuhangang/chat-app-backend/types"
+	"github.com/yuhangang/chat-app-backend/user_errors"
+
+	"golang.org/x/oauth2"
+)
+
+const koidcLoginStateLife = 10 * time.Minute
+const kmaxUsernameAttempts = 5
+
+type OidcHandlerImpl struct {
+	userRepository   db.UserRepository
+	mfaRepository    db.MfaRepository
+	identityProvider service.IdentityProvider
+	jwtService       types.JwtService
+}
+
+func NewOidcHandler(userRepo db.UserRepository, mfaRepo db.MfaRepository, identityProvider service.IdentityProvider, jwtService types.JwtService) *OidcHandlerImpl {
+	return &OidcHandlerImpl{
+		userRepository:   userRepo,
+		mfaRepository:    mfaRepo,
+		identityProvider: identityProvider,
+		jwtService:       jwtService,
+	}
+}
+
+// GetProviders lists the configured identity providers
+func (h *OidcHandlerImpl) GetProviders(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+
+	json.NewEncoder(w).Encode(map[string][]string{"providers": h.identityProvider.Providers()})
+}
+
+// StartLogin returns the provider URL to send the browser to for signing in
+func (h *OidcHandlerImpl) StartLogin(w http.ResponseWriter, r *http.Request) {
+	h.start(w, r, nil)
+}
+
+// StartLink is StartLogin for a signed in user, guests included, who wants to add the
+// provider account as a way to sign in. A guest linking an account that is already registered
+// is merged into that account instead.
+func (h *OidcHandlerImpl) StartLink(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(ctxkey.UserIDKey).(uint)
+	h.start(w, r, &userID)
+}
+
+func (h *OidcHandlerImpl) start(w http.ResponseWriter, r *http.Request, linkUserID *uint) {
+	provider := providerFromPath(r.URL.Path)
+
+	state, _, err := securetoken.Generate(32)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	nonce, _, err := securetoken.Generate(32)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	codeVerifier := oauth2.GenerateVerifier()
+
+	authorizationURL, err := h.identityProvider.AuthCodeURL(r.Context(), provider, state, nonce, codeVerifier)
+	if err != nil {
+		http.Error(w, err.Error(), httpStatusForError(err))
+		return
+	}
+
+	err = h.userRepository.CreateOidcLoginState(r.Context(), tables.OidcLoginState{
+		State:        state,
+		Provider:     provider,
+		Nonce:        nonce,
+		CodeVerifier: codeVerifier,
+		LinkUserID:   linkUserID,
+		ExpiresAt:    time.Now().Add(koidcLoginStateLife),
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+
+	json.NewEncoder(w).Encode(map[string]string{"authorization_url": authorizationURL})
+}
+
+// Callback finishes a provider login with the code and state the provider redirected back with.
+// Known identities sign in, new ones get a fresh account, and link requests are attached to the
+// user who started them.
+func (h *OidcHandlerImpl) Callback(w http.ResponseWriter, r *http.Request) {
+	provider := providerFromPath(r.URL.Path)
+	code := r.FormValue("code")
+	state := r.FormValue("state")
+
+	if code == "" || state == "" {
+		http.Error(w, "missing code or state", http.StatusBadRequest)
+		return
+	}
+
+	loginState, err := h.userRepository.ConsumeOidcLoginState(r.Context(), state, provider)
+	if err != nil {
+		http.Error(w, err.Error(), httpStatusForError(err))
+		return
+	}
+
+	identity, err := h.identityProvider.Exchange(r.Context(), provider, code, loginState.CodeVerifier, loginState.Nonce)
+	if err != nil {
+		log.Printf("Provider login with %s failed: %v", provider, err)
+		http.Error(w, "provider login failed", http.StatusUnauthorized)
+		return
+	}
+
+	var user tables.User
+	var guestID *uint
+	status := http.StatusOK
+
+	if loginState.LinkUserID != nil {
+		err = h.userRepository.LinkIdentity(r.Context(), tables.UserIdentity{
+			UserID:   *loginState.LinkUserID,
+			Provider: identity.Provider,
+			Subject:  identity.Subject,
+			Email:    identity.Email,
+		})
+		if err == nil {
+			user, err = h.userRepository.GetUser(r.Context(), *loginState.LinkUserID)
+		} else if errors.Is(err, user_errors.ErrIdentityLinked) {
+			user, err = h.guestIdentityOwner(r, *loginState.LinkUserID, identity)
+			guestID = loginState.LinkUserID
+		}
+	} else {
+		user, err = h.userRepository.GetUserByIdentity(r.Context(), identity.Provider, identity.Subject)
+		if errors.Is(err, user_errors.ErrUserNotFound) {
+			user, err = h.createUserForIdentity(r, identity)
+			status = http.StatusCreated
+		}
+	}
+	if err != nil {
+		http.Error(w, err.Error(), httpStatusForError(err))
+		return
+	}
+
+	// Generate JWT, or a challenge when the user has two-factor authentication. A guest logging
+	// into the identity's owner is merged into it, after the challenge if there is one.
+	var jwtPayloadResponse interface{}
+	if guestID != nil {
+		jwtPayloadResponse, err = newUpgradeResponse(r.Context(), h.userRepository, h.jwtService, h.mfaRepository, *guestID, user, clientInfo(r))
+	} else {
+		jwtPayloadResponse, err = newLoginResponse(r.Context(), h.jwtService, h.mfaRepository, user, clientInfo(r))
+	}
+	if err != nil {
+		http.Error(w, err.Error(), httpStatusForError(err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	if err := json.NewEncoder(w).Encode(jwtPayloadResponse); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// guestIdentityOwner handles a guest linking a provider account that already belongs to someone,
+// which means the guest is logging into their existing account and their chats move over to it.
+// Returns the owner to log into. Real accounts keep getting ErrIdentityLinked.
+func (h *OidcHandlerImpl) guestIdentityOwner(r *http.Request, guestID uint, identity service.ExternalIdentity) (tables.User, error) {
+	guest, err := isGuestAccount(r.Context(), h.userRepository, guestID)
+	if err != nil {
+		return tables.User{}, err
+	}
+	if !guest {
+		return tables.User{}, user_errors.ErrIdentityLinked
+	}
+
+	owner, err := h.userRepository.GetUserByIdentity(r.Context(), identity.Provider, identity.Subject)
+	if err != nil {
+		return tables.User{}, err
+	}
+	if owner.DisabledAt != nil {
+		return tables.User{}, user_errors.ErrAccountDisabled
+	}
+
+	return owner, nil
+}
+
+// createUserForIdentity creates an account for a first time provider login. The provider's
+// username is used when free, otherwise a random suffix is added. A verified email is copied
+// over unless another account already has it, accounts are never merged by email.
+func (h *OidcHandlerImpl) createUserForIdentity(r *http.Request, identity service.ExternalIdentity) (tables.User, error) {
+	user := tables.User{}
+
+	if identity.Email != "" && identity.EmailVerified {
+		_, err := h.userRepository.GetUserByEmail(r.Context(), identity.Email)
+		if errors.Is(err, user_errors.ErrUserNotFound) {
+			email := identity.Email
+			now := time.Now()
+			user.Email = &email
+			user.EmailVerifiedAt = &now
+		} else if err != nil {
+			return tables.User{}, err
+		}
+	}
+
+	userIdentity := tables.UserIdentity{
+		Provider: identity.Provider,
+		Subject:  identity.Subject,
+		Email:    identity.Email,
+	}
+
+	base := usernameForIdentity(identity)
+	user.Username = base
+
+	for attempt := 0; ; attempt++ {
+		created, err := h.userRepository.CreateUserWithIdentity(r.Context(), user, userIdentity)
+		if !errors.Is(err, user_errors.ErrUsernameExists) || attempt == kmaxUsernameAttempts {
+			return created, err
+		}
+
+		user.Username = base + "_" + uuid.New().String()[:6]
+	}
+}
+
+// usernameForIdentity derives a username from the provider profile, keeping only
+// lowercase letters, digits, dots, dashes and underscores
+func usernameForIdentity(identity service.ExternalIdentity) string {
+	candidate := identity.PreferredUsername
+	if candidate == "" && identity.Email != "" {
+		candidate = strings.SplitN(identity.Email, "@", 2)[0]
+	}
+
+	var builder strings.Builder
+	for _, r := range strings.ToLower(candidate) {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') || r == '.' || r == '-' || r == '_' {
+			builder.WriteRune(r)
+		}
+		if builder.Len() == 30 {
+			break
+		}
+	}
+
+	if builder.Len() < 3 {
+		return identity.Provider + "_" + uuid.New().String()[:8]
+	}
+
+	return builder.String()
+}
+
+func providerFromPath(path string) string {
+	// get provider from URL path, /auth/oidc/{provider}/...
+	parts := strings.Split(path, "/")
+	if len(parts) < 4 {
+		return ""
+	}
+
+	return parts[3]
+}
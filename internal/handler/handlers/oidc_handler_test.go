@@ -0,0 +1,113 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/yuhangang/chat-app-backend/internal/db/repository"
+	"github.com/yuhangang/chat-app-backend/internal/db/tables"
+	"github.com/yuhangang/chat-app-backend/internal/service"
+
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// fakeIdentityProvider remembers the login it started and fails every exchange, which is enough
+// to see whether the callback got past the state check
+type fakeIdentityProvider struct {
+	state        string
+	nonce        string
+	codeVerifier string
+
+	exchanges     int
+	exchangeNonce string
+}
+
+func (p *fakeIdentityProvider) Providers() []string {
+	return []string{"test"}
+}
+
+func (p *fakeIdentityProvider) AuthCodeURL(ctx context.Context, provider string, state string, nonce string, codeVerifier string) (string, error) {
+	p.state, p.nonce, p.codeVerifier = state, nonce, codeVerifier
+
+	return "https://issuer.example.com/authorize?state=" + url.QueryEscape(state), nil
+}
+
+func (p *fakeIdentityProvider) Exchange(ctx context.Context, provider string, code string, codeVerifier string, nonce string) (service.ExternalIdentity, error) {
+	p.exchanges++
+	p.exchangeNonce = nonce
+
+	return service.ExternalIdentity{}, errors.New("exchange is not part of this test")
+}
+
+func newTestOidcHandler(t *testing.T) (*OidcHandlerImpl, *fakeIdentityProvider) {
+	t.Helper()
+
+	conn, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{TranslateError: true, Logger: logger.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.AutoMigrate(&tables.User{}, &tables.OidcLoginState{}); err != nil {
+		t.Fatal(err)
+	}
+
+	provider := &fakeIdentityProvider{}
+
+	return NewOidcHandler(repository.NewUserRepo(conn), nil, provider, nil), provider
+}
+
+func oidcCallback(h *OidcHandlerImpl, provider string, state string) int {
+	form := url.Values{"code": {"code"}, "state": {state}}
+	r := httptest.NewRequest(http.MethodPost, "/auth/oidc/"+provider+"/callback", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	w := httptest.NewRecorder()
+	h.Callback(w, r)
+
+	return w.Code
+}
+
+func TestOidcCallbackChecksState(t *testing.T) {
+	h, provider := newTestOidcHandler(t)
+
+	w := httptest.NewRecorder()
+	h.StartLogin(w, httptest.NewRequest(http.MethodPost, "/auth/oidc/test/login", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("StartLogin status = %d: %s", w.Code, w.Body)
+	}
+
+	tests := []struct {
+		name       string
+		provider   string
+		state      string
+		wantStatus int
+		exchanges  int
+	}{
+		{name: "unknown state", provider: "test", state: "forged-state", wantStatus: http.StatusBadRequest},
+		{name: "state of another provider", provider: "other", state: provider.state, wantStatus: http.StatusBadRequest},
+		{name: "matching state", provider: "test", state: provider.state, wantStatus: http.StatusUnauthorized, exchanges: 1},
+		{name: "replayed state", provider: "test", state: provider.state, wantStatus: http.StatusBadRequest, exchanges: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if status := oidcCallback(h, tt.provider, tt.state); status != tt.wantStatus {
+				t.Errorf("status = %d, want %d", status, tt.wantStatus)
+			}
+			if provider.exchanges != tt.exchanges {
+				t.Errorf("exchanges = %d, want %d", provider.exchanges, tt.exchanges)
+			}
+		})
+	}
+
+	// the nonce stored with the state is the one the ID token is checked against
+	if provider.exchangeNonce != provider.nonce {
+		t.Errorf("exchange nonce = %q, want %q", provider.exchangeNonce, provider.nonce)
+	}
+}
@@ -0,0 +1,237 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/yuhangang/chat-app-backend/internal/db"
+	"github.com/yuhangang/chat-app-backend/internal/db/tables"
+	"github.com/yuhangang/chat-app-backend/pkg/ctxkey"
+)
+
+const kmaxFolderNameLength = 100
+const kmaxTagNameLength = 50
+const kdefaultTagColor = "#808080"
+
+var tagColorPattern = regexp.MustCompile(`^#[0-9a-fA-F]{6}$`)
+
+// OrganizerHandlerImpl manages the folders and tags chat rooms are sorted into. Rooms are moved
+// and tagged through the chat handler.
+type OrganizerHandlerImpl struct {
+	organizerRepository db.OrganizerRepository
+}
+
+func NewOrganizerHandler(organizerRepo db.OrganizerRepository) *OrganizerHandlerImpl {
+	return &OrganizerHandlerImpl{organizerRepository: organizerRepo}
+}
+
+// GetFolders lists all of the user's folders flat, clients build the tree from parent_id
+func (h *OrganizerHandlerImpl) GetFolders(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(ctxkey.UserIDKey).(uint)
+
+	folders, err := h.organizerRepository.GetFolders(r.Context(), userID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, folders)
+}
+
+// CreateFolder creates a folder named name, inside parent_id if given
+func (h *OrganizerHandlerImpl) CreateFolder(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(ctxkey.UserIDKey).(uint)
+
+	name, ok := parseName(w, r.FormValue("name"), kmaxFolderNameLength)
+	if !ok {
+		return
+	}
+	parentID, ok := parseOptionalID(w, r.FormValue("parent_id"), "parent_id")
+	if !ok {
+		return
+	}
+
+	folder, err := h.organizerRepository.CreateFolder(r.Context(), tables.ChatFolder{
+		UserID:   userID,
+		ParentID: parentID,
+		Name:     name,
+	})
+	if err != nil {
+		http.Error(w, err.Error(), httpStatusForError(err))
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, folder)
+}
+
+// UpdateFolder renames the folder and moves it into parent_id, empty for the top level. Fields
+// left out of the form are kept.
+func (h *OrganizerHandlerImpl) UpdateFolder(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(ctxkey.UserIDKey).(uint)
+
+	folderID, ok := pathID(w, r, 2)
+	if !ok {
+		return
+	}
+
+	if err := r.ParseMultipartForm(kmaxFormMemory); err != nil && !errors.Is(err, http.ErrNotMultipart) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var name *string
+	if value, set := formField(r, "name"); set {
+		parsed, ok := parseName(w, value, kmaxFolderNameLength)
+		if !ok {
+			return
+		}
+		name = &parsed
+	}
+
+	value, move := formField(r, "parent_id")
+	parentID, ok := parseOptionalID(w, value, "parent_id")
+	if !ok {
+		return
+	}
+
+	folder, err := h.organizerRepository.UpdateFolder(r.Context(), folderID, userID, name, move, parentID)
+	if err != nil {
+		http.Error(w, err.Error(), httpStatusForError(err))
+		return
+	}
+
+	writeJSON(w, http.StatusOK, folder)
+}
+
+// DeleteFolder deletes the folder, its subfolders and rooms move up to its parent
+func (h *OrganizerHandlerImpl) DeleteFolder(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(ctxkey.UserIDKey).(uint)
+
+	folderID, ok := pathID(w, r, 2)
+	if !ok {
+		return
+	}
+
+	if err := h.organizerRepository.DeleteFolder(r.Context(), folderID, userID); err != nil {
+		http.Error(w, err.Error(), httpStatusForError(err))
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *OrganizerHandlerImpl) GetTags(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(ctxkey.UserIDKey).(uint)
+
+	tags, err := h.organizerRepository.GetTags(r.Context(), userID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, tags)
+}
+
+// CreateTag creates a tag named name, with color as #rrggbb or grey if left out. Tag names are
+// unique per user.
+func (h *OrganizerHandlerImpl) CreateTag(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(ctxkey.UserIDKey).(uint)
+
+	name, ok := parseName(w, r.FormValue("name"), kmaxTagNameLength)
+	if !ok {
+		return
+	}
+
+	color := r.FormValue("color")
+	if color == "" {
+		color = kdefaultTagColor
+	}
+	if !tagColorPattern.MatchString(color) {
+		http.Error(w, "color must be #rrggbb", http.StatusBadRequest)
+		return
+	}
+
+	tag, err := h.organizerRepository.CreateTag(r.Context(), tables.ChatTag{
+		UserID: userID,
+		Name:   name,
+		Color:  strings.ToLower(color),
+	})
+	if err != nil {
+		http.Error(w, err.Error(), httpStatusForError(err))
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, tag)
+}
+
+// UpdateTag renames or recolors the tag, fields left out of the form are kept
+func (h *OrganizerHandlerImpl) UpdateTag(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(ctxkey.UserIDKey).(uint)
+
+	tagID, ok := pathID(w, r, 2)
+	if !ok {
+		return
+	}
+
+	if err := r.ParseMultipartForm(kmaxFormMemory); err != nil && !errors.Is(err, http.ErrNotMultipart) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var name, color *string
+	if value, set := formField(r, "name"); set {
+		parsed, ok := parseName(w, value, kmaxTagNameLength)
+		if !ok {
+			return
+		}
+		name = &parsed
+	}
+	if value, set := formField(r, "color"); set {
+		if !tagColorPattern.MatchString(value) {
+			http.Error(w, "color must be #rrggbb", http.StatusBadRequest)
+			return
+		}
+		value = strings.ToLower(value)
+		color = &value
+	}
+
+	tag, err := h.organizerRepository.UpdateTag(r.Context(), tagID, userID, name, color)
+	if err != nil {
+		http.Error(w, err.Error(), httpStatusForError(err))
+		return
+	}
+
+	writeJSON(w, http.StatusOK, tag)
+}
+
+// DeleteTag deletes the tag and takes it off every room
+func (h *OrganizerHandlerImpl) DeleteTag(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(ctxkey.UserIDKey).(uint)
+
+	tagID, ok := pathID(w, r, 2)
+	if !ok {
+		return
+	}
+
+	if err := h.organizerRepository.DeleteTag(r.Context(), tagID, userID); err != nil {
+		http.Error(w, err.Error(), httpStatusForError(err))
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// parseName trims the name and checks it is 1 to maxLength characters
+func parseName(w http.ResponseWriter, name string, maxLength int) (string, bool) {
+	name = strings.TrimSpace(name)
+	if name == "" || utf8.RuneCountInString(name) > maxLength {
+		http.Error(w, fmt.Sprintf("name must be 1 to %d characters", maxLength), http.StatusBadRequest)
+		return "", false
+	}
+
+	return name, true
+}
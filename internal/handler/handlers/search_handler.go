@@ -0,0 +1,144 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/yuhangang/chat-app-backend/internal/db"
+	"github.com/yuhangang/chat-app-backend/internal/service"
+	"github.com/yuhangang/chat-app-backend/pkg/ctxkey"
+	"github.com/yuhangang/chat-app-backend/types"
+)
+
+// krrfK damps the weight of the top ranks in reciprocal rank fusion, 60 as in the original paper
+const krrfK = 60
+
+type SearchHandlerImpl struct {
+	searchRepository    db.SearchRepository
+	embeddingRepository db.EmbeddingRepository
+	embedder            service.Embedder
+}
+
+// NewSearchHandler takes a nil embedder when semantic search is off
+func NewSearchHandler(searchRepository db.SearchRepository, embeddingRepository db.EmbeddingRepository, embedder service.Embedder) *SearchHandlerImpl {
+	return &SearchHandlerImpl{
+		searchRepository:    searchRepository,
+		embeddingRepository: embeddingRepository,
+		embedder:            embedder,
+	}
+}
+
+// Search finds q in the user's messages, room names and attachments, best match first. Each
+// result has an HTML snippet with the matches in <mark>, and the room and message to open.
+func (h *SearchHandlerImpl) Search(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(ctxkey.UserIDKey).(uint)
+
+	query, ok := searchQuery(w, r)
+	if !ok {
+		return
+	}
+
+	results, err := h.searchRepository.Search(r.Context(), userID, query, parseLimit(r))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, results)
+}
+
+// SemanticSearch finds the user's messages closest in meaning to q, with their similarity as
+// score. With hybrid=true the keyword matches are fused in by reciprocal rank fusion and the
+// score is the fused one.
+func (h *SearchHandlerImpl) SemanticSearch(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(ctxkey.UserIDKey).(uint)
+
+	query, ok := searchQuery(w, r)
+	if !ok {
+		return
+	}
+
+	if h.embedder == nil {
+		http.Error(w, "semantic search is not enabled", http.StatusNotImplemented)
+		return
+	}
+
+	limit := parseLimit(r)
+
+	vector, err := h.embedder.EmbedQuery(r.Context(), query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	results, err := h.embeddingRepository.SearchEmbeddings(r.Context(), userID, h.embedder.Model(), vector, limit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if r.URL.Query().Get("hybrid") == "true" {
+		keywordResults, err := h.searchRepository.Search(r.Context(), userID, query, limit)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		// keyword results go first, so a match found by both keeps its highlighted snippet
+		results = fuseResults(limit, keywordResults, results)
+	}
+
+	writeJSON(w, http.StatusOK, results)
+}
+
+func searchQuery(w http.ResponseWriter, r *http.Request) (string, bool) {
+	query := strings.TrimSpace(r.URL.Query().Get("q"))
+	if query == "" {
+		http.Error(w, "missing q", http.StatusBadRequest)
+		return "", false
+	}
+
+	return query, true
+}
+
+// fuseResults merges ranked lists by reciprocal rank fusion: a result scores 1/(krrfK+rank) in
+// every list it is in, so results ranked well by several lists come first
+func fuseResults(limit int, lists ...[]types.SearchResult) []types.SearchResult {
+	fused := []types.SearchResult{}
+	positions := map[string]int{}
+	for _, list := range lists {
+		for rank, result := range list {
+			key := resultKey(result)
+			position, ok := positions[key]
+			if !ok {
+				position = len(fused)
+				positions[key] = position
+				result.Score = 0
+				fused = append(fused, result)
+			}
+			fused[position].Score += 1 / float64(krrfK+rank+1)
+		}
+	}
+
+	sort.SliceStable(fused, func(i, j int) bool { return fused[i].Score > fused[j].Score })
+	if len(fused) > limit {
+		fused = fused[:limit]
+	}
+
+	return fused
+}
+
+// resultKey identifies what a result points at, whichever search found it
+func resultKey(result types.SearchResult) string {
+	var messageID, attachmentID uint
+	if result.MessageID != nil {
+		messageID = *result.MessageID
+	}
+	if result.AttachmentID != nil {
+		attachmentID = *result.AttachmentID
+	}
+
+	return fmt.Sprintf("%s/%d/%d/%d", result.Kind, result.ChatRoomID, messageID, attachmentID)
+}
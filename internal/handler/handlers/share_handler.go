@@ -0,0 +1,219 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/yuhangang/chat-app-backend/internal/access"
+	"github.com/yuhangang/chat-app-backend/internal/db"
+	"github.com/yuhangang/chat-app-backend/internal/db/tables"
+	"github.com/yuhangang/chat-app-backend/internal/service"
+	"github.com/yuhangang/chat-app-backend/pkg/ctxkey"
+	"github.com/yuhangang/chat-app-backend/pkg/securetoken"
+)
+
+const kmaxShareLife = 365 * 24 * time.Hour
+
+// kshareFileUserID is who file URLs in a share are signed for. Nobody, so the URLs don't reveal
+// the owner's ID.
+const kshareFileUserID = 0
+
+type ShareHandlerImpl struct {
+	chatRepository  db.ChatRepository
+	shareRepository db.ShareRepository
+	fileSigner      service.FileSigner
+}
+
+func NewShareHandler(chatRepo db.ChatRepository, shareRepo db.ShareRepository, fileSigner service.FileSigner) *ShareHandlerImpl {
+	return &ShareHandlerImpl{
+		chatRepository:  chatRepo,
+		shareRepository: shareRepo,
+		fileSigner:      fileSigner,
+	}
+}
+
+// SharedChatResponse is a shared chat as anyone with the link sees it, without user IDs
+type SharedChatResponse struct {
+	Name      string          `json:"name"`
+	SharedAt  time.Time       `json:"shared_at"`
+	ExpiresAt *time.Time      `json:"expires_at"`
+	Messages  []SharedMessage `json:"messages"`
+}
+
+type SharedMessage struct {
+	Body        string             `json:"body"`
+	IsUser      bool               `json:"is_user"`
+	CreatedAt   time.Time          `json:"created_at"`
+	Attachments []SharedAttachment `json:"attachments"`
+	Embeds      []SharedEmbed      `json:"embeds"`
+}
+
+type SharedAttachment struct {
+	FileName     string `json:"file_name"`
+	FileType     string `json:"file_type"`
+	FileSize     int64  `json:"file_size"`
+	URL          string `json:"url"`
+	ThumbnailURL string `json:"thumbnail_url,omitempty"`
+}
+
+type SharedEmbed struct {
+	EmbedType string `json:"embed_type"`
+	EmbedKey  string `json:"embed_key"`
+	Data      string `json:"data"`
+}
+
+// CreateShare shares the room read-only up to its latest message, expiring after expires_in_days
+// if given. Sharing again replaces the previous link.
+func (h *ShareHandlerImpl) CreateShare(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(ctxkey.UserIDKey).(uint)
+
+	chatRoomID, ok := pathID(w, r, 2)
+	if !ok {
+		return
+	}
+
+	chatRoom, err := authorizeChatRoom(r.Context(), h.chatRepository, userID, chatRoomID, access.ChatActionManage)
+	if err != nil {
+		http.Error(w, err.Error(), httpStatusForError(err))
+		return
+	}
+
+	share := tables.ChatShare{
+		ChatRoomID: chatRoom.ID,
+		UserID:     chatRoom.UserID,
+	}
+
+	if value := r.FormValue("expires_in_days"); value != "" {
+		days, err := strconv.Atoi(value)
+		life := time.Duration(days) * 24 * time.Hour
+		if err != nil || days <= 0 || life > kmaxShareLife {
+			http.Error(w, "expires_in_days must be between 1 and 365", http.StatusBadRequest)
+			return
+		}
+		expiresAt := time.Now().Add(life)
+		share.ExpiresAt = &expiresAt
+	}
+
+	// only the hash is stored, the link is shown this once
+	slug, slugHash, err := securetoken.Generate(16)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	share.SlugHash = slugHash
+
+	share, err = h.shareRepository.CreateShare(r.Context(), share)
+	if err != nil {
+		http.Error(w, err.Error(), httpStatusForError(err))
+		return
+	}
+
+	share.Slug = slug
+	share.URL = strings.TrimSuffix(appURL(), "/") + "/share/" + slug
+
+	writeJSON(w, http.StatusCreated, share)
+}
+
+// DeleteShare revokes the room's link
+func (h *ShareHandlerImpl) DeleteShare(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(ctxkey.UserIDKey).(uint)
+
+	chatRoomID, ok := pathID(w, r, 2)
+	if !ok {
+		return
+	}
+
+	chatRoom, err := authorizeChatRoom(r.Context(), h.chatRepository, userID, chatRoomID, access.ChatActionManage)
+	if err != nil {
+		http.Error(w, err.Error(), httpStatusForError(err))
+		return
+	}
+
+	if err := h.shareRepository.DeleteShare(r.Context(), chatRoom.ID, chatRoom.UserID); err != nil {
+		http.Error(w, err.Error(), httpStatusForError(err))
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// GetSharedChat returns the shared chat to anyone with the link
+func (h *ShareHandlerImpl) GetSharedChat(w http.ResponseWriter, r *http.Request) {
+	slug, ok := shareSlug(w, r)
+	if !ok {
+		return
+	}
+
+	share, messages, err := h.shareRepository.GetSharedChat(r.Context(), securetoken.Hash(slug))
+	if err != nil {
+		http.Error(w, err.Error(), httpStatusForError(err))
+		return
+	}
+
+	response := SharedChatResponse{
+		Name:      share.Name,
+		SharedAt:  share.CreatedAt,
+		ExpiresAt: share.ExpiresAt,
+		Messages:  make([]SharedMessage, len(messages)),
+	}
+	for i, message := range messages {
+		shared := SharedMessage{
+			Body:        message.Body,
+			IsUser:      message.IsUser,
+			CreatedAt:   message.CreatedAt,
+			Attachments: make([]SharedAttachment, len(message.Attachments)),
+			Embeds:      make([]SharedEmbed, len(message.Embeds)),
+		}
+		for j, attachment := range message.Attachments {
+			shared.Attachments[j] = SharedAttachment{
+				FileName: attachment.FileName,
+				FileType: attachment.FileType,
+				FileSize: attachment.FileSize,
+				URL:      h.fileSigner.SignFileURL(attachment.FilePath, kshareFileUserID),
+			}
+			if attachment.ThumbnailPath != "" {
+				shared.Attachments[j].ThumbnailURL = h.fileSigner.SignFileURL(attachment.ThumbnailPath, kshareFileUserID)
+			}
+		}
+		for j, embed := range message.Embeds {
+			shared.Embeds[j] = SharedEmbed{EmbedType: embed.EmbedType, EmbedKey: embed.EmbedKey, Data: embed.Data}
+		}
+		response.Messages[i] = shared
+	}
+
+	// the signed URLs expire, a cached page would outlive them
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, response)
+}
+
+// ForkSharedChat copies the shared chat into a new room of the user, to continue it there
+func (h *ShareHandlerImpl) ForkSharedChat(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(ctxkey.UserIDKey).(uint)
+
+	slug, ok := shareSlug(w, r)
+	if !ok {
+		return
+	}
+
+	chatRoom, err := h.shareRepository.ForkSharedChat(r.Context(), securetoken.Hash(slug), userID, uuid.New().String())
+	if err != nil {
+		http.Error(w, err.Error(), httpStatusForError(err))
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, chatRoom)
+}
+
+// shareSlug reads the slug from /share/{slug}/...
+func shareSlug(w http.ResponseWriter, r *http.Request) (string, bool) {
+	parts := strings.Split(r.URL.Path, "/")
+	if len(parts) < 3 || parts[2] == "" {
+		http.Error(w, "missing share slug", http.StatusBadRequest)
+		return "", false
+	}
+
+	return parts[2], true
+}
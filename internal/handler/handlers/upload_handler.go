@@ -0,0 +1,341 @@
+package handlers
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"hash/fnv"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/yuhangang/chat-app-backend/internal/db"
+	"github.com/yuhangang/chat-app-backend/internal/db/tables"
+	"github.com/yuhangang/chat-app-backend/internal/service"
+	"github.com/yuhangang/chat-app-backend/internal/service/upload_validation"
+	"github.com/yuhangang/chat-app-backend/pkg/ctxkey"
+)
+
+const ktusVersion = "1.0.0"
+const ktusExtensions = "creation,termination,expiration"
+const kuploadLife = 24 * time.Hour
+const kuploadLockStripes = 64
+
+// UploadHandlerImpl implements the tus 1.0 core protocol with the creation, termination and
+// expiration extensions, see https://tus.io/protocols/resumable-upload
+type UploadHandlerImpl struct {
+	uploadRepository db.UploadRepository
+	userRepository   db.UserRepository
+	storageService   service.StorageService
+
+	// serialises PATCH requests per upload, striped by upload ID so abandoned uploads leave
+	// nothing behind
+	uploadLocks [kuploadLockStripes]sync.Mutex
+}
+
+func NewUploadHandler(uploadRepository db.UploadRepository, userRepository db.UserRepository, storageService service.StorageService) *UploadHandlerImpl {
+	return &UploadHandlerImpl{
+		uploadRepository: uploadRepository,
+		userRepository:   userRepository,
+		storageService:   storageService,
+	}
+}
+
+// UploadOptions advertises the supported tus version, extensions and maximum size
+func (h *UploadHandlerImpl) UploadOptions(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Tus-Resumable", ktusVersion)
+	w.Header().Set("Tus-Version", ktusVersion)
+	w.Header().Set("Tus-Extension", ktusExtensions)
+	w.Header().Set("Tus-Max-Size", strconv.FormatInt(upload_validation.MaxUploadSize(), 10))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// CreateUpload starts a new upload of Upload-Length bytes and returns its location
+func (h *UploadHandlerImpl) CreateUpload(w http.ResponseWriter, r *http.Request) {
+	if !h.checkTusResumable(w, r) {
+		return
+	}
+
+	userID := r.Context().Value(ctxkey.UserIDKey).(uint)
+
+	if r.Header.Get("Upload-Defer-Length") != "" {
+		http.Error(w, "deferred upload length is not supported", http.StatusBadRequest)
+		return
+	}
+
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		http.Error(w, "invalid Upload-Length", http.StatusBadRequest)
+		return
+	}
+
+	user, err := h.userRepository.GetUser(r.Context(), userID)
+	if err != nil {
+		http.Error(w, err.Error(), httpStatusForError(err))
+		return
+	}
+	maxSize := upload_validation.EffectiveMaxUploadSize(user.MaxUploadSize)
+	if err := upload_validation.CheckSize(length, maxSize); err != nil {
+		http.Error(w, err.Error(), httpStatusForError(err))
+		return
+	}
+
+	metadata := parseUploadMetadata(r.Header.Get("Upload-Metadata"))
+	fileName := metadata["filename"]
+	if fileName == "" {
+		fileName = "upload"
+	}
+
+	upload := tables.Upload{
+		ID:        uuid.New().String(),
+		ExpiresAt: time.Now().Add(kuploadLife),
+		UserID:    userID,
+		FileName:  fileName,
+		Length:    length,
+	}
+
+	if err := h.storageService.CreatePartialFile(upload.ID); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	upload, err = h.uploadRepository.CreateUpload(r.Context(), upload)
+	if err != nil {
+		h.storageService.DeletePartialFile(upload.ID)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// an empty file is complete as soon as it exists
+	if length == 0 {
+		if err := h.completeUpload(r, upload); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.Header().Set("Tus-Resumable", ktusVersion)
+	w.Header().Set("Location", "/files/"+upload.ID)
+	w.Header().Set("Upload-Expires", upload.ExpiresAt.UTC().Format(http.TimeFormat))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+
+	json.NewEncoder(w).Encode(map[string]string{"upload_id": upload.ID})
+}
+
+// GetUploadOffset reports how many bytes of the upload the server has
+func (h *UploadHandlerImpl) GetUploadOffset(w http.ResponseWriter, r *http.Request) {
+	if !h.checkTusResumable(w, r) {
+		return
+	}
+
+	upload, ok := h.getUpload(w, r)
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Tus-Resumable", ktusVersion)
+	w.Header().Set("Upload-Offset", strconv.FormatInt(upload.UploadOffset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(upload.Length, 10))
+	w.Header().Set("Upload-Expires", upload.ExpiresAt.UTC().Format(http.TimeFormat))
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+}
+
+// AppendUpload appends the request body at Upload-Offset and completes the upload once
+// every byte has arrived
+func (h *UploadHandlerImpl) AppendUpload(w http.ResponseWriter, r *http.Request) {
+	if !h.checkTusResumable(w, r) {
+		return
+	}
+
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		http.Error(w, "Content-Type must be application/offset+octet-stream", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		http.Error(w, "invalid Upload-Offset", http.StatusBadRequest)
+		return
+	}
+
+	lock := h.uploadLock(uploadIDFromPath(r.URL.Path))
+	lock.Lock()
+	defer lock.Unlock()
+
+	upload, ok := h.getUpload(w, r)
+	if !ok {
+		return
+	}
+
+	if upload.Completed {
+		http.Error(w, "upload is already complete", http.StatusForbidden)
+		return
+	}
+	if offset != upload.UploadOffset {
+		http.Error(w, "Upload-Offset does not match the current offset", http.StatusConflict)
+		return
+	}
+
+	// never accept more than the declared length
+	remaining := upload.Length - upload.UploadOffset
+	if r.ContentLength > remaining {
+		http.Error(w, "chunk exceeds Upload-Length", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	body := http.MaxBytesReader(w, r.Body, remaining)
+	newOffset, writeErr := h.storageService.AppendPartialFile(upload.ID, upload.UploadOffset, body)
+
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(writeErr, &maxBytesErr) {
+		// the offset is left as is, so the oversized chunk is truncated away on the next PATCH
+		http.Error(w, "chunk exceeds Upload-Length", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	// keep whatever arrived, the client resumes from the stored offset
+	if err := h.uploadRepository.UpdateUploadOffset(r.Context(), upload.ID, newOffset); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if writeErr != nil {
+		http.Error(w, writeErr.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	upload.UploadOffset = newOffset
+	if upload.UploadOffset == upload.Length {
+		if err := h.completeUpload(r, upload); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.Header().Set("Tus-Resumable", ktusVersion)
+	w.Header().Set("Upload-Offset", strconv.FormatInt(upload.UploadOffset, 10))
+	w.Header().Set("Upload-Expires", upload.ExpiresAt.UTC().Format(http.TimeFormat))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// DeleteUpload terminates the upload and discards everything received
+func (h *UploadHandlerImpl) DeleteUpload(w http.ResponseWriter, r *http.Request) {
+	if !h.checkTusResumable(w, r) {
+		return
+	}
+
+	// a PATCH in flight would complete the upload, or write its partial file, behind our back
+	lock := h.uploadLock(uploadIDFromPath(r.URL.Path))
+	lock.Lock()
+	defer lock.Unlock()
+
+	upload, ok := h.getUpload(w, r)
+	if !ok {
+		return
+	}
+
+	if err := h.uploadRepository.DeleteUpload(r.Context(), upload.ID); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := h.storageService.DeletePartialFile(upload.ID); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Tus-Resumable", ktusVersion)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// completeUpload streams the assembled file into content-addressed storage
+func (h *UploadHandlerImpl) completeUpload(r *http.Request, upload tables.Upload) error {
+	partialFile, err := h.storageService.OpenPartialFile(upload.ID)
+	if err != nil {
+		return err
+	}
+	defer partialFile.Close()
+
+	fileKey, size, err := h.storageService.SaveFileFrom(upload.FileName, partialFile)
+	if err != nil {
+		return err
+	}
+
+	if err := h.uploadRepository.CompleteUpload(r.Context(), upload.ID, fileKey, size); err != nil {
+		return err
+	}
+
+	return h.storageService.DeletePartialFile(upload.ID)
+}
+
+// uploadLock returns the lock guarding the upload, shared with the uploads of the same stripe
+func (h *UploadHandlerImpl) uploadLock(uploadID string) *sync.Mutex {
+	hash := fnv.New32a()
+	hash.Write([]byte(uploadID))
+
+	return &h.uploadLocks[hash.Sum32()%kuploadLockStripes]
+}
+
+func (h *UploadHandlerImpl) getUpload(w http.ResponseWriter, r *http.Request) (tables.Upload, bool) {
+	uploadID := uploadIDFromPath(r.URL.Path)
+	if _, err := uuid.Parse(uploadID); err != nil {
+		http.NotFound(w, r)
+		return tables.Upload{}, false
+	}
+
+	userID := r.Context().Value(ctxkey.UserIDKey).(uint)
+	upload, err := h.uploadRepository.GetUpload(r.Context(), uploadID, userID)
+	if err != nil {
+		w.Header().Set("Tus-Resumable", ktusVersion)
+		http.Error(w, err.Error(), httpStatusForError(err))
+		return tables.Upload{}, false
+	}
+
+	return upload, true
+}
+
+func (h *UploadHandlerImpl) checkTusResumable(w http.ResponseWriter, r *http.Request) bool {
+	if r.Header.Get("Tus-Resumable") != ktusVersion {
+		w.Header().Set("Tus-Version", ktusVersion)
+		http.Error(w, "unsupported tus version", http.StatusPreconditionFailed)
+		return false
+	}
+
+	return true
+}
+
+func uploadIDFromPath(path string) string {
+	// get upload ID from URL path, /files/{id}
+	parts := strings.Split(path, "/")
+	if len(parts) < 3 {
+		return ""
+	}
+
+	return parts[2]
+}
+
+// parseUploadMetadata decodes the Upload-Metadata header, comma separated "key base64value" pairs
+func parseUploadMetadata(header string) map[string]string {
+	metadata := make(map[string]string)
+	for _, pair := range strings.Split(header, ",") {
+		fields := strings.Fields(pair)
+		if len(fields) == 0 {
+			continue
+		}
+
+		var value string
+		if len(fields) > 1 {
+			decoded, err := base64.StdEncoding.DecodeString(fields[1])
+			if err != nil {
+				continue
+			}
+			value = string(decoded)
+		}
+		metadata[fields[0]] = value
+	}
+
+	return metadata
+}
@@ -1,21 +1,60 @@
 package handlers
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
+	"log"
+	"mime/multipart"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
 
 	"github.com/yuhangang/chat-app-backend/internal/db"
 	"github.com/yuhangang/chat-app-backend/internal/db/tables"
+	"github.com/yuhangang/chat-app-backend/internal/service"
+	"github.com/yuhangang/chat-app-backend/internal/service/image_processing"
+	"github.com/yuhangang/chat-app-backend/internal/service/password"
+	"github.com/yuhangang/chat-app-backend/internal/service/upload_validation"
 	"github.com/yuhangang/chat-app-backend/pkg/ctxkey"
+	"github.com/yuhangang/chat-app-backend/user_errors"
+
+	"golang.org/x/text/language"
 )
 
+const kmaxAvatarSize = 5 << 20
+const kavatarDimension = 512
+const kmaxDisplayNameLength = 100
+
 type UserHandlerImpl struct {
-	userRepository db.UserRepository
+	userRepository       db.UserRepository
+	sessionRepository    db.SessionRepository
+	mfaRepository        db.MfaRepository
+	chatConfigRepository db.ChatConfigRepository
+	storageService       service.StorageService
+	fileSigner           service.FileSigner
+	filePurger           service.FilePurger
 }
 
-func NewUserHandler(userRepo db.UserRepository) *UserHandlerImpl {
+func NewUserHandler(
+	userRepo db.UserRepository,
+	sessionRepo db.SessionRepository,
+	mfaRepo db.MfaRepository,
+	chatConfigRepo db.ChatConfigRepository,
+	storageService service.StorageService,
+	fileSigner service.FileSigner,
+	filePurger service.FilePurger,
+) *UserHandlerImpl {
 	return &UserHandlerImpl{
-		userRepository: userRepo,
+		userRepository:       userRepo,
+		sessionRepository:    sessionRepo,
+		mfaRepository:        mfaRepo,
+		chatConfigRepository: chatConfigRepo,
+		storageService:       storageService,
+		fileSigner:           fileSigner,
+		filePurger:           filePurger,
 	}
 }
 
@@ -39,8 +78,325 @@ func (h *UserHandlerImpl) GetUser(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// DeleteUser permanently deletes the account and everything in it, including stored files.
+// The request must repeat the username as confirm, the password if the account has one, and a
+// code or recovery_code if two-factor authentication is enabled.
+func (h *UserHandlerImpl) DeleteUser(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(ctxkey.UserIDKey).(uint)
+
+	user, err := h.userRepository.GetUser(r.Context(), userID)
+	if err != nil {
+		http.Error(w, err.Error(), httpStatusForError(err))
+		return
+	}
+
+	if r.FormValue("confirm") != user.Username {
+		http.Error(w, "confirm must be the username", http.StatusBadRequest)
+		return
+	}
+	if user.HasPassword() && !password.Verify(user.PasswordHash, r.FormValue("password")) {
+		http.Error(w, "password is incorrect", http.StatusUnauthorized)
+		return
+	}
+
+	mfaEnabled, err := h.mfaRepository.IsMfaEnabled(r.Context(), userID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if mfaEnabled {
+		if err := verifySecondFactor(r, h.userRepository, h.mfaRepository, user); err != nil {
+			http.Error(w, err.Error(), httpStatusForError(err))
+			return
+		}
+	}
+
+	fileKeys, uploadIDs, err := h.userRepository.DeleteUser(r.Context(), userID)
+	if err != nil {
+		http.Error(w, err.Error(), httpStatusForError(err))
+		return
+	}
+
+	// the account is gone either way, leftovers are reclaimed by garbage collection
+	for _, uploadID := range uploadIDs {
+		if err := h.storageService.DeletePartialFile(uploadID); err != nil {
+			log.Printf("Failed to delete partial upload %s: %v", uploadID, err)
+		}
+	}
+	if err := h.filePurger.Purge(r.Context(), fileKeys); err != nil {
+		log.Printf("Failed to purge files of deleted user %d: %v", userID, err)
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ChangePassword sets a new password after checking the current one. Guest accounts have no
+// password yet and set their first one without it. Every other session is signed out.
+func (h *UserHandlerImpl) ChangePassword(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(ctxkey.UserIDKey).(uint)
+	sessionID := r.Context().Value(ctxkey.SessionIDKey).(string)
+	currentPassword := r.FormValue("current_password")
+	newPassword := r.FormValue("new_password")
+
+	if newPassword == "" {
+		http.Error(w, "missing new password", http.StatusBadRequest)
+		return
+	}
+
+	user, err := h.userRepository.GetUser(r.Context(), userID)
+	if err != nil {
+		http.Error(w, err.Error(), httpStatusForError(err))
+		return
+	}
+
+	if user.HasPassword() && !password.Verify(user.PasswordHash, currentPassword) {
+		http.Error(w, "current password is incorrect", http.StatusUnauthorized)
+		return
+	}
+
+	if err := password.CheckStrength(newPassword, user.Username); err != nil {
+		http.Error(w, err.Error(), httpStatusForError(err))
+		return
+	}
+
+	passwordHash, err := password.Hash(newPassword)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err := h.userRepository.SetPassword(r.Context(), userID, passwordHash, sessionID); err != nil {
+		http.Error(w, err.Error(), httpStatusForError(err))
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// GetSessions lists the devices the user is signed in on, marking the one making the request
+func (h *UserHandlerImpl) GetSessions(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(ctxkey.UserIDKey).(uint)
+	currentSessionID := r.Context().Value(ctxkey.SessionIDKey).(string)
+
+	sessions, err := h.sessionRepository.GetActiveSessions(r.Context(), userID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	for i := range sessions {
+		sessions[i].Current = sessions[i].ID == currentSessionID
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+
+	if err := json.NewEncoder(w).Encode(sessions); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// DeleteSession signs the user out on one device
+func (h *UserHandlerImpl) DeleteSession(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(ctxkey.UserIDKey).(uint)
+
+	// get session ID from URL path, /user/sessions/{id}
+	parts := strings.Split(r.URL.Path, "/")
+	if len(parts) < 4 || parts[3] == "" {
+		http.Error(w, "missing session id", http.StatusBadRequest)
+		return
+	}
+
+	if err := h.sessionRepository.RevokeSession(r.Context(), parts[3], userID); err != nil {
+		http.Error(w, err.Error(), httpStatusForError(err))
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *UserHandlerImpl) GetProfile(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(ctxkey.UserIDKey).(uint)
+
+	profile, err := h.userRepository.GetProfile(r.Context(), userID)
+	if err != nil {
+		http.Error(w, err.Error(), httpStatusForError(err))
+		return
+	}
+
+	h.signAvatarURL(&profile)
+
+	writeJSON(w, http.StatusOK, profile)
+}
+
+// UpdateProfile changes the profile fields present in the form and leaves the others alone.
+// An empty value clears a field. The avatar is sent as a multipart image file, or removed with
+// remove_avatar=true.
+func (h *UserHandlerImpl) UpdateProfile(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(ctxkey.UserIDKey).(uint)
+
+	r.Body = http.MaxBytesReader(w, r.Body, kmaxAvatarSize+multipartOverhead)
+	if err := r.ParseMultipartForm(kmaxAvatarSize); err != nil && !errors.Is(err, http.ErrNotMultipart) {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			http.Error(w, user_errors.ErrFileTooLarge.Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	profile, err := h.userRepository.GetProfile(r.Context(), userID)
+	if err != nil {
+		http.Error(w, err.Error(), httpStatusForError(err))
+		return
+	}
+
+	if displayName, ok := formField(r, "display_name"); ok {
+		displayName = strings.TrimSpace(displayName)
+		if utf8.RuneCountInString(displayName) > kmaxDisplayNameLength {
+			http.Error(w, "display_name is too long", http.StatusBadRequest)
+			return
+		}
+		profile.DisplayName = displayName
+	}
+
+	if locale, ok := formField(r, "locale"); ok {
+		if locale != "" {
+			tag, err := language.Parse(locale)
+			if err != nil {
+				http.Error(w, "locale must be a BCP 47 language tag", http.StatusBadRequest)
+				return
+			}
+			locale = tag.String()
+		}
+		profile.Locale = locale
+	}
+
+	if timezone, ok := formField(r, "timezone"); ok {
+		if timezone != "" {
+			// Local would mean the server's zone, not the user's
+			if _, err := time.LoadLocation(timezone); err != nil || timezone == "Local" {
+				http.Error(w, "timezone must be an IANA time zone name", http.StatusBadRequest)
+				return
+			}
+		}
+		profile.Timezone = timezone
+	}
+
+	if theme, ok := formField(r, "theme"); ok {
+		if theme != tables.ThemeSystem && theme != tables.ThemeLight && theme != tables.ThemeDark {
+			http.Error(w, "theme must be one of system, light, dark", http.StatusBadRequest)
+			return
+		}
+		profile.Theme = theme
+	}
+
+	if modelKey, ok := formField(r, "default_model"); ok {
+		if modelKey != "" {
+			if err := checkChatModel(r.Context(), h.chatConfigRepository, modelKey); err != nil {
+				http.Error(w, err.Error(), httpStatusForError(err))
+				return
+			}
+		}
+		profile.DefaultModel = modelKey
+	}
+
+	if persona, ok := formField(r, "default_persona"); ok {
+		if persona != "" {
+			if _, err := h.chatConfigRepository.GetPersonaByKey(r.Context(), persona); err != nil {
+				http.Error(w, err.Error(), httpStatusForError(err))
+				return
+			}
+		}
+		profile.DefaultPersona = persona
+	}
+
+	var avatarSize int64
+	if removeAvatar, _ := strconv.ParseBool(r.FormValue("remove_avatar")); removeAvatar {
+		profile.AvatarKey = ""
+	} else if _, fileHeader, err := r.FormFile("avatar"); err == nil {
+		profile.AvatarKey, avatarSize, err = h.saveAvatar(fileHeader)
+		if err != nil {
+			http.Error(w, err.Error(), httpStatusForError(err))
+			return
+		}
+	} else if !errors.Is(err, http.ErrMissingFile) && !errors.Is(err, http.ErrNotMultipart) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	profile, err = h.userRepository.SaveProfile(r.Context(), profile, avatarSize)
+	if err != nil {
+		http.Error(w, err.Error(), httpStatusForError(err))
+		return
+	}
+
+	h.signAvatarURL(&profile)
+
+	writeJSON(w, http.StatusOK, profile)
+}
+
+// saveAvatar stores the uploaded image downscaled to kavatarDimension and without metadata,
+// and returns its file key and size
+func (h *UserHandlerImpl) saveAvatar(fileHeader *multipart.FileHeader) (string, int64, error) {
+	data, err := readFileHeader(fileHeader, kmaxAvatarSize)
+	if err != nil {
+		return "", 0, err
+	}
+
+	contentType, err := upload_validation.DetectContentType(bytes.NewReader(data))
+	if err != nil {
+		return "", 0, err
+	}
+	if !image_processing.IsProcessable(contentType) {
+		return "", 0, user_errors.ErrUnsupportedMediaType
+	}
+
+	processed, err := image_processing.Process(data, contentType, fileHeader.Filename, kavatarDimension, kavatarDimension)
+	if err != nil {
+		return "", 0, imageProcessingError(err)
+	}
+
+	fileKey, err := h.storageService.SaveFile(processed.FileName, processed.Data)
+	if err != nil {
+		return "", 0, err
+	}
+
+	return fileKey, int64(len(processed.Data)), nil
+}
+
+func (h *UserHandlerImpl) signAvatarURL(profile *tables.UserProfile) {
+	if profile.AvatarKey != "" {
+		profile.AvatarURL = h.fileSigner.SignFileURL(profile.AvatarKey, profile.UserID)
+	}
+}
+
+// formField returns the form value and whether the field was sent at all, so an empty value
+// can clear a field while a missing one leaves it alone
+func formField(r *http.Request, key string) (string, bool) {
+	values, ok := r.Form[key]
+	if !ok || len(values) == 0 {
+		return "", false
+	}
+
+	return values[0], true
+}
+
 type UserResponse struct {
-	AccessToken  string      `json:"access_token"`
-	RefreshToken string      `json:"refresh_token"`
+	AccessToken  string      `json:"access_token,omitempty"`
+	RefreshToken string      `json:"refresh_token,omitempty"`
 	User         tables.User `json:"user"`
+	MfaRequired  bool        `json:"mfa_required,omitempty"`
+	MfaToken     string      `json:"mfa_token,omitempty"` // Sent instead of the tokens when a second login step is needed
+}
+
+// httpStatusForError maps user_errors to their HTTP status, anything else is an internal error
+func httpStatusForError(err error) int {
+	var userErr *user_errors.UserError
+	if errors.As(err, &userErr) {
+		return user_errors.MapErrorCodeToHTTPStatus(userErr.Code)
+	}
+
+	return http.StatusInternalServerError
 }
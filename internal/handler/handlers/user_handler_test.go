@@ -0,0 +1,72 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/yuhangang/chat-app-backend/internal/db/repository"
+	"github.com/yuhangang/chat-app-backend/internal/db/tables"
+	"github.com/yuhangang/chat-app-backend/internal/service/password"
+	"github.com/yuhangang/chat-app-backend/pkg/ctxkey"
+	"github.com/yuhangang/chat-app-backend/pkg/totp"
+
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+func TestDeleteUserRequiresSecondFactor(t *testing.T) {
+	conn, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{TranslateError: true, Logger: logger.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.AutoMigrate(&tables.User{}, &tables.TotpCredential{}, &tables.RecoveryCode{}); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	userRepo := repository.NewUserRepo(conn)
+	mfaRepo := repository.NewMfaRepo(conn)
+
+	hash, err := password.Hash("correct horse battery staple")
+	if err != nil {
+		t.Fatal(err)
+	}
+	user, err := userRepo.CreateUser(ctx, tables.User{Username: "ada", PasswordHash: hash})
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mfaRepo.SaveTotpCredential(ctx, tables.TotpCredential{UserID: user.ID, Secret: secret}); err != nil {
+		t.Fatal(err)
+	}
+	if err := mfaRepo.ConfirmTotpCredential(ctx, user.ID, totp.Step(time.Now())-2, []string{"unused"}); err != nil {
+		t.Fatal(err)
+	}
+
+	h := NewUserHandler(userRepo, nil, mfaRepo, nil, nil, nil, nil)
+
+	for name, code := range map[string]string{"missing code": "", "wrong code": "000000"} {
+		query := url.Values{"confirm": {"ada"}, "password": {"correct horse battery staple"}, "code": {code}}
+		r := httptest.NewRequest(http.MethodDelete, "/user?"+query.Encode(), nil)
+		r = r.WithContext(context.WithValue(r.Context(), ctxkey.UserIDKey, user.ID))
+
+		w := httptest.NewRecorder()
+		h.DeleteUser(w, r)
+
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("%s: status = %d, want %d", name, w.Code, http.StatusUnauthorized)
+		}
+	}
+
+	if _, err := userRepo.GetUser(ctx, user.ID); err != nil {
+		t.Fatalf("user was deleted without the second factor: %v", err)
+	}
+}
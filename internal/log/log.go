@@ -9,6 +9,11 @@ var (
 	ErrorLogger *logrus.Logger
 )
 
+// the loggers are ready on import, nothing has to remember to set them up first
+func init() {
+	SetupLoggers()
+}
+
 func SetupLoggers() {
 
 	InfoLogger = logrus.New()
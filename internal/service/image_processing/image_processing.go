@@ -0,0 +1,199 @@
+package image_processing
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"golang.org/x/image/draw"
+	"golang.org/x/image/webp"
+)
+
+const kdefaultMaxDimension = 2048
+const kdefaultMaxPixels = 40_000_000
+const kdefaultThumbnailDimension = 256
+const kjpegQuality = 90
+const kthumbnailQuality = 80
+
+// ErrImageTooLarge is returned for images declaring more pixels than MaxPixels, they are
+// refused before decoding since a small compressed file can expand to gigabytes
+var ErrImageTooLarge = errors.New("image has too many pixels")
+
+// ProcessedImage is an image re-encoded without metadata, plus a JPEG thumbnail
+type ProcessedImage struct {
+	Data        []byte
+	ContentType string
+	FileName    string
+	Thumbnail   []byte
+}
+
+// IsProcessable reports whether the sniffed content type is an image the pipeline can decode
+func IsProcessable(contentType string) bool {
+	switch contentType {
+	case "image/jpeg", "image/png", "image/gif", "image/webp":
+		return true
+	}
+	return false
+}
+
+// MaxDimension is the longest side images are downscaled to before storage, from IMAGE_MAX_DIMENSION when set
+func MaxDimension() int {
+	return dimensionFromEnv("IMAGE_MAX_DIMENSION", kdefaultMaxDimension)
+}
+
+// MaxPixels is the most pixels, width times height, an image may have to be decoded, from
+// IMAGE_MAX_PIXELS when set
+func MaxPixels() int {
+	return dimensionFromEnv("IMAGE_MAX_PIXELS", kdefaultMaxPixels)
+}
+
+// ThumbnailDimension is the longest side of generated thumbnails, from THUMBNAIL_DIMENSION when set
+func ThumbnailDimension() int {
+	return dimensionFromEnv("THUMBNAIL_DIMENSION", kdefaultThumbnailDimension)
+}
+
+// Process decodes the image, applies its EXIF orientation, downscales it to fit maxDimension
+// and re-encodes it. Re-encoding drops every metadata block, including EXIF GPS data.
+// JPEGs stay JPEG, every other format is stored as PNG.
+func Process(data []byte, contentType string, fileName string, maxDimension int, thumbnailDimension int) (ProcessedImage, error) {
+	img, err := decode(data, contentType)
+	if err != nil {
+		return ProcessedImage{}, err
+	}
+
+	// rotating after downscaling touches fewer pixels, fit is the same either way round
+	img = fit(img, maxDimension, draw.CatmullRom)
+	if contentType == "image/jpeg" {
+		img = applyOrientation(img, jpegOrientation(data))
+	}
+
+	var buffer bytes.Buffer
+	outputType := contentType
+	if contentType == "image/jpeg" {
+		err = jpeg.Encode(&buffer, img, &jpeg.Options{Quality: kjpegQuality})
+	} else {
+		outputType = "image/png"
+		err = png.Encode(&buffer, img)
+	}
+	if err != nil {
+		return ProcessedImage{}, fmt.Errorf("failed to encode image: %w", err)
+	}
+
+	thumbnail, err := thumbnail(img, thumbnailDimension)
+	if err != nil {
+		return ProcessedImage{}, err
+	}
+
+	return ProcessedImage{
+		Data:        buffer.Bytes(),
+		ContentType: outputType,
+		FileName:    fileNameFor(fileName, outputType),
+		Thumbnail:   thumbnail,
+	}, nil
+}
+
+// decode decodes the image after checking from its header that it is not too large
+func decode(data []byte, contentType string) (image.Image, error) {
+	var decodeConfig func(io.Reader) (image.Config, error)
+	var decodeImage func(io.Reader) (image.Image, error)
+
+	switch contentType {
+	case "image/jpeg":
+		decodeConfig, decodeImage = jpeg.DecodeConfig, jpeg.Decode
+	case "image/png":
+		decodeConfig, decodeImage = png.DecodeConfig, png.Decode
+	case "image/gif":
+		// only the first frame is kept
+		decodeConfig, decodeImage = gif.DecodeConfig, gif.Decode
+	case "image/webp":
+		decodeConfig, decodeImage = webp.DecodeConfig, webp.Decode
+	default:
+		return nil, fmt.Errorf("unsupported image type %s", contentType)
+	}
+
+	config, err := decodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode image: %w", err)
+	}
+	if config.Width <= 0 || config.Height <= 0 || config.Width > MaxPixels()/config.Height {
+		return nil, ErrImageTooLarge
+	}
+
+	img, err := decodeImage(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode image: %w", err)
+	}
+
+	return img, nil
+}
+
+// fit scales the image down so its longest side is at most maxDimension, never up
+func fit(img image.Image, maxDimension int, scaler draw.Scaler) image.Image {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if maxDimension <= 0 || (width <= maxDimension && height <= maxDimension) {
+		return img
+	}
+
+	if width >= height {
+		height = max(1, height*maxDimension/width)
+		width = maxDimension
+	} else {
+		width = max(1, width*maxDimension/height)
+		height = maxDimension
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	scaler.Scale(dst, dst.Bounds(), img, bounds, draw.Src, nil)
+
+	return dst
+}
+
+func thumbnail(img image.Image, dimension int) ([]byte, error) {
+	scaled := fit(img, dimension, draw.ApproxBiLinear)
+
+	// JPEG has no alpha channel, so flatten transparent images onto white
+	bounds := scaled.Bounds()
+	flattened := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(flattened, flattened.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+	draw.Draw(flattened, flattened.Bounds(), scaled, bounds.Min, draw.Over)
+
+	var buffer bytes.Buffer
+	if err := jpeg.Encode(&buffer, flattened, &jpeg.Options{Quality: kthumbnailQuality}); err != nil {
+		return nil, fmt.Errorf("failed to encode thumbnail: %w", err)
+	}
+
+	return buffer.Bytes(), nil
+}
+
+func fileNameFor(fileName string, contentType string) string {
+	ext := ".png"
+	if contentType == "image/jpeg" {
+		ext = ".jpg"
+		if current := strings.ToLower(filepath.Ext(fileName)); current == ".jpeg" || current == ".jpg" {
+			return fileName
+		}
+	}
+
+	return strings.TrimSuffix(fileName, filepath.Ext(fileName)) + ext
+}
+
+func dimensionFromEnv(key string, fallback int) int {
+	if value := os.Getenv(key); value != "" {
+		if dimension, err := strconv.Atoi(value); err == nil && dimension > 0 {
+			return dimension
+		}
+	}
+
+	return fallback
+}
@@ -0,0 +1,129 @@
+package image_processing
+
+import (
+	"encoding/binary"
+	"image"
+
+	"golang.org/x/image/draw"
+	"golang.org/x/image/math/f64"
+)
+
+// jpegOrientation returns the EXIF orientation tag (1-8) of a JPEG, or 1 when there is none.
+// Only the APP1 Exif segment is parsed, everything else is skipped.
+func jpegOrientation(data []byte) int {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return 1
+	}
+
+	offset := 2
+	for offset+4 <= len(data) {
+		if data[offset] != 0xFF {
+			return 1
+		}
+		marker := data[offset+1]
+		segmentLength := int(binary.BigEndian.Uint16(data[offset+2:]))
+
+		// start of scan, image data follows and there is no more metadata
+		if marker == 0xDA {
+			return 1
+		}
+
+		segmentEnd := offset + 2 + segmentLength
+		if segmentLength < 2 || segmentEnd > len(data) {
+			return 1
+		}
+
+		if marker == 0xE1 {
+			segment := data[offset+4 : segmentEnd]
+			if len(segment) > 6 && string(segment[:6]) == "Exif\x00\x00" {
+				return tiffOrientation(segment[6:])
+			}
+		}
+
+		offset = segmentEnd
+	}
+
+	return 1
+}
+
+func tiffOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 1
+	}
+
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+
+	ifdOffset := int(order.Uint32(tiff[4:]))
+	if ifdOffset+2 > len(tiff) {
+		return 1
+	}
+
+	entries := int(order.Uint16(tiff[ifdOffset:]))
+	for i := 0; i < entries; i++ {
+		entry := ifdOffset + 2 + i*12
+		if entry+12 > len(tiff) {
+			return 1
+		}
+
+		// 0x0112 is the orientation tag, a SHORT stored inline in the value field
+		if order.Uint16(tiff[entry:]) == 0x0112 {
+			orientation := int(order.Uint16(tiff[entry+8:]))
+			if orientation < 1 || orientation > 8 {
+				return 1
+			}
+			return orientation
+		}
+	}
+
+	return 1
+}
+
+// applyOrientation rotates and flips the image so it displays upright without the EXIF tag
+func applyOrientation(img image.Image, orientation int) image.Image {
+	if orientation <= 1 || orientation > 8 {
+		return img
+	}
+
+	bounds := img.Bounds()
+	width, height := float64(bounds.Dx()), float64(bounds.Dy())
+	minX, minY := float64(bounds.Min.X), float64(bounds.Min.Y)
+
+	// the matrix maps source to destination coordinates, with the source moved to the origin
+	var matrix f64.Aff3
+	switch orientation {
+	case 2: // mirrored horizontally
+		matrix = f64.Aff3{-1, 0, width + minX, 0, 1, -minY}
+	case 3: // rotated 180
+		matrix = f64.Aff3{-1, 0, width + minX, 0, -1, height + minY}
+	case 4: // mirrored vertically
+		matrix = f64.Aff3{1, 0, -minX, 0, -1, height + minY}
+	case 5: // mirrored along the top-left diagonal
+		matrix = f64.Aff3{0, 1, -minY, 1, 0, -minX}
+	case 6: // rotated 90 clockwise
+		matrix = f64.Aff3{0, -1, height + minY, 1, 0, -minX}
+	case 7: // mirrored along the top-right diagonal
+		matrix = f64.Aff3{0, -1, height + minY, -1, 0, width + minX}
+	case 8: // rotated 90 counter-clockwise
+		matrix = f64.Aff3{0, 1, -minY, -1, 0, width + minX}
+	}
+
+	// orientations 5-8 swap the axes
+	dstWidth, dstHeight := bounds.Dx(), bounds.Dy()
+	if orientation >= 5 {
+		dstWidth, dstHeight = dstHeight, dstWidth
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dstWidth, dstHeight))
+
+	// quarter turns and flips land every pixel exactly on another, nearest neighbour copies them
+	draw.NearestNeighbor.Transform(dst, matrix, img, bounds, draw.Src, nil)
+
+	return dst
+}
@@ -0,0 +1,94 @@
+package password
+
+import (
+	"strings"
+	"unicode"
+
+	"github.com/yuhangang/chat-app-backend/user_errors"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const kbcryptCost = 12
+const kminLength = 10
+
+// bcrypt ignores everything past 72 bytes, so longer passwords are rejected rather than truncated
+const kmaxLength = 72
+
+// dummyHash is compared against when the user does not exist, so unknown usernames
+// take as long to reject as wrong passwords
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("dummy password for timing"), kbcryptCost)
+
+// commonPasswords holds, lowercased, popular passwords that would otherwise pass the class check
+var commonPasswords = map[string]bool{
+	"password123!": true, "password1234": true, "p@ssw0rd123": true, "p@ssword123": true,
+	"welcome123!": true, "qwerty12345!": true, "letmein123!": true, "iloveyou123!": true,
+	"admin12345!": true, "changeme123!": true,
+}
+
+// Hash returns the bcrypt hash of the password
+func Hash(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), kbcryptCost)
+	if err != nil {
+		return "", err
+	}
+
+	return string(hash), nil
+}
+
+// Verify compares the password with the hash in constant time. An empty hash, i.e. an account
+// without a password, never matches but still costs a full comparison.
+func Verify(hash string, password string) bool {
+	if hash == "" {
+		bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+		return false
+	}
+
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
+
+// CheckStrength rejects passwords that are too short or long, too simple, too common,
+// or contain the username
+func CheckStrength(password string, username string) error {
+	if len(password) < kminLength {
+		return user_errors.New(user_errors.ErrCodeWeakPassword, "password must be at least 10 characters")
+	}
+	if len(password) > kmaxLength {
+		return user_errors.New(user_errors.ErrCodeWeakPassword, "password must be at most 72 bytes")
+	}
+
+	var hasLower, hasUpper, hasDigit, hasSymbol bool
+	for _, r := range password {
+		switch {
+		case unicode.IsLower(r):
+			hasLower = true
+		case unicode.IsUpper(r):
+			hasUpper = true
+		case unicode.IsDigit(r):
+			hasDigit = true
+		default:
+			hasSymbol = true
+		}
+	}
+
+	classes := 0
+	for _, has := range []bool{hasLower, hasUpper, hasDigit, hasSymbol} {
+		if has {
+			classes++
+		}
+	}
+	if classes < 3 {
+		return user_errors.New(user_errors.ErrCodeWeakPassword,
+			"password must mix at least three of lowercase, uppercase, digits and symbols")
+	}
+
+	lowered := strings.ToLower(password)
+	if commonPasswords[lowered] {
+		return user_errors.New(user_errors.ErrCodeWeakPassword, "password is too common")
+	}
+	if username != "" && strings.Contains(lowered, strings.ToLower(username)) {
+		return user_errors.New(user_errors.ErrCodeWeakPassword, "password must not contain the username")
+	}
+
+	return nil
+}
@@ -1,7 +1,123 @@
 package service
 
-import "mime/multipart"
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+)
 
 type StorageService interface {
-	SaveFile(attachment *multipart.FileHeader) (string, error)
+	SaveFile(fileName string, data []byte) (string, error)
+	SaveFileFrom(fileName string, src io.Reader) (string, int64, error)
+	ReadFile(fileKey string) ([]byte, error)
+	OpenFile(fileKey string) (io.ReadCloser, error)
+	DeleteFile(fileKey string) error
+	StatFile(fileKey string) (FileInfo, error)
+	ListFiles() ([]FileInfo, error)
+	// FileLock guards a stored file between saves reusing it and garbage collection deleting it
+	FileLock(fileKey string) sync.Locker
+
+	CreatePartialFile(uploadID string) error
+	AppendPartialFile(uploadID string, offset int64, src io.Reader) (int64, error)
+	OpenPartialFile(uploadID string) (io.ReadCloser, error)
+	DeletePartialFile(uploadID string) error
+}
+
+type FileInfo struct {
+	Key     string
+	Size    int64
+	ModTime time.Time
+}
+
+// FilePurger deletes stored files that nothing references anymore without waiting for garbage collection
+type FilePurger interface {
+	Purge(ctx context.Context, fileKeys []string) error
+}
+
+// DataExporter builds a user's data export in the background
+type DataExporter interface {
+	Start(exportID string, userID uint)
+}
+
+// Embedder turns text into vectors that lie close together when the texts mean similar things
+type Embedder interface {
+	// Model names the vector space, vectors from different models can't be compared
+	Model() string
+	EmbedDocuments(ctx context.Context, texts []string) ([][]float32, error)
+	EmbedQuery(ctx context.Context, text string) ([]float32, error)
+}
+
+type FileSigner interface {
+	SignFileURL(fileKey string, userID uint) string
+	SignFileURLWithTTL(fileKey string, userID uint, ttl time.Duration) string
+	VerifyFileURL(fileKey string, userID uint, expires int64, signature string) error
+}
+
+// IdentityProvider signs users in with external OAuth2 and OpenID Connect providers
+type IdentityProvider interface {
+	Providers() []string
+	AuthCodeURL(ctx context.Context, provider string, state string, nonce string, codeVerifier string) (string, error)
+	Exchange(ctx context.Context, provider string, code string, codeVerifier string, nonce string) (ExternalIdentity, error)
+}
+
+// ExternalIdentity is a user as verified by an identity provider
+type ExternalIdentity struct {
+	Provider          string
+	Subject           string // Stable user ID at the provider
+	Email             string
+	EmailVerified     bool
+	Name              string
+	PreferredUsername string
+}
+
+// Mailer delivers outgoing email
+type Mailer interface {
+	Send(ctx context.Context, message MailMessage) error
+}
+
+// MailMessage is a plain text email
+type MailMessage struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// EventHub fans live chat room events out to the users watching the room. It keeps who is
+// viewing, typing and waiting on the assistant in memory only, transports such as server sent
+// events or websockets subscribe to it.
+type EventHub interface {
+	// Subscribe starts delivering the room's events to the user, beginning with its current
+	// state. The user counts as viewing the room until the returned func is called. The channel
+	// is closed when unsubscribed, or when the subscriber falls too far behind and should
+	// subscribe again.
+	Subscribe(chatRoomID uint, userID uint) (<-chan RoomEvent, func())
+	Publish(event RoomEvent)
+	// SetTyping marks the user typing in the room, it stops by itself unless renewed
+	SetTyping(chatRoomID uint, userID uint, typing bool)
+	// SetThinking marks the assistant working on a reply to the user's message
+	SetThinking(chatRoomID uint, userID uint, thinking bool)
+	// Disconnect closes the user's subscriptions to the room, e.g. after they lost access
+	Disconnect(chatRoomID uint, userID uint)
+	// DisconnectRoom closes every subscription to the room, e.g. after it was deleted
+	DisconnectRoom(chatRoomID uint)
+}
+
+// Chat room event types
+const (
+	RoomEventPresence = "presence" // UserID started or stopped viewing the room
+	RoomEventTyping   = "typing"   // UserID started or stopped typing
+	RoomEventThinking = "thinking" // the assistant started or stopped replying to UserID
+	RoomEventMessage  = "message"  // UserID posted, MessageID is the reply
+	RoomEventRead     = "read"     // UserID read up to MessageID
+)
+
+// RoomEvent is something that happened in a chat room
+type RoomEvent struct {
+	Type       string    `json:"type"`
+	ChatRoomID uint      `json:"chat_room_id"`
+	UserID     uint      `json:"user_id"`
+	Active     bool      `json:"active"`               // For presence, typing and thinking
+	MessageID  uint      `json:"message_id,omitempty"` // For message and read
+	At         time.Time `json:"at"`
 }
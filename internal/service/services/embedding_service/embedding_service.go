@@ -0,0 +1,109 @@
+package embedding_service
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/yuhangang/chat-app-backend/internal/service"
+
+	"github.com/google/generative-ai-go/genai"
+	"google.golang.org/api/option"
+)
+
+const kdefaultGeminiEmbeddingModel = "text-embedding-004"
+
+// kmaxTextLength is in characters, longer texts are cut so one long message can't fail a batch
+const kmaxTextLength = 8000
+
+// NewEmbeddingServiceV1 picks the embedder named by EMBEDDER: gemini or hash. Gemini is the
+// default. With none, semantic search is off and the returned embedder is nil, as it is when the
+// Gemini client can't be created: the rest of the app runs without semantic search.
+func NewEmbeddingServiceV1(ctx context.Context) (service.Embedder, error) {
+	switch driver := os.Getenv("EMBEDDER"); driver {
+	case "", "gemini":
+		model := os.Getenv("EMBEDDING_MODEL")
+		if model == "" {
+			model = kdefaultGeminiEmbeddingModel
+		}
+		embedder, err := NewGeminiEmbedderV1(ctx, model)
+		if err != nil {
+			log.Printf("Semantic search is off, the Gemini embedder could not be created: %v", err)
+			return nil, nil
+		}
+		return embedder, nil
+	case "hash":
+		return NewHashEmbedderV1(), nil
+	case "none":
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("unknown EMBEDDER %s", driver)
+	}
+}
+
+// GeminiEmbedderV1 embeds with a Gemini embedding model
+type GeminiEmbedderV1 struct {
+	client *genai.Client
+	model  string
+}
+
+func NewGeminiEmbedderV1(ctx context.Context, model string) (*GeminiEmbedderV1, error) {
+	client, err := genai.NewClient(ctx, option.WithAPIKey(os.Getenv("GEMINI_API_KEY")))
+	if err != nil {
+		return nil, err
+	}
+
+	return &GeminiEmbedderV1{client: client, model: model}, nil
+}
+
+func (e *GeminiEmbedderV1) Model() string {
+	return "gemini/" + e.model
+}
+
+func (e *GeminiEmbedderV1) EmbedDocuments(ctx context.Context, texts []string) ([][]float32, error) {
+	return e.embed(ctx, genai.TaskTypeRetrievalDocument, texts)
+}
+
+func (e *GeminiEmbedderV1) EmbedQuery(ctx context.Context, text string) ([]float32, error) {
+	vectors, err := e.embed(ctx, genai.TaskTypeRetrievalQuery, []string{text})
+	if err != nil {
+		return nil, err
+	}
+
+	return vectors[0], nil
+}
+
+func (e *GeminiEmbedderV1) embed(ctx context.Context, taskType genai.TaskType, texts []string) ([][]float32, error) {
+	model := e.client.EmbeddingModel(e.model)
+	model.TaskType = taskType
+
+	batch := model.NewBatch()
+	for _, text := range texts {
+		batch.AddContent(genai.Text(truncate(text)))
+	}
+
+	response, err := model.BatchEmbedContents(ctx, batch)
+	if err != nil {
+		return nil, err
+	}
+	if len(response.Embeddings) != len(texts) {
+		return nil, fmt.Errorf("expected %d embeddings, got %d", len(texts), len(response.Embeddings))
+	}
+
+	vectors := make([][]float32, len(texts))
+	for i, embedding := range response.Embeddings {
+		vectors[i] = embedding.Values
+	}
+
+	return vectors, nil
+}
+
+func truncate(text string) string {
+	runes := []rune(text)
+	if len(runes) > kmaxTextLength {
+		return string(runes[:kmaxTextLength])
+	}
+
+	return text
+}
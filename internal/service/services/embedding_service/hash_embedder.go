@@ -0,0 +1,76 @@
+package embedding_service
+
+import (
+	"context"
+	"hash/fnv"
+	"math"
+	"strings"
+	"unicode"
+)
+
+const khashDimensions = 256
+
+// HashEmbedderV1 hashes words and their character trigrams into a fixed size vector. It runs
+// offline and finds shared words and spellings rather than meaning, for development and tests.
+type HashEmbedderV1 struct{}
+
+func NewHashEmbedderV1() *HashEmbedderV1 {
+	return &HashEmbedderV1{}
+}
+
+func (e *HashEmbedderV1) Model() string {
+	return "hash-256"
+}
+
+func (e *HashEmbedderV1) EmbedDocuments(_ context.Context, texts []string) ([][]float32, error) {
+	vectors := make([][]float32, len(texts))
+	for i, text := range texts {
+		vectors[i] = hashVector(text)
+	}
+
+	return vectors, nil
+}
+
+func (e *HashEmbedderV1) EmbedQuery(_ context.Context, text string) ([]float32, error) {
+	return hashVector(text), nil
+}
+
+func hashVector(text string) []float32 {
+	vector := make([]float32, khashDimensions)
+
+	add := func(feature string, weight float32) {
+		hash := fnv.New32a()
+		hash.Write([]byte(feature))
+		sum := hash.Sum32()
+		// the top bit picks the sign, so unrelated features cancel out rather than pile up
+		if sum&(1<<31) != 0 {
+			weight = -weight
+		}
+		vector[sum%khashDimensions] += weight
+	}
+
+	words := strings.FieldsFunc(strings.ToLower(truncate(text)), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+	for _, word := range words {
+		add("w:"+word, 1)
+
+		runes := []rune("^" + word + "$")
+		for i := 0; i+3 <= len(runes); i++ {
+			add("t:"+string(runes[i:i+3]), 0.5)
+		}
+	}
+
+	var norm float64
+	for _, value := range vector {
+		norm += float64(value * value)
+	}
+	if norm > 0 {
+		scale := float32(1 / math.Sqrt(norm))
+		for i := range vector {
+			vector[i] *= scale
+		}
+	}
+
+	return vector
+}
@@ -0,0 +1,151 @@
+package embedding_service
+
+import (
+	"context"
+	"log"
+	"os"
+	"time"
+
+	"github.com/yuhangang/chat-app-backend/internal/db"
+	"github.com/yuhangang/chat-app-backend/internal/db/tables"
+	"github.com/yuhangang/chat-app-backend/internal/service"
+)
+
+const kdefaultIndexInterval = 1 * time.Minute
+const kindexBatchSize = 32
+
+// kmaxEmbedAttempts is how often a message the embedder rejects is tried before it is left out
+// of semantic search, until the next restart
+const kmaxEmbedAttempts = 3
+
+// IndexerV1 periodically embeds messages that have no embedding from the current model yet. New
+// messages, older ones and all of them after a model change are picked up the same way.
+type IndexerV1 struct {
+	embeddingRepository db.EmbeddingRepository
+	embedder            service.Embedder
+	interval            time.Duration
+	failures            map[uint]int // failed attempts per message, only touched by Index
+}
+
+func NewIndexerV1(embeddingRepository db.EmbeddingRepository, embedder service.Embedder) *IndexerV1 {
+	interval := kdefaultIndexInterval
+	if value := os.Getenv("EMBED_INTERVAL"); value != "" {
+		if parsed, err := time.ParseDuration(value); err == nil && parsed > 0 {
+			interval = parsed
+		}
+	}
+
+	return &IndexerV1{
+		embeddingRepository: embeddingRepository,
+		embedder:            embedder,
+		interval:            interval,
+		failures:            map[uint]int{},
+	}
+}
+
+// Start indexes every interval until the context is cancelled
+func (ix *IndexerV1) Start(ctx context.Context) {
+	ticker := time.NewTicker(ix.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			count, err := ix.Index(ctx)
+			if err != nil {
+				log.Printf("Embedding messages failed after %d: %v", count, err)
+				continue
+			}
+			if count > 0 {
+				log.Printf("Embedded %d messages", count)
+			}
+		}
+	}
+}
+
+// Index embeds pending messages in batches until none are left and returns how many it embedded.
+// A batch that fails is retried message by message, so one message the embedder rejects doesn't
+// hold up the others.
+func (ix *IndexerV1) Index(ctx context.Context) (int, error) {
+	count := 0
+	model := ix.embedder.Model()
+
+	var afterID uint
+	for {
+		messages, err := ix.embeddingRepository.GetUnembeddedMessages(ctx, model, afterID, kindexBatchSize)
+		if err != nil || len(messages) == 0 {
+			return count, err
+		}
+		afterID = messages[len(messages)-1].ID
+
+		pending := make([]tables.ChatMessage, 0, len(messages))
+		for _, message := range messages {
+			if ix.failures[message.ID] < kmaxEmbedAttempts {
+				pending = append(pending, message)
+			}
+		}
+		if len(pending) == 0 {
+			continue
+		}
+
+		err = ix.embed(ctx, model, pending)
+		if err == nil {
+			count += len(pending)
+			continue
+		}
+		if len(pending) == 1 {
+			ix.recordFailure(pending[0].ID, err)
+			continue
+		}
+
+		var failed []uint
+		for _, message := range pending {
+			if err := ix.embed(ctx, model, []tables.ChatMessage{message}); err != nil {
+				failed = append(failed, message.ID)
+				continue
+			}
+			count++
+		}
+
+		// nothing went through at all, the embedder is down rather than the messages at fault
+		if len(failed) == len(pending) {
+			return count, err
+		}
+		for _, messageID := range failed {
+			ix.recordFailure(messageID, err)
+		}
+	}
+}
+
+func (ix *IndexerV1) embed(ctx context.Context, model string, messages []tables.ChatMessage) error {
+	messageIDs := make([]uint, len(messages))
+	texts := make([]string, len(messages))
+	for i, message := range messages {
+		messageIDs[i] = message.ID
+		texts[i] = message.Body
+	}
+
+	vectors, err := ix.embedder.EmbedDocuments(ctx, texts)
+	if err != nil {
+		return err
+	}
+
+	if err := ix.embeddingRepository.SaveEmbeddings(ctx, model, messageIDs, vectors); err != nil {
+		return err
+	}
+
+	for _, messageID := range messageIDs {
+		delete(ix.failures, messageID)
+	}
+
+	return nil
+}
+
+func (ix *IndexerV1) recordFailure(messageID uint, err error) {
+	ix.failures[messageID]++
+	if ix.failures[messageID] == kmaxEmbedAttempts {
+		log.Printf("Leaving message %d out of semantic search after %d failed attempts: %v", messageID, kmaxEmbedAttempts, err)
+	}
+}
@@ -0,0 +1,127 @@
+package embedding_service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/yuhangang/chat-app-backend/internal/db/repository"
+	"github.com/yuhangang/chat-app-backend/internal/db/tables"
+
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// rejectingEmbedder fails every call that includes a text containing reject, and all of them
+// while down
+type rejectingEmbedder struct {
+	HashEmbedderV1
+	reject string
+	down   bool
+	calls  int
+}
+
+func (e *rejectingEmbedder) EmbedDocuments(ctx context.Context, texts []string) ([][]float32, error) {
+	e.calls++
+	if e.down {
+		return nil, errors.New("embedder unavailable")
+	}
+	for _, text := range texts {
+		if strings.Contains(text, e.reject) {
+			return nil, errors.New("text rejected")
+		}
+	}
+
+	return e.HashEmbedderV1.EmbedDocuments(ctx, texts)
+}
+
+func newTestIndexer(t *testing.T, embedder *rejectingEmbedder, bodies ...string) (*IndexerV1, *gorm.DB) {
+	t.Helper()
+
+	conn, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{TranslateError: true, Logger: logger.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.AutoMigrate(&tables.ChatMessage{}, &tables.MessageEmbedding{}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, body := range bodies {
+		if err := conn.Create(&tables.ChatMessage{Body: body, ChatRoomID: 1, IsUser: true}).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return NewIndexerV1(repository.NewEmbeddingRepo(conn), embedder), conn
+}
+
+func embeddedCount(t *testing.T, conn *gorm.DB) int64 {
+	t.Helper()
+
+	var count int64
+	if err := conn.Model(&tables.MessageEmbedding{}).Count(&count).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	return count
+}
+
+func TestIndexSkipsRejectedMessages(t *testing.T) {
+	bodies := make([]string, 2*kindexBatchSize)
+	for i := range bodies {
+		bodies[i] = fmt.Sprintf("message %d", i)
+	}
+	bodies[1] = "poison"
+
+	embedder := &rejectingEmbedder{reject: "poison"}
+	indexer, conn := newTestIndexer(t, embedder, bodies...)
+
+	count, err := indexer.Index(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != len(bodies)-1 {
+		t.Errorf("embedded %d messages, want %d", count, len(bodies)-1)
+	}
+	if stored := embeddedCount(t, conn); stored != int64(len(bodies)-1) {
+		t.Errorf("%d embeddings stored, want %d", stored, len(bodies)-1)
+	}
+
+	// retried a few times, then left alone
+	for i := 1; i < kmaxEmbedAttempts+2; i++ {
+		if _, err := indexer.Index(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	embedder.calls = 0
+	if _, err := indexer.Index(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if embedder.calls != 0 {
+		t.Errorf("embedder was called %d times for a message that kept failing", embedder.calls)
+	}
+}
+
+func TestIndexStopsWhileEmbedderIsDown(t *testing.T) {
+	embedder := &rejectingEmbedder{reject: "poison", down: true}
+	indexer, conn := newTestIndexer(t, embedder, "first", "second")
+
+	if _, err := indexer.Index(context.Background()); err == nil {
+		t.Fatal("Index succeeded with the embedder down")
+	}
+	if len(indexer.failures) != 0 {
+		t.Errorf("an outage counted as failed attempts for %d messages", len(indexer.failures))
+	}
+
+	embedder.down = false
+	count, err := indexer.Index(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 2 || embeddedCount(t, conn) != 2 {
+		t.Errorf("embedded %d messages after the outage, want 2", count)
+	}
+}
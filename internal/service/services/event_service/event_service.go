@@ -0,0 +1,290 @@
+package event_service
+
+import (
+	"sync"
+	"time"
+
+	"github.com/yuhangang/chat-app-backend/internal/service"
+)
+
+// ktypingTimeout ends typing that the client stopped renewing, e.g. because it went away
+const ktypingTimeout = 6 * time.Second
+
+// ksubscriberBuffer is how many events a subscriber may fall behind before it is dropped
+const ksubscriberBuffer = 64
+
+// EventHubV1 is an in-process EventHub, subscribers only see events published on the same
+// server
+type EventHubV1 struct {
+	mu    sync.Mutex
+	rooms map[uint]*room
+}
+
+// room is the live state of a chat room, kept while anyone watches it or something is going on
+type room struct {
+	subscribers map[*subscriber]struct{}
+	viewers     map[uint]int     // Open subscriptions per user
+	typing      map[uint]*typist // Per user
+	thinking    map[uint]int     // Replies being generated per asking user
+}
+
+type subscriber struct {
+	userID uint
+	events chan service.RoomEvent
+}
+
+// typist is a user's typing, it ends when the timer fires unless renewed first
+type typist struct {
+	timer *time.Timer
+}
+
+func NewEventHubV1() *EventHubV1 {
+	return &EventHubV1{rooms: map[uint]*room{}}
+}
+
+func (hub *EventHubV1) Subscribe(chatRoomID uint, userID uint) (<-chan service.RoomEvent, func()) {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+
+	room := hub.room(chatRoomID)
+
+	room.viewers[userID]++
+	if room.viewers[userID] == 1 {
+		hub.broadcast(chatRoomID, room, newEvent(service.RoomEventPresence, chatRoomID, userID, true))
+	}
+
+	// the buffer holds the current state on top of the usual backlog
+	state := hub.state(chatRoomID, room)
+	sub := &subscriber{userID: userID, events: make(chan service.RoomEvent, ksubscriberBuffer+len(state))}
+	for _, event := range state {
+		sub.events <- event
+	}
+	room.subscribers[sub] = struct{}{}
+
+	var once sync.Once
+	unsubscribe := func() {
+		once.Do(func() {
+			hub.mu.Lock()
+			defer hub.mu.Unlock()
+
+			hub.remove(chatRoomID, sub)
+		})
+	}
+
+	return sub.events, unsubscribe
+}
+
+func (hub *EventHubV1) Publish(event service.RoomEvent) {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+
+	room, ok := hub.rooms[event.ChatRoomID]
+	if !ok {
+		return
+	}
+	if event.At.IsZero() {
+		event.At = time.Now()
+	}
+
+	hub.broadcast(event.ChatRoomID, room, event)
+}
+
+func (hub *EventHubV1) SetTyping(chatRoomID uint, userID uint, typing bool) {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+
+	if !typing {
+		if room, ok := hub.rooms[chatRoomID]; ok {
+			hub.stopTyping(chatRoomID, room, userID)
+			hub.cleanup(chatRoomID, room)
+		}
+		return
+	}
+
+	room := hub.room(chatRoomID)
+
+	current, renewed := room.typing[userID]
+	if renewed {
+		current.timer.Stop()
+	}
+
+	next := &typist{}
+	next.timer = time.AfterFunc(ktypingTimeout, func() {
+		hub.expireTyping(chatRoomID, userID, next)
+	})
+	room.typing[userID] = next
+
+	if !renewed {
+		hub.broadcast(chatRoomID, room, newEvent(service.RoomEventTyping, chatRoomID, userID, true))
+	}
+}
+
+func (hub *EventHubV1) SetThinking(chatRoomID uint, userID uint, thinking bool) {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+
+	room := hub.room(chatRoomID)
+	defer hub.cleanup(chatRoomID, room)
+
+	if thinking {
+		room.thinking[userID]++
+		if room.thinking[userID] == 1 {
+			hub.broadcast(chatRoomID, room, newEvent(service.RoomEventThinking, chatRoomID, userID, true))
+		}
+		return
+	}
+
+	if room.thinking[userID] == 0 {
+		return
+	}
+	room.thinking[userID]--
+	if room.thinking[userID] == 0 {
+		delete(room.thinking, userID)
+		hub.broadcast(chatRoomID, room, newEvent(service.RoomEventThinking, chatRoomID, userID, false))
+	}
+}
+
+func (hub *EventHubV1) Disconnect(chatRoomID uint, userID uint) {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+
+	room, ok := hub.rooms[chatRoomID]
+	if !ok {
+		return
+	}
+
+	for sub := range room.subscribers {
+		if sub.userID == userID {
+			hub.remove(chatRoomID, sub)
+		}
+	}
+}
+
+func (hub *EventHubV1) DisconnectRoom(chatRoomID uint) {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+
+	room, ok := hub.rooms[chatRoomID]
+	if !ok {
+		return
+	}
+
+	for sub := range room.subscribers {
+		hub.remove(chatRoomID, sub)
+	}
+}
+
+// room returns the room's state, starting it if nothing is going on in the room
+func (hub *EventHubV1) room(chatRoomID uint) *room {
+	if existing, ok := hub.rooms[chatRoomID]; ok {
+		return existing
+	}
+
+	created := &room{
+		subscribers: map[*subscriber]struct{}{},
+		viewers:     map[uint]int{},
+		typing:      map[uint]*typist{},
+		thinking:    map[uint]int{},
+	}
+	hub.rooms[chatRoomID] = created
+
+	return created
+}
+
+// cleanup forgets the room once nothing is going on in it
+func (hub *EventHubV1) cleanup(chatRoomID uint, room *room) {
+	// viewers rather than subscribers, a subscription counts from before it is added
+	if len(room.viewers) == 0 && len(room.typing) == 0 && len(room.thinking) == 0 {
+		delete(hub.rooms, chatRoomID)
+	}
+}
+
+// state describes what is going on in the room as events, for new subscribers
+func (hub *EventHubV1) state(chatRoomID uint, room *room) []service.RoomEvent {
+	var events []service.RoomEvent
+	for userID := range room.viewers {
+		events = append(events, newEvent(service.RoomEventPresence, chatRoomID, userID, true))
+	}
+	for userID := range room.typing {
+		events = append(events, newEvent(service.RoomEventTyping, chatRoomID, userID, true))
+	}
+	for userID := range room.thinking {
+		events = append(events, newEvent(service.RoomEventThinking, chatRoomID, userID, true))
+	}
+
+	return events
+}
+
+// broadcast sends the event to the room's subscribers. Subscribers whose buffer is full are
+// dropped rather than holding up the others, they resubscribe and get the current state.
+func (hub *EventHubV1) broadcast(chatRoomID uint, room *room, event service.RoomEvent) {
+	var behind []*subscriber
+	for sub := range room.subscribers {
+		select {
+		case sub.events <- event:
+		default:
+			behind = append(behind, sub)
+		}
+	}
+
+	for _, sub := range behind {
+		hub.remove(chatRoomID, sub)
+	}
+}
+
+// remove ends the subscription, the user stops viewing the room with their last one
+func (hub *EventHubV1) remove(chatRoomID uint, sub *subscriber) {
+	room, ok := hub.rooms[chatRoomID]
+	if !ok {
+		return
+	}
+	if _, ok := room.subscribers[sub]; !ok {
+		return
+	}
+
+	delete(room.subscribers, sub)
+	close(sub.events)
+
+	room.viewers[sub.userID]--
+	if room.viewers[sub.userID] == 0 {
+		delete(room.viewers, sub.userID)
+		hub.stopTyping(chatRoomID, room, sub.userID)
+		hub.broadcast(chatRoomID, room, newEvent(service.RoomEventPresence, chatRoomID, sub.userID, false))
+	}
+
+	hub.cleanup(chatRoomID, room)
+}
+
+func (hub *EventHubV1) stopTyping(chatRoomID uint, room *room, userID uint) {
+	current, ok := room.typing[userID]
+	if !ok {
+		return
+	}
+
+	current.timer.Stop()
+	delete(room.typing, userID)
+	hub.broadcast(chatRoomID, room, newEvent(service.RoomEventTyping, chatRoomID, userID, false))
+}
+
+func (hub *EventHubV1) expireTyping(chatRoomID uint, userID uint, expired *typist) {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+
+	room, ok := hub.rooms[chatRoomID]
+	if !ok || room.typing[userID] != expired {
+		return
+	}
+
+	hub.stopTyping(chatRoomID, room, userID)
+	hub.cleanup(chatRoomID, room)
+}
+
+func newEvent(eventType string, chatRoomID uint, userID uint, active bool) service.RoomEvent {
+	return service.RoomEvent{
+		Type:       eventType,
+		ChatRoomID: chatRoomID,
+		UserID:     userID,
+		Active:     active,
+		At:         time.Now(),
+	}
+}
@@ -0,0 +1,208 @@
+package export_service
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/yuhangang/chat-app-backend/internal/db"
+	"github.com/yuhangang/chat-app-backend/internal/db/tables"
+	"github.com/yuhangang/chat-app-backend/internal/service"
+)
+
+// kbuildTimeout bounds one export, a stuck build is marked failed so the user can ask again
+const kbuildTimeout = 30 * time.Minute
+
+// ExportServiceV1 builds data exports as ZIP files: the profile as JSON, every chat room as
+// JSON and Markdown, and every attachment file
+type ExportServiceV1 struct {
+	ctx              context.Context
+	exportRepository db.ExportRepository
+	userRepository   db.UserRepository
+	chatRepository   db.ChatRepository
+	storageService   service.StorageService
+}
+
+func NewExportServiceV1(
+	ctx context.Context,
+	exportRepository db.ExportRepository,
+	userRepository db.UserRepository,
+	chatRepository db.ChatRepository,
+	storageService service.StorageService,
+) *ExportServiceV1 {
+	return &ExportServiceV1{
+		ctx:              ctx,
+		exportRepository: exportRepository,
+		userRepository:   userRepository,
+		chatRepository:   chatRepository,
+		storageService:   storageService,
+	}
+}
+
+// Start builds the export in the background and records the result on it
+func (s *ExportServiceV1) Start(exportID string, userID uint) {
+	go func() {
+		ctx, cancel := context.WithTimeout(s.ctx, kbuildTimeout)
+		defer cancel()
+
+		if err := s.build(ctx, exportID, userID); err != nil {
+			log.Printf("Failed to build export %s: %v", exportID, err)
+			if err := s.exportRepository.FailExport(context.Background(), exportID, "export could not be built"); err != nil {
+				log.Printf("Failed to mark export %s failed: %v", exportID, err)
+			}
+		}
+	}()
+}
+
+func (s *ExportServiceV1) build(ctx context.Context, exportID string, userID uint) error {
+	user, err := s.userRepository.GetUser(ctx, userID)
+	if err != nil {
+		return err
+	}
+
+	profile, err := s.userRepository.GetProfile(ctx, userID)
+	if err != nil {
+		return err
+	}
+
+	chatRooms, err := s.chatRepository.GetChatRoomsWithMessages(ctx, userID)
+	if err != nil {
+		return err
+	}
+
+	// the archive is streamed into storage as it is written
+	reader, writer := io.Pipe()
+	go func() {
+		writer.CloseWithError(s.writeArchive(ctx, writer, user, profile, chatRooms))
+	}()
+
+	fileKey, size, err := s.storageService.SaveFileFrom("export.zip", reader)
+	// unblocks the writer if storage gave up before the archive was complete
+	reader.Close()
+	if err != nil {
+		return err
+	}
+
+	return s.exportRepository.CompleteExport(ctx, exportID, fileKey, size)
+}
+
+// writeArchive writes the export as a ZIP file to dst
+func (s *ExportServiceV1) writeArchive(ctx context.Context, dst io.Writer, user tables.User, profile tables.UserProfile, chatRooms []tables.ChatRoom) error {
+	archive := zip.NewWriter(dst)
+
+	err := writeJSON(archive, "profile.json", map[string]interface{}{"user": user, "profile": profile})
+	if err != nil {
+		return err
+	}
+
+	if profile.AvatarKey != "" {
+		s.writeFile(archive, "avatar"+path.Ext(profile.AvatarKey), profile.AvatarKey)
+	}
+
+	for _, chatRoom := range chatRooms {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		// rooms shared with the user are exported without their owner's folder and pin
+		if chatRoom.UserID != user.ID {
+			chatRoom.HideOrganizer()
+		}
+
+		// attachments are stored next to the chats, the url points at the copy in the archive
+		for i := range chatRoom.ChatMessages {
+			for j := range chatRoom.ChatMessages[i].Attachments {
+				attachment := &chatRoom.ChatMessages[i].Attachments[j]
+				attachment.URL = fmt.Sprintf("attachments/%d/%d-%s", chatRoom.ID, attachment.ID, safeFileName(attachment.FileName))
+				s.writeFile(archive, attachment.URL, attachment.FilePath)
+			}
+		}
+
+		name := fmt.Sprintf("chats/%d", chatRoom.ID)
+		if err := writeJSON(archive, name+".json", chatRoom); err != nil {
+			return err
+		}
+		if err := writeEntry(archive, name+".md", []byte(markdown(chatRoom))); err != nil {
+			return err
+		}
+	}
+
+	return archive.Close()
+}
+
+// writeFile copies a stored file into the archive. A file missing from storage is left out
+// rather than failing the whole export.
+func (s *ExportServiceV1) writeFile(archive *zip.Writer, name string, fileKey string) {
+	data, err := s.storageService.ReadFile(fileKey)
+	if err != nil {
+		log.Printf("Leaving %s out of export: %v", fileKey, err)
+		return
+	}
+
+	if err := writeEntry(archive, name, data); err != nil {
+		log.Printf("Leaving %s out of export: %v", fileKey, err)
+	}
+}
+
+func writeJSON(archive *zip.Writer, name string, value interface{}) error {
+	data, err := json.MarshalIndent(value, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return writeEntry(archive, name, data)
+}
+
+func writeEntry(archive *zip.Writer, name string, data []byte) error {
+	writer, err := archive.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate, Modified: time.Now()})
+	if err != nil {
+		return err
+	}
+
+	_, err = writer.Write(data)
+
+	return err
+}
+
+// markdown renders the chat as a readable transcript, linking attachments to their archive copies
+func markdown(chatRoom tables.ChatRoom) string {
+	var builder strings.Builder
+
+	fmt.Fprintf(&builder, "# %s\n\n", chatRoom.Name)
+	fmt.Fprintf(&builder, "Created %s\n", chatRoom.CreatedAt.UTC().Format(time.RFC3339))
+
+	for _, message := range chatRoom.ChatMessages {
+		author := "Assistant"
+		if message.IsUser {
+			author = "You"
+		}
+
+		fmt.Fprintf(&builder, "\n## %s, %s\n\n%s\n", author, message.CreatedAt.UTC().Format(time.RFC3339), message.Body)
+
+		if len(message.Attachments) > 0 {
+			builder.WriteString("\n")
+		}
+		for _, attachment := range message.Attachments {
+			// the chats folder sits next to the attachments folder
+			fmt.Fprintf(&builder, "- [%s](../%s)\n", attachment.FileName, attachment.URL)
+		}
+	}
+
+	return builder.String()
+}
+
+// safeFileName keeps only the base name, so a stored file name can't place an entry outside its folder
+func safeFileName(fileName string) string {
+	name := path.Base(strings.ReplaceAll(fileName, "\\", "/"))
+	if name == "." || name == "/" || name == ".." {
+		return "file"
+	}
+
+	return name
+}
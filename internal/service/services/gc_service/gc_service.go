@@ -0,0 +1,261 @@
+package gc_service
+
+import (
+	"context"
+	"log"
+	"os"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/yuhangang/chat-app-backend/internal/db"
+	"github.com/yuhangang/chat-app-backend/internal/db/tables"
+	"github.com/yuhangang/chat-app-backend/internal/service"
+)
+
+const kdefaultInterval = 1 * time.Hour
+const kdefaultTrashRetentionDays = 30
+
+// contentAddressedKey matches the keys the storage service names files by. Files named
+// otherwise were not written by it and are never collected.
+var contentAddressedKey = regexp.MustCompile(`^[0-9a-f]{64}(\.[a-z0-9]+)?$`)
+
+// kgracePeriod protects files written by uploads whose attachment row is not committed yet
+const kgracePeriod = 1 * time.Hour
+
+// Report lists what a collection run deleted, or would delete in dry-run mode
+type Report struct {
+	DryRun         bool     `json:"dry_run"`
+	ExpiredUploads []string `json:"expired_uploads"`
+	ExpiredExports []string `json:"expired_exports"`
+	PurgedRooms    []uint   `json:"purged_rooms"`
+	OrphanBlobs    []string `json:"orphan_blobs"`
+	UntrackedFiles []string `json:"untracked_files"`
+	ReclaimedBytes int64    `json:"reclaimed_bytes"`
+}
+
+// GarbageCollectorV1 periodically removes stored files whose blob reference count dropped to zero
+type GarbageCollectorV1 struct {
+	blobRepository   db.BlobRepository
+	uploadRepository db.UploadRepository
+	exportRepository db.ExportRepository
+	chatRepository   db.ChatRepository
+	storageService   service.StorageService
+	interval         time.Duration
+	trashRetention   time.Duration
+	dryRun           bool
+}
+
+func NewGarbageCollectorV1(
+	blobRepository db.BlobRepository,
+	uploadRepository db.UploadRepository,
+	exportRepository db.ExportRepository,
+	chatRepository db.ChatRepository,
+	storageService service.StorageService,
+) *GarbageCollectorV1 {
+	interval := kdefaultInterval
+	if value := os.Getenv("GC_INTERVAL"); value != "" {
+		if parsed, err := time.ParseDuration(value); err == nil && parsed > 0 {
+			interval = parsed
+		}
+	}
+
+	retentionDays := kdefaultTrashRetentionDays
+	if value := os.Getenv("TRASH_RETENTION_DAYS"); value != "" {
+		if parsed, err := strconv.Atoi(value); err == nil && parsed > 0 {
+			retentionDays = parsed
+		}
+	}
+
+	return &GarbageCollectorV1{
+		blobRepository:   blobRepository,
+		uploadRepository: uploadRepository,
+		exportRepository: exportRepository,
+		chatRepository:   chatRepository,
+		storageService:   storageService,
+		interval:         interval,
+		trashRetention:   time.Duration(retentionDays) * 24 * time.Hour,
+		dryRun:           os.Getenv("GC_DRY_RUN") == "true",
+	}
+}
+
+// Start runs a collection every interval until the context is cancelled
+func (gc *GarbageCollectorV1) Start(ctx context.Context) {
+	ticker := time.NewTicker(gc.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			report, err := gc.Collect(ctx, gc.dryRun)
+			if err != nil {
+				log.Printf("Garbage collection failed: %v", err)
+				continue
+			}
+			log.Printf("Garbage collection (dry run: %t): %d expired uploads, %d expired exports, %d purged rooms, %d orphan blobs, %d untracked files, %d bytes",
+				report.DryRun, len(report.ExpiredUploads), len(report.ExpiredExports), len(report.PurgedRooms), len(report.OrphanBlobs), len(report.UntrackedFiles), report.ReclaimedBytes)
+			if report.DryRun {
+				log.Printf("Garbage collection would delete blobs %v and untracked files %v", report.OrphanBlobs, report.UntrackedFiles)
+			}
+		}
+	}
+}
+
+// Collect deletes expired resumable uploads and data exports and purges rooms that were in the
+// trash longer than the retention period, then deletes orphan blobs and untracked files older
+// than the grace period. In dry-run mode nothing is deleted and the report lists what would have
+// been, except for exports and rooms, which are only reported once deleted.
+func (gc *GarbageCollectorV1) Collect(ctx context.Context, dryRun bool) (Report, error) {
+	report := Report{DryRun: dryRun}
+	cutoff := time.Now().Add(-kgracePeriod)
+
+	expired, err := gc.uploadRepository.GetExpiredUploads(ctx, time.Now())
+	if err != nil {
+		return report, err
+	}
+
+	for _, upload := range expired {
+		if !dryRun {
+			if err := gc.uploadRepository.DeleteUpload(ctx, upload.ID); err != nil {
+				return report, err
+			}
+			if err := gc.storageService.DeletePartialFile(upload.ID); err != nil {
+				return report, err
+			}
+		}
+
+		report.ExpiredUploads = append(report.ExpiredUploads, upload.ID)
+	}
+
+	if !dryRun {
+		report.ExpiredExports, err = gc.exportRepository.DeleteExpiredExports(ctx, time.Now())
+		if err != nil {
+			return report, err
+		}
+
+		report.PurgedRooms, err = gc.chatRepository.PurgeDeletedRooms(ctx, time.Now().Add(-gc.trashRetention))
+		if err != nil {
+			return report, err
+		}
+	}
+
+	orphans, err := gc.blobRepository.GetOrphanBlobs(ctx, cutoff)
+	if err != nil {
+		return report, err
+	}
+
+	for _, blob := range orphans {
+		collected, err := gc.deleteOrphanBlob(ctx, blob, cutoff, dryRun)
+		if err != nil {
+			return report, err
+		}
+		if !collected {
+			continue
+		}
+
+		report.OrphanBlobs = append(report.OrphanBlobs, blob.FileKey)
+		report.ReclaimedBytes += blob.Size
+	}
+
+	files, err := gc.storageService.ListFiles()
+	if err != nil {
+		return report, err
+	}
+
+	var candidates []string
+	sizes := make(map[string]int64)
+	for _, file := range files {
+		if file.ModTime.Before(cutoff) && contentAddressedKey.MatchString(file.Key) {
+			candidates = append(candidates, file.Key)
+			sizes[file.Key] = file.Size
+		}
+	}
+
+	untracked, err := gc.blobRepository.GetUntrackedFileKeys(ctx, candidates)
+	if err != nil {
+		return report, err
+	}
+
+	for _, fileKey := range untracked {
+		collected, err := gc.deleteUntrackedFile(ctx, fileKey, cutoff, dryRun)
+		if err != nil {
+			return report, err
+		}
+		if !collected {
+			continue
+		}
+
+		report.UntrackedFiles = append(report.UntrackedFiles, fileKey)
+		report.ReclaimedBytes += sizes[fileKey]
+	}
+
+	return report, nil
+}
+
+// Purge deletes the files of the keys right away if nothing references them anymore, instead of
+// waiting for the next collection. Files touched within the grace period may be in use by an
+// upload that is about to reference them and are left to the regular collection.
+func (gc *GarbageCollectorV1) Purge(ctx context.Context, fileKeys []string) error {
+	cutoff := time.Now().Add(-kgracePeriod)
+
+	orphans, err := gc.blobRepository.GetOrphanBlobsByKeys(ctx, fileKeys)
+	if err != nil {
+		return err
+	}
+
+	for _, blob := range orphans {
+		if _, err := gc.deleteOrphanBlob(ctx, blob, cutoff, false); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// deleteOrphanBlob deletes the blob and its file unless it was referenced again or its file was
+// touched after the cutoff, and reports whether it was, or in dry-run mode would be, deleted.
+// The file's lock keeps a save from reusing the file between the checks and the delete.
+func (gc *GarbageCollectorV1) deleteOrphanBlob(ctx context.Context, blob tables.Blob, cutoff time.Time, dryRun bool) (bool, error) {
+	lock := gc.storageService.FileLock(blob.FileKey)
+	lock.Lock()
+	defer lock.Unlock()
+
+	// a dedup hit touches the file, so a recent mtime means an upload is reusing it
+	if info, err := gc.storageService.StatFile(blob.FileKey); err == nil && info.ModTime.After(cutoff) {
+		return false, nil
+	}
+	if dryRun {
+		return true, nil
+	}
+
+	deleted, err := gc.blobRepository.DeleteOrphanBlob(ctx, blob.ID)
+	if err != nil || !deleted {
+		return false, err
+	}
+
+	return true, gc.storageService.DeleteFile(blob.FileKey)
+}
+
+// deleteUntrackedFile deletes a file that had no blob when listed, unless it was saved again
+// after the cutoff or got a blob since, and reports whether it was, or would be, deleted
+func (gc *GarbageCollectorV1) deleteUntrackedFile(ctx context.Context, fileKey string, cutoff time.Time, dryRun bool) (bool, error) {
+	lock := gc.storageService.FileLock(fileKey)
+	lock.Lock()
+	defer lock.Unlock()
+
+	info, err := gc.storageService.StatFile(fileKey)
+	if err != nil || info.ModTime.After(cutoff) {
+		return false, nil
+	}
+	untracked, err := gc.blobRepository.GetUntrackedFileKeys(ctx, []string{fileKey})
+	if err != nil || len(untracked) == 0 {
+		return false, err
+	}
+	if dryRun {
+		return true, nil
+	}
+
+	return true, gc.storageService.DeleteFile(fileKey)
+}
@@ -0,0 +1,241 @@
+package gc_service
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/yuhangang/chat-app-backend/internal/db/repository"
+	"github.com/yuhangang/chat-app-backend/internal/db/tables"
+	"github.com/yuhangang/chat-app-backend/internal/service/services/storage_service"
+
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// newTestCollector returns a collector over an in-memory database and a temporary upload
+// directory, with the directory's path
+func newTestCollector(t *testing.T) (*GarbageCollectorV1, *gorm.DB, *storage_service.StorageServiceV1, string) {
+	t.Helper()
+
+	conn, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{TranslateError: true, Logger: logger.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = conn.AutoMigrate(&tables.Blob{}, &tables.Upload{}, &tables.DataExport{}, &tables.ChatRoom{}, &tables.ChatMessage{},
+		&tables.ChatAttachment{}, &tables.ChatEmbed{}, &tables.MessageEmbedding{}, &tables.ChatRoomTag{}, &tables.ChatShare{},
+		&tables.ChatShareMessage{}, &tables.ChatRoomMember{}, &tables.ChatRoomRead{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	uploadDir := t.TempDir()
+	t.Setenv("UPLOAD_DIR", uploadDir)
+	storageService := storage_service.NewStorageServiceV1()
+
+	gc := NewGarbageCollectorV1(repository.NewBlobRepo(conn), repository.NewUploadRepo(conn), repository.NewExportRepo(conn),
+		repository.NewChatRoomRepo(conn), storageService)
+
+	return gc, conn, storageService, uploadDir
+}
+
+// age moves the file's modification time, and the blob's last release if it has one, past the
+// grace period
+func age(t *testing.T, conn *gorm.DB, uploadDir string, fileKey string) {
+	t.Helper()
+
+	old := time.Now().Add(-2 * kgracePeriod)
+	if err := os.Chtimes(filepath.Join(uploadDir, fileKey), old, old); err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.Model(&tables.Blob{}).Where("file_key = ?", fileKey).UpdateColumn("updated_at", old).Error; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func exists(uploadDir string, fileKey string) bool {
+	_, err := os.Stat(filepath.Join(uploadDir, fileKey))
+	return err == nil
+}
+
+func TestCollectDeletesUnreferencedFiles(t *testing.T) {
+	gc, conn, storageService, uploadDir := newTestCollector(t)
+	ctx := context.Background()
+
+	save := func(name string, content string) string {
+		fileKey, err := storageService.SaveFile(name, []byte(content))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return fileKey
+	}
+	referenced := save("kept.txt", "still attached")
+	orphan := save("orphan.txt", "attachment deleted")
+	untracked := save("untracked.txt", "upload failed before its reference")
+	recent := save("recent.txt", "upload about to take its reference")
+	if err := os.WriteFile(filepath.Join(uploadDir, "notes.txt"), []byte("not ours"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	blobs := []tables.Blob{
+		{FileKey: referenced, Size: 14, RefCount: 1},
+		{FileKey: orphan, Size: 18, RefCount: 0},
+	}
+	if err := conn.Create(&blobs).Error; err != nil {
+		t.Fatal(err)
+	}
+	for _, fileKey := range []string{referenced, orphan, untracked, "notes.txt"} {
+		age(t, conn, uploadDir, fileKey)
+	}
+
+	wantOrphans := []string{orphan}
+	wantUntracked := []string{untracked}
+	wantBytes := int64(18 + len("upload failed before its reference"))
+
+	report, err := gc.Collect(ctx, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.DryRun || !reflect.DeepEqual(report.OrphanBlobs, wantOrphans) || !reflect.DeepEqual(report.UntrackedFiles, wantUntracked) {
+		t.Errorf("dry run reported orphans %v and untracked %v, want %v and %v", report.OrphanBlobs, report.UntrackedFiles, wantOrphans, wantUntracked)
+	}
+	if report.ReclaimedBytes != wantBytes {
+		t.Errorf("dry run reclaims %d bytes, want %d", report.ReclaimedBytes, wantBytes)
+	}
+	for _, fileKey := range []string{referenced, orphan, untracked, recent, "notes.txt"} {
+		if !exists(uploadDir, fileKey) {
+			t.Errorf("dry run deleted %s", fileKey)
+		}
+	}
+
+	report, err = gc.Collect(ctx, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(report.OrphanBlobs, wantOrphans) || !reflect.DeepEqual(report.UntrackedFiles, wantUntracked) || report.ReclaimedBytes != wantBytes {
+		t.Errorf("collection reported orphans %v, untracked %v and %d bytes, want %v, %v and %d",
+			report.OrphanBlobs, report.UntrackedFiles, report.ReclaimedBytes, wantOrphans, wantUntracked, wantBytes)
+	}
+	for _, fileKey := range []string{orphan, untracked} {
+		if exists(uploadDir, fileKey) {
+			t.Errorf("%s was not deleted", fileKey)
+		}
+	}
+	for _, fileKey := range []string{referenced, recent, "notes.txt"} {
+		if !exists(uploadDir, fileKey) {
+			t.Errorf("%s was deleted", fileKey)
+		}
+	}
+
+	var remaining []string
+	conn.Model(&tables.Blob{}).Order("file_key").Pluck("file_key", &remaining)
+	if !reflect.DeepEqual(remaining, []string{referenced}) {
+		t.Errorf("blobs left %v, want only the referenced %s", remaining, referenced)
+	}
+}
+
+func TestCollectKeepsOrphansSavedAgain(t *testing.T) {
+	gc, conn, storageService, uploadDir := newTestCollector(t)
+	ctx := context.Background()
+
+	fileKey, err := storageService.SaveFile("report.pdf", []byte("quarterly report"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.Create(&tables.Blob{FileKey: fileKey, Size: 16}).Error; err != nil {
+		t.Fatal(err)
+	}
+	age(t, conn, uploadDir, fileKey)
+
+	// the same content uploaded again, its attachment isn't committed yet
+	if _, err := storageService.SaveFile("copy.pdf", []byte("quarterly report")); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := gc.Collect(ctx, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.OrphanBlobs) != 0 || !exists(uploadDir, fileKey) {
+		t.Fatalf("collected %v, want the file saved again to stay", report.OrphanBlobs)
+	}
+
+	if err := gc.Purge(ctx, []string{fileKey}); err != nil {
+		t.Fatal(err)
+	}
+	if !exists(uploadDir, fileKey) {
+		t.Fatal("purge deleted the file saved again")
+	}
+
+	age(t, conn, uploadDir, fileKey)
+	if err := gc.Purge(ctx, []string{fileKey}); err != nil {
+		t.Fatal(err)
+	}
+	if exists(uploadDir, fileKey) {
+		t.Error("purge kept the unreferenced file")
+	}
+}
+
+func TestCollectKeepsCompletedUploadsUntilTheyExpire(t *testing.T) {
+	gc, conn, storageService, uploadDir := newTestCollector(t)
+	ctx := context.Background()
+	uploadRepo := repository.NewUploadRepo(conn)
+
+	content := []byte("a finished resumable upload")
+	upload, err := uploadRepo.CreateUpload(ctx, tables.Upload{
+		ID: "4f1c2b7e-1111-4e2a-9c3d-5a6b7c8d9e0f", ExpiresAt: time.Now().Add(time.Hour),
+		UserID: 1, FileName: "notes.txt", Length: int64(len(content)),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fileKey, err := storageService.SaveFile(upload.FileName, content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := uploadRepo.CompleteUpload(ctx, upload.ID, fileKey, int64(len(content))); err != nil {
+		t.Fatal(err)
+	}
+	age(t, conn, uploadDir, fileKey)
+
+	report, err := gc.Collect(ctx, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.OrphanBlobs) != 0 || len(report.UntrackedFiles) != 0 || !exists(uploadDir, fileKey) {
+		t.Fatalf("collected orphans %v and untracked %v, want the completed upload kept", report.OrphanBlobs, report.UntrackedFiles)
+	}
+
+	if err := conn.Model(&tables.Upload{}).Where("id = ?", upload.ID).Update("expires_at", time.Now().Add(-time.Minute)).Error; err != nil {
+		t.Fatal(err)
+	}
+	report, err = gc.Collect(ctx, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(report.ExpiredUploads, []string{upload.ID}) {
+		t.Fatalf("expired uploads %v, want %s", report.ExpiredUploads, upload.ID)
+	}
+
+	var blob tables.Blob
+	if err := conn.Where("file_key = ?", fileKey).First(&blob).Error; err != nil {
+		t.Fatal(err)
+	}
+	if blob.RefCount != 0 {
+		t.Fatalf("ref count after expiry = %d, want the upload's reference released", blob.RefCount)
+	}
+
+	// collected once the release is older than the grace period
+	age(t, conn, uploadDir, fileKey)
+	report, err = gc.Collect(ctx, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(report.OrphanBlobs, []string{fileKey}) || exists(uploadDir, fileKey) {
+		t.Errorf("collected %v, want the expired upload's file %s", report.OrphanBlobs, fileKey)
+	}
+}
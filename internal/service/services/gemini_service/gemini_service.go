@@ -35,8 +35,8 @@ func NewGeminiServiceV1(ctx context.Context) *GeminiServiceV1 {
 	}
 }
 
-func (s *GeminiServiceV1) CallGemini(ctx context.Context, sessionID string, prompt string, history []*genai.Content) (types.GeminiApiResponse, error) {
-	model := s.client.GenerativeModel("gemini-2.0-flash")
+func (s *GeminiServiceV1) CallGemini(ctx context.Context, sessionID string, prompt string, history []*genai.Content, options types.ChatOptions) (types.GeminiApiResponse, error) {
+	model := s.generativeModel(options)
 
 	// Configure model response format
 	model.ResponseMIMEType = "application/json"
@@ -85,7 +85,7 @@ func (s *GeminiServiceV1) CallGemini(ctx context.Context, sessionID string, prom
 	}, nil
 }
 
-func (s *GeminiServiceV1) SendFileWithText(ctx context.Context, sessionID string, prompt string, history []*genai.Content, tempFilePath string) (types.GeminiApiResponse, error) {
+func (s *GeminiServiceV1) SendFileWithText(ctx context.Context, sessionID string, prompt string, history []*genai.Content, tempFilePath string, options types.ChatOptions) (types.GeminiApiResponse, error) {
 	log.Println("SendFileWithText")
 	uploadedFile, err := s.uploadFile(ctx, tempFilePath)
 	if err != nil {
@@ -93,7 +93,7 @@ func (s *GeminiServiceV1) SendFileWithText(ctx context.Context, sessionID string
 	}
 	defer s.client.DeleteFile(ctx, uploadedFile.Name)
 
-	model := s.client.GenerativeModel("gemini-2.0-flash")
+	model := s.generativeModel(options)
 
 	// Configure model response format
 	model.ResponseMIMEType = "application/json"
@@ -138,6 +138,21 @@ func (s *GeminiServiceV1) SendFileWithText(ctx context.Context, sessionID string
 	}, nil
 }
 
+// generativeModel returns the chat's model with its persona's system instruction
+func (s *GeminiServiceV1) generativeModel(options types.ChatOptions) *genai.GenerativeModel {
+	modelKey := options.ModelKey
+	if modelKey == "" {
+		modelKey = types.DefaultModelKey
+	}
+
+	model := s.client.GenerativeModel(modelKey)
+	if options.Instruction != "" {
+		model.SystemInstruction = genai.NewUserContent(genai.Text(options.Instruction))
+	}
+
+	return model
+}
+
 // Helper function to upload the file and return the uploaded file details
 func (s *GeminiServiceV1) uploadFile(ctx context.Context, tempFilePath string) (*genai.File, error) {
 	file, err := s.client.UploadFileFromPath(ctx, tempFilePath, nil)
@@ -1,103 +1,271 @@
 package jwt_service
 
 import (
+	"context"
 	"errors"
+	"log"
 	"os"
 	"time"
 
+	"github.com/google/uuid"
+	"github.com/yuhangang/chat-app-backend/internal/db"
+	"github.com/yuhangang/chat-app-backend/internal/db/tables"
 	"github.com/yuhangang/chat-app-backend/internal/handler"
+	"github.com/yuhangang/chat-app-backend/pkg/securetoken"
 	"github.com/yuhangang/chat-app-backend/types"
+	"github.com/yuhangang/chat-app-backend/user_errors"
 
 	"github.com/golang-jwt/jwt/v5"
 )
 
 const kaccessTokenLife = 30 * time.Minute
 const krefreshTokenLife = 60 * 24 * time.Hour
+const kdefaultKeyReloadInterval = 5 * time.Minute
 
+// JwtServiceImpl signs access tokens with the asymmetric keys in the key directory, so other
+// services can verify them against the published JWKS. Refresh tokens are only ever read back
+// by this service and stay HS256 with REFRESH_SECRET.
 type JwtServiceImpl struct {
-	accessSecret  []byte
-	refreshSecret []byte
+	keys              *keySet
+	refreshSecret     []byte
+	sessionRepository db.SessionRepository
+	userRepository    db.UserRepository
+	reloadInterval    time.Duration
 }
 
-func NewJwtService() (*JwtServiceImpl, error) {
-	accessSecretFromEnv := os.Getenv("ACCESS_SECRET")
+func NewJwtService(sessionRepository db.SessionRepository, userRepository db.UserRepository) (*JwtServiceImpl, error) {
 	refreshSecretFromEnv := os.Getenv("REFRESH_SECRET")
 
-	if accessSecretFromEnv == "" || refreshSecretFromEnv == "" {
+	if refreshSecretFromEnv == "" {
 		return nil, handler.ErrMissingJWTSecret
 	}
 
+	keys, err := newKeySet()
+	if err != nil {
+		return nil, err
+	}
+
+	reloadInterval := kdefaultKeyReloadInterval
+	if value := os.Getenv("JWT_KEY_RELOAD_INTERVAL"); value != "" {
+		if parsed, err := time.ParseDuration(value); err == nil && parsed > 0 {
+			reloadInterval = parsed
+		}
+	}
+
 	return &JwtServiceImpl{
-		accessSecret:  []byte(accessSecretFromEnv),
-		refreshSecret: []byte(refreshSecretFromEnv),
+		keys:              keys,
+		refreshSecret:     []byte(refreshSecretFromEnv),
+		sessionRepository: sessionRepository,
+		userRepository:    userRepository,
+		reloadInterval:    reloadInterval,
 	}, nil
 }
 
-func (j *JwtServiceImpl) GenerateTokens(userID uint) (types.JwtPayload, error) {
-	accessToken, err := j.createToken(userID, j.accessSecret, kaccessTokenLife)
+// WatchKeys reloads the key directory every reload interval until the context is cancelled, so
+// keys added or retired on disk take effect without a restart
+func (j *JwtServiceImpl) WatchKeys(ctx context.Context) {
+	ticker := time.NewTicker(j.reloadInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			j.keys.reload()
+		}
+	}
+}
+
+// PublicKeys returns the public half of every access token key, active or not
+func (j *JwtServiceImpl) PublicKeys() types.JSONWebKeySet {
+	return j.keys.publicKeys()
+}
+
+// GenerateTokens starts a new session for the user on the client's device and returns its
+// first token pair. Disabled users get ErrAccountDisabled.
+func (j *JwtServiceImpl) GenerateTokens(ctx context.Context, userID uint, client types.ClientInfo) (types.JwtPayload, error) {
+	user, err := j.getEnabledUser(ctx, userID)
 	if err != nil {
 		return types.JwtPayload{}, err
 	}
 
-	refreshToken, err := j.createToken(userID, j.refreshSecret, krefreshTokenLife)
+	sessionID := uuid.New().String()
+
+	payload, refreshToken, err := j.createTokenPair(user, sessionID)
 	if err != nil {
 		return types.JwtPayload{}, err
 	}
 
-	return types.JwtPayload{
-		AccessToken:  accessToken,
-		RefreshToken: refreshToken,
-	}, nil
+	session := tables.Session{
+		ID:         sessionID,
+		UserID:     userID,
+		UserAgent:  client.UserAgent,
+		IPAddress:  client.IPAddress,
+		LastSeenAt: time.Now(),
+		ExpiresAt:  refreshToken.ExpiresAt,
+	}
+	if err := j.sessionRepository.CreateSession(ctx, session, refreshToken); err != nil {
+		return types.JwtPayload{}, err
+	}
+
+	return payload, nil
 }
 
-func (j *JwtServiceImpl) RefreshAccessToken(refreshToken string) (string, error) {
+// RefreshTokens exchanges a refresh token for a new token pair in the same session, picking up
+// role changes. The old refresh token stops working, and presenting it again revokes the session.
+func (j *JwtServiceImpl) RefreshTokens(ctx context.Context, refreshToken string, client types.ClientInfo) (types.JwtPayload, error) {
 	// Validate the refresh token
 	claims, err := j.ValidateRefreshToken(refreshToken)
 	if err != nil {
-		return "", err
+		return types.JwtPayload{}, err
+	}
+
+	// tokens from before sessions existed can't be rotated
+	if claims.SessionID == "" {
+		return types.JwtPayload{}, handler.ErrInvalidToken
 	}
 
-	// Check if refresh token is expired
-	if time.Now().After(claims.ExpiresAt.Time) {
-		return "", handler.ErrExpiredToken
+	user, err := j.getEnabledUser(ctx, claims.UserID)
+	if err != nil {
+		return types.JwtPayload{}, err
+	}
+
+	payload, newRefreshToken, err := j.createTokenPair(user, claims.SessionID)
+	if err != nil {
+		return types.JwtPayload{}, err
 	}
 
-	// Generate new access token
-	newAccessToken, err := j.createToken(claims.UserID, j.accessSecret, kaccessTokenLife)
+	err = j.sessionRepository.RotateRefreshToken(ctx, securetoken.Hash(refreshToken), newRefreshToken, client)
+	if errors.Is(err, user_errors.ErrInvalidToken) {
+		return types.JwtPayload{}, handler.ErrInvalidToken
+	}
 	if err != nil {
-		return "", err
+		return types.JwtPayload{}, err
 	}
 
-	return newAccessToken, nil
+	return payload, nil
 }
 
-func (j *JwtServiceImpl) ValidateAccessToken(tokenString string) (types.Claims, error) {
-	return j.parseToken(tokenString, j.accessSecret)
+// ValidateAccessToken checks the token's signature and expiry and that its session is not revoked
+func (j *JwtServiceImpl) ValidateAccessToken(ctx context.Context, tokenString string) (types.Claims, error) {
+	claims, err := j.parseToken(tokenString, j.accessKeyFunc, accessTokenMethods)
+	if err != nil {
+		return types.Claims{}, err
+	}
+
+	if claims.SessionID == "" {
+		return types.Claims{}, handler.ErrInvalidToken
+	}
+
+	active, err := j.sessionRepository.IsSessionActive(ctx, claims.SessionID)
+	if err != nil {
+		return types.Claims{}, err
+	}
+	if !active {
+		return types.Claims{}, handler.ErrRevokedToken
+	}
+
+	if err := j.sessionRepository.TouchSession(ctx, claims.SessionID); err != nil {
+		log.Printf("Failed to update last seen of session %s: %v", claims.SessionID, err)
+	}
+
+	return claims, nil
 }
 
 func (j *JwtServiceImpl) ValidateRefreshToken(tokenString string) (types.Claims, error) {
-	return j.parseToken(tokenString, j.refreshSecret)
+	return j.parseToken(tokenString, j.refreshKeyFunc, []string{jwt.SigningMethodHS256.Alg()})
 }
 
-func (j *JwtServiceImpl) createToken(userID uint, secret []byte, duration time.Duration) (string, error) {
-	claims := types.Claims{
-		UserID: userID,
+func (j *JwtServiceImpl) RevokeSession(ctx context.Context, userID uint, sessionID string) error {
+	return j.sessionRepository.RevokeSession(ctx, sessionID, userID)
+}
+
+func (j *JwtServiceImpl) RevokeAllSessions(ctx context.Context, userID uint) error {
+	return j.sessionRepository.RevokeAllSessions(ctx, userID)
+}
+
+// createTokenPair signs an access and a refresh token for the session, and returns the
+// refresh token's row to store
+func (j *JwtServiceImpl) createTokenPair(user tables.User, sessionID string) (types.JwtPayload, tables.RefreshToken, error) {
+	key := j.keys.signingKey()
+	accessToken := jwt.NewWithClaims(key.method, newClaims(user, sessionID, kaccessTokenLife))
+	accessToken.Header["kid"] = key.kid
+
+	signedAccessToken, err := accessToken.SignedString(key.privateKey)
+	if err != nil {
+		return types.JwtPayload{}, tables.RefreshToken{}, err
+	}
+
+	refreshToken := jwt.NewWithClaims(jwt.SigningMethodHS256, newClaims(user, sessionID, krefreshTokenLife))
+
+	signedRefreshToken, err := refreshToken.SignedString(j.refreshSecret)
+	if err != nil {
+		return types.JwtPayload{}, tables.RefreshToken{}, err
+	}
+
+	payload := types.JwtPayload{
+		AccessToken:  signedAccessToken,
+		RefreshToken: signedRefreshToken,
+	}
+	refreshTokenRow := tables.RefreshToken{
+		SessionID: sessionID,
+		TokenHash: securetoken.Hash(signedRefreshToken),
+		ExpiresAt: time.Now().Add(krefreshTokenLife),
+	}
+
+	return payload, refreshTokenRow, nil
+}
+
+func newClaims(user tables.User, sessionID string, duration time.Duration) types.Claims {
+	return types.Claims{
+		UserID:    user.ID,
+		SessionID: sessionID,
+		Role:      user.Role,
 		RegisteredClaims: jwt.RegisteredClaims{
+			// unique per token, so two tokens issued in the same second never share a hash
+			ID:        uuid.New().String(),
 			ExpiresAt: jwt.NewNumericDate(time.Now().Add(duration)),
 			IssuedAt:  jwt.NewNumericDate(time.Now()),
 		},
 	}
+}
+
+func (j *JwtServiceImpl) getEnabledUser(ctx context.Context, userID uint) (tables.User, error) {
+	user, err := j.userRepository.GetUser(ctx, userID)
+	if err != nil {
+		return tables.User{}, err
+	}
+	if user.DisabledAt != nil {
+		return tables.User{}, user_errors.ErrAccountDisabled
+	}
+
+	return user, nil
+}
+
+// accessKeyFunc looks up the public key named by the token's kid header
+func (j *JwtServiceImpl) accessKeyFunc(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+
+	key, ok := j.keys.verificationKey(kid)
+	if !ok {
+		return nil, handler.ErrInvalidToken
+	}
+	if token.Method.Alg() != key.method.Alg() {
+		return nil, handler.ErrInvalidToken
+	}
+
+	return key.privateKey.Public(), nil
+}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString(secret)
+func (j *JwtServiceImpl) refreshKeyFunc(token *jwt.Token) (interface{}, error) {
+	return j.refreshSecret, nil
 }
 
-func (j *JwtServiceImpl) parseToken(tokenString string, secret []byte) (types.Claims, error) {
+func (j *JwtServiceImpl) parseToken(tokenString string, keyFunc jwt.Keyfunc, methods []string) (types.Claims, error) {
 	claims := &types.Claims{}
 
-	token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
-		return secret, nil
-	})
+	token, err := jwt.ParseWithClaims(tokenString, claims, keyFunc, jwt.WithValidMethods(methods))
 
 	if err != nil {
 		if errors.Is(err, jwt.ErrTokenExpired) {
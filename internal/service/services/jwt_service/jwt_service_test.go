@@ -0,0 +1,218 @@
+package jwt_service
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/yuhangang/chat-app-backend/internal/db/repository"
+	"github.com/yuhangang/chat-app-backend/internal/db/tables"
+	"github.com/yuhangang/chat-app-backend/internal/handler"
+	"github.com/yuhangang/chat-app-backend/types"
+
+	"github.com/golang-jwt/jwt/v5"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// newTestJwtService returns a service over an in-memory database holding one user, with its keys
+// in keyDir
+func newTestJwtService(t *testing.T, keyDir string) (*JwtServiceImpl, *repository.SessionRepo, tables.User) {
+	t.Helper()
+
+	conn, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{TranslateError: true, Logger: logger.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.AutoMigrate(&tables.User{}, &tables.Session{}, &tables.RefreshToken{}); err != nil {
+		t.Fatal(err)
+	}
+	user := tables.User{Username: "ada", PasswordHash: "hash"}
+	if err := conn.Create(&user).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("REFRESH_SECRET", "refresh-secret")
+	t.Setenv("JWT_KEY_DIR", keyDir)
+
+	sessionRepo := repository.NewSessionRepo(conn)
+	jwtService, err := NewJwtService(sessionRepo, repository.NewUserRepo(conn))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return jwtService, sessionRepo, user
+}
+
+func writeRSAKey(t *testing.T, dir string, kid string) {
+	t.Helper()
+
+	privateKey, err := rsa.GenerateKey(rand.Reader, kminRSAKeyBits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(privateKey)})
+	if err := os.WriteFile(filepath.Join(dir, kid+".pem"), data, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func tokenKid(t *testing.T, tokenString string) string {
+	t.Helper()
+
+	token, _, err := jwt.NewParser().ParseUnverified(tokenString, &types.Claims{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	kid, _ := token.Header["kid"].(string)
+
+	return kid
+}
+
+func TestKeyRotationKeepsOldTokensValid(t *testing.T) {
+	keyDir := t.TempDir()
+	jwtService, _, user := newTestJwtService(t, keyDir)
+	ctx := context.Background()
+
+	// an empty key directory gets a first Ed25519 key
+	jwks := jwtService.PublicKeys()
+	if len(jwks.Keys) != 1 || jwks.Keys[0].Kty != "OKP" || jwks.Keys[0].Crv != "Ed25519" || jwks.Keys[0].X == "" {
+		t.Fatalf("JWKS = %+v, want one generated Ed25519 key", jwks.Keys)
+	}
+	firstKid := jwks.Keys[0].Kid
+
+	before, err := jwtService.GenerateTokens(ctx, user.ID, types.ClientInfo{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if kid := tokenKid(t, before.AccessToken); kid != firstKid {
+		t.Fatalf("token signed with kid %q, want %q", kid, firstKid)
+	}
+
+	// a later kid in sort order takes over signing once the directory is reloaded
+	const nextKid = "99991231-000000"
+	writeRSAKey(t, keyDir, nextKid)
+	jwtService.keys.reload()
+
+	after, err := jwtService.GenerateTokens(ctx, user.ID, types.ClientInfo{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if kid := tokenKid(t, after.AccessToken); kid != nextKid {
+		t.Errorf("token signed with kid %q after rotation, want %q", kid, nextKid)
+	}
+	for name, token := range map[string]string{"old": before.AccessToken, "new": after.AccessToken} {
+		if _, err := jwtService.ValidateAccessToken(ctx, token); err != nil {
+			t.Errorf("%s token: %v", name, err)
+		}
+	}
+
+	jwks = jwtService.PublicKeys()
+	if len(jwks.Keys) != 2 || jwks.Keys[0].Kid != firstKid || jwks.Keys[1].Kid != nextKid {
+		t.Fatalf("JWKS = %+v, want both keys sorted by kid", jwks.Keys)
+	}
+	rsaKey := jwks.Keys[1]
+	if rsaKey.Kty != "RSA" || rsaKey.Alg != "RS256" || rsaKey.Use != "sig" || rsaKey.N == "" || rsaKey.E != "AQAB" {
+		t.Errorf("RSA JWK = %+v, want RS256 with modulus and exponent", rsaKey)
+	}
+
+	// retiring the old key ends the tokens it signed
+	if err := os.Remove(filepath.Join(keyDir, firstKid+".pem")); err != nil {
+		t.Fatal(err)
+	}
+	jwtService.keys.reload()
+
+	if _, err := jwtService.ValidateAccessToken(ctx, before.AccessToken); err == nil {
+		t.Error("token of the retired key still validates")
+	}
+	if _, err := jwtService.ValidateAccessToken(ctx, after.AccessToken); err != nil {
+		t.Errorf("token of the active key: %v", err)
+	}
+}
+
+func TestSigningKeyIDPicksTheKey(t *testing.T) {
+	keyDir := t.TempDir()
+	writeRSAKey(t, keyDir, "a-old")
+	writeRSAKey(t, keyDir, "b-new")
+
+	t.Setenv("JWT_SIGNING_KEY_ID", "a-old")
+	jwtService, _, user := newTestJwtService(t, keyDir)
+
+	payload, err := jwtService.GenerateTokens(context.Background(), user.ID, types.ClientInfo{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if kid := tokenKid(t, payload.AccessToken); kid != "a-old" {
+		t.Errorf("token signed with kid %q, want the configured a-old", kid)
+	}
+
+	t.Setenv("JWT_SIGNING_KEY_ID", "missing")
+	if _, err := NewJwtService(nil, nil); err == nil {
+		t.Error("unknown signing key id was accepted")
+	}
+}
+
+func TestAccessTokenWithUnknownKidIsRejected(t *testing.T) {
+	jwtService, _, user := newTestJwtService(t, t.TempDir())
+	ctx := context.Background()
+
+	payload, err := jwtService.GenerateTokens(ctx, user.ID, types.ClientInfo{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims, err := jwtService.ValidateAccessToken(ctx, payload.AccessToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the same claims signed by the active key, but naming a key that doesn't exist
+	key := jwtService.keys.signingKey()
+	forged := jwt.NewWithClaims(key.method, claims)
+	forged.Header["kid"] = "unknown"
+	forgedString, err := forged.SignedString(key.privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := jwtService.ValidateAccessToken(ctx, forgedString); !errors.Is(err, handler.ErrInvalidToken) {
+		t.Errorf("unknown kid: err = %v, want ErrInvalidToken", err)
+	}
+}
+
+func TestReusedRefreshTokenRevokesTheSession(t *testing.T) {
+	jwtService, sessionRepo, user := newTestJwtService(t, t.TempDir())
+	ctx := context.Background()
+
+	first, err := jwtService.GenerateTokens(ctx, user.ID, types.ClientInfo{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := jwtService.RefreshTokens(ctx, first.RefreshToken, types.ClientInfo{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims, err := jwtService.ValidateAccessToken(ctx, second.AccessToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := jwtService.RefreshTokens(ctx, first.RefreshToken, types.ClientInfo{}); !errors.Is(err, handler.ErrInvalidToken) {
+		t.Fatalf("reused refresh token: err = %v, want ErrInvalidToken", err)
+	}
+	if active, err := sessionRepo.IsSessionActive(ctx, claims.SessionID); err != nil || active {
+		t.Fatalf("session active = %v, %v after reuse, want revoked", active, err)
+	}
+	if _, err := jwtService.ValidateAccessToken(ctx, second.AccessToken); !errors.Is(err, handler.ErrRevokedToken) {
+		t.Errorf("access token of the revoked session: err = %v, want ErrRevokedToken", err)
+	}
+	if _, err := jwtService.RefreshTokens(ctx, second.RefreshToken, types.ClientInfo{}); !errors.Is(err, handler.ErrInvalidToken) {
+		t.Errorf("current refresh token of the revoked session: err = %v, want ErrInvalidToken", err)
+	}
+}
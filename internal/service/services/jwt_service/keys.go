@@ -0,0 +1,258 @@
+package jwt_service
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/yuhangang/chat-app-backend/types"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const kdefaultKeyDir = "keys"
+const kminRSAKeyBits = 2048
+
+// accessTokenMethods are the only algorithms access tokens are accepted with
+var accessTokenMethods = []string{jwt.SigningMethodRS256.Alg(), jwt.SigningMethodEdDSA.Alg()}
+
+// signingKey is one private key from the key directory, named by its kid
+type signingKey struct {
+	kid        string
+	method     jwt.SigningMethod
+	privateKey crypto.Signer
+}
+
+// keySet holds every key in the key directory. All of them verify tokens, so tokens signed
+// with a key being rotated out stay valid, but only the active one signs new tokens.
+type keySet struct {
+	dir         string
+	activeKeyID string
+
+	mu     sync.RWMutex
+	keys   map[string]signingKey
+	active signingKey
+}
+
+// newKeySet loads the keys in JWT_KEY_DIR. Each key is a PEM encoded RSA (2048 bits or more) or
+// Ed25519 private key in a <kid>.pem file. JWT_SIGNING_KEY_ID picks the key that signs, by
+// default the last kid in sort order, so date prefixed names rotate by adding a file.
+func newKeySet() (*keySet, error) {
+	set := &keySet{
+		dir:         os.Getenv("JWT_KEY_DIR"),
+		activeKeyID: os.Getenv("JWT_SIGNING_KEY_ID"),
+	}
+	if set.dir == "" {
+		set.dir = kdefaultKeyDir
+	}
+
+	if err := set.load(true); err != nil {
+		return nil, err
+	}
+
+	return set, nil
+}
+
+// load reads the key directory. On startup an empty directory gets a first Ed25519 key, so a
+// fresh checkout can sign tokens without setup.
+func (set *keySet) load(generateIfEmpty bool) error {
+	keys, err := readKeyDir(set.dir)
+	if err != nil {
+		return err
+	}
+
+	if len(keys) == 0 && !generateIfEmpty {
+		return fmt.Errorf("no signing keys in %s", set.dir)
+	}
+	if len(keys) == 0 {
+		key, err := generateKey(set.dir)
+		if err != nil {
+			return fmt.Errorf("no signing keys in %s and failed to generate one: %w", set.dir, err)
+		}
+		log.Printf("No signing keys in %s, generated %s", set.dir, key.kid)
+		keys[key.kid] = key
+	}
+
+	activeKeyID := set.activeKeyID
+	if activeKeyID == "" {
+		kids := make([]string, 0, len(keys))
+		for kid := range keys {
+			kids = append(kids, kid)
+		}
+		sort.Strings(kids)
+		activeKeyID = kids[len(kids)-1]
+	}
+
+	active, ok := keys[activeKeyID]
+	if !ok {
+		return fmt.Errorf("signing key %s not found in %s", activeKeyID, set.dir)
+	}
+
+	set.mu.Lock()
+	defer set.mu.Unlock()
+
+	set.keys = keys
+	set.active = active
+
+	return nil
+}
+
+// reload picks up keys added to or removed from the directory, keeping the current keys on error
+func (set *keySet) reload() {
+	if err := set.load(false); err != nil {
+		log.Printf("Failed to reload signing keys: %v", err)
+	}
+}
+
+func (set *keySet) signingKey() signingKey {
+	set.mu.RLock()
+	defer set.mu.RUnlock()
+
+	return set.active
+}
+
+func (set *keySet) verificationKey(kid string) (signingKey, bool) {
+	set.mu.RLock()
+	defer set.mu.RUnlock()
+
+	key, ok := set.keys[kid]
+	return key, ok
+}
+
+// publicKeys returns every key as a JSON Web Key, sorted by kid
+func (set *keySet) publicKeys() types.JSONWebKeySet {
+	set.mu.RLock()
+	defer set.mu.RUnlock()
+
+	jwks := types.JSONWebKeySet{Keys: []types.JSONWebKey{}}
+	for _, key := range set.keys {
+		jwks.Keys = append(jwks.Keys, key.publicJWK())
+	}
+	sort.Slice(jwks.Keys, func(i, j int) bool { return jwks.Keys[i].Kid < jwks.Keys[j].Kid })
+
+	return jwks
+}
+
+func (key signingKey) publicJWK() types.JSONWebKey {
+	jwk := types.JSONWebKey{
+		Kid: key.kid,
+		Use: "sig",
+		Alg: key.method.Alg(),
+	}
+
+	switch publicKey := key.privateKey.Public().(type) {
+	case *rsa.PublicKey:
+		jwk.Kty = "RSA"
+		jwk.N = base64.RawURLEncoding.EncodeToString(publicKey.N.Bytes())
+		jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(publicKey.E)).Bytes())
+	case ed25519.PublicKey:
+		jwk.Kty = "OKP"
+		jwk.Crv = "Ed25519"
+		jwk.X = base64.RawURLEncoding.EncodeToString(publicKey)
+	}
+
+	return jwk
+}
+
+func readKeyDir(dir string) (map[string]signingKey, error) {
+	keys := make(map[string]signingKey)
+
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return keys, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for _, entry := range entries {
+		if entry.IsDir() || filepath.Ext(entry.Name()) != ".pem" {
+			continue
+		}
+
+		kid := strings.TrimSuffix(entry.Name(), ".pem")
+		key, err := readKey(filepath.Join(dir, entry.Name()), kid)
+		if err != nil {
+			log.Printf("Skipping signing key %s: %v", entry.Name(), err)
+			continue
+		}
+		keys[kid] = key
+	}
+
+	return keys, nil
+}
+
+func readKey(path string, kid string) (signingKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return signingKey{}, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return signingKey{}, errors.New("no PEM data")
+	}
+
+	var privateKey interface{}
+	switch block.Type {
+	case "PRIVATE KEY":
+		privateKey, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		privateKey, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	default:
+		return signingKey{}, fmt.Errorf("unsupported PEM type %s", block.Type)
+	}
+	if err != nil {
+		return signingKey{}, err
+	}
+
+	switch privateKey := privateKey.(type) {
+	case *rsa.PrivateKey:
+		if privateKey.N.BitLen() < kminRSAKeyBits {
+			return signingKey{}, fmt.Errorf("RSA key must be at least %d bits", kminRSAKeyBits)
+		}
+		return signingKey{kid: kid, method: jwt.SigningMethodRS256, privateKey: privateKey}, nil
+	case ed25519.PrivateKey:
+		return signingKey{kid: kid, method: jwt.SigningMethodEdDSA, privateKey: privateKey}, nil
+	default:
+		return signingKey{}, errors.New("only RSA and Ed25519 keys are supported")
+	}
+}
+
+func generateKey(dir string) (signingKey, error) {
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return signingKey{}, err
+	}
+
+	der, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	if err != nil {
+		return signingKey{}, err
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return signingKey{}, err
+	}
+
+	kid := time.Now().UTC().Format("20060102-150405")
+	data := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	if err := os.WriteFile(filepath.Join(dir, kid+".pem"), data, 0600); err != nil {
+		return signingKey{}, err
+	}
+
+	return signingKey{kid: kid, method: jwt.SigningMethodEdDSA, privateKey: privateKey}, nil
+}
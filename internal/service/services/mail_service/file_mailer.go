@@ -0,0 +1,46 @@
+package mail_service
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/yuhangang/chat-app-backend/internal/service"
+)
+
+const kdefaultMailDir = "mail"
+
+// FileMailerV1 writes every message as an .eml file to MAIL_DIR, for tests and development
+// setups that want to open the mails
+type FileMailerV1 struct {
+	from string
+	dir  string
+}
+
+func NewFileMailerV1(from string) (*FileMailerV1, error) {
+	dir := os.Getenv("MAIL_DIR")
+	if dir == "" {
+		dir = kdefaultMailDir
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create mail folder: %w", err)
+	}
+
+	return &FileMailerV1{from: from, dir: dir}, nil
+}
+
+func (m *FileMailerV1) Send(_ context.Context, message service.MailMessage) error {
+	data, err := formatMessage(m.from, message)
+	if err != nil {
+		return err
+	}
+
+	// time prefixed, so the folder lists in the order the mails were sent
+	name := time.Now().UTC().Format("20060102-150405.000000") + "-" + uuid.New().String()[:8] + ".eml"
+
+	return os.WriteFile(filepath.Join(m.dir, name), data, 0600)
+}
@@ -0,0 +1,97 @@
+package mail_service
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"mime"
+	"net/mail"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/yuhangang/chat-app-backend/internal/service"
+)
+
+const kdefaultMailFrom = "no-reply@localhost"
+
+var ErrInvalidHeader = errors.New("mail header contains a line break")
+
+// NewMailServiceV1 picks the mailer named by MAIL_DRIVER: smtp, file or console. Console is
+// the default, so development runs without a mail server.
+func NewMailServiceV1() (service.Mailer, error) {
+	from := os.Getenv("MAIL_FROM")
+	if from == "" {
+		from = kdefaultMailFrom
+	}
+	if _, err := mail.ParseAddress(from); err != nil {
+		return nil, fmt.Errorf("invalid MAIL_FROM: %w", err)
+	}
+
+	switch driver := os.Getenv("MAIL_DRIVER"); driver {
+	case "smtp":
+		return NewSmtpMailerV1(from)
+	case "file":
+		return NewFileMailerV1(from)
+	case "", "console":
+		return NewConsoleMailerV1(from), nil
+	default:
+		return nil, fmt.Errorf("unknown MAIL_DRIVER %s", driver)
+	}
+}
+
+// ConsoleMailerV1 writes every message to the log instead of sending it
+type ConsoleMailerV1 struct {
+	from string
+}
+
+func NewConsoleMailerV1(from string) *ConsoleMailerV1 {
+	return &ConsoleMailerV1{from: from}
+}
+
+func (m *ConsoleMailerV1) Send(_ context.Context, message service.MailMessage) error {
+	data, err := formatMessage(m.from, message)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Mail to %s:\n%s", message.To, data)
+
+	return nil
+}
+
+// formatMessage renders the message as a UTF-8 plain text RFC 5322 email
+func formatMessage(from string, message service.MailMessage) ([]byte, error) {
+	if strings.ContainsAny(message.To, "\r\n") || strings.ContainsAny(message.Subject, "\r\n") {
+		return nil, ErrInvalidHeader
+	}
+	if _, err := mail.ParseAddress(message.To); err != nil {
+		return nil, err
+	}
+
+	var buffer bytes.Buffer
+	fmt.Fprintf(&buffer, "From: %s\r\n", from)
+	fmt.Fprintf(&buffer, "To: %s\r\n", message.To)
+	fmt.Fprintf(&buffer, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", message.Subject))
+	fmt.Fprintf(&buffer, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&buffer, "Message-ID: <%s@%s>\r\n", uuid.New().String(), domainOf(from))
+	buffer.WriteString("MIME-Version: 1.0\r\n")
+	buffer.WriteString("Content-Type: text/plain; charset=UTF-8\r\n")
+	buffer.WriteString("Content-Transfer-Encoding: 8bit\r\n")
+	buffer.WriteString("\r\n")
+	buffer.WriteString(strings.ReplaceAll(strings.ReplaceAll(message.Body, "\r\n", "\n"), "\n", "\r\n"))
+
+	return buffer.Bytes(), nil
+}
+
+func domainOf(address string) string {
+	parsed, err := mail.ParseAddress(address)
+	if err != nil {
+		return "localhost"
+	}
+
+	return parsed.Address[strings.LastIndex(parsed.Address, "@")+1:]
+}
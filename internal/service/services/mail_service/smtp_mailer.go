@@ -0,0 +1,142 @@
+package mail_service
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"os"
+	"time"
+
+	"github.com/yuhangang/chat-app-backend/internal/service"
+)
+
+const kdefaultSmtpPort = "587"
+const ksmtpTimeout = 30 * time.Second
+
+// ksmtpsPort is the implicit TLS port, every other port upgrades with STARTTLS when offered
+const ksmtpsPort = "465"
+
+var ErrMissingSmtpHost = errors.New("missing SMTP_HOST in environment")
+
+// SmtpMailerV1 sends through the SMTP server in SMTP_HOST and SMTP_PORT, logging in with
+// SMTP_USERNAME and SMTP_PASSWORD when set
+type SmtpMailerV1 struct {
+	from     string
+	host     string
+	port     string
+	username string
+	password string
+}
+
+func NewSmtpMailerV1(from string) (*SmtpMailerV1, error) {
+	host := os.Getenv("SMTP_HOST")
+	if host == "" {
+		return nil, ErrMissingSmtpHost
+	}
+
+	port := os.Getenv("SMTP_PORT")
+	if port == "" {
+		port = kdefaultSmtpPort
+	}
+
+	return &SmtpMailerV1{
+		from:     from,
+		host:     host,
+		port:     port,
+		username: os.Getenv("SMTP_USERNAME"),
+		password: os.Getenv("SMTP_PASSWORD"),
+	}, nil
+}
+
+func (m *SmtpMailerV1) Send(ctx context.Context, message service.MailMessage) error {
+	data, err := formatMessage(m.from, message)
+	if err != nil {
+		return err
+	}
+
+	from, err := mail.ParseAddress(m.from)
+	if err != nil {
+		return err
+	}
+	to, err := mail.ParseAddress(message.To)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, ksmtpTimeout)
+	defer cancel()
+
+	client, err := m.dial(ctx)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	if m.port != ksmtpsPort {
+		if ok, _ := client.Extension("STARTTLS"); ok {
+			if err := client.StartTLS(&tls.Config{ServerName: m.host}); err != nil {
+				return err
+			}
+		}
+	}
+
+	// net/smtp refuses to send PLAIN credentials over a connection without TLS
+	if m.username != "" {
+		if err := client.Auth(smtp.PlainAuth("", m.username, m.password, m.host)); err != nil {
+			return err
+		}
+	}
+
+	if err := client.Mail(from.Address); err != nil {
+		return err
+	}
+	if err := client.Rcpt(to.Address); err != nil {
+		return err
+	}
+
+	writer, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := writer.Write(data); err != nil {
+		return err
+	}
+	if err := writer.Close(); err != nil {
+		return err
+	}
+
+	return client.Quit()
+}
+
+func (m *SmtpMailerV1) dial(ctx context.Context) (*smtp.Client, error) {
+	address := net.JoinHostPort(m.host, m.port)
+	dialer := &net.Dialer{}
+
+	var conn net.Conn
+	var err error
+	if m.port == ksmtpsPort {
+		tlsDialer := &tls.Dialer{NetDialer: dialer, Config: &tls.Config{ServerName: m.host}}
+		conn, err = tlsDialer.DialContext(ctx, "tcp", address)
+	} else {
+		conn, err = dialer.DialContext(ctx, "tcp", address)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// the whole exchange has to finish before the context's deadline
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	client, err := smtp.NewClient(conn, m.host)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return client, nil
+}
@@ -0,0 +1,96 @@
+package oidc_service
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"math/big"
+)
+
+type jsonWebKey struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+type jsonWebKeySet struct {
+	Keys []jsonWebKey `json:"keys"`
+}
+
+// publicKeys returns the RSA and EC signing keys of the set by kid, skipping anything it cannot use
+func (set jsonWebKeySet) publicKeys() map[string]interface{} {
+	keys := make(map[string]interface{})
+
+	for _, key := range set.Keys {
+		if key.Use != "" && key.Use != "sig" {
+			continue
+		}
+
+		switch key.Kty {
+		case "RSA":
+			if publicKey, ok := key.rsaPublicKey(); ok {
+				keys[key.Kid] = publicKey
+			}
+		case "EC":
+			if publicKey, ok := key.ecPublicKey(); ok {
+				keys[key.Kid] = publicKey
+			}
+		}
+	}
+
+	return keys
+}
+
+func (key jsonWebKey) rsaPublicKey() (*rsa.PublicKey, bool) {
+	n, err := base64.RawURLEncoding.DecodeString(key.N)
+	if err != nil {
+		return nil, false
+	}
+	e, err := base64.RawURLEncoding.DecodeString(key.E)
+	if err != nil || len(e) == 0 || len(e) > 4 {
+		return nil, false
+	}
+
+	return &rsa.PublicKey{
+		N: new(big.Int).SetBytes(n),
+		E: int(new(big.Int).SetBytes(e).Int64()),
+	}, true
+}
+
+func (key jsonWebKey) ecPublicKey() (*ecdsa.PublicKey, bool) {
+	var curve elliptic.Curve
+	switch key.Crv {
+	case "P-256":
+		curve = elliptic.P256()
+	case "P-384":
+		curve = elliptic.P384()
+	default:
+		return nil, false
+	}
+
+	x, err := base64.RawURLEncoding.DecodeString(key.X)
+	if err != nil {
+		return nil, false
+	}
+	y, err := base64.RawURLEncoding.DecodeString(key.Y)
+	if err != nil {
+		return nil, false
+	}
+
+	publicKey := &ecdsa.PublicKey{
+		Curve: curve,
+		X:     new(big.Int).SetBytes(x),
+		Y:     new(big.Int).SetBytes(y),
+	}
+	if !curve.IsOnCurve(publicKey.X, publicKey.Y) {
+		return nil, false
+	}
+
+	return publicKey, true
+}
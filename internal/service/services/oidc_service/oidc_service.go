@@ -0,0 +1,421 @@
+package oidc_service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/yuhangang/chat-app-backend/internal/service"
+	"github.com/yuhangang/chat-app-backend/user_errors"
+
+	"golang.org/x/oauth2"
+)
+
+const (
+	kproviderTypeOIDC   = "oidc"
+	kproviderTypeGitHub = "github"
+)
+
+// unknown kids only trigger a JWKS refetch this often, so tokens with made up kids can't make
+// every login hit the provider
+const kjwksRefetchInterval = 1 * time.Minute
+
+var ErrInvalidIDToken = errors.New("invalid id token")
+
+// well known issuers, so configuring these providers only needs client credentials
+var defaultIssuers = map[string]string{
+	"google": "https://accounts.google.com",
+}
+
+var githubEndpoint = oauth2.Endpoint{
+	AuthURL:  "https://github.com/login/oauth/authorize",
+	TokenURL: "https://github.com/login/oauth/access_token",
+}
+
+const kgithubUserURL = "https://api.github.com/user"
+const kgithubEmailsURL = "https://api.github.com/user/emails"
+
+// provider is one configured login provider. OIDC providers are set up lazily from their
+// discovery document, GitHub is plain OAuth2 with its user API. The fields set from the
+// environment never change afterwards.
+type provider struct {
+	name         string
+	providerType string
+	issuer       string
+	config       oauth2.Config
+
+	// set once by resolve and read without locking from then on
+	resolveMu sync.Mutex
+	resolved  atomic.Pointer[resolvedProvider]
+
+	keysMu        sync.Mutex
+	keys          map[string]interface{}
+	keysFetchedAt time.Time
+}
+
+// resolvedProvider is the complete, immutable configuration of a provider, endpoints included
+type resolvedProvider struct {
+	config  oauth2.Config
+	jwksURI string
+}
+
+type OidcServiceV1 struct {
+	providers  map[string]*provider
+	httpClient *http.Client
+}
+
+// NewOidcServiceV1 reads the providers listed in OIDC_PROVIDERS. Each provider NAME is configured
+// with OIDC_NAME_CLIENT_ID, OIDC_NAME_CLIENT_SECRET, OIDC_NAME_REDIRECT_URL and, for generic
+// OIDC providers, OIDC_NAME_ISSUER. OIDC_NAME_TYPE is "github" for GitHub and "oidc" otherwise.
+func NewOidcServiceV1() *OidcServiceV1 {
+	s := &OidcServiceV1{
+		providers:  make(map[string]*provider),
+		httpClient: &http.Client{Timeout: 10 * time.Second},
+	}
+
+	for _, name := range strings.Split(os.Getenv("OIDC_PROVIDERS"), ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+
+		p, err := newProviderFromEnv(name)
+		if err != nil {
+			log.Printf("Skipping identity provider %s: %v", name, err)
+			continue
+		}
+		s.providers[name] = p
+	}
+
+	return s
+}
+
+func newProviderFromEnv(name string) (*provider, error) {
+	prefix := "OIDC_" + strings.ToUpper(name) + "_"
+
+	providerType := os.Getenv(prefix + "TYPE")
+	if providerType == "" {
+		providerType = kproviderTypeOIDC
+		if name == kproviderTypeGitHub {
+			providerType = kproviderTypeGitHub
+		}
+	}
+
+	p := &provider{
+		name:         name,
+		providerType: providerType,
+		config: oauth2.Config{
+			ClientID:     os.Getenv(prefix + "CLIENT_ID"),
+			ClientSecret: os.Getenv(prefix + "CLIENT_SECRET"),
+			RedirectURL:  os.Getenv(prefix + "REDIRECT_URL"),
+		},
+	}
+	if p.config.ClientID == "" || p.config.RedirectURL == "" {
+		return nil, errors.New("missing client id or redirect url")
+	}
+
+	switch providerType {
+	case kproviderTypeGitHub:
+		p.config.Endpoint = githubEndpoint
+		p.config.Scopes = []string{"read:user", "user:email"}
+	case kproviderTypeOIDC:
+		p.issuer = strings.TrimSuffix(os.Getenv(prefix+"ISSUER"), "/")
+		if p.issuer == "" {
+			p.issuer = defaultIssuers[name]
+		}
+		if p.issuer == "" {
+			return nil, errors.New("missing issuer")
+		}
+		p.config.Scopes = []string{"openid", "email", "profile"}
+	default:
+		return nil, fmt.Errorf("unsupported provider type %s", providerType)
+	}
+
+	if scopes := os.Getenv(prefix + "SCOPES"); scopes != "" {
+		p.config.Scopes = strings.Split(scopes, " ")
+	}
+
+	return p, nil
+}
+
+// Providers returns the names of the configured providers
+func (s *OidcServiceV1) Providers() []string {
+	names := make([]string, 0, len(s.providers))
+	for name := range s.providers {
+		names = append(names, name)
+	}
+
+	return names
+}
+
+// AuthCodeURL returns the provider's authorization URL with state, nonce and an S256 PKCE challenge
+func (s *OidcServiceV1) AuthCodeURL(ctx context.Context, providerName string, state string, nonce string, codeVerifier string) (string, error) {
+	p, ok := s.providers[providerName]
+	if !ok {
+		return "", user_errors.ErrUnknownProvider
+	}
+
+	resolved, err := s.resolve(ctx, p)
+	if err != nil {
+		return "", err
+	}
+
+	options := []oauth2.AuthCodeOption{oauth2.S256ChallengeOption(codeVerifier)}
+	if p.providerType == kproviderTypeOIDC {
+		options = append(options, oauth2.SetAuthURLParam("nonce", nonce))
+	}
+
+	return resolved.config.AuthCodeURL(state, options...), nil
+}
+
+// Exchange redeems the authorization code with the PKCE verifier and returns the verified identity.
+// For OIDC providers the ID token signature, issuer, audience, expiry and nonce are all checked.
+func (s *OidcServiceV1) Exchange(ctx context.Context, providerName string, code string, codeVerifier string, nonce string) (service.ExternalIdentity, error) {
+	p, ok := s.providers[providerName]
+	if !ok {
+		return service.ExternalIdentity{}, user_errors.ErrUnknownProvider
+	}
+
+	// the login may have been started before a restart, so discovery may not have run yet
+	resolved, err := s.resolve(ctx, p)
+	if err != nil {
+		return service.ExternalIdentity{}, err
+	}
+
+	ctx = context.WithValue(ctx, oauth2.HTTPClient, s.httpClient)
+	token, err := resolved.config.Exchange(ctx, code, oauth2.VerifierOption(codeVerifier))
+	if err != nil {
+		return service.ExternalIdentity{}, fmt.Errorf("failed to exchange code: %w", err)
+	}
+
+	if p.providerType == kproviderTypeGitHub {
+		return s.githubIdentity(ctx, p, resolved, token)
+	}
+
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok || rawIDToken == "" {
+		return service.ExternalIdentity{}, ErrInvalidIDToken
+	}
+
+	return s.verifyIDToken(ctx, p, resolved, rawIDToken, nonce)
+}
+
+type idTokenClaims struct {
+	Nonce             string `json:"nonce"`
+	Email             string `json:"email"`
+	EmailVerified     bool   `json:"email_verified"`
+	Name              string `json:"name"`
+	PreferredUsername string `json:"preferred_username"`
+	jwt.RegisteredClaims
+}
+
+func (s *OidcServiceV1) verifyIDToken(ctx context.Context, p *provider, resolved *resolvedProvider, rawIDToken string, nonce string) (service.ExternalIdentity, error) {
+	claims := &idTokenClaims{}
+
+	_, err := jwt.ParseWithClaims(rawIDToken, claims, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		return s.signingKey(ctx, p, resolved.jwksURI, kid)
+	},
+		jwt.WithValidMethods([]string{"RS256", "RS384", "RS512", "ES256", "ES384"}),
+		jwt.WithIssuer(p.issuer),
+		jwt.WithAudience(p.config.ClientID),
+		jwt.WithExpirationRequired(),
+	)
+	if err != nil {
+		return service.ExternalIdentity{}, fmt.Errorf("%w: %v", ErrInvalidIDToken, err)
+	}
+
+	if claims.Nonce == "" || claims.Nonce != nonce {
+		return service.ExternalIdentity{}, fmt.Errorf("%w: nonce mismatch", ErrInvalidIDToken)
+	}
+	if claims.Subject == "" {
+		return service.ExternalIdentity{}, fmt.Errorf("%w: missing subject", ErrInvalidIDToken)
+	}
+
+	return service.ExternalIdentity{
+		Provider:          p.name,
+		Subject:           claims.Subject,
+		Email:             claims.Email,
+		EmailVerified:     claims.EmailVerified,
+		Name:              claims.Name,
+		PreferredUsername: claims.PreferredUsername,
+	}, nil
+}
+
+func (s *OidcServiceV1) githubIdentity(ctx context.Context, p *provider, resolved *resolvedProvider, token *oauth2.Token) (service.ExternalIdentity, error) {
+	client := resolved.config.Client(ctx, token)
+
+	var user struct {
+		ID    int64  `json:"id"`
+		Login string `json:"login"`
+		Name  string `json:"name"`
+	}
+	if err := getJSON(client, kgithubUserURL, &user); err != nil {
+		return service.ExternalIdentity{}, err
+	}
+	if user.ID == 0 {
+		return service.ExternalIdentity{}, errors.New("github user has no id")
+	}
+
+	identity := service.ExternalIdentity{
+		Provider:          p.name,
+		Subject:           strconv.FormatInt(user.ID, 10),
+		Name:              user.Name,
+		PreferredUsername: user.Login,
+	}
+
+	// the profile email may be unset or unverified, ask for the verified primary one
+	var emails []struct {
+		Email    string `json:"email"`
+		Primary  bool   `json:"primary"`
+		Verified bool   `json:"verified"`
+	}
+	if err := getJSON(client, kgithubEmailsURL, &emails); err == nil {
+		for _, email := range emails {
+			if email.Primary && email.Verified {
+				identity.Email = email.Email
+				identity.EmailVerified = true
+			}
+		}
+	}
+
+	return identity, nil
+}
+
+// resolve returns the provider's configuration, loading the endpoints of OIDC providers from
+// their discovery document the first time. A failed discovery is retried on the next call.
+func (s *OidcServiceV1) resolve(ctx context.Context, p *provider) (*resolvedProvider, error) {
+	if resolved := p.resolved.Load(); resolved != nil {
+		return resolved, nil
+	}
+
+	p.resolveMu.Lock()
+	defer p.resolveMu.Unlock()
+
+	if resolved := p.resolved.Load(); resolved != nil {
+		return resolved, nil
+	}
+
+	resolved := &resolvedProvider{config: p.config}
+	if p.providerType == kproviderTypeOIDC {
+		if err := s.discover(ctx, p, resolved); err != nil {
+			return nil, err
+		}
+	}
+
+	p.resolved.Store(resolved)
+
+	return resolved, nil
+}
+
+// discover fills in the endpoints from the provider's discovery document
+func (s *OidcServiceV1) discover(ctx context.Context, p *provider, resolved *resolvedProvider) error {
+	var document struct {
+		Issuer                string `json:"issuer"`
+		AuthorizationEndpoint string `json:"authorization_endpoint"`
+		TokenEndpoint         string `json:"token_endpoint"`
+		JwksURI               string `json:"jwks_uri"`
+	}
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, p.issuer+"/.well-known/openid-configuration", nil)
+	if err != nil {
+		return err
+	}
+	if err := doJSON(s.httpClient, request, &document); err != nil {
+		return fmt.Errorf("failed to discover %s: %w", p.name, err)
+	}
+
+	if strings.TrimSuffix(document.Issuer, "/") != p.issuer {
+		return fmt.Errorf("discovery issuer %s does not match %s", document.Issuer, p.issuer)
+	}
+	if document.AuthorizationEndpoint == "" || document.TokenEndpoint == "" || document.JwksURI == "" {
+		return fmt.Errorf("discovery document of %s is missing endpoints", p.name)
+	}
+
+	resolved.config.Endpoint = oauth2.Endpoint{
+		AuthURL:  document.AuthorizationEndpoint,
+		TokenURL: document.TokenEndpoint,
+	}
+	resolved.jwksURI = document.JwksURI
+
+	return nil
+}
+
+// signingKey returns the provider's public key for kid. An unknown kid refetches the JWKS so key
+// rotation at the provider is picked up, at most once per kjwksRefetchInterval.
+func (s *OidcServiceV1) signingKey(ctx context.Context, p *provider, jwksURI string, kid string) (interface{}, error) {
+	p.keysMu.Lock()
+	defer p.keysMu.Unlock()
+
+	if key, ok := p.lookupKey(kid); ok {
+		return key, nil
+	}
+	if time.Since(p.keysFetchedAt) < kjwksRefetchInterval {
+		return nil, fmt.Errorf("no signing key with kid %q", kid)
+	}
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, jwksURI, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	p.keysFetchedAt = time.Now()
+
+	var jwks jsonWebKeySet
+	if err := doJSON(s.httpClient, request, &jwks); err != nil {
+		return nil, fmt.Errorf("failed to fetch jwks: %w", err)
+	}
+
+	p.keys = jwks.publicKeys()
+	if key, ok := p.lookupKey(kid); ok {
+		return key, nil
+	}
+
+	return nil, fmt.Errorf("no signing key with kid %q", kid)
+}
+
+// lookupKey finds the cached key for kid. A single key without kid is used for every token.
+func (p *provider) lookupKey(kid string) (interface{}, bool) {
+	if key, ok := p.keys[kid]; ok {
+		return key, true
+	}
+	if key, ok := p.keys[""]; ok && len(p.keys) == 1 {
+		return key, true
+	}
+
+	return nil, false
+}
+
+func getJSON(client *http.Client, url string, target interface{}) error {
+	request, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Accept", "application/json")
+
+	return doJSON(client, request, target)
+}
+
+func doJSON(client *http.Client, request *http.Request, target interface{}) error {
+	response, err := client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %d from %s", response.StatusCode, request.URL)
+	}
+
+	return json.NewDecoder(response.Body).Decode(target)
+}
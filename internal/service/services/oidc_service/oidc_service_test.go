@@ -0,0 +1,363 @@
+package oidc_service
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/yuhangang/chat-app-backend/user_errors"
+)
+
+const (
+	ktestClientID     = "test-client"
+	ktestCode         = "test-code"
+	ktestCodeVerifier = "test-verifier-test-verifier-test-verifier-123"
+	ktestNonce        = "test-nonce"
+)
+
+// testIssuer is a minimal OIDC provider serving discovery, JWKS and a token endpoint that hands
+// out whatever ID token the test sets
+type testIssuer struct {
+	server *httptest.Server
+
+	mu             sync.Mutex
+	keys           map[string]*rsa.PrivateKey
+	idToken        string
+	discoveryCount int
+	jwksCount      int
+}
+
+func newTestIssuer(t *testing.T) *testIssuer {
+	t.Helper()
+
+	issuer := &testIssuer{keys: make(map[string]*rsa.PrivateKey)}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		issuer.mu.Lock()
+		issuer.discoveryCount++
+		issuer.mu.Unlock()
+
+		writeTestJSON(w, map[string]string{
+			"issuer":                 issuer.server.URL,
+			"authorization_endpoint": issuer.server.URL + "/authorize",
+			"token_endpoint":         issuer.server.URL + "/token",
+			"jwks_uri":               issuer.server.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		issuer.mu.Lock()
+		defer issuer.mu.Unlock()
+		issuer.jwksCount++
+
+		var set jsonWebKeySet
+		for kid, key := range issuer.keys {
+			set.Keys = append(set.Keys, jsonWebKey{
+				Kid: kid,
+				Kty: "RSA",
+				Use: "sig",
+				N:   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			})
+		}
+		writeTestJSON(w, set)
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("code") != ktestCode || r.FormValue("code_verifier") != ktestCodeVerifier {
+			http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+			return
+		}
+
+		issuer.mu.Lock()
+		defer issuer.mu.Unlock()
+		writeTestJSON(w, map[string]interface{}{
+			"access_token": "access",
+			"token_type":   "Bearer",
+			"expires_in":   3600,
+			"id_token":     issuer.idToken,
+		})
+	})
+
+	issuer.server = httptest.NewServer(mux)
+	t.Cleanup(issuer.server.Close)
+
+	return issuer
+}
+
+func writeTestJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// rotate replaces the published keys with a fresh key under kid and returns it
+func (issuer *testIssuer) rotate(t *testing.T, kid string) *rsa.PrivateKey {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	issuer.mu.Lock()
+	defer issuer.mu.Unlock()
+	issuer.keys = map[string]*rsa.PrivateKey{kid: key}
+
+	return key
+}
+
+func (issuer *testIssuer) setIDToken(token string) {
+	issuer.mu.Lock()
+	defer issuer.mu.Unlock()
+	issuer.idToken = token
+}
+
+func (issuer *testIssuer) counts() (discovery int, jwks int) {
+	issuer.mu.Lock()
+	defer issuer.mu.Unlock()
+
+	return issuer.discoveryCount, issuer.jwksCount
+}
+
+// claims returns valid ID token claims for the issuer, changed by the case
+func (issuer *testIssuer) claims() *idTokenClaims {
+	return &idTokenClaims{
+		Nonce:         ktestNonce,
+		Email:         "ada@example.com",
+		EmailVerified: true,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    issuer.server.URL,
+			Subject:   "subject-1",
+			Audience:  jwt.ClaimStrings{ktestClientID},
+			IssuedAt:  jwt.NewNumericDate(time.Now()),
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour)),
+		},
+	}
+}
+
+func signTestToken(t *testing.T, key *rsa.PrivateKey, kid string, claims *idTokenClaims) string {
+	t.Helper()
+
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = kid
+
+	signed, err := token.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return signed
+}
+
+func newTestService(t *testing.T, issuer *testIssuer) *OidcServiceV1 {
+	t.Helper()
+
+	t.Setenv("OIDC_PROVIDERS", "test")
+	t.Setenv("OIDC_TEST_CLIENT_ID", ktestClientID)
+	t.Setenv("OIDC_TEST_CLIENT_SECRET", "secret")
+	t.Setenv("OIDC_TEST_REDIRECT_URL", "http://localhost/callback")
+	t.Setenv("OIDC_TEST_ISSUER", issuer.server.URL)
+
+	s := NewOidcServiceV1()
+	s.httpClient = issuer.server.Client()
+
+	return s
+}
+
+func TestAuthCodeURLDiscoversEndpointsOnce(t *testing.T) {
+	issuer := newTestIssuer(t)
+	s := newTestService(t, issuer)
+
+	for i := 0; i < 2; i++ {
+		rawURL, err := s.AuthCodeURL(context.Background(), "test", "state-1", ktestNonce, ktestCodeVerifier)
+		if err != nil {
+			t.Fatalf("AuthCodeURL: %v", err)
+		}
+
+		authURL, err := url.Parse(rawURL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := authURL.Scheme + "://" + authURL.Host + authURL.Path; got != issuer.server.URL+"/authorize" {
+			t.Errorf("authorization endpoint = %s", got)
+		}
+
+		query := authURL.Query()
+		for param, want := range map[string]string{
+			"client_id":             ktestClientID,
+			"state":                 "state-1",
+			"nonce":                 ktestNonce,
+			"code_challenge_method": "S256",
+		} {
+			if got := query.Get(param); got != want {
+				t.Errorf("%s = %q, want %q", param, got, want)
+			}
+		}
+		if query.Get("code_challenge") == "" {
+			t.Error("missing code_challenge")
+		}
+	}
+
+	if discovery, _ := issuer.counts(); discovery != 1 {
+		t.Errorf("discovery fetched %d times, want 1", discovery)
+	}
+}
+
+func TestAuthCodeURLUnknownProvider(t *testing.T) {
+	s := newTestService(t, newTestIssuer(t))
+
+	_, err := s.AuthCodeURL(context.Background(), "other", "state", ktestNonce, ktestCodeVerifier)
+	if !errors.Is(err, user_errors.ErrUnknownProvider) {
+		t.Fatalf("err = %v, want ErrUnknownProvider", err)
+	}
+}
+
+func TestExchangeVerifiesIDToken(t *testing.T) {
+	issuer := newTestIssuer(t)
+	key := issuer.rotate(t, "kid-1")
+
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		token   func() string
+		wantErr bool
+	}{
+		{
+			name:  "valid",
+			token: func() string { return signTestToken(t, key, "kid-1", issuer.claims()) },
+		},
+		{
+			name: "nonce mismatch",
+			token: func() string {
+				claims := issuer.claims()
+				claims.Nonce = "other-nonce"
+				return signTestToken(t, key, "kid-1", claims)
+			},
+			wantErr: true,
+		},
+		{
+			name:    "bad signature",
+			token:   func() string { return signTestToken(t, otherKey, "kid-1", issuer.claims()) },
+			wantErr: true,
+		},
+		{
+			name: "other issuer",
+			token: func() string {
+				claims := issuer.claims()
+				claims.Issuer = "https://evil.example.com"
+				return signTestToken(t, key, "kid-1", claims)
+			},
+			wantErr: true,
+		},
+		{
+			name: "other audience",
+			token: func() string {
+				claims := issuer.claims()
+				claims.Audience = jwt.ClaimStrings{"other-client"}
+				return signTestToken(t, key, "kid-1", claims)
+			},
+			wantErr: true,
+		},
+		{
+			name: "expired",
+			token: func() string {
+				claims := issuer.claims()
+				claims.ExpiresAt = jwt.NewNumericDate(time.Now().Add(-time.Minute))
+				return signTestToken(t, key, "kid-1", claims)
+			},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// a fresh service has not discovered anything, Exchange has to do it itself
+			s := newTestService(t, issuer)
+			issuer.setIDToken(tt.token())
+
+			identity, err := s.Exchange(context.Background(), "test", ktestCode, ktestCodeVerifier, ktestNonce)
+			if tt.wantErr {
+				if !errors.Is(err, ErrInvalidIDToken) {
+					t.Fatalf("err = %v, want ErrInvalidIDToken", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Exchange: %v", err)
+			}
+			if identity.Provider != "test" || identity.Subject != "subject-1" || identity.Email != "ada@example.com" || !identity.EmailVerified {
+				t.Errorf("identity = %+v", identity)
+			}
+		})
+	}
+}
+
+func TestExchangeRejectsWrongCodeVerifier(t *testing.T) {
+	issuer := newTestIssuer(t)
+	key := issuer.rotate(t, "kid-1")
+	issuer.setIDToken(signTestToken(t, key, "kid-1", issuer.claims()))
+	s := newTestService(t, issuer)
+
+	if _, err := s.Exchange(context.Background(), "test", ktestCode, "wrong-verifier", ktestNonce); err == nil {
+		t.Fatal("Exchange succeeded with the wrong code verifier")
+	}
+}
+
+func TestSigningKeyRotation(t *testing.T) {
+	issuer := newTestIssuer(t)
+	s := newTestService(t, issuer)
+	ctx := context.Background()
+
+	oldKey := issuer.rotate(t, "kid-1")
+	issuer.setIDToken(signTestToken(t, oldKey, "kid-1", issuer.claims()))
+	if _, err := s.Exchange(ctx, "test", ktestCode, ktestCodeVerifier, ktestNonce); err != nil {
+		t.Fatalf("Exchange with the first key: %v", err)
+	}
+
+	// the provider rotates its key, tokens with the new kid refetch the JWKS once the
+	// refetch interval has passed
+	newKey := issuer.rotate(t, "kid-2")
+	issuer.setIDToken(signTestToken(t, newKey, "kid-2", issuer.claims()))
+
+	if _, err := s.Exchange(ctx, "test", ktestCode, ktestCodeVerifier, ktestNonce); !errors.Is(err, ErrInvalidIDToken) {
+		t.Fatalf("err = %v, want ErrInvalidIDToken within the refetch interval", err)
+	}
+	if _, jwks := issuer.counts(); jwks != 1 {
+		t.Fatalf("jwks fetched %d times within the refetch interval, want 1", jwks)
+	}
+
+	p := s.providers["test"]
+	p.keysMu.Lock()
+	p.keysFetchedAt = time.Now().Add(-kjwksRefetchInterval)
+	p.keysMu.Unlock()
+
+	if _, err := s.Exchange(ctx, "test", ktestCode, ktestCodeVerifier, ktestNonce); err != nil {
+		t.Fatalf("Exchange with the rotated key: %v", err)
+	}
+
+	// made up kids don't refetch again
+	issuer.setIDToken(signTestToken(t, newKey, "kid-unknown", issuer.claims()))
+	for i := 0; i < 3; i++ {
+		if _, err := s.Exchange(ctx, "test", ktestCode, ktestCodeVerifier, ktestNonce); !errors.Is(err, ErrInvalidIDToken) {
+			t.Fatalf("err = %v, want ErrInvalidIDToken for an unknown kid", err)
+		}
+	}
+
+	if discovery, jwks := issuer.counts(); discovery != 1 || jwks != 2 {
+		t.Errorf("discovery fetched %d times and jwks %d times, want 1 and 2", discovery, jwks)
+	}
+}
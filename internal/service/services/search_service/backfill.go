@@ -0,0 +1,80 @@
+package search_service
+
+import (
+	"bytes"
+	"context"
+
+	"github.com/yuhangang/chat-app-backend/internal/db"
+	"github.com/yuhangang/chat-app-backend/internal/log"
+	"github.com/yuhangang/chat-app-backend/internal/service"
+	"github.com/yuhangang/chat-app-backend/internal/service/text_extraction"
+	"github.com/yuhangang/chat-app-backend/internal/service/upload_validation"
+)
+
+const kbackfillBatchSize = 32
+
+// ExtractionBackfillV1 extracts the text of attachments stored before text was extracted on
+// upload, so they can be found by their content too. Every attachment is done once, files missing
+// from storage are left with an empty text.
+type ExtractionBackfillV1 struct {
+	searchRepository db.SearchRepository
+	storageService   service.StorageService
+}
+
+func NewExtractionBackfillV1(searchRepository db.SearchRepository, storageService service.StorageService) *ExtractionBackfillV1 {
+	return &ExtractionBackfillV1{
+		searchRepository: searchRepository,
+		storageService:   storageService,
+	}
+}
+
+// Start runs the backfill once, meant to be started in the background on startup
+func (b *ExtractionBackfillV1) Start(ctx context.Context) {
+	count, err := b.Backfill(ctx)
+	if err != nil {
+		log.ErrorLogger.Errorf("Extracting attachment text failed after %d: %v", count, err)
+		return
+	}
+	if count > 0 {
+		log.InfoLogger.Printf("Extracted the text of %d attachments", count)
+	}
+}
+
+// Backfill extracts pending attachments in batches until none are left and returns how many it did
+func (b *ExtractionBackfillV1) Backfill(ctx context.Context) (int, error) {
+	count := 0
+
+	for {
+		attachments, err := b.searchRepository.GetUnextractedAttachments(ctx, kbackfillBatchSize)
+		if err != nil || len(attachments) == 0 {
+			return count, err
+		}
+
+		for _, attachment := range attachments {
+			if err := ctx.Err(); err != nil {
+				return count, err
+			}
+
+			if err := b.searchRepository.SetExtractedText(ctx, attachment.ID, b.extract(attachment.FilePath)); err != nil {
+				return count, err
+			}
+			count++
+		}
+	}
+}
+
+// extract sniffs the stored file like an upload and returns its text
+func (b *ExtractionBackfillV1) extract(fileKey string) string {
+	data, err := b.storageService.ReadFile(fileKey)
+	if err != nil {
+		log.InfoLogger.Printf("Leaving %s out of the search index: %v", fileKey, err)
+		return ""
+	}
+
+	contentType, err := upload_validation.DetectContentType(bytes.NewReader(data))
+	if err != nil {
+		return ""
+	}
+
+	return text_extraction.Extract(contentType, data)
+}
@@ -0,0 +1,77 @@
+package search_service
+
+import (
+	"context"
+	"testing"
+
+	"github.com/yuhangang/chat-app-backend/internal/db/repository"
+	"github.com/yuhangang/chat-app-backend/internal/db/tables"
+	"github.com/yuhangang/chat-app-backend/internal/service/services/storage_service"
+
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+func TestBackfillExtractsStoredAttachmentsOnce(t *testing.T) {
+	conn, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{TranslateError: true, Logger: logger.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.AutoMigrate(&tables.ChatAttachment{}); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("UPLOAD_DIR", t.TempDir())
+	storageService := storage_service.NewStorageServiceV1()
+	fileKey, err := storageService.SaveFile("notes.txt", []byte("quarterly numbers for the board"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// stored before extraction existed, so without any text
+	legacy := []tables.ChatAttachment{
+		{FileName: "notes.txt", FileType: "text/plain", FilePath: fileKey, MessageID: 1},
+		{FileName: "gone.txt", FileType: "text/plain", FilePath: "missing.txt", MessageID: 1},
+	}
+	if err := conn.Omit("extracted_text").Create(&legacy).Error; err != nil {
+		t.Fatal(err)
+	}
+	extracted := tables.ChatAttachment{FileName: "new.txt", FileType: "text/plain", FilePath: fileKey, MessageID: 1, ExtractedText: "kept as is"}
+	if err := conn.Create(&extracted).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	backfill := NewExtractionBackfillV1(repository.NewSearchRepo(conn), storageService)
+
+	count, err := backfill.Backfill(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != len(legacy) {
+		t.Errorf("backfilled %d attachments, want %d", count, len(legacy))
+	}
+
+	want := map[uint]string{
+		legacy[0].ID: "quarterly numbers for the board",
+		legacy[1].ID: "",
+		extracted.ID: "kept as is",
+	}
+	for id, text := range want {
+		var attachment tables.ChatAttachment
+		if err := conn.First(&attachment, id).Error; err != nil {
+			t.Fatal(err)
+		}
+		if attachment.ExtractedText != text {
+			t.Errorf("attachment %d text = %q, want %q", id, attachment.ExtractedText, text)
+		}
+	}
+
+	count, err = backfill.Backfill(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 0 {
+		t.Errorf("second backfill did %d attachments, want 0", count)
+	}
+}
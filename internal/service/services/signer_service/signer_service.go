@@ -0,0 +1,84 @@
+package signer_service
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const kdefaultFileServerURL = "http://localhost:3002"
+const kdefaultFileURLLife = 15 * time.Minute
+
+var (
+	ErrMissingSigningSecret = errors.New("missing FILE_SIGNING_SECRET in environment")
+	ErrInvalidSignature     = errors.New("invalid file signature")
+	ErrExpiredSignature     = errors.New("file url has expired")
+)
+
+type SignerServiceV1 struct {
+	secret  []byte
+	baseURL string
+}
+
+func NewSignerServiceV1() (*SignerServiceV1, error) {
+	secret := os.Getenv("FILE_SIGNING_SECRET")
+	if secret == "" {
+		return nil, ErrMissingSigningSecret
+	}
+
+	baseURL := os.Getenv("FILE_SERVER_URL")
+	if baseURL == "" {
+		baseURL = kdefaultFileServerURL
+	}
+
+	return &SignerServiceV1{
+		secret:  []byte(secret),
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+	}, nil
+}
+
+// SignFileURL returns a file server URL for the stored file key that only
+// the given user can use, and only until the default lifetime elapses
+func (s *SignerServiceV1) SignFileURL(fileKey string, userID uint) string {
+	return s.SignFileURLWithTTL(fileKey, userID, kdefaultFileURLLife)
+}
+
+// SignFileURLWithTTL is SignFileURL with an explicit lifetime
+func (s *SignerServiceV1) SignFileURLWithTTL(fileKey string, userID uint, ttl time.Duration) string {
+	expires := time.Now().Add(ttl).Unix()
+
+	query := url.Values{}
+	query.Set("uid", strconv.FormatUint(uint64(userID), 10))
+	query.Set("exp", strconv.FormatInt(expires, 10))
+	query.Set("sig", s.sign(fileKey, userID, expires))
+
+	return fmt.Sprintf("%s/uploads/%s?%s", s.baseURL, url.PathEscape(fileKey), query.Encode())
+}
+
+// VerifyFileURL checks the signature and expiry of a signed file URL
+func (s *SignerServiceV1) VerifyFileURL(fileKey string, userID uint, expires int64, signature string) error {
+	expected := s.sign(fileKey, userID, expires)
+	if !hmac.Equal([]byte(expected), []byte(signature)) {
+		return ErrInvalidSignature
+	}
+
+	if time.Now().Unix() > expires {
+		return ErrExpiredSignature
+	}
+
+	return nil
+}
+
+func (s *SignerServiceV1) sign(fileKey string, userID uint, expires int64) string {
+	mac := hmac.New(sha256.New, s.secret)
+	fmt.Fprintf(mac, "%s|%d|%d", fileKey, userID, expires)
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,72 @@
+package signer_service
+
+import (
+	"errors"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestVerifyFileURL(t *testing.T) {
+	signer := &SignerServiceV1{secret: []byte("secret"), baseURL: "http://files.test"}
+	expires := time.Now().Add(time.Minute).Unix()
+	signature := signer.sign("abc.png", 1, expires)
+
+	tests := []struct {
+		name      string
+		fileKey   string
+		userID    uint
+		expires   int64
+		signature string
+		want      error
+	}{
+		{"valid", "abc.png", 1, expires, signature, nil},
+		{"other file", "abd.png", 1, expires, signature, ErrInvalidSignature},
+		{"other user", "abc.png", 2, expires, signature, ErrInvalidSignature},
+		{"extended expiry", "abc.png", 1, expires + 3600, signature, ErrInvalidSignature},
+		{"tampered signature", "abc.png", 1, expires, strings.Repeat("0", len(signature)), ErrInvalidSignature},
+		{"empty signature", "abc.png", 1, expires, "", ErrInvalidSignature},
+		{"expired", "abc.png", 1, expires - 120, signer.sign("abc.png", 1, expires-120), ErrExpiredSignature},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := signer.VerifyFileURL(test.fileKey, test.userID, test.expires, test.signature)
+			if !errors.Is(err, test.want) {
+				t.Errorf("VerifyFileURL() = %v, want %v", err, test.want)
+			}
+		})
+	}
+}
+
+func TestVerifyFileURLOtherSecret(t *testing.T) {
+	signer := &SignerServiceV1{secret: []byte("secret")}
+	other := &SignerServiceV1{secret: []byte("other")}
+	expires := time.Now().Add(time.Minute).Unix()
+
+	err := signer.VerifyFileURL("abc.png", 1, expires, other.sign("abc.png", 1, expires))
+	if !errors.Is(err, ErrInvalidSignature) {
+		t.Errorf("VerifyFileURL() = %v, want %v", err, ErrInvalidSignature)
+	}
+}
+
+func TestSignFileURLRoundTrip(t *testing.T) {
+	signer := &SignerServiceV1{secret: []byte("secret"), baseURL: "http://files.test"}
+
+	signed, err := url.Parse(signer.SignFileURLWithTTL("abc.png", 7, time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if signed.Path != "/uploads/abc.png" {
+		t.Errorf("path = %q, want /uploads/abc.png", signed.Path)
+	}
+
+	query := signed.Query()
+	userID, _ := strconv.ParseUint(query.Get("uid"), 10, 64)
+	expires, _ := strconv.ParseInt(query.Get("exp"), 10, 64)
+	if err := signer.VerifyFileURL("abc.png", uint(userID), expires, query.Get("sig")); err != nil {
+		t.Errorf("VerifyFileURL() = %v, want nil", err)
+	}
+}
@@ -1,19 +1,31 @@
 package storage_service
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"hash/fnv"
 	"io"
 	"log"
-	"mime/multipart"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
+	"time"
 
-	"github.com/google/uuid"
+	"github.com/yuhangang/chat-app-backend/internal/service"
 )
 
+const kpartialDir = "partial"
+const kfileLockStripes = 64
+
 type StorageServiceV1 struct {
 	uploadDir string
+
+	// held while a save reuses or replaces a file and while the garbage collector checks and
+	// deletes it, striped by file key
+	fileLocks [kfileLockStripes]sync.Mutex
 }
 
 func NewStorageServiceV1() *StorageServiceV1 {
@@ -29,58 +41,251 @@ func NewStorageServiceV1() *StorageServiceV1 {
 		log.Fatal("Folder does not exist")
 	}
 
+	// resumable uploads are assembled here, out of reach of ListFiles and the garbage collector
+	if err := ensureDirExists(filepath.Join(uploadDir, kpartialDir)); err != nil {
+		log.Fatal("Failed to create partial upload folder")
+	}
+
 	return &StorageServiceV1{
 		uploadDir: uploadDir,
 	}
 }
 
-// Method to save a file
-func (s *StorageServiceV1) SaveFile(attachment *multipart.FileHeader) (string, error) {
-	// Generate a unique file name using a UUID
-	fileName := s.generateUniqueFileName(attachment.Filename)
+// SaveFile stores the data under its SHA-256 content address and returns the file key,
+// relative to the upload directory. Saving identical content again reuses the existing file.
+func (s *StorageServiceV1) SaveFile(originalFileName string, data []byte) (string, error) {
+	fileName := s.contentAddressedFileName(originalFileName, data)
 	filePath := filepath.Join(s.uploadDir, fileName)
 
-	// Save the uploaded file to disk
-	if err := s.saveUploadedFile(attachment, filePath); err != nil {
+	lock := s.FileLock(fileName)
+	lock.Lock()
+	defer lock.Unlock()
+
+	// Already stored, only touch it so the garbage collector sees it as recently used
+	if _, err := os.Stat(filePath); err == nil {
+		now := time.Now()
+		if err := os.Chtimes(filePath, now, now); err != nil {
+			return "", fmt.Errorf("failed to touch file: %w", err)
+		}
+		return fileName, nil
+	}
+
+	// Write to a temp file and rename, so a concurrent reader never sees a partial file
+	tempFile, err := os.CreateTemp(s.uploadDir, ".tmp_*")
+	if err != nil {
+		return "", fmt.Errorf("failed to create temp file: %w", err)
+	}
+	defer os.Remove(tempFile.Name())
+
+	if _, err := tempFile.Write(data); err != nil {
+		tempFile.Close()
 		return "", fmt.Errorf("failed to save file: %w", err)
 	}
+	if err := tempFile.Close(); err != nil {
+		return "", fmt.Errorf("failed to save file: %w", err)
+	}
+
+	if err := os.Rename(tempFile.Name(), filePath); err != nil {
+		return "", fmt.Errorf("failed to save file: %w", err)
+	}
+
+	return fileName, nil
+}
+
+// SaveFileFrom stores everything read from src like SaveFile, without holding it in memory,
+// and returns the file key and the number of bytes stored
+func (s *StorageServiceV1) SaveFileFrom(originalFileName string, src io.Reader) (string, int64, error) {
+	tempFile, err := os.CreateTemp(s.uploadDir, ".tmp_*")
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to create temp file: %w", err)
+	}
+	defer os.Remove(tempFile.Name())
+
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(tempFile, hash), src)
+	if err != nil {
+		tempFile.Close()
+		return "", size, fmt.Errorf("failed to save file: %w", err)
+	}
+	if err := tempFile.Close(); err != nil {
+		return "", size, fmt.Errorf("failed to save file: %w", err)
+	}
+
+	// the content address is only known once everything is written
+	fileName := hex.EncodeToString(hash.Sum(nil)) + safeExtension(originalFileName)
+
+	lock := s.FileLock(fileName)
+	lock.Lock()
+	defer lock.Unlock()
+
+	if err := os.Rename(tempFile.Name(), filepath.Join(s.uploadDir, fileName)); err != nil {
+		return "", size, fmt.Errorf("failed to save file: %w", err)
+	}
+
+	return fileName, size, nil
+}
+
+// ReadFile returns the content of a stored file
+func (s *StorageServiceV1) ReadFile(fileKey string) ([]byte, error) {
+	data, err := os.ReadFile(filepath.Join(s.uploadDir, filepath.Base(fileKey)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read file: %w", err)
+	}
+
+	return data, nil
+}
+
+// OpenFile opens a stored file for reading, the caller closes it
+func (s *StorageServiceV1) OpenFile(fileKey string) (io.ReadCloser, error) {
+	file, err := os.Open(filepath.Join(s.uploadDir, filepath.Base(fileKey)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open file: %w", err)
+	}
+
+	return file, nil
+}
+
+// DeleteFile removes a stored file, deleting a file that is already gone is not an error
+func (s *StorageServiceV1) DeleteFile(fileKey string) error {
+	err := os.Remove(filepath.Join(s.uploadDir, filepath.Base(fileKey)))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to delete file: %w", err)
+	}
+
+	return nil
+}
+
+// StatFile returns the size and modification time of a stored file
+func (s *StorageServiceV1) StatFile(fileKey string) (service.FileInfo, error) {
+	info, err := os.Stat(filepath.Join(s.uploadDir, filepath.Base(fileKey)))
+	if err != nil {
+		return service.FileInfo{}, err
+	}
 
-	return filePath, nil
+	return service.FileInfo{Key: fileKey, Size: info.Size(), ModTime: info.ModTime()}, nil
 }
 
-// Helper to generate a unique file name using UUID
-func (s *StorageServiceV1) generateUniqueFileName(originalFileName string) string {
-	ext := filepath.Ext(originalFileName) // Get the file extension
-	base := strings.TrimSuffix(originalFileName, ext)
-	uuid := uuid.New().String() // Generate a unique identifier
+// ListFiles returns every stored file at the top level of the upload directory
+func (s *StorageServiceV1) ListFiles() ([]service.FileInfo, error) {
+	entries, err := os.ReadDir(s.uploadDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list files: %w", err)
+	}
+
+	var files []service.FileInfo
+	for _, entry := range entries {
+		// skip directories and in-flight temp files
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		files = append(files, service.FileInfo{Key: entry.Name(), Size: info.Size(), ModTime: info.ModTime()})
+	}
 
-	return fmt.Sprintf("%s_%s%s", base, uuid, ext)
+	return files, nil
 }
 
-// Helper to save the uploaded file to the file system
-func (s *StorageServiceV1) saveUploadedFile(attachment *multipart.FileHeader, destinationPath string) error {
-	// Open the uploaded file
-	srcFile, err := attachment.Open()
+// FileLock returns the lock guarding the stored file, shared with the files of the same stripe
+func (s *StorageServiceV1) FileLock(fileKey string) sync.Locker {
+	hash := fnv.New32a()
+	hash.Write([]byte(fileKey))
+
+	return &s.fileLocks[hash.Sum32()%kfileLockStripes]
+}
+
+// CreatePartialFile creates the empty file a resumable upload is appended to
+func (s *StorageServiceV1) CreatePartialFile(uploadID string) error {
+	file, err := os.OpenFile(s.partialFilePath(uploadID), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
 	if err != nil {
-		return fmt.Errorf("failed to open uploaded file: %w", err)
+		return fmt.Errorf("failed to create partial file: %w", err)
 	}
-	defer srcFile.Close()
 
-	// Create the destination file
-	dstFile, err := os.Create(destinationPath)
+	return file.Close()
+}
+
+// AppendPartialFile writes src at offset, which must be the current end of the partial file.
+// It returns the new size, including whatever was written before a read error.
+func (s *StorageServiceV1) AppendPartialFile(uploadID string, offset int64, src io.Reader) (int64, error) {
+	file, err := os.OpenFile(s.partialFilePath(uploadID), os.O_WRONLY, 0644)
 	if err != nil {
-		return fmt.Errorf("failed to create destination file: %w", err)
+		return offset, fmt.Errorf("failed to open partial file: %w", err)
 	}
-	defer dstFile.Close()
+	defer file.Close()
 
-	// Copy the content from the uploaded file to the destination
-	if _, err := io.Copy(dstFile, srcFile); err != nil {
-		return fmt.Errorf("failed to copy file content: %w", err)
+	// drop anything past the acknowledged offset, e.g. from a chunk that failed half way
+	if err := file.Truncate(offset); err != nil {
+		return offset, fmt.Errorf("failed to truncate partial file: %w", err)
+	}
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return offset, fmt.Errorf("failed to seek partial file: %w", err)
+	}
+
+	written, err := io.Copy(file, src)
+	if err != nil {
+		return offset + written, fmt.Errorf("failed to write partial file: %w", err)
+	}
+
+	return offset + written, nil
+}
+
+// OpenPartialFile opens the content received so far for a resumable upload, the caller closes it
+func (s *StorageServiceV1) OpenPartialFile(uploadID string) (io.ReadCloser, error) {
+	file, err := os.Open(s.partialFilePath(uploadID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open partial file: %w", err)
+	}
+
+	return file, nil
+}
+
+// DeletePartialFile removes a resumable upload's partial file, if there is one
+func (s *StorageServiceV1) DeletePartialFile(uploadID string) error {
+	err := os.Remove(s.partialFilePath(uploadID))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to delete partial file: %w", err)
 	}
 
 	return nil
 }
 
+func (s *StorageServiceV1) partialFilePath(uploadID string) string {
+	return filepath.Join(s.uploadDir, kpartialDir, filepath.Base(uploadID))
+}
+
+// Helper to name a file after the SHA-256 of its content, keeping the original extension
+func (s *StorageServiceV1) contentAddressedFileName(originalFileName string, data []byte) string {
+	sum := sha256.Sum256(data)
+
+	return hex.EncodeToString(sum[:]) + safeExtension(originalFileName)
+}
+
+// safeExtension returns the lower cased extension of the file name, or nothing if it is unusual
+func safeExtension(originalFileName string) string {
+	ext := strings.ToLower(filepath.Ext(originalFileName))
+	if !isSafeExtension(ext) {
+		return ""
+	}
+
+	return ext
+}
+
+func isSafeExtension(ext string) bool {
+	if len(ext) < 2 || len(ext) > 10 {
+		return false
+	}
+	for _, r := range ext[1:] {
+		if (r < 'a' || r > 'z') && (r < '0' || r > '9') {
+			return false
+		}
+	}
+
+	return true
+}
+
 func ensureDirExists(dir string) error {
 	if _, err := os.Stat(dir); os.IsNotExist(err) {
 		err := os.MkdirAll(dir, 0755) // Set appropriate permissions
@@ -0,0 +1,40 @@
+package text_extraction
+
+import (
+	"io"
+	"strings"
+)
+
+// kmaxTextSize bounds the text kept per attachment, enough to find a document by its content
+const kmaxTextSize = 64 << 10
+
+// Extract returns the searchable text of a document, empty for files whose text can't be read.
+// Only plain text is read for now, PDFs need a parser.
+func Extract(contentType string, data []byte) string {
+	if contentType != "text/plain" {
+		return ""
+	}
+
+	if len(data) > kmaxTextSize {
+		data = data[:kmaxTextSize]
+	}
+
+	// also drops a character cut in half by the limit
+	text := strings.ToValidUTF8(string(data), "")
+
+	return strings.ReplaceAll(text, "\x00", "")
+}
+
+// ExtractFrom is Extract for a file that is not in memory, only the part that is kept is read
+func ExtractFrom(contentType string, src io.Reader) (string, error) {
+	if contentType != "text/plain" {
+		return "", nil
+	}
+
+	data, err := io.ReadAll(io.LimitReader(src, kmaxTextSize))
+	if err != nil {
+		return "", err
+	}
+
+	return Extract(contentType, data), nil
+}
@@ -0,0 +1,107 @@
+package upload_validation
+
+import (
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/yuhangang/chat-app-backend/user_errors"
+)
+
+// Model capabilities, as stored comma separated on tables.LlmModel
+const (
+	CapabilityText     = "text"
+	CapabilityVision   = "vision"
+	CapabilityDocument = "document"
+	CapabilityAudio    = "audio"
+)
+
+const kdefaultMaxUploadSize = 20 << 20
+
+// sniffLen is the number of bytes http.DetectContentType looks at
+const sniffLen = 512
+
+// allowedTypesByCapability lists the sniffed content types a model with the capability accepts
+var allowedTypesByCapability = map[string][]string{
+	CapabilityVision:   {"image/png", "image/jpeg", "image/gif", "image/webp"},
+	CapabilityDocument: {"application/pdf", "text/plain"},
+	CapabilityAudio:    {"audio/mpeg", "audio/wave", "audio/ogg", "audio/aiff"},
+}
+
+// MaxUploadSize returns the global upload limit in bytes, from MAX_UPLOAD_SIZE when set
+func MaxUploadSize() int64 {
+	if value := os.Getenv("MAX_UPLOAD_SIZE"); value != "" {
+		if size, err := strconv.ParseInt(value, 10, 64); err == nil && size > 0 {
+			return size
+		}
+	}
+
+	return kdefaultMaxUploadSize
+}
+
+// EffectiveMaxUploadSize applies a per-user limit on top of the global one; zero means no user limit
+func EffectiveMaxUploadSize(userLimit int64) int64 {
+	globalLimit := MaxUploadSize()
+	if userLimit > 0 && userLimit < globalLimit {
+		return userLimit
+	}
+
+	return globalLimit
+}
+
+// ParseCapabilities splits a comma separated capability list
+func ParseCapabilities(capabilities string) []string {
+	var result []string
+	for _, capability := range strings.Split(capabilities, ",") {
+		if capability = strings.TrimSpace(capability); capability != "" {
+			result = append(result, capability)
+		}
+	}
+
+	return result
+}
+
+// DetectContentType sniffs the real content type from the first bytes of the file,
+// ignoring whatever Content-Type the client claimed
+func DetectContentType(file io.Reader) (string, error) {
+	buffer := make([]byte, sniffLen)
+	n, err := io.ReadFull(file, buffer)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", fmt.Errorf("failed to read file header: %w", err)
+	}
+
+	mediaType, _, err := mime.ParseMediaType(http.DetectContentType(buffer[:n]))
+	if err != nil {
+		return "", fmt.Errorf("failed to parse content type: %w", err)
+	}
+
+	return mediaType, nil
+}
+
+// CheckSize rejects uploads over the size limit with a 413 user error
+func CheckSize(size int64, maxSize int64) error {
+	if size > maxSize {
+		return user_errors.New(user_errors.ErrCodeFileTooLarge,
+			fmt.Sprintf("file exceeds the maximum upload size of %d bytes", maxSize))
+	}
+
+	return nil
+}
+
+// CheckContentType rejects content types none of the model's capabilities accept with a 415 user error
+func CheckContentType(contentType string, capabilities []string) error {
+	for _, capability := range capabilities {
+		for _, allowed := range allowedTypesByCapability[capability] {
+			if contentType == allowed {
+				return nil
+			}
+		}
+	}
+
+	return user_errors.New(user_errors.ErrCodeUnsupportedMediaType,
+		fmt.Sprintf("file type %s is not supported by this model", contentType))
+}
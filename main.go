@@ -4,6 +4,8 @@ import (
 	"context"
 	"log"
 
+	"github.com/yuhangang/chat-app-backend/internal/service/services/signer_service"
+
 	"github.com/joho/godotenv"
 )
 
@@ -16,8 +18,14 @@ func main() {
 	// env of gemini api key
 	log.Println("Starting server...")
 
-	httpServer := NewHttpServer(ctx, ":8080")
-	fileServer := NewFileServer(":3002")
+	// shared by the API, which signs attachment URLs, and the file server, which verifies them
+	fileSigner, err := signer_service.NewSignerServiceV1()
+	if err != nil {
+		log.Fatalf("Failed to create file signer: %v", err)
+	}
+
+	httpServer := NewHttpServer(ctx, ":8080", fileSigner)
+	fileServer := NewFileServer(":3002", fileSigner)
 	go func() {
 		if err := httpServer.Run(); err != nil {
 			log.Fatalf("HTTP server failed to start: %v", err)
@@ -7,3 +7,9 @@ type contextKey struct {
 
 // UserIDKey is used to store/retrieve user ID from context
 var UserIDKey = &contextKey{"user_id"}
+
+// SessionIDKey is used to store/retrieve the session ID of the access token from context
+var SessionIDKey = &contextKey{"session_id"}
+
+// RoleKey is used to store/retrieve the user's role from context
+var RoleKey = &contextKey{"role"}
@@ -0,0 +1,77 @@
+package cursor
+
+import (
+	"encoding/base64"
+	"testing"
+	"time"
+)
+
+func encodeRaw(value string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(value))
+}
+
+func TestEncodeDecode(t *testing.T) {
+	at := time.Unix(1700000000, 123456789)
+
+	tests := []struct {
+		name   string
+		cursor Cursor
+	}{
+		{"id only", Cursor{ID: 7}},
+		{"time and id", Cursor{Time: at, ID: 42}},
+		{"rank, time and id", Cursor{Rank: 1, Time: at, ID: 42}},
+		{"negative rank", Cursor{Rank: -3, Time: at, ID: 9}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			decoded, err := Decode(test.cursor.Encode())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if decoded.Rank != test.cursor.Rank || !decoded.Time.Equal(test.cursor.Time) || decoded.ID != test.cursor.ID {
+				t.Errorf("Decode(Encode(%+v)) = %+v", test.cursor, decoded)
+			}
+		})
+	}
+}
+
+func TestDecode(t *testing.T) {
+	at := time.Unix(1700000000, 123456789)
+
+	tests := []struct {
+		name    string
+		value   string
+		want    Cursor
+		wantErr bool
+	}{
+		{name: "empty", value: "", want: Cursor{}},
+		{name: "current format", value: encodeRaw("1.1700000000123456789.42"), want: Cursor{Rank: 1, Time: at, ID: 42}},
+		{name: "two fields", value: encodeRaw("1700000000123456789.42"), wantErr: true},
+		{name: "not base64", value: "not a cursor!", wantErr: true},
+		{name: "one field", value: encodeRaw("42"), wantErr: true},
+		{name: "four fields", value: encodeRaw("1.2.3.4"), wantErr: true},
+		{name: "zero id", value: encodeRaw("0.0.0"), wantErr: true},
+		{name: "negative id", value: encodeRaw("0.0.-1"), wantErr: true},
+		{name: "not a number", value: encodeRaw("a.b.c"), wantErr: true},
+		{name: "trailing garbage", value: encodeRaw("0.0.42x"), wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := Decode(test.value)
+			if test.wantErr {
+				if err != ErrInvalidCursor {
+					t.Fatalf("Decode(%q) error = %v, want %v", test.value, err, ErrInvalidCursor)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.Rank != test.want.Rank || !got.Time.Equal(test.want.Time) || got.ID != test.want.ID {
+				t.Errorf("Decode(%q) = %+v, want %+v", test.value, got, test.want)
+			}
+		})
+	}
+}
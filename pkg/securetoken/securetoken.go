@@ -0,0 +1,27 @@
+package securetoken
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+)
+
+// Generate returns a random URL-safe token of n bytes and the hash to store in its place
+func Generate(n int) (token string, hash string, err error) {
+	buffer := make([]byte, n)
+	if _, err := rand.Read(buffer); err != nil {
+		return "", "", err
+	}
+
+	token = base64.RawURLEncoding.EncodeToString(buffer)
+
+	return token, Hash(token), nil
+}
+
+// Hash returns the SHA-256 hex digest of a token, tokens are only ever stored hashed
+func Hash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,101 @@
+package totp
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// RFC 6238 defaults, the only parameters every authenticator app supports
+const kperiod = 30
+const kdigits = 6
+const kmodulo = 1000000 // 10^kdigits
+const ksecretSize = 20
+
+// kskew is how many steps either side of now are accepted, for clock drift and slow typing
+const kskew = 1
+
+var encoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// GenerateSecret returns a random 160 bit secret, base32 encoded as authenticator apps expect
+func GenerateSecret() (string, error) {
+	buffer := make([]byte, ksecretSize)
+	if _, err := rand.Read(buffer); err != nil {
+		return "", err
+	}
+
+	return encoding.EncodeToString(buffer), nil
+}
+
+// ProvisioningURI returns the otpauth:// URI an authenticator app scans to add the secret
+func ProvisioningURI(issuer string, account string, secret string) string {
+	query := url.Values{}
+	query.Set("secret", secret)
+	query.Set("issuer", issuer)
+	query.Set("algorithm", "SHA1")
+	query.Set("digits", fmt.Sprint(kdigits))
+	query.Set("period", fmt.Sprint(kperiod))
+
+	label := url.PathEscape(issuer + ":" + account)
+
+	return "otpauth://totp/" + label + "?" + query.Encode()
+}
+
+// Step returns the time step t falls in
+func Step(t time.Time) int64 {
+	return t.Unix() / kperiod
+}
+
+// Code returns the code for the secret at the given time step
+func Code(secret string, step int64) (string, error) {
+	key, err := encoding.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return "", err
+	}
+
+	var counter [8]byte
+	binary.BigEndian.PutUint64(counter[:], uint64(step))
+
+	mac := hmac.New(sha1.New, key)
+	mac.Write(counter[:])
+	sum := mac.Sum(nil)
+
+	// dynamic truncation, RFC 4226 section 5.3
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	return fmt.Sprintf("%0*d", kdigits, value%kmodulo), nil
+}
+
+// Validate checks a code against the steps around now, skipping steps up to and including
+// lastStep so a code can't be replayed. Returns the matched step, to be stored as the new lastStep.
+func Validate(secret string, code string, now time.Time, lastStep int64) (int64, bool) {
+	code = strings.TrimSpace(code)
+	if len(code) != kdigits {
+		return 0, false
+	}
+
+	current := Step(now)
+	for step := current - kskew; step <= current+kskew; step++ {
+		if step <= lastStep {
+			continue
+		}
+
+		expected, err := Code(secret, step)
+		if err != nil {
+			return 0, false
+		}
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+
+	return 0, false
+}
@@ -0,0 +1,102 @@
+package totp
+
+import (
+	"testing"
+	"time"
+)
+
+// the ASCII secret "12345678901234567890" of the RFC 6238 test vectors, base32 encoded
+const krfcSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestCodeMatchesRFC6238Vectors(t *testing.T) {
+	// the RFC lists 8 digit codes, 6 digit codes are their last 6 digits
+	vectors := []struct {
+		unix int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+
+	for _, vector := range vectors {
+		code, err := Code(krfcSecret, Step(time.Unix(vector.unix, 0)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if code != vector.code {
+			t.Errorf("code at %d = %s, want %s", vector.unix, code, vector.code)
+		}
+	}
+
+	// authenticator apps may show the secret in lower case
+	if code, _ := Code("gezdgnbvgy3tqojqgezdgnbvgy3tqojq", Step(time.Unix(59, 0))); code != "287082" {
+		t.Errorf("lower case secret gives %s, want 287082", code)
+	}
+}
+
+func TestValidateAcceptsOneStepOfSkew(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+	current := Step(now)
+
+	for offset := int64(-2); offset <= 2; offset++ {
+		code, err := Code(krfcSecret, current+offset)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		step, ok := Validate(krfcSecret, code, now, 0)
+		wantOK := offset >= -kskew && offset <= kskew
+		if ok != wantOK {
+			t.Errorf("code %d steps away: ok = %v, want %v", offset, ok, wantOK)
+		}
+		if ok && step != current+offset {
+			t.Errorf("code %d steps away matched step %d, want %d", offset, step, current+offset)
+		}
+	}
+
+	code, _ := Code(krfcSecret, current)
+	if _, ok := Validate(krfcSecret, " "+code+" ", now, 0); !ok {
+		t.Error("code with surrounding spaces was rejected")
+	}
+	for _, wrong := range []string{"", "12345", "1234567", "000000"} {
+		if _, ok := Validate(krfcSecret, wrong, now, 0); ok {
+			t.Errorf("code %q was accepted", wrong)
+		}
+	}
+}
+
+func TestValidateRejectsUsedSteps(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+	current := Step(now)
+
+	code, err := Code(krfcSecret, current)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	step, ok := Validate(krfcSecret, code, now, 0)
+	if !ok {
+		t.Fatal("fresh code was rejected")
+	}
+
+	// the step is stored as used, the same code can't be replayed
+	if _, ok := Validate(krfcSecret, code, now, step); ok {
+		t.Error("code of a used step was accepted again")
+	}
+
+	// nor can an earlier code within the skew once a later step was used
+	previous, _ := Code(krfcSecret, current-1)
+	if _, ok := Validate(krfcSecret, previous, now, step); ok {
+		t.Error("code of a step before the used one was accepted")
+	}
+
+	// the next step's code still works
+	next, _ := Code(krfcSecret, current+1)
+	if matched, ok := Validate(krfcSecret, next, now, step); !ok || matched != current+1 {
+		t.Errorf("next step's code: matched %d, %v, want %d", matched, ok, current+1)
+	}
+}
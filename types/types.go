@@ -3,11 +3,25 @@ package types
 import (
 	"context"
 	"net/http"
+	"time"
 
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/google/generative-ai-go/genai"
 )
 
+// DefaultModelKey is the LLM model used for chats
+const DefaultModelKey = "gemini-2.0-flash"
+
+// DefaultPersona is the persona chats use unless the user picks another
+const DefaultPersona = "assistant"
+
+// ChatOptions are the per chat settings the model is called with, fixed when the chat is created
+type ChatOptions struct {
+	ModelKey    string
+	Persona     string
+	Instruction string // the persona's system instruction, looked up when the chat is called
+}
+
 type ChatMessages struct {
 	Messages string
 }
@@ -18,25 +32,112 @@ type HttpHandlerV1 interface {
 }
 
 type Claims struct {
-	UserID uint `json:"user_id"`
+	UserID    uint   `json:"user_id"`
+	SessionID string `json:"sid"`
+	Role      string `json:"role"`
 	jwt.RegisteredClaims
 }
 
+// ClientInfo describes the device a session was started from
+type ClientInfo struct {
+	UserAgent string
+	IPAddress string
+}
+
 type JwtPayload struct {
 	AccessToken  string `json:"access_token"`
 	RefreshToken string `json:"refresh_token"`
 }
 
 type JwtService interface {
-	GenerateTokens(userID uint) (JwtPayload, error)
-	ValidateAccessToken(tokenString string) (Claims, error)
+	GenerateTokens(ctx context.Context, userID uint, client ClientInfo) (JwtPayload, error)
+	ValidateAccessToken(ctx context.Context, tokenString string) (Claims, error)
 	ValidateRefreshToken(tokenString string) (Claims, error)
-	RefreshAccessToken(refreshToken string) (string, error)
+	RefreshTokens(ctx context.Context, refreshToken string, client ClientInfo) (JwtPayload, error)
+	RevokeSession(ctx context.Context, userID uint, sessionID string) error
+	RevokeAllSessions(ctx context.Context, userID uint) error
+	PublicKeys() JSONWebKeySet
+}
+
+// JSONWebKey is the public half of a token signing key, see RFC 7517
+type JSONWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n,omitempty"`   // RSA modulus
+	E   string `json:"e,omitempty"`   // RSA exponent
+	Crv string `json:"crv,omitempty"` // OKP curve
+	X   string `json:"x,omitempty"`   // OKP public key
+}
+
+type JSONWebKeySet struct {
+	Keys []JSONWebKey `json:"keys"`
 }
 
 type HttpServiceV1 interface {
-	CallGemini(context.Context, string, string, []*genai.Content) (GeminiApiResponse, error)
-	SendFileWithText(ctx context.Context, string, prompt string, history []*genai.Content, tempFilePath string) (GeminiApiResponse, error)
+	CallGemini(context.Context, string, string, []*genai.Content, ChatOptions) (GeminiApiResponse, error)
+	SendFileWithText(ctx context.Context, string, prompt string, history []*genai.Content, tempFilePath string, options ChatOptions) (GeminiApiResponse, error)
+}
+
+// Attachment is a validated upload, ready to be sent to the LLM and stored
+type Attachment struct {
+	FileName    string
+	ContentType string // Sniffed from the content, never taken from the client
+	Size        int64
+	Data        []byte
+	FileKey     string // Storage key of a file that is stored already, Data is nil then
+	Thumbnail   []byte // JPEG thumbnail for images, nil otherwise
+	Text        string // Searchable text of documents, empty otherwise
+}
+
+// ChatRoomFilter narrows a listing of chat rooms, zero values don't filter
+type ChatRoomFilter struct {
+	FolderID    *uint // Zero for rooms outside any folder
+	TagID       uint
+	Archived    bool // Only archived rooms instead of only the others
+	PinnedFirst bool
+	Shared      bool // Rooms the user is a member of instead of their own, the other fields don't apply
+}
+
+// ChatRoomMember is a user with a role in a chat room, the owner included
+type ChatRoomMember struct {
+	UserID    uint      `json:"user_id"`
+	Username  string    `json:"username"`
+	Role      string    `json:"role"`
+	CreatedAt time.Time `json:"created_at"` // When the member joined, or the room was created for the owner
+
+	LastReadMessageID uint `json:"last_read_message_id"` // For read receipts, 0 until they read the room
+}
+
+// ChatRoomChanges are the fields to set on chat rooms, nil fields are left alone
+type ChatRoomChanges struct {
+	Name     *string
+	Pinned   *bool
+	Archived *bool
+	Move     bool // Move to FolderID, or out of any folder when it is nil
+	FolderID *uint
+	TagIDs   *[]uint // Replace the tags with these
+}
+
+// Search result kinds, what the match was found in
+const (
+	SearchKindMessage    = "message"
+	SearchKindRoom       = "room"
+	SearchKindAttachment = "attachment"
+)
+
+// SearchResult is one match of a search. The snippet is HTML escaped, with the matched terms
+// wrapped in <mark>.
+type SearchResult struct {
+	Kind         string    `json:"kind"`
+	ChatRoomID   uint      `json:"chat_room_id"`
+	ChatRoomName string    `json:"chat_room_name"`
+	MessageID    *uint     `json:"message_id,omitempty"`    // Set for message and attachment matches
+	AttachmentID *uint     `json:"attachment_id,omitempty"` // Set for attachment matches
+	Snippet      string    `json:"snippet"`
+	Score        float64   `json:"score,omitempty"` // Similarity or fused score, higher is better
+	CreatedAt    time.Time `json:"created_at"`
 }
 
 type GeminiApiResponse struct {
@@ -7,9 +7,39 @@ import (
 
 // Define custom error codes
 const (
-	ErrCodeUserNotFound   = 1001
-	ErrCodeUsernameExists = 1002
-	ErrCodeInternal       = 1003
+	ErrCodeUserNotFound         = 1001
+	ErrCodeUsernameExists       = 1002
+	ErrCodeInternal             = 1003
+	ErrCodeFileTooLarge         = 1004
+	ErrCodeUnsupportedMediaType = 1005
+	ErrCodeChatRoomNotFound     = 1006
+	ErrCodeUploadNotFound       = 1007
+	ErrCodeWeakPassword         = 1008
+	ErrCodeInvalidCredentials   = 1009
+	ErrCodeAccountLocked        = 1010
+	ErrCodeInvalidToken         = 1011
+	ErrCodeEmailExists          = 1012
+	ErrCodeIdentityLinked       = 1013
+	ErrCodeUnknownProvider      = 1014
+	ErrCodeSessionNotFound      = 1015
+	ErrCodeApiKeyNotFound       = 1016
+	ErrCodeAccountDisabled      = 1017
+	ErrCodeModelNotFound        = 1018
+	ErrCodeNotGuestAccount      = 1019
+	ErrCodeInvalidMfaCode       = 1020
+	ErrCodeMfaAlreadyEnabled    = 1021
+	ErrCodeMfaNotEnabled        = 1022
+	ErrCodeModelUnavailable     = 1023
+	ErrCodeUnknownPersona       = 1024
+	ErrCodeExportNotFound       = 1025
+	ErrCodeFolderNotFound       = 1026
+	ErrCodeTagNotFound          = 1027
+	ErrCodeTagExists            = 1028
+	ErrCodeInvalidFolderParent  = 1029
+	ErrCodeShareNotFound        = 1030
+	ErrCodeChatRoomAccessDenied = 1031
+	ErrCodeMemberNotFound       = 1032
+	ErrCodeAlreadyMember        = 1033
 )
 
 // UserError structure with code, message, and optional context (cause)
@@ -46,19 +76,65 @@ func Wrap(err error, code int, message string) *UserError {
 
 // Predefined errors using codes and messages
 var (
-	ErrUserNotFound   = New(ErrCodeUserNotFound, "user not found")
-	ErrUsernameExists = New(ErrCodeUsernameExists, "username already exists")
-	ErrInternal       = New(ErrCodeInternal, "internal server error")
+	ErrUserNotFound         = New(ErrCodeUserNotFound, "user not found")
+	ErrUsernameExists       = New(ErrCodeUsernameExists, "username already exists")
+	ErrInternal             = New(ErrCodeInternal, "internal server error")
+	ErrFileTooLarge         = New(ErrCodeFileTooLarge, "file exceeds the maximum upload size")
+	ErrUnsupportedMediaType = New(ErrCodeUnsupportedMediaType, "file type is not supported")
+	ErrChatRoomNotFound     = New(ErrCodeChatRoomNotFound, "chat room not found")
+	ErrUploadNotFound       = New(ErrCodeUploadNotFound, "upload not found")
+	ErrWeakPassword         = New(ErrCodeWeakPassword, "password is too weak")
+	ErrInvalidCredentials   = New(ErrCodeInvalidCredentials, "invalid username or password")
+	ErrAccountLocked        = New(ErrCodeAccountLocked, "account is temporarily locked, try again later")
+	ErrInvalidToken         = New(ErrCodeInvalidToken, "token is invalid or has expired")
+	ErrEmailExists          = New(ErrCodeEmailExists, "email is already used by another account")
+	ErrIdentityLinked       = New(ErrCodeIdentityLinked, "identity is already linked to another user")
+	ErrUnknownProvider      = New(ErrCodeUnknownProvider, "identity provider is not configured")
+	ErrSessionNotFound      = New(ErrCodeSessionNotFound, "session not found")
+	ErrApiKeyNotFound       = New(ErrCodeApiKeyNotFound, "api key not found")
+	ErrAccountDisabled      = New(ErrCodeAccountDisabled, "account is disabled")
+	ErrModelNotFound        = New(ErrCodeModelNotFound, "model not found")
+	ErrNotGuestAccount      = New(ErrCodeNotGuestAccount, "only guest accounts can be merged into another account")
+	ErrInvalidMfaCode       = New(ErrCodeInvalidMfaCode, "invalid authentication code")
+	ErrMfaAlreadyEnabled    = New(ErrCodeMfaAlreadyEnabled, "two-factor authentication is already enabled")
+	ErrMfaNotEnabled        = New(ErrCodeMfaNotEnabled, "two-factor authentication is not enabled")
+	ErrModelUnavailable     = New(ErrCodeModelUnavailable, "model is not available")
+	ErrUnknownPersona       = New(ErrCodeUnknownPersona, "unknown persona")
+	ErrExportNotFound       = New(ErrCodeExportNotFound, "export not found")
+	ErrFolderNotFound       = New(ErrCodeFolderNotFound, "folder not found")
+	ErrTagNotFound          = New(ErrCodeTagNotFound, "tag not found")
+	ErrTagExists            = New(ErrCodeTagExists, "a tag with this name already exists")
+	ErrInvalidFolderParent  = New(ErrCodeInvalidFolderParent, "folder cannot be moved into itself or nested deeper")
+	ErrShareNotFound        = New(ErrCodeShareNotFound, "share not found")
+	ErrChatRoomAccessDenied = New(ErrCodeChatRoomAccessDenied, "user does not have access to chat room")
+	ErrMemberNotFound       = New(ErrCodeMemberNotFound, "member not found")
+	ErrAlreadyMember        = New(ErrCodeAlreadyMember, "user is already a member of the chat room")
 )
 
 func MapErrorCodeToHTTPStatus(code int) int {
 	switch code {
-	case ErrCodeUserNotFound:
+	case ErrCodeUserNotFound, ErrCodeChatRoomNotFound, ErrCodeUploadNotFound, ErrCodeUnknownProvider,
+		ErrCodeSessionNotFound, ErrCodeApiKeyNotFound, ErrCodeModelNotFound, ErrCodeExportNotFound,
+		ErrCodeFolderNotFound, ErrCodeTagNotFound, ErrCodeShareNotFound, ErrCodeMemberNotFound:
 		return http.StatusNotFound
-	case ErrCodeUsernameExists:
+	case ErrCodeUsernameExists, ErrCodeEmailExists, ErrCodeIdentityLinked, ErrCodeNotGuestAccount,
+		ErrCodeMfaAlreadyEnabled, ErrCodeTagExists, ErrCodeAlreadyMember:
 		return http.StatusConflict
 	case ErrCodeInternal:
 		return http.StatusInternalServerError
+	case ErrCodeWeakPassword, ErrCodeInvalidToken, ErrCodeMfaNotEnabled, ErrCodeModelUnavailable, ErrCodeUnknownPersona,
+		ErrCodeInvalidFolderParent:
+		return http.StatusBadRequest
+	case ErrCodeInvalidCredentials, ErrCodeInvalidMfaCode:
+		return http.StatusUnauthorized
+	case ErrCodeAccountDisabled, ErrCodeChatRoomAccessDenied:
+		return http.StatusForbidden
+	case ErrCodeAccountLocked:
+		return http.StatusTooManyRequests
+	case ErrCodeFileTooLarge:
+		return http.StatusRequestEntityTooLarge
+	case ErrCodeUnsupportedMediaType:
+		return http.StatusUnsupportedMediaType
 	default:
 		return http.StatusInternalServerError
 	}